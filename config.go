@@ -44,10 +44,13 @@ func newConfig() *config {
 			MaxConcurrentRegistrations: 10,
 			MaxConcurrentDeletes:       10,
 			MaxRegistrationAttempts:    10,
+			RegistrationBackoff:        1000,
+			MaxRegistrationBackoff:     60000,
 			EnableTelemetry:            true,
 			EnableReportedProps:        false,
 			EnableTwinUpdateAcks:       false,
 			EnableCommandAcks:          false,
+			C2DPollInterval:            5000,
 		},
 	}
 }
@@ -118,10 +118,13 @@ Simulation:
     maxConcurrentRegistrations: 10      # Maximum number of concurrent device registrations (DPS calls).
     maxConcurrentDeletes: 10            # Maximum number of concurrent device deletes.
     maxRegistrationAttempts: 10         # Maximum number of device registration attempts.
+    registrationBackoff: 1000           # Backoff in milli seconds after the first failed device registration attempt, doubled after each attempt.
+    maxRegistrationBackoff: 60000       # Maximum backoff in milli seconds between device registration attempts.
     enableTelemetry: true               # Enable device telemetry sends across all simulations.
     enableReportedProps: true           # Enable device reported property sends across all simulations.
     enableTwinUpdateAcks: true          # Enable device twin (desired property) update acknowledgement across all simulations.
     enableCommandAcks: true             # Enable device command (direct method, C2D) acknowledgement across all simulations.
+    c2dPollInterval: 5000               # Interval in milli seconds between receiving c2d commands over HTTPS when they are settled explicitly.
 Data:
     dataDirectory: "."                  # Directory used for storing Simulation data.
 Logger:
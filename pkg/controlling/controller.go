@@ -62,6 +62,16 @@ func (c *Controller) StopSimulation(simulation *models.Simulation) error {
 func (c *Controller) ProvisionDevices(ctx context.Context, simulation *models.Simulation, target *models.SimulationTarget, model *models.DeviceModel, maxDeviceID int, numDevices int) error {
 	provisioner := simulating.NewProvisioner(c.context, c.simulationCfg)
 
+	// devices are registered with the custom payload of the device config of the model
+	deviceConfig, err := c.getDeviceConfig(simulation, model)
+	if err != nil {
+		return err
+	}
+	payload, err := simulating.ParseProvisioningPayload(deviceConfig)
+	if err != nil {
+		return err
+	}
+
 	wg := sync.WaitGroup{}
 	for i := 1; i <= numDevices; i++ {
 		select {
@@ -75,7 +85,7 @@ func (c *Controller) ProvisionDevices(ctx context.Context, simulation *models.Si
 				maxDeviceID+i)
 
 			wg.Add(1)
-			go c.provisionDevice(simulation, target, model, deviceID, provisioner, &wg)
+			go c.provisionDevice(simulation, target, model, payload, deviceID, provisioner, &wg)
 
 			// throttle DPS registrations
 			if i%c.simulationCfg.MaxConcurrentRegistrations == 0 {
@@ -103,8 +113,8 @@ func (c *Controller) ProvisionDevices(ctx context.Context, simulation *models.Si
 
 // provisionDevice provisions a device in IoT Central and saves it into the database cache.
 func (c *Controller) provisionDevice(simulation *models.Simulation, target *models.SimulationTarget,
-	model *models.DeviceModel, deviceID string, provisioner *simulating.DeviceProvisioner,
-	wg *sync.WaitGroup) {
+	model *models.DeviceModel, payload *simulating.ProvisioningPayload, deviceID string,
+	provisioner *simulating.DeviceProvisioner, wg *sync.WaitGroup) {
 	defer wg.Done()
 
 	req := &simulating.ProvisioningRequest{
@@ -113,6 +123,7 @@ func (c *Controller) provisionDevice(simulation *models.Simulation, target *mode
 		Target:     target,
 		Simulation: simulation,
 		Model:      model,
+		Payload:    payload,
 	}
 
 	// call DPS to register the device
@@ -126,11 +137,28 @@ func (c *Controller) provisionDevice(simulation *models.Simulation, target *mode
 		TargetID:         req.Target.ID,
 		DeviceID:         req.DeviceID,
 		ConnectionString: result.ConnectionString,
+		Payload:          result.Payload,
 	}
 	storing.TargetDevices.Set(&newDevice)
 	//log.Debug().Str("deviceId", req.DeviceID).Msg("saved device in cache")
 }
 
+// getDeviceConfig gets the first device config of the simulation simulating the model, in the order of their ids, nil if none.
+// Devices provisioned by model have no device config of their own, so they register like the devices of that config.
+func (c *Controller) getDeviceConfig(simulation *models.Simulation, model *models.DeviceModel) (*models.SimulationDeviceConfig, error) {
+	deviceConfigs, err := storing.DeviceConfigs.List(simulation.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, dc := range deviceConfigs {
+		if dc.ModelID == model.ID {
+			return dc, nil
+		}
+	}
+	return nil, nil
+}
+
 func (c *Controller) DeleteAllDevices(ctx context.Context, sim *models.Simulation, target *models.SimulationTarget) error {
 	targetDevices, err := storing.TargetDevices.ListByTargetIdSimId(target.ID, sim.ID)
 	if err != nil {
@@ -240,6 +268,18 @@ func (c *Controller) deleteDevice(ctx context.Context, target *models.Simulation
 	// user might want to delete devices from Central that might not exist in client side case
 	// ignore errors
 	_ = storing.TargetDevices.Delete(target.ID, deviceID)
+	_ = storing.TargetDeviceProperties.Delete(target.ID, deviceID)
+	_ = storing.TargetDeviceCertificates.Delete(target.ID, deviceID)
+}
+
+// GetTargetCertificates gets the CA certificates signing the device certificates of a target, generating them if needed.
+func (c *Controller) GetTargetCertificates(target *models.SimulationTarget) (*models.SimulationTargetCertificates, error) {
+	return simulating.GetTargetCertificates(target)
+}
+
+// ImportTargetCertificates imports the CA certificates signing the device certificates of a target.
+func (c *Controller) ImportTargetCertificates(certs *models.SimulationTargetCertificates) error {
+	return simulating.ImportTargetCertificates(certs)
 }
 
 // ResetSimulationStatus resets all simulation status to stopped
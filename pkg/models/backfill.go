@@ -0,0 +1,20 @@
+package models
+
+import "time"
+
+type (
+	// BackfillConfig defines the range of virtual time over which the simulation sends historical telemetry.
+	BackfillConfig struct {
+		Start time.Time `json:"start"` // virtual time from which telemetry is backfilled.
+		End   time.Time `json:"end"`   // virtual time till which telemetry is backfilled, the time the backfill first started if not set.
+	}
+
+	// BackfillCheckpoint defines the progress of the backfill of a simulation, from which a stopped backfill resumes.
+	BackfillCheckpoint struct {
+		SimulationID string    `json:"simulationId"` // the id of the simulation.
+		Start        time.Time `json:"start"`        // virtual time from which telemetry is backfilled.
+		End          time.Time `json:"end"`          // virtual time till which telemetry is backfilled.
+		Time         time.Time `json:"time"`         // virtual time till which telemetry was sent, zero till the first wave is sent.
+		Progress     float64   `json:"progress"`     // percentage of the virtual time range that was sent.
+	}
+)
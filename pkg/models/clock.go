@@ -0,0 +1,14 @@
+package models
+
+type (
+	// ClockConfig defines the clock of the simulated devices, and how late or out of order their telemetry arrives.
+	ClockConfig struct {
+		Skew        int     `json:"skew"`        // maximum offset in seconds of the clock of each device, ahead or behind.
+		Drift       float64 `json:"drift"`       // maximum drift in seconds per hour of the clock of each device, ahead or behind.
+		FutureRate  float64 `json:"futureRate"`  // percentage of telemetry messages with timestamps in the future.
+		Future      int     `json:"future"`      // maximum seconds by which timestamps are in the future, 60 by default.
+		DelayRate   float64 `json:"delayRate"`   // percentage of telemetry messages that are delayed.
+		Delay       int     `json:"delay"`       // maximum delay in seconds of delayed messages, 60 by default.
+		ReorderRate float64 `json:"reorderRate"` // percentage of telemetry messages that are sent after the messages created after them.
+	}
+)
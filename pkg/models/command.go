@@ -0,0 +1,54 @@
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+type (
+	// C2DOutcome defines how the simulated device settles a cloud to device message of an asynchronous command.
+	C2DOutcome string
+
+	// CommandBehavior defines how the simulated device responds to a command.
+	CommandBehavior struct {
+		Status        int         `json:"status"`        // status code of successful responses, 200 by default.
+		FailureRate   float64     `json:"failureRate"`   // percentage of commands that fail.
+		FailureStatus int         `json:"failureStatus"` // status code of failed responses, 500 by default.
+		Delay         int         `json:"delay"`         // processing time in milliseconds before responding.
+		Jitter        int         `json:"jitter"`        // maximum random processing time in milliseconds added to the delay.
+		Response      interface{} `json:"response"`      // fixed response payload; generated from the response schema of the command otherwise.
+		Outcome       C2DOutcome  `json:"outcome"`       // settlement of the cloud to device messages of asynchronous commands, complete by default.
+	}
+)
+
+const (
+	// C2DOutcomeComplete specifies that the message is completed and removed from the device queue.
+	C2DOutcomeComplete C2DOutcome = "complete"
+	// C2DOutcomeReject specifies that the message is rejected and moved to the dead letter queue.
+	C2DOutcomeReject C2DOutcome = "reject"
+	// C2DOutcomeAbandon specifies that the message is abandoned and put back on the device queue for redelivery.
+	C2DOutcomeAbandon C2DOutcome = "abandon"
+)
+
+// UnmarshalJSON handles the un-marshalling of c2d outcome.
+func (o *C2DOutcome) UnmarshalJSON(b []byte) error {
+	var p string
+	if err := json.Unmarshal(b, &p); err != nil {
+		return err
+	}
+
+	if p == "" {
+		return nil
+	}
+
+	s := C2DOutcome(p)
+	switch s {
+	case C2DOutcomeComplete,
+		C2DOutcomeReject,
+		C2DOutcomeAbandon:
+		*o = s
+		return nil
+	default:
+		return fmt.Errorf("invalid c2d outcome type %s", p)
+	}
+}
@@ -1,6 +1,9 @@
 package models
 
-import "strings"
+import (
+	"fmt"
+	"strings"
+)
 
 type (
 	// DeviceModel is the device capability model decorated with and ID/Name to be used in simulation
@@ -8,28 +11,42 @@ type (
 		ID              string                   `json:"id"`
 		Name            string                   `json:"name"`
 		CapabilityModel []map[string]interface{} `json:"capabilityModel"`
+		Script          string                   `json:"script"`       // Starlark script with hooks defining the behavior of the devices.
+		StateMachine    *StateMachine            `json:"stateMachine"` // states of the devices driven by commands, writable properties and timers.
+	}
+
+	// DeviceModelFile is a file stored along with a device model, e.g. a telemetry recording to replay.
+	DeviceModelFile struct {
+		ModelID string `json:"modelId"` // the id of the model that the file belongs to.
+		Name    string `json:"name"`    // name of the file.
+		Content string `json:"content"` // content of the file.
 	}
 
 	// TelemetryType represents a telemetry capability of a device
 	TelemetryType struct {
-		ID     string
-		Name   string
-		Schema string
+		ID            string
+		Name          string
+		Schema        *Schema
+		SemanticTypes []string // semantic types of the telemetry, e.g. Event or State.
+		Interval      int      // interval in seconds between sends of the telemetry, sent in every message if 0.
 	}
 
 	// PropertyType represents a property capability of a device
 	PropertyType struct {
-		ID       string
-		Name     string
-		Schema   string
-		Writable bool
+		ID            string
+		Name          string
+		Schema        *Schema
+		Writable      bool
+		SemanticTypes []string // semantic types of the property, e.g. Temperature.
 	}
 
 	// CommandType represents a command capability of a device
 	CommandType struct {
-		ID     string
-		Name   string
-		IsSync bool
+		ID       string
+		Name     string
+		IsSync   bool
+		Request  *Schema // schema of the request payload, nil if the command has no request.
+		Response *Schema // schema of the response payload, nil if the command has no response.
 	}
 
 	// Component represents a component in the Device Capability Model
@@ -37,6 +54,8 @@ type (
 		ComponentID   string
 		ComponentType string // FIX THIS LATER!!!
 		ComponentName string
+		IsComponent   bool // true if the interface is a named component of the root interface rather than the root interface or an interface it extends.
+		Interval      int  // interval in seconds between sends of the telemetry of the component, sent in every message if 0.
 
 		Telemetry  []*TelemetryType
 		Properties []*PropertyType
@@ -55,7 +74,9 @@ func (d *DeviceModel) ParseDeviceCapabilityModel() *DeviceCapabilityModel {
 	var defaultComponent Component
 	defaultComponent.ComponentID = "Default"
 	defaultComponent.ComponentName = "Default"
-	compMap := make(map[string]string)
+	compMap := make(map[string][]string)
+	compIntervals := make(map[string]int)
+	schemas := newSchemaResolver(d.CapabilityModel)
 
 	for _, component := range d.CapabilityModel {
 		var ct Component
@@ -69,17 +90,24 @@ func (d *DeviceModel) ParseDeviceCapabilityModel() *DeviceCapabilityModel {
 		contents, ok := component["contents"].([]interface{})
 		if ok {
 			for _, content := range contents {
-				var id, typ, name, schema string
+				var id, typ, name string
+				var semanticTypes []string
+				var schema, request, response interface{}
 				var writable, isSync bool
+				var interval int
 				for contName, contVal := range content.(map[string]interface{}) {
 					if strings.ToLower(contName) == "@type" {
 						typ, ok = contVal.(string)
 						if !ok {
+							// the content type is combined with semantic types, e.g. ["Telemetry", "Event"]
 							types := contVal.([]interface{})
 							for _, t := range types {
 								tempType := strings.ToLower(t.(string))
-								if tempType == "telemetry" {
+								switch tempType {
+								case "telemetry", "property", "command", "component", "relationship":
 									typ = tempType
+								default:
+									semanticTypes = append(semanticTypes, t.(string))
 								}
 							}
 						}
@@ -88,9 +116,18 @@ func (d *DeviceModel) ParseDeviceCapabilityModel() *DeviceCapabilityModel {
 					} else if strings.ToLower(contName) == "name" {
 						name = contVal.(string)
 					} else if strings.ToLower(contName) == "schema" {
-						schema = contVal.(string)
+						schema = contVal
 					} else if strings.ToLower(contName) == "writable" {
 						writable = contVal.(bool)
+					} else if strings.ToLower(contName) == "request" {
+						request = contVal
+					} else if strings.ToLower(contName) == "response" {
+						response = contVal
+					} else if strings.ToLower(contName) == "interval" {
+						// the send interval is a Starling annotation, not part of DTDL
+						if v, ok := contVal.(float64); ok {
+							interval = int(v)
+						}
 					} else if strings.ToLower(contName) == "commandtype" {
 						if strings.ToLower(contVal.(string)) == "synchronous" {
 							isSync = true
@@ -99,24 +136,32 @@ func (d *DeviceModel) ParseDeviceCapabilityModel() *DeviceCapabilityModel {
 				}
 				if strings.ToLower(typ) == "telemetry" {
 					ct.Telemetry = append(ct.Telemetry, &TelemetryType{
-						ID:     id,
-						Name:   name,
-						Schema: schema,
+						ID:            id,
+						Name:          name,
+						Schema:        schemas.parse(schema),
+						SemanticTypes: semanticTypes,
+						Interval:      interval,
 					})
 				} else if strings.ToLower(typ) == "component" {
-					compMap[schema] = name
+					if iface, ok := schema.(string); ok {
+						compMap[iface] = append(compMap[iface], name)
+						compIntervals[name] = interval
+					}
 				} else if strings.ToLower(typ) == "property" {
 					ct.Properties = append(ct.Properties, &PropertyType{
-						ID:       id,
-						Name:     name,
-						Schema:   schema,
-						Writable: writable,
+						ID:            id,
+						Name:          name,
+						Schema:        schemas.parse(schema),
+						Writable:      writable,
+						SemanticTypes: semanticTypes,
 					})
 				} else if strings.ToLower(typ) == "command" {
 					ct.Commands = append(ct.Commands, &CommandType{
-						ID:     id,
-						Name:   name,
-						IsSync: isSync,
+						ID:       id,
+						Name:     name,
+						IsSync:   isSync,
+						Request:  schemas.parsePayload(request),
+						Response: schemas.parsePayload(response),
 					})
 				}
 			}
@@ -129,12 +174,64 @@ func (d *DeviceModel) ParseDeviceCapabilityModel() *DeviceCapabilityModel {
 		dcm.Components = append(dcm.Components, &defaultComponent)
 	}
 
-	// fill in the component names
+	// fill in the component names; an interface can be used by more than one component
+	var components []*Component
 	for _, comp := range dcm.Components {
-		compName, ok := compMap[comp.ComponentID]
-		if ok {
-			comp.ComponentName = compName
+		compNames, ok := compMap[comp.ComponentID]
+		if !ok {
+			components = append(components, comp)
+			continue
+		}
+
+		for _, compName := range compNames {
+			instance := *comp
+			instance.ComponentName = compName
+			instance.IsComponent = true
+			instance.Interval = compIntervals[compName]
+			components = append(components, &instance)
 		}
 	}
+	dcm.Components = components
 	return &dcm
 }
+
+// IsEvent checks whether the telemetry is an event, which is sent sporadically instead of periodically.
+func (t *TelemetryType) IsEvent() bool {
+	return t.hasSemanticType("Event")
+}
+
+// IsState checks whether the telemetry is a state, whose value only changes on transitions.
+func (t *TelemetryType) IsState() bool {
+	return t.hasSemanticType("State")
+}
+
+// hasSemanticType checks whether the telemetry has the given semantic type.
+func (t *TelemetryType) hasSemanticType(semanticType string) bool {
+	for _, st := range t.SemanticTypes {
+		if strings.EqualFold(st, semanticType) {
+			return true
+		}
+	}
+	return false
+}
+
+// CommandName gets the name by which the command is invoked on the device.
+// Commands of a component are prefixed with the component name as per IoT Plug and Play conventions.
+func (c *Component) CommandName(command *CommandType) string {
+	if c.IsComponent {
+		return fmt.Sprintf("%s*%s", c.ComponentName, command.Name)
+	}
+	return command.Name
+}
+
+// FindCommand finds the component and the command by the name by which the command is invoked on the device.
+func (d *DeviceCapabilityModel) FindCommand(name string) (*Component, *CommandType) {
+	for _, comp := range d.Components {
+		for _, command := range comp.Commands {
+			if comp.CommandName(command) == name {
+				return comp, command
+			}
+		}
+	}
+	return nil, nil
+}
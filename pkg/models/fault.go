@@ -0,0 +1,61 @@
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+type (
+	// TelemetryFaultType defines the kind of fault injected into telemetry.
+	TelemetryFaultType string
+
+	// TelemetryFault defines a fault injected into the telemetry messages of the simulated devices.
+	TelemetryFault struct {
+		Type      TelemetryFaultType `json:"type"`      // the kind of fault.
+		Rate      float64            `json:"rate"`      // percentage of telemetry messages into which the fault is injected.
+		Telemetry []string           `json:"telemetry"` // telemetry affected by value faults by name, or by "component.name" for components; all telemetry if empty.
+		Magnitude float64            `json:"magnitude"` // factor by which spikes multiply values, 10 by default.
+		Duration  int                `json:"duration"`  // number of messages in which a stuck sensor repeats its value, 10 by default.
+		Size      int                `json:"size"`      // bytes of padding added to oversized messages, 262144 (256 KB) by default.
+	}
+)
+
+const (
+	// TelemetryFaultSpike multiplies the value of a numeric telemetry by the magnitude.
+	TelemetryFaultSpike TelemetryFaultType = "spike"
+	// TelemetryFaultStuck repeats the value of a telemetry for the duration.
+	TelemetryFaultStuck TelemetryFaultType = "stuck"
+	// TelemetryFaultOutOfRange replaces the value of a numeric telemetry with a value outside the range of its generator.
+	TelemetryFaultOutOfRange TelemetryFaultType = "outOfRange"
+	// TelemetryFaultMissing removes a telemetry from the message.
+	TelemetryFaultMissing TelemetryFaultType = "missing"
+	// TelemetryFaultWrongType replaces the value of a telemetry with a value of another type.
+	TelemetryFaultWrongType TelemetryFaultType = "wrongType"
+	// TelemetryFaultMalformed truncates the JSON body of the message.
+	TelemetryFaultMalformed TelemetryFaultType = "malformed"
+	// TelemetryFaultOversized pads the message beyond the maximum IoT Hub message size.
+	TelemetryFaultOversized TelemetryFaultType = "oversized"
+)
+
+// UnmarshalJSON handles the un-marshalling of telemetry fault type.
+func (t *TelemetryFaultType) UnmarshalJSON(b []byte) error {
+	var p string
+	if err := json.Unmarshal(b, &p); err != nil {
+		return err
+	}
+
+	s := TelemetryFaultType(p)
+	switch s {
+	case TelemetryFaultSpike,
+		TelemetryFaultStuck,
+		TelemetryFaultOutOfRange,
+		TelemetryFaultMissing,
+		TelemetryFaultWrongType,
+		TelemetryFaultMalformed,
+		TelemetryFaultOversized:
+		*t = s
+		return nil
+	default:
+		return fmt.Errorf("invalid telemetry fault type %s", p)
+	}
+}
@@ -0,0 +1,65 @@
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+type (
+	// ValueGeneratorType defines the behavior of the values generated for a telemetry or a property.
+	ValueGeneratorType string
+
+	// ValueGenerator defines how the values of a telemetry or a property are generated by the simulated device.
+	ValueGenerator struct {
+		Type   ValueGeneratorType `json:"type"`   // behavior of the generated values.
+		Min    float64            `json:"min"`    // minimum value.
+		Max    float64            `json:"max"`    // maximum value.
+		Period int                `json:"period"` // period of a sine wave or the interval between steps in seconds.
+		Noise  float64            `json:"noise"`  // maximum random noise added to or subtracted from each value.
+		Drift  float64            `json:"drift"`  // change of the values per hour since the device started generating values.
+		Step   float64            `json:"step"`   // maximum change between values of a random walk, or the change of each step.
+		Values []interface{}      `json:"values"` // values of a sequence, sent in order and repeated.
+		Value  interface{}        `json:"value"`  // value of a constant.
+	}
+)
+
+const (
+	// ValueGeneratorRandom generates uniformly distributed random values between min and max.
+	ValueGeneratorRandom ValueGeneratorType = "random"
+	// ValueGeneratorSine generates a sine wave oscillating between min and max.
+	ValueGeneratorSine ValueGeneratorType = "sine"
+	// ValueGeneratorRandomWalk generates values starting between min and max that change randomly by at most step.
+	ValueGeneratorRandomWalk ValueGeneratorType = "randomWalk"
+	// ValueGeneratorStep generates values starting at min that increase by step every period and wrap around at max.
+	ValueGeneratorStep ValueGeneratorType = "step"
+	// ValueGeneratorSequence generates the values of a fixed sequence in order.
+	ValueGeneratorSequence ValueGeneratorType = "sequence"
+	// ValueGeneratorConstant generates a constant value.
+	ValueGeneratorConstant ValueGeneratorType = "constant"
+)
+
+// UnmarshalJSON handles the un-marshalling of value generator type.
+func (t *ValueGeneratorType) UnmarshalJSON(b []byte) error {
+	var p string
+	if err := json.Unmarshal(b, &p); err != nil {
+		return err
+	}
+
+	if p == "" {
+		return nil
+	}
+
+	s := ValueGeneratorType(p)
+	switch s {
+	case ValueGeneratorRandom,
+		ValueGeneratorSine,
+		ValueGeneratorRandomWalk,
+		ValueGeneratorStep,
+		ValueGeneratorSequence,
+		ValueGeneratorConstant:
+		*t = s
+		return nil
+	default:
+		return fmt.Errorf("invalid value generator type %s", p)
+	}
+}
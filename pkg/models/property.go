@@ -0,0 +1,13 @@
+package models
+
+type (
+	// PropertyAckBehavior defines how the simulated device acknowledges updates of a writable property.
+	PropertyAckBehavior struct {
+		Status      int     `json:"status"`      // status code of the acknowledgement, 200 by default.
+		Description string  `json:"description"` // description of the acknowledgement, "completed" by default.
+		Delay       int     `json:"delay"`       // time in milliseconds before the update is acknowledged.
+		Jitter      int     `json:"jitter"`      // maximum random time in milliseconds added to the delay.
+		IgnoreRate  float64 `json:"ignoreRate"`  // percentage of updates that are never acknowledged.
+		Pending     bool    `json:"pending"`     // acknowledge the update as pending (202) immediately, and with the status after the delay.
+	}
+)
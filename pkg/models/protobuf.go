@@ -0,0 +1,197 @@
+package models
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	// ProtoValuesField is the field number of the values of the wrapper messages of nested arrays and maps,
+	// which cannot be repeated in Protobuf.
+	ProtoValuesField = 1
+	// ProtoMapKeyField is the field number of the keys of map entries.
+	ProtoMapKeyField = 1
+	// ProtoMapValueField is the field number of the values of map entries.
+	ProtoMapValueField = 2
+	// ProtoRecordsField is the field number of the records of packed telemetry messages.
+	ProtoRecordsField = 1
+	// ProtoTimestampField is the field number of the timestamp of the records of telemetry envelopes.
+	ProtoTimestampField = 1
+	// ProtoRecordValuesField is the field number of the values of the records of telemetry envelopes.
+	ProtoRecordValuesField = 2
+)
+
+var (
+	// geopointFields are the fields of the geopoint schema, encoded as a message in Protobuf.
+	geopointFields = []*SchemaField{
+		{Name: "lat", Schema: &Schema{Type: "double"}},
+		{Name: "lon", Schema: &Schema{Type: "double"}},
+		{Name: "alt", Schema: &Schema{Type: "double"}},
+	}
+
+	// vectorFields are the fields of the vector schema, encoded as a message in Protobuf.
+	vectorFields = []*SchemaField{
+		{Name: "x", Schema: &Schema{Type: "double"}},
+		{Name: "y", Schema: &Schema{Type: "double"}},
+		{Name: "z", Schema: &Schema{Type: "double"}},
+	}
+)
+
+// TelemetryFields gets the fields of the telemetry messages of the root interface, or of a component.
+// Fields are numbered in the order they are returned, starting from 1.
+func (d *DeviceCapabilityModel) TelemetryFields(componentName string) []*SchemaField {
+	var fields []*SchemaField
+	for _, comp := range d.Components {
+		if comp.IsComponent != (componentName != "") || (comp.IsComponent && comp.ComponentName != componentName) {
+			continue
+		}
+		for _, telemetry := range comp.Telemetry {
+			fields = append(fields, &SchemaField{
+				Name:   telemetry.Name,
+				Schema: telemetry.Schema,
+			})
+		}
+	}
+	return fields
+}
+
+// ProtoSchema gets the Protobuf schema of the telemetry messages of the device, derived from the capability model.
+// The root interface and each component have their own message, along with the messages of packed telemetry.
+func (d *DeviceCapabilityModel) ProtoSchema(modelID string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "// Telemetry messages of the device model '%s'.\n", modelID)
+	b.WriteString("syntax = \"proto3\";\n\npackage starling;\n")
+
+	components := []string{""}
+	for _, comp := range d.Components {
+		if comp.IsComponent && len(comp.Telemetry) > 0 {
+			components = append(components, comp.ComponentName)
+		}
+	}
+	for _, componentName := range components {
+		name := GetProtoTelemetryMessage(componentName)
+		b.WriteString("\n")
+		writeProtoMessage(&b, name, d.TelemetryFields(componentName), "")
+		fmt.Fprintf(&b, "\nmessage %sArray {\n  repeated %s records = %d;\n}\n", name, name, ProtoRecordsField)
+		fmt.Fprintf(&b, "\nmessage %sEnvelope {\n  message Record {\n    string timestamp = %d;\n    %s values = %d;\n  }\n  repeated Record records = %d;\n}\n",
+			name, ProtoTimestampField, name, ProtoRecordValuesField, ProtoRecordsField)
+	}
+
+	b.WriteString("\n")
+	writeProtoMessage(&b, "GeoPoint", geopointFields, "")
+	b.WriteString("\n")
+	writeProtoMessage(&b, "Vector", vectorFields, "")
+	return b.String()
+}
+
+// GetProtoTelemetryMessage gets the name of the Protobuf message of the telemetry of the root interface, or of a component.
+func GetProtoTelemetryMessage(componentName string) string {
+	return getProtoName(componentName) + "Telemetry"
+}
+
+// GetProtoFields gets the fields of the Protobuf message of an object, geopoint or vector schema.
+func GetProtoFields(schema *Schema) []*SchemaField {
+	if schema == nil {
+		return nil
+	}
+	switch schema.Type {
+	case SchemaTypeObject:
+		return schema.Fields
+	case "geopoint":
+		return geopointFields
+	case "vector":
+		return vectorFields
+	}
+	return nil
+}
+
+// IsProtoWrapped checks whether values of the schema are wrapped in a message when they are elements of an array or
+// values of a map, since repeated fields and maps cannot be nested in Protobuf.
+func IsProtoWrapped(schema *Schema) bool {
+	return schema != nil && (schema.Type == SchemaTypeArray || schema.Type == SchemaTypeMap)
+}
+
+// writeProtoMessage writes the declaration of a message with the given fields, and of the messages nested in it.
+func writeProtoMessage(b *strings.Builder, name string, fields []*SchemaField, indent string) {
+	fmt.Fprintf(b, "%smessage %s {\n", indent, name)
+	for i, field := range fields {
+		typ := getProtoType(b, field.Name, field.Schema, indent+"  ")
+		fmt.Fprintf(b, "%s  %s %s = %d;\n", indent, typ, field.Name, i+1)
+	}
+	fmt.Fprintf(b, "%s}\n", indent)
+}
+
+// getProtoType gets the Protobuf type of a field with the given schema, writing the nested messages it needs.
+func getProtoType(b *strings.Builder, name string, schema *Schema, indent string) string {
+	if schema == nil {
+		return "string"
+	}
+
+	switch schema.Type {
+	case "boolean":
+		return "bool"
+	case "double", "float":
+		return schema.Type
+	case "integer":
+		return "int32"
+	case "long":
+		return "int64"
+	case "geopoint":
+		return "GeoPoint"
+	case "vector":
+		return "Vector"
+	case SchemaTypeEnum:
+		if schema.ValueSchema == "integer" {
+			return "int32"
+		}
+		return "string"
+	case SchemaTypeObject:
+		message := getProtoName(name)
+		writeProtoMessage(b, message, schema.Fields, indent)
+		return message
+	case SchemaTypeArray:
+		return "repeated " + getProtoElementType(b, name+"Element", schema.ElementSchema, indent)
+	case SchemaTypeMap:
+		if schema.MapValue == nil {
+			return "map<string, string>"
+		}
+		return fmt.Sprintf("map<string, %s>", getProtoElementType(b, name+"Value", schema.MapValue.Schema, indent))
+	}
+
+	// date, datetime, duration, string and time
+	return "string"
+}
+
+// getProtoElementType gets the Protobuf type of the elements of an array or the values of a map,
+// wrapping nested arrays and maps in a message.
+func getProtoElementType(b *strings.Builder, name string, schema *Schema, indent string) string {
+	if !IsProtoWrapped(schema) {
+		return getProtoType(b, name, schema, indent)
+	}
+
+	message := getProtoName(name)
+	fmt.Fprintf(b, "%smessage %s {\n", indent, message)
+	typ := getProtoType(b, "values", schema, indent+"  ")
+	fmt.Fprintf(b, "%s  %s values = %d;\n", indent, typ, ProtoValuesField)
+	fmt.Fprintf(b, "%s}\n", indent)
+	return message
+}
+
+// getProtoName gets a Protobuf message name from a DTDL name, e.g. thermostat1 is Thermostat1.
+func getProtoName(name string) string {
+	var b strings.Builder
+	upper := true
+	for _, r := range name {
+		if r == '_' {
+			upper = true
+			continue
+		}
+		if upper {
+			b.WriteString(strings.ToUpper(string(r)))
+			upper = false
+		} else {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
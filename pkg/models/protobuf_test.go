@@ -0,0 +1,149 @@
+package models
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTelemetryFields(t *testing.T) {
+	d := &DeviceCapabilityModel{
+		Components: []*Component{
+			{ComponentName: "Default", Telemetry: []*TelemetryType{{Name: "temperature"}}},
+			{ComponentName: "sensor", IsComponent: true, Telemetry: []*TelemetryType{{Name: "humidity"}, {Name: "pressure"}}},
+			{ComponentName: "Inherited", Telemetry: []*TelemetryType{{Name: "battery"}}},
+		},
+	}
+
+	tests := []struct {
+		componentName string
+		want          []string
+	}{
+		{componentName: "", want: []string{"temperature", "battery"}},
+		{componentName: "sensor", want: []string{"humidity", "pressure"}},
+		{componentName: "missing", want: nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.componentName, func(t *testing.T) {
+			var got []string
+			for _, field := range d.TelemetryFields(tt.componentName) {
+				got = append(got, field.Name)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("TelemetryFields() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProtoSchema(t *testing.T) {
+	integer := &Schema{Type: "integer"}
+
+	tests := []struct {
+		name      string
+		telemetry []*TelemetryType
+		want      string
+	}{
+		{
+			name: "primitives",
+			telemetry: []*TelemetryType{
+				{Name: "on", Schema: &Schema{Type: "boolean"}},
+				{Name: "temperature", Schema: &Schema{Type: "double"}},
+				{Name: "count", Schema: integer},
+				{Name: "total", Schema: &Schema{Type: "long"}},
+				{Name: "since", Schema: &Schema{Type: "datetime"}},
+				{Name: "location", Schema: &Schema{Type: "geopoint"}},
+				{Name: "level", Schema: &Schema{Type: SchemaTypeEnum, ValueSchema: "integer"}},
+				{Name: "unknown"},
+			},
+			want: `message Telemetry {
+  bool on = 1;
+  double temperature = 2;
+  int32 count = 3;
+  int64 total = 4;
+  string since = 5;
+  GeoPoint location = 6;
+  int32 level = 7;
+  string unknown = 8;
+}
+`,
+		},
+		{
+			name: "object",
+			telemetry: []*TelemetryType{
+				{Name: "fan_speed", Schema: &Schema{Type: SchemaTypeObject, Fields: []*SchemaField{{Name: "rpm", Schema: integer}}}},
+			},
+			want: `message Telemetry {
+  message FanSpeed {
+    int32 rpm = 1;
+  }
+  FanSpeed fan_speed = 1;
+}
+`,
+		},
+		{
+			name: "arrays and maps",
+			telemetry: []*TelemetryType{
+				{Name: "counts", Schema: &Schema{Type: SchemaTypeArray, ElementSchema: integer}},
+				{Name: "matrix", Schema: &Schema{Type: SchemaTypeArray, ElementSchema: &Schema{Type: SchemaTypeArray, ElementSchema: integer}}},
+				{Name: "labels", Schema: &Schema{Type: SchemaTypeMap, MapValue: &SchemaField{Name: "value", Schema: integer}}},
+			},
+			want: `message Telemetry {
+  repeated int32 counts = 1;
+  message MatrixElement {
+    repeated int32 values = 1;
+  }
+  repeated MatrixElement matrix = 2;
+  map<string, int32> labels = 3;
+}
+`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &DeviceCapabilityModel{Components: []*Component{{ComponentName: "Default", Telemetry: tt.telemetry}}}
+			got := d.ProtoSchema("thermostat")
+			if !strings.Contains(got, "\n"+tt.want) {
+				t.Errorf("ProtoSchema() = %s, want a message %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProtoSchemaComponents(t *testing.T) {
+	d := &DeviceCapabilityModel{
+		Components: []*Component{
+			{ComponentName: "Default", Telemetry: []*TelemetryType{{Name: "temperature", Schema: &Schema{Type: "double"}}}},
+			{ComponentName: "thermostat1", IsComponent: true, Telemetry: []*TelemetryType{{Name: "humidity", Schema: &Schema{Type: "double"}}}},
+			{ComponentName: "deviceInfo", IsComponent: true},
+		},
+	}
+	schema := d.ProtoSchema("thermostat")
+
+	tests := []struct {
+		name    string
+		message string
+		want    bool
+	}{
+		{name: "root interface", message: "message Telemetry {\n  double temperature = 1;\n}\n", want: true},
+		{name: "root interface array", message: "message TelemetryArray {\n  repeated Telemetry records = 1;\n}\n", want: true},
+		{name: "component", message: "message Thermostat1Telemetry {\n  double humidity = 1;\n}\n", want: true},
+		{
+			name:    "component envelope",
+			message: "message Thermostat1TelemetryEnvelope {\n  message Record {\n    string timestamp = 1;\n    Thermostat1Telemetry values = 2;\n  }\n  repeated Record records = 1;\n}\n",
+			want:    true,
+		},
+		{name: "component without telemetry", message: "message DeviceInfoTelemetry {", want: false},
+		{name: "geopoint", message: "message GeoPoint {\n  double lat = 1;\n  double lon = 2;\n  double alt = 3;\n}\n", want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := strings.Contains(schema, "\n"+tt.message); got != tt.want {
+				t.Errorf("ProtoSchema() = %s, want message %s: %v", schema, tt.message, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,51 @@
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+type (
+	// ReplayFormat defines the format of a telemetry recording.
+	ReplayFormat string
+
+	// ReplayConfig defines how simulated devices replay telemetry recorded from real devices.
+	ReplayConfig struct {
+		File            string            `json:"file"`            // name of the recording file stored along with the device model.
+		Format          ReplayFormat      `json:"format"`          // format of the recording; derived from the file extension when not specified.
+		Columns         map[string]string `json:"columns"`         // telemetry names (or "component.name") by column name; columns named after a telemetry are mapped implicitly.
+		TimestampColumn string            `json:"timestampColumn"` // column containing the recorded time of each row; rows are sent at the telemetry interval when not specified.
+		Speed           float64           `json:"speed"`           // factor by which the recorded inter-arrival times are shortened, e.g. 2 replays twice as fast; defaults to 1.
+		Loop            bool              `json:"loop"`            // restart the replay from the first row after sending the last row.
+		DeviceOffset    int               `json:"deviceOffset"`    // number of rows by which the first row replayed by each device is shifted.
+	}
+)
+
+const (
+	// ReplayFormatCsv specifies a comma separated recording with a header row.
+	ReplayFormatCsv ReplayFormat = "csv"
+	// ReplayFormatJsonl specifies a recording with a JSON object per line.
+	ReplayFormatJsonl ReplayFormat = "jsonl"
+)
+
+// UnmarshalJSON handles the un-marshalling of replay format.
+func (f *ReplayFormat) UnmarshalJSON(b []byte) error {
+	var p string
+	if err := json.Unmarshal(b, &p); err != nil {
+		return err
+	}
+
+	if p == "" {
+		return nil
+	}
+
+	s := ReplayFormat(p)
+	switch s {
+	case ReplayFormatCsv,
+		ReplayFormatJsonl:
+		*f = s
+		return nil
+	default:
+		return fmt.Errorf("invalid replay format type %s", p)
+	}
+}
@@ -0,0 +1,21 @@
+package models
+
+type (
+	// GeoPoint defines a point on earth.
+	GeoPoint struct {
+		Lat float64 `json:"lat"` // latitude in degrees.
+		Lon float64 `json:"lon"` // longitude in degrees.
+		Alt float64 `json:"alt"` // altitude in meters.
+	}
+
+	// RouteConfig defines how simulated devices move along routes or wander inside an area.
+	RouteConfig struct {
+		Files            []string   `json:"files"`            // names of GPX or GeoJSON files with routes or areas stored along with the device model; devices are assigned the routes in turn.
+		Area             []GeoPoint `json:"area"`             // polygon inside which devices wander between random points, when no files are specified.
+		Speed            float64    `json:"speed"`            // average speed in km/h, 50 by default.
+		SpeedVariation   float64    `json:"speedVariation"`   // percentage by which the speed randomly varies between points.
+		Telemetry        string     `json:"telemetry"`        // geopoint telemetry following the route by name, or by "component.name" for components; all geopoint telemetry if empty.
+		HeadingTelemetry string     `json:"headingTelemetry"` // telemetry receiving the heading in degrees, by name or by "component.name".
+		SpeedTelemetry   string     `json:"speedTelemetry"`   // telemetry receiving the speed in km/h, by name or by "component.name".
+	}
+)
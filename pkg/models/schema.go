@@ -0,0 +1,206 @@
+package models
+
+import (
+	"strings"
+)
+
+type (
+	// Schema represents the DTDL schema of a telemetry, property, command payload or a field of a complex schema.
+	Schema struct {
+		ID            string         // @id of the schema, if it was declared with one.
+		Type          string         // primitive schema (e.g. double, string) or complex schema type (object, enum, map, array).
+		Fields        []*SchemaField // fields of an object schema.
+		ValueSchema   string         // value schema (integer or string) of an enum schema.
+		EnumValues    []*EnumValue   // values of an enum schema.
+		MapKey        *SchemaField   // key of a map schema.
+		MapValue      *SchemaField   // value of a map schema.
+		ElementSchema *Schema        // schema of the elements of an array schema.
+	}
+
+	// SchemaField represents a named field of an object schema or the key/value of a map schema.
+	SchemaField struct {
+		Name   string
+		Schema *Schema
+	}
+
+	// EnumValue represents a single value of an enum schema.
+	EnumValue struct {
+		Name  string
+		Value interface{}
+	}
+
+	// schemaResolver resolves schemas that are declared inline or referenced by their @id.
+	schemaResolver struct {
+		definitions map[string]map[string]interface{} // schema definitions indexed by their @id.
+		resolving   map[string]bool                   // schemas being resolved, used to detect cyclic references.
+	}
+)
+
+const (
+	// SchemaTypeObject specifies a DTDL Object schema.
+	SchemaTypeObject = "object"
+	// SchemaTypeEnum specifies a DTDL Enum schema.
+	SchemaTypeEnum = "enum"
+	// SchemaTypeMap specifies a DTDL Map schema.
+	SchemaTypeMap = "map"
+	// SchemaTypeArray specifies a DTDL Array schema.
+	SchemaTypeArray = "array"
+
+	// maxSchemaDepth is the maximum depth of nested complex schemas allowed by DTDL v2.
+	maxSchemaDepth = 5
+)
+
+// newSchemaResolver creates a schema resolver with all the schema definitions in the capability model.
+func newSchemaResolver(capabilityModel []map[string]interface{}) *schemaResolver {
+	r := &schemaResolver{
+		definitions: make(map[string]map[string]interface{}),
+		resolving:   make(map[string]bool),
+	}
+	for _, iface := range capabilityModel {
+		r.collect(iface)
+	}
+	return r
+}
+
+// collect walks through a DTDL element and indexes all the schema definitions that have an @id.
+func (r *schemaResolver) collect(element interface{}) {
+	switch e := element.(type) {
+	case map[string]interface{}:
+		if id, ok := e["@id"].(string); ok && getComplexSchemaType(e) != "" {
+			r.definitions[id] = e
+		}
+		for _, v := range e {
+			r.collect(v)
+		}
+	case []interface{}:
+		for _, v := range e {
+			r.collect(v)
+		}
+	}
+}
+
+// parse builds the schema tree of a DTDL schema declaration.
+func (r *schemaResolver) parse(schema interface{}) *Schema {
+	return r.parseWithDepth(schema, 0)
+}
+
+// parsePayload parses the schema of a command request or response payload.
+func (r *schemaResolver) parsePayload(payload interface{}) *Schema {
+	p, ok := payload.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	return r.parse(p["schema"])
+}
+
+// parseWithDepth parses a schema declaration nested at the given depth of complex schemas.
+func (r *schemaResolver) parseWithDepth(schema interface{}, depth int) *Schema {
+	if depth > maxSchemaDepth {
+		return nil
+	}
+
+	switch s := schema.(type) {
+	case string:
+		def, ok := r.definitions[s]
+		if !ok {
+			return &Schema{Type: strings.ToLower(s)}
+		}
+
+		// guard against schemas referencing themselves
+		if r.resolving[s] {
+			return nil
+		}
+		r.resolving[s] = true
+		defer delete(r.resolving, s)
+		return r.parseWithDepth(def, depth)
+	case map[string]interface{}:
+		return r.parseComplexSchema(s, depth)
+	}
+
+	return nil
+}
+
+// parseComplexSchema parses an inline object, enum, map or array schema.
+func (r *schemaResolver) parseComplexSchema(schema map[string]interface{}, depth int) *Schema {
+	var result Schema
+	result.ID, _ = schema["@id"].(string)
+	result.Type = getComplexSchemaType(schema)
+
+	switch result.Type {
+	case SchemaTypeObject:
+		fields, _ := schema["fields"].([]interface{})
+		for _, f := range fields {
+			if field := r.parseField(f, depth); field != nil {
+				result.Fields = append(result.Fields, field)
+			}
+		}
+	case SchemaTypeEnum:
+		valueSchema, _ := schema["valueSchema"].(string)
+		result.ValueSchema = strings.ToLower(valueSchema)
+		values, _ := schema["enumValues"].([]interface{})
+		for _, v := range values {
+			value, ok := v.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			var ev EnumValue
+			ev.Name, _ = value["name"].(string)
+			ev.Value = value["enumValue"]
+			if f, ok := ev.Value.(float64); ok && result.ValueSchema == "integer" {
+				ev.Value = int(f)
+			}
+			result.EnumValues = append(result.EnumValues, &ev)
+		}
+	case SchemaTypeMap:
+		result.MapKey = r.parseField(schema["mapKey"], depth)
+		result.MapValue = r.parseField(schema["mapValue"], depth)
+	case SchemaTypeArray:
+		result.ElementSchema = r.parseWithDepth(schema["elementSchema"], depth+1)
+		if result.ElementSchema == nil {
+			return nil
+		}
+	default:
+		return nil
+	}
+
+	return &result
+}
+
+// parseField parses a field of an object schema or the key/value of a map schema.
+func (r *schemaResolver) parseField(field interface{}, depth int) *SchemaField {
+	f, ok := field.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+
+	schema := r.parseWithDepth(f["schema"], depth+1)
+	if schema == nil {
+		return nil
+	}
+
+	name, _ := f["name"].(string)
+	return &SchemaField{
+		Name:   name,
+		Schema: schema,
+	}
+}
+
+// getComplexSchemaType gets the complex schema type from the @type of a schema declaration.
+func getComplexSchemaType(schema map[string]interface{}) string {
+	var types []interface{}
+	switch t := schema["@type"].(type) {
+	case string:
+		types = append(types, t)
+	case []interface{}:
+		types = t
+	}
+
+	for _, t := range types {
+		typ, _ := t.(string)
+		switch strings.ToLower(typ) {
+		case SchemaTypeObject, SchemaTypeEnum, SchemaTypeMap, SchemaTypeArray:
+			return strings.ToLower(typ)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,129 @@
+package models
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestSchemaResolverParse(t *testing.T) {
+	definitions := `[{
+		"@id": "dtmi:example:device;1",
+		"@type": "Interface",
+		"schemas": [
+			{"@id": "dtmi:example:point;1", "@type": "Object", "fields": [
+				{"name": "x", "schema": "double"},
+				{"name": "y", "schema": "double"}
+			]},
+			{"@id": "dtmi:example:loop;1", "@type": "Object", "fields": [
+				{"name": "next", "schema": "dtmi:example:loop;1"}
+			]}
+		]
+	}]`
+	var capabilityModel []map[string]interface{}
+	if err := json.Unmarshal([]byte(definitions), &capabilityModel); err != nil {
+		t.Fatal(err)
+	}
+
+	point := &Schema{ID: "dtmi:example:point;1", Type: SchemaTypeObject, Fields: []*SchemaField{
+		{Name: "x", Schema: &Schema{Type: "double"}},
+		{Name: "y", Schema: &Schema{Type: "double"}},
+	}}
+
+	tests := []struct {
+		name   string
+		schema string
+		want   *Schema
+	}{
+		{
+			name:   "primitive",
+			schema: `"Double"`,
+			want:   &Schema{Type: "double"},
+		},
+		{
+			name:   "object",
+			schema: `{"@type": "Object", "fields": [{"name": "on", "schema": "boolean"}, {"name": "level", "schema": "integer"}]}`,
+			want: &Schema{Type: SchemaTypeObject, Fields: []*SchemaField{
+				{Name: "on", Schema: &Schema{Type: "boolean"}},
+				{Name: "level", Schema: &Schema{Type: "integer"}},
+			}},
+		},
+		{
+			name:   "integer enum",
+			schema: `{"@type": "Enum", "valueSchema": "integer", "enumValues": [{"name": "off", "enumValue": 0}, {"name": "on", "enumValue": 1}]}`,
+			want: &Schema{Type: SchemaTypeEnum, ValueSchema: "integer", EnumValues: []*EnumValue{
+				{Name: "off", Value: 0},
+				{Name: "on", Value: 1},
+			}},
+		},
+		{
+			name:   "string enum",
+			schema: `{"@type": "Enum", "valueSchema": "string", "enumValues": [{"name": "low", "enumValue": "L"}]}`,
+			want: &Schema{Type: SchemaTypeEnum, ValueSchema: "string", EnumValues: []*EnumValue{
+				{Name: "low", Value: "L"},
+			}},
+		},
+		{
+			name:   "map",
+			schema: `{"@type": "Map", "mapKey": {"name": "sensor", "schema": "string"}, "mapValue": {"name": "reading", "schema": "float"}}`,
+			want: &Schema{
+				Type:     SchemaTypeMap,
+				MapKey:   &SchemaField{Name: "sensor", Schema: &Schema{Type: "string"}},
+				MapValue: &SchemaField{Name: "reading", Schema: &Schema{Type: "float"}},
+			},
+		},
+		{
+			name:   "array of references",
+			schema: `{"@type": "Array", "elementSchema": "dtmi:example:point;1"}`,
+			want:   &Schema{Type: SchemaTypeArray, ElementSchema: point},
+		},
+		{
+			name:   "semantic types",
+			schema: `{"@type": ["Object", "Location"], "fields": [{"name": "lat", "schema": "double"}]}`,
+			want: &Schema{Type: SchemaTypeObject, Fields: []*SchemaField{
+				{Name: "lat", Schema: &Schema{Type: "double"}},
+			}},
+		},
+		{
+			name:   "reference",
+			schema: `"dtmi:example:point;1"`,
+			want:   point,
+		},
+		{
+			name:   "cyclic reference",
+			schema: `"dtmi:example:loop;1"`,
+			want:   &Schema{ID: "dtmi:example:loop;1", Type: SchemaTypeObject},
+		},
+		{
+			name:   "array without element schema",
+			schema: `{"@type": "Array"}`,
+			want:   nil,
+		},
+		{
+			name:   "unknown complex schema",
+			schema: `{"@type": "Unknown"}`,
+			want:   nil,
+		},
+		{
+			name:   "too deep",
+			schema: `{"@type": "Array", "elementSchema": {"@type": "Array", "elementSchema": {"@type": "Array", "elementSchema": {"@type": "Array", "elementSchema": {"@type": "Array", "elementSchema": {"@type": "Array", "elementSchema": "double"}}}}}}`,
+			want:   nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var schema interface{}
+			if err := json.Unmarshal([]byte(tt.schema), &schema); err != nil {
+				t.Fatal(err)
+			}
+
+			got := newSchemaResolver(capabilityModel).parse(schema)
+			if !reflect.DeepEqual(got, tt.want) {
+				gotJSON, _ := json.Marshal(got)
+				wantJSON, _ := json.Marshal(tt.want)
+				t.Errorf("parse() = %s, want %s", gotJSON, wantJSON)
+			}
+		})
+	}
+}
@@ -12,14 +12,38 @@ type (
 	// TelemetryFormat defines the format of the telemetry messages sent from the simulated device.
 	TelemetryFormat string
 
+	// TelemetryEncoding defines the content encoding (compression) of the telemetry messages sent from the simulated device.
+	TelemetryEncoding string
+
+	// TelemetryPacking defines how the telemetry messages of a batch are packed into multi-record messages.
+	TelemetryPacking string
+
+	// DeviceTransport defines the protocol the simulated device uses to connect to IoT Hub.
+	DeviceTransport string
+
 	// SimulationStatus specifies the current status of the simulation.
 	SimulationStatus string
 
 	// SimulationDeviceConfig defines the device configuration for a simulation.
 	SimulationDeviceConfig struct {
-		ID          string `json:"id"`          // the id of the configuration
-		ModelID     string `json:"modelId"`     // the model to simulate.
-		DeviceCount int    `json:"deviceCount"` // the total no. of devices to simulate.
+		ID                          string                          `json:"id"`                          // the id of the configuration
+		ModelID                     string                          `json:"modelId"`                     // the model to simulate.
+		DeviceCount                 int                             `json:"deviceCount"`                 // the total no. of devices to simulate.
+		Generators                  map[string]*ValueGenerator      `json:"generators"`                  // value generators by telemetry or property name, or by "component.name" for components; random values are generated otherwise.
+		Replay                      *ReplayConfig                   `json:"replay"`                      // replay recorded telemetry instead of generating it.
+		Route                       *RouteConfig                    `json:"route"`                       // move devices along routes or inside an area.
+		Commands                    map[string]*CommandBehavior     `json:"commands"`                    // command behaviors by command name, or by "component.name" for components; commands succeed immediately otherwise.
+		PropertyAcks                map[string]*PropertyAckBehavior `json:"propertyAcks"`                // acknowledgement behaviors by writable property name, or by "component.name" for components; updates are completed immediately otherwise.
+		ReportChangedPropertiesOnly bool                            `json:"reportChangedPropertiesOnly"` // send only the read-only properties whose values changed since they were last reported.
+		Faults                      []*TelemetryFault               `json:"faults"`                      // faults injected into telemetry.
+		EventRates                  map[string]float64              `json:"eventRates"`                  // average number of events or state transitions per hour by telemetry name, or by "component.name" for components.
+		TelemetryIntervals          map[string]int                  `json:"telemetryIntervals"`          // intervals in seconds between sends by telemetry name, "component.name" or component name; overrides the intervals of the model.
+		Clock                       *ClockConfig                    `json:"clock"`                       // clock skew and drift of the devices, and late or out of order telemetry.
+		MessageProperties           map[string]string               `json:"messageProperties"`           // application properties of telemetry messages by name; values are templates, e.g. "{{.DeviceID}}".
+		ContentType                 string                          `json:"contentType"`                 // template of the content type of telemetry messages, overriding the content type of the telemetry format.
+		Transport                   DeviceTransport                 `json:"transport"`                   // protocol the devices use to connect to IoT Hub, MQTT if not set.
+		PollInterval                int                             `json:"pollInterval"`                // interval in milliseconds between c2d polls of HTTPS devices; c2dPollInterval of the config if not set.
+		ProvisioningPayload         map[string]interface{}          `json:"provisioningPayload"`         // custom payload sent to DPS when registering, with the model id; string values are templates, e.g. "{{.DeviceID}}".
 	}
 
 	// Simulation definition.
@@ -35,6 +59,11 @@ type (
 		ReportedPropsInterval int                      `json:"reportedPropertyInterval"` // interval to wait between sending reported properties.
 		DisconnectBehavior    DeviceDisconnectBehavior `json:"disconnectBehavior"`       // device connection behavior.
 		TelemetryFormat       TelemetryFormat          `json:"telemetryFormat"`          // format of telemetry messages.
+		TelemetryEncoding     TelemetryEncoding        `json:"telemetryEncoding"`        // content encoding (compression) of telemetry messages.
+		TelemetryPacking      TelemetryPacking         `json:"telemetryPacking"`         // packing of the telemetry messages of a batch into multi-record messages.
+		MaxMessageSize        int                      `json:"maxMessageSize"`           // maximum size in bytes of packed telemetry messages, 256 KB if 0.
+		Seed                  int64                    `json:"seed"`                     // seed of the random values generated by the devices; runs with the same seed generate the same values, random if 0.
+		Backfill              *BackfillConfig          `json:"backfill"`                 // send historical telemetry over a range of virtual time as fast as possible instead of in real time.
 	}
 )
 
@@ -57,10 +86,41 @@ const (
 	// DeviceDisconnectAfterTelemetrySend specifies that the device should disconnect after sending telemetry.
 	DeviceDisconnectAfterTelemetrySend DeviceDisconnectBehavior = "telemetry"
 
+	// DeviceTransportMqtt specifies that the device connects over MQTT on port 8883.
+	DeviceTransportMqtt DeviceTransport = "mqtt"
+	// DeviceTransportMqttWs specifies that the device connects over MQTT over WebSockets on port 443.
+	DeviceTransportMqttWs DeviceTransport = "mqtt-ws"
+	// DeviceTransportAmqp specifies that the device connects over AMQP on port 5671.
+	DeviceTransportAmqp DeviceTransport = "amqp"
+	// DeviceTransportAmqpWs specifies that the device connects over AMQP over WebSockets on port 443.
+	DeviceTransportAmqpWs DeviceTransport = "amqp-ws"
+	// DeviceTransportHttp specifies that the device sends over the HTTPS device API without holding a connection.
+	DeviceTransportHttp DeviceTransport = "http"
+
 	// TelemetryFormatDefault specifies that the device sends telemetry in default JSON format.
 	TelemetryFormatDefault TelemetryFormat = "default"
 	// TelemetryFormatOpcua specifies that the device sends telemetry in opcua JSON format.
 	TelemetryFormatOpcua TelemetryFormat = "opcua"
+	// TelemetryFormatCbor specifies that the device sends telemetry in CBOR format.
+	TelemetryFormatCbor TelemetryFormat = "cbor"
+	// TelemetryFormatMsgpack specifies that the device sends telemetry in MessagePack format.
+	TelemetryFormatMsgpack TelemetryFormat = "msgpack"
+	// TelemetryFormatProtobuf specifies that the device sends telemetry in Protobuf format, with the schema derived from the device model.
+	TelemetryFormatProtobuf TelemetryFormat = "protobuf"
+
+	// TelemetryEncodingNone specifies that telemetry messages are not compressed.
+	TelemetryEncodingNone TelemetryEncoding = "none"
+	// TelemetryEncodingGzip specifies that telemetry messages are compressed with gzip.
+	TelemetryEncodingGzip TelemetryEncoding = "gzip"
+	// TelemetryEncodingDeflate specifies that telemetry messages are compressed with deflate.
+	TelemetryEncodingDeflate TelemetryEncoding = "deflate"
+
+	// TelemetryPackingNone specifies that each record of a batch is sent in its own message.
+	TelemetryPackingNone TelemetryPacking = "none"
+	// TelemetryPackingArray specifies that the records of a batch are packed into a JSON array.
+	TelemetryPackingArray TelemetryPacking = "array"
+	// TelemetryPackingEnvelope specifies that the records of a batch are packed into an envelope with per-record timestamps.
+	TelemetryPackingEnvelope TelemetryPacking = "envelope"
 )
 
 // UnmarshalJSON handles the un-marshalling of simulation status
@@ -111,6 +171,31 @@ func (d *DeviceDisconnectBehavior) UnmarshalJSON(b []byte) error {
 	}
 }
 
+// UnmarshalJSON handles the un-marshalling of device transport.
+func (t *DeviceTransport) UnmarshalJSON(b []byte) error {
+	var p string
+	if err := json.Unmarshal(b, &p); err != nil {
+		return err
+	}
+
+	if p == "" {
+		return nil
+	}
+
+	s := DeviceTransport(p)
+	switch s {
+	case DeviceTransportMqtt,
+		DeviceTransportMqttWs,
+		DeviceTransportAmqp,
+		DeviceTransportAmqpWs,
+		DeviceTransportHttp:
+		*t = s
+		return nil
+	default:
+		return fmt.Errorf("invalid device transport type %s", p)
+	}
+}
+
 // UnmarshalJSON handles the un-marshalling of telemetry format
 func (tf *TelemetryFormat) UnmarshalJSON(b []byte) error {
 	var p string
@@ -125,10 +210,59 @@ func (tf *TelemetryFormat) UnmarshalJSON(b []byte) error {
 	s := TelemetryFormat(p)
 	switch s {
 	case TelemetryFormatDefault,
-		TelemetryFormatOpcua:
+		TelemetryFormatOpcua,
+		TelemetryFormatCbor,
+		TelemetryFormatMsgpack,
+		TelemetryFormatProtobuf:
 		*tf = s
 		return nil
 	default:
 		return fmt.Errorf("invalid telemetry format type %s", p)
 	}
 }
+
+// UnmarshalJSON handles the un-marshalling of telemetry encoding
+func (te *TelemetryEncoding) UnmarshalJSON(b []byte) error {
+	var p string
+	if err := json.Unmarshal(b, &p); err != nil {
+		return err
+	}
+
+	if p == "" {
+		return nil
+	}
+
+	s := TelemetryEncoding(p)
+	switch s {
+	case TelemetryEncodingNone,
+		TelemetryEncodingGzip,
+		TelemetryEncodingDeflate:
+		*te = s
+		return nil
+	default:
+		return fmt.Errorf("invalid telemetry encoding type %s", p)
+	}
+}
+
+// UnmarshalJSON handles the un-marshalling of telemetry packing
+func (tp *TelemetryPacking) UnmarshalJSON(b []byte) error {
+	var p string
+	if err := json.Unmarshal(b, &p); err != nil {
+		return err
+	}
+
+	if p == "" {
+		return nil
+	}
+
+	s := TelemetryPacking(p)
+	switch s {
+	case TelemetryPackingNone,
+		TelemetryPackingArray,
+		TelemetryPackingEnvelope:
+		*tp = s
+		return nil
+	default:
+		return fmt.Errorf("invalid telemetry packing type %s", p)
+	}
+}
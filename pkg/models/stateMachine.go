@@ -0,0 +1,64 @@
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+type (
+	// StateTriggerType defines what triggers a transition between device states.
+	StateTriggerType string
+
+	// StateMachine defines the states of a device and the transitions between them.
+	StateMachine struct {
+		Initial        string         `json:"initial"`        // name of the state in which devices start, the first state by default.
+		StateTelemetry string         `json:"stateTelemetry"` // telemetry receiving the name of the active state, by name or by "component.name" for components.
+		States         []*DeviceState `json:"states"`         // states of the device.
+	}
+
+	// DeviceState defines the telemetry sent by a device in a state and the transitions to other states.
+	DeviceState struct {
+		Name        string                     `json:"name"`        // name of the state.
+		Telemetry   []string                   `json:"telemetry"`   // telemetry sent in the state by name, or by "component.name" for components; all telemetry if empty.
+		Generators  map[string]*ValueGenerator `json:"generators"`  // value generators used in the state by telemetry or property name, or by "component.name"; the device configuration generators otherwise.
+		Transitions []*StateTransition         `json:"transitions"` // transitions to other states, the first triggered transition is taken.
+	}
+
+	// StateTransition defines a transition to another state and what triggers it.
+	StateTransition struct {
+		To       string           `json:"to"`       // name of the next state.
+		Trigger  StateTriggerType `json:"trigger"`  // what triggers the transition.
+		Command  string           `json:"command"`  // command triggering the transition by name, or by "component.name" for components.
+		Property string           `json:"property"` // writable property triggering the transition by name, or by "component.name" for components.
+		Value    interface{}      `json:"value"`    // desired value of the property triggering the transition; any value if not specified.
+		After    int              `json:"after"`    // time in seconds in the state after which a timer triggers the transition.
+	}
+)
+
+const (
+	// StateTriggerCommand triggers the transition when the device receives the command.
+	StateTriggerCommand StateTriggerType = "command"
+	// StateTriggerProperty triggers the transition when the device receives an update of the writable property.
+	StateTriggerProperty StateTriggerType = "property"
+	// StateTriggerTimer triggers the transition after the device has been in the state for some time.
+	StateTriggerTimer StateTriggerType = "timer"
+)
+
+// UnmarshalJSON handles the un-marshalling of state trigger type.
+func (t *StateTriggerType) UnmarshalJSON(b []byte) error {
+	var p string
+	if err := json.Unmarshal(b, &p); err != nil {
+		return err
+	}
+
+	s := StateTriggerType(p)
+	switch s {
+	case StateTriggerCommand,
+		StateTriggerProperty,
+		StateTriggerTimer:
+		*t = s
+		return nil
+	default:
+		return fmt.Errorf("invalid state trigger type %s", p)
+	}
+}
@@ -1,17 +1,43 @@
 package models
 
+import (
+	"encoding/json"
+	"fmt"
+)
+
 type SimulationTargetType string
 
+// TargetAuthType defines how the devices of a target authenticate with DPS and IoT Hub.
+type TargetAuthType string
+
 type (
 	// SimulationTarget specifies the target of a simulation
 	SimulationTarget struct {
-		ID              string `json:"id"`              // user supplied identifier of a target.
-		Name            string `json:"name"`            // display name of the target.
-		ProvisioningURL string `json:"provisioningUrl"` // DPS provisioning URL.
-		IDScope         string `json:"idScope"`         // the id scope of the provisioning endpoint.
-		MasterKey       string `json:"masterKey"`       // the master SAS key of the provisioning endpoint.
-		AppUrl          string `json:"appUrl"`          // Central app URL
-		AppToken        string `json:"appToken"`        // Central app token for API access
+		ID              string         `json:"id"`              // user supplied identifier of a target.
+		Name            string         `json:"name"`            // display name of the target.
+		ProvisioningURL string         `json:"provisioningUrl"` // DPS provisioning URL.
+		IDScope         string         `json:"idScope"`         // the id scope of the provisioning endpoint.
+		MasterKey       string         `json:"masterKey"`       // the master SAS key of the provisioning endpoint.
+		AppUrl          string         `json:"appUrl"`          // Central app URL
+		AppToken        string         `json:"appToken"`        // Central app token for API access
+		AuthType        TargetAuthType `json:"authType"`        // authentication of the devices, symmetric keys derived from the master key if not set.
+	}
+
+	// SimulationTargetCertificates the CA hierarchy signing the X.509 certificates of the devices in a target, PEM encoded.
+	SimulationTargetCertificates struct {
+		TargetID                string `json:"targetId"`                  // identifier of a target.
+		RootCertificate         string `json:"rootCertificate"`           // root CA certificate, verified in DPS or IoT Hub.
+		RootKey                 string `json:"rootKey,omitempty"`         // private key of the root CA, not needed if the intermediate CA is imported.
+		IntermediateCertificate string `json:"intermediateCertificate"`   // intermediate CA certificate signed by the root CA, signing the device certificates.
+		IntermediateKey         string `json:"intermediateKey,omitempty"` // private key of the intermediate CA.
+	}
+
+	// SimulationTargetDeviceCertificate cached X.509 certificate of a device in a target, PEM encoded.
+	SimulationTargetDeviceCertificate struct {
+		TargetID    string `json:"targetId"`    // identifier of a target.
+		DeviceID    string `json:"deviceId"`    // device identifier in the target, the common name of the certificate.
+		Certificate string `json:"certificate"` // certificate chain of the device, followed by the intermediate CA certificate.
+		PrivateKey  string `json:"privateKey"`  // private key of the device.
 	}
 
 	// SimulationTargetModels specifies the models configured for a simulation target.
@@ -22,8 +48,52 @@ type (
 
 	// SimulationTargetDevice cached copy of a device connection string  in a target.
 	SimulationTargetDevice struct {
-		TargetID         string `json:"targetId"`         // identifier of a target.
-		DeviceID         string `json:"deviceId"`         // device identifier in the target.
-		ConnectionString string `json:"connectionString"` // IoT Hub connection string for the device.
+		TargetID         string                 `json:"targetId"`          // identifier of a target.
+		DeviceID         string                 `json:"deviceId"`          // device identifier in the target.
+		ConnectionString string                 `json:"connectionString"`  // IoT Hub connection string for the device.
+		Payload          map[string]interface{} `json:"payload,omitempty"` // payload returned by DPS when the device registered, e.g. by custom allocation functions.
 	}
+
+	// SimulationTargetEnrollment individual enrollment of a device in the DPS of a target.
+	SimulationTargetEnrollment struct {
+		TargetID       string `json:"targetId"`       // identifier of a target.
+		RegistrationID string `json:"registrationId"` // registration id of the enrollment, the id of the device it provisions.
+		PrimaryKey     string `json:"primaryKey"`     // symmetric key of the enrollment, used instead of a key derived from the master key.
+	}
+
+	// SimulationTargetDeviceProperties persistent values of the read-only properties of a device in a target.
+	SimulationTargetDeviceProperties struct {
+		TargetID   string                 `json:"targetId"`   // identifier of a target.
+		DeviceID   string                 `json:"deviceId"`   // device identifier in the target.
+		Properties map[string]interface{} `json:"properties"` // values of read-only properties by name, or by "component.name" for components.
+	}
+)
+
+const (
+	// TargetAuthSymmetricKey specifies that devices authenticate with keys derived from the master key of the target.
+	TargetAuthSymmetricKey TargetAuthType = "symmetricKey"
+	// TargetAuthX509 specifies that devices authenticate with X.509 certificates signed by the CA of the target.
+	TargetAuthX509 TargetAuthType = "x509"
 )
+
+// UnmarshalJSON handles the un-marshalling of target authentication type.
+func (t *TargetAuthType) UnmarshalJSON(b []byte) error {
+	var p string
+	if err := json.Unmarshal(b, &p); err != nil {
+		return err
+	}
+
+	if p == "" {
+		return nil
+	}
+
+	s := TargetAuthType(p)
+	switch s {
+	case TargetAuthSymmetricKey,
+		TargetAuthX509:
+		*t = s
+		return nil
+	default:
+		return fmt.Errorf("invalid target authentication type %s", p)
+	}
+}
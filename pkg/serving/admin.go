@@ -31,6 +31,8 @@ func StartAdmin(cfg *Config, ctrl *controlling.Controller) {
 	router.HandleFunc("/api/simulation/{id}", deleteSimulation).Methods(http.MethodDelete)
 	router.HandleFunc("/api/simulation/{id}/start", startSimulation).Methods(http.MethodPost)
 	router.HandleFunc("/api/simulation/{id}/stop", stopSimulation).Methods(http.MethodPost)
+	router.HandleFunc("/api/simulation/{id}/backfill", getBackfillCheckpoint).Methods(http.MethodGet)
+	router.HandleFunc("/api/simulation/{id}/backfill", deleteBackfillCheckpoint).Methods(http.MethodDelete)
 	router.HandleFunc("/api/simulation/{id}/provision/{modelId}/{numDevices}", provisionDevices).Methods(http.MethodPost)
 	router.HandleFunc("/api/simulation/{id}/provision", deleteAllDevices).Methods(http.MethodDelete)
 	router.HandleFunc("/api/simulation/{id}/provision/{modelId}/{numDevices}", deleteDevices).Methods(http.MethodDelete)
@@ -51,11 +53,22 @@ func StartAdmin(cfg *Config, ctrl *controlling.Controller) {
 	router.HandleFunc("/api/target/{id}/models", getTargetModels).Methods(http.MethodGet)
 	router.HandleFunc("/api/target/{id}/models", upsertTargetModels).Methods(http.MethodPut)
 	router.HandleFunc("/api/target/{id}/models", deleteTargetModels).Methods(http.MethodDelete)
+	router.HandleFunc("/api/target/{id}/certificates", getTargetCertificates).Methods(http.MethodGet)
+	router.HandleFunc("/api/target/{id}/certificates", importTargetCertificates).Methods(http.MethodPut)
+	router.HandleFunc("/api/target/{id}/certificates", deleteTargetCertificates).Methods(http.MethodDelete)
+	router.HandleFunc("/api/target/{id}/enrollments", listTargetEnrollments).Methods(http.MethodGet)
+	router.HandleFunc("/api/target/{id}/enrollments", importTargetEnrollments).Methods(http.MethodPut)
+	router.HandleFunc("/api/target/{id}/enrollments", deleteTargetEnrollments).Methods(http.MethodDelete)
 
 	router.HandleFunc("/api/model", listDeviceModels).Methods(http.MethodGet)
 	router.HandleFunc("/api/model", upsertDeviceModel).Methods(http.MethodPut)
 	router.HandleFunc("/api/model/{id}", getDeviceModel).Methods(http.MethodGet)
 	router.HandleFunc("/api/model/{id}", deleteDeviceModel).Methods(http.MethodDelete)
+	router.HandleFunc("/api/model/{id}/proto", getDeviceModelProto).Methods(http.MethodGet)
+	router.HandleFunc("/api/model/{id}/file", listDeviceModelFiles).Methods(http.MethodGet)
+	router.HandleFunc("/api/model/{id}/file/{name}", getDeviceModelFile).Methods(http.MethodGet)
+	router.HandleFunc("/api/model/{id}/file/{name}", upsertDeviceModelFile).Methods(http.MethodPut)
+	router.HandleFunc("/api/model/{id}/file/{name}", deleteDeviceModelFile).Methods(http.MethodDelete)
 
 	// Serve Starling UX
 	router.PathPrefix("/").Handler(http.StripPrefix("/", http.FileServer(getFileSystem())))
@@ -0,0 +1,91 @@
+package serving
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/iot-for-all/starling/pkg/models"
+	"github.com/iot-for-all/starling/pkg/storing"
+)
+
+// listDeviceModelFiles lists the names of all files of a model.
+func listDeviceModelFiles(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	files, err := storing.DeviceModelFiles.List(id)
+	if handleError(err, w) {
+		return
+	}
+
+	names := make([]string, 0, len(files))
+	for _, file := range files {
+		names = append(names, file.Name)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(names)
+	handleError(err, w)
+}
+
+// getDeviceModelFile gets the content of a file of a model.
+func getDeviceModelFile(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+	name := vars["name"]
+
+	file, err := storing.DeviceModelFiles.Get(id, name)
+	if handleError(err, w) {
+		return
+	}
+
+	if file == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	_, err = w.Write([]byte(file.Content))
+	handleError(err, w)
+}
+
+// upsertDeviceModelFile adds a new or updates an existing file of a model with the content of the request body.
+func upsertDeviceModelFile(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+	name := vars["name"]
+
+	model, err := storing.DeviceModels.Get(id)
+	if handleError(err, w) {
+		return
+	}
+
+	if model == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	req, err := ioutil.ReadAll(r.Body)
+	if handleError(err, w) {
+		return
+	}
+
+	file := models.DeviceModelFile{
+		ModelID: id,
+		Name:    name,
+		Content: string(req),
+	}
+	err = storing.DeviceModelFiles.Set(&file)
+	handleError(err, w)
+}
+
+// deleteDeviceModelFile deletes an existing file of a model.
+func deleteDeviceModelFile(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+	name := vars["name"]
+	err := storing.DeviceModelFiles.Delete(id, name)
+	handleError(err, w)
+}
@@ -41,6 +41,26 @@ func getDeviceModel(w http.ResponseWriter, r *http.Request) {
 	handleError(err, w)
 }
 
+// getDeviceModelProto gets the Protobuf schema of the telemetry messages sent by devices of an existing model.
+func getDeviceModelProto(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	model, err := storing.DeviceModels.Get(id)
+	if handleError(err, w) {
+		return
+	}
+
+	if model == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	_, err = w.Write([]byte(model.ParseDeviceCapabilityModel().ProtoSchema(model.ID)))
+	handleError(err, w)
+}
+
 // upsertDeviceModel adds a new or updates an existing device model.
 func upsertDeviceModel(w http.ResponseWriter, r *http.Request) {
 	req, err := ioutil.ReadAll(r.Body)
@@ -69,5 +89,19 @@ func deleteDeviceModel(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	id := vars["id"]
 	err := storing.DeviceModels.Delete(id)
-	handleError(err, w)
+	if handleError(err, w) {
+		return
+	}
+
+	// delete the files stored along with the model
+	files, err := storing.DeviceModelFiles.List(id)
+	if handleError(err, w) {
+		return
+	}
+	for _, file := range files {
+		err = storing.DeviceModelFiles.Delete(id, file.Name)
+		if handleError(err, w) {
+			return
+		}
+	}
 }
@@ -89,6 +89,12 @@ func deleteSimulation(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	id := vars["id"]
 	err := storing.Simulations.Delete(id)
+	if handleError(err, w) {
+		return
+	}
+
+	// the backfill checkpoint of the simulation is of no use without it
+	err = storing.BackfillCheckpoints.Delete(id)
 	handleError(err, w)
 }
 
@@ -126,6 +132,34 @@ func stopSimulation(w http.ResponseWriter, r *http.Request) {
 	handleError(err, w)
 }
 
+// getBackfillCheckpoint gets the progress of the backfill of a simulation.
+func getBackfillCheckpoint(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	checkpoint, err := storing.BackfillCheckpoints.Get(id)
+	if handleError(err, w) {
+		return
+	}
+
+	if checkpoint == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(checkpoint)
+	handleError(err, w)
+}
+
+// deleteBackfillCheckpoint deletes the checkpoint of the backfill of a simulation, so that the next backfill starts over.
+func deleteBackfillCheckpoint(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+	err := storing.BackfillCheckpoints.Delete(id)
+	handleError(err, w)
+}
+
 // provisionDevices provisions devices in a target based on the device configs from the given start index
 func provisionDevices(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
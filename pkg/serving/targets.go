@@ -2,6 +2,7 @@ package serving
 
 import (
 	"encoding/json"
+	"fmt"
 	"github.com/gorilla/mux"
 	"github.com/iot-for-all/starling/pkg/models"
 	"github.com/iot-for-all/starling/pkg/storing"
@@ -179,9 +180,207 @@ func deleteTarget(w http.ResponseWriter, r *http.Request) {
 	}
 
 	err = storing.TargetModels.Delete(id)
+	if handleError(err, w) {
+		return
+	}
+
+	err = storing.TargetCertificates.Delete(id)
+	if handleError(err, w) {
+		return
+	}
+
+	err = deleteTargetDeviceCertificates(id)
+	if handleError(err, w) {
+		return
+	}
+
+	// enrollments hold the keys of the devices, so they are not left behind
+	enrollments, err := storing.TargetEnrollments.List(id)
+	if handleError(err, w) {
+		return
+	}
+	for _, enrollment := range enrollments {
+		err = storing.TargetEnrollments.Delete(id, enrollment.RegistrationID)
+		if handleError(err, w) {
+			return
+		}
+	}
+}
+
+// getTargetCertificates gets the root and intermediate CA certificates of a target, without their private keys.
+// The CA is generated if the target does not have one yet, so that the root CA can be verified in DPS before simulating.
+func getTargetCertificates(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+	t, err := storing.Targets.Get(id)
+	if handleError(err, w) {
+		return
+	}
+
+	if t == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	certs, err := controller.GetTargetCertificates(t)
+	if handleError(err, w) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(&models.SimulationTargetCertificates{
+		TargetID:                certs.TargetID,
+		RootCertificate:         certs.RootCertificate,
+		IntermediateCertificate: certs.IntermediateCertificate,
+	})
+	handleError(err, w)
+}
+
+// importTargetCertificates imports the root and intermediate CA certificates of a target, with the private key of the intermediate CA.
+func importTargetCertificates(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	req, err := ioutil.ReadAll(r.Body)
+	if handleError(err, w) {
+		return
+	}
+
+	var certs models.SimulationTargetCertificates
+	err = json.Unmarshal(req, &certs)
+	if handleError(err, w) {
+		return
+	}
+
+	certs.TargetID = id
+	err = controller.ImportTargetCertificates(&certs)
+	if handleError(err, w) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(&models.SimulationTargetCertificates{
+		TargetID:                certs.TargetID,
+		RootCertificate:         certs.RootCertificate,
+		IntermediateCertificate: certs.IntermediateCertificate,
+	})
 	handleError(err, w)
 }
 
+// deleteTargetCertificates deletes the CA certificates of a target, which are generated again on their next use.
+// The certificates of the devices are deleted too, since they are issued by the deleted intermediate CA.
+func deleteTargetCertificates(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+	err := storing.TargetCertificates.Delete(id)
+	if handleError(err, w) {
+		return
+	}
+
+	err = deleteTargetDeviceCertificates(id)
+	handleError(err, w)
+}
+
+// deleteTargetDeviceCertificates deletes the cached certificates of all devices in a target.
+func deleteTargetDeviceCertificates(id string) error {
+	certs, err := storing.TargetDeviceCertificates.List(id)
+	if err != nil {
+		return err
+	}
+	for _, cert := range certs {
+		err = storing.TargetDeviceCertificates.Delete(id, cert.DeviceID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// listTargetEnrollments lists the individual enrollments of a target.
+func listTargetEnrollments(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+	items, err := storing.TargetEnrollments.List(id)
+	if handleError(err, w) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(items)
+	handleError(err, w)
+}
+
+// importTargetEnrollments imports the keys of individual enrollments of a target from an array of enrollments.
+// Enrollments have a registrationId and a primaryKey, or an attestation with the symmetric keys as exported from DPS.
+func importTargetEnrollments(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	req, err := ioutil.ReadAll(r.Body)
+	if handleError(err, w) {
+		return
+	}
+
+	var items []struct {
+		RegistrationID string `json:"registrationId"`
+		PrimaryKey     string `json:"primaryKey"`
+		Attestation    struct {
+			SymmetricKey struct {
+				PrimaryKey string `json:"primaryKey"`
+			} `json:"symmetricKey"`
+		} `json:"attestation"`
+	}
+	err = json.Unmarshal(req, &items)
+	if handleError(err, w) {
+		return
+	}
+
+	enrollments := make([]models.SimulationTargetEnrollment, 0, len(items))
+	for _, item := range items {
+		key := item.PrimaryKey
+		if key == "" {
+			key = item.Attestation.SymmetricKey.PrimaryKey
+		}
+		if item.RegistrationID == "" || key == "" {
+			handleError(fmt.Errorf("enrollment '%s' does not have a registration id and a primary key", item.RegistrationID), w)
+			return
+		}
+		enrollments = append(enrollments, models.SimulationTargetEnrollment{
+			TargetID:       id,
+			RegistrationID: item.RegistrationID,
+			PrimaryKey:     key,
+		})
+	}
+
+	for i := range enrollments {
+		err = storing.TargetEnrollments.Set(&enrollments[i])
+		if handleError(err, w) {
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(enrollments)
+	handleError(err, w)
+}
+
+// deleteTargetEnrollments deletes all individual enrollments of a target
+func deleteTargetEnrollments(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+	items, err := storing.TargetEnrollments.List(id)
+	if handleError(err, w) {
+		return
+	}
+
+	for _, item := range items {
+		err = storing.TargetEnrollments.Delete(id, item.RegistrationID)
+		if handleError(err, w) {
+			return
+		}
+	}
+}
+
 // deleteTargetModels deletes existing target models
 func deleteTargetModels(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
@@ -0,0 +1,652 @@
+package simulating
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/go-amqp"
+	"github.com/amenzhinsky/iothub/common"
+	"github.com/amenzhinsky/iothub/iotdevice/transport"
+	"github.com/amenzhinsky/iothub/logger"
+	"github.com/gorilla/websocket"
+)
+
+type (
+	// amqpTransport is the AMQP transport of the IoT Hub device client, which only comes with an MQTT transport.
+	// Telemetry, c2d messages, direct methods and twins use the links of the IoT Hub device API, over AMQP on port 5671,
+	// or over WebSockets on port 443.
+	amqpTransport struct {
+		webSocket      bool                          // connect over WebSockets on port 443.
+		logger         logger.Logger                 // logger of the transport.
+		deviceID       string                        // id of the connected device.
+		conn           *amqp.Client                  // AMQP connection to IoT Hub.
+		session        *amqp.Session                 // session of the links of the device.
+		sender         amqpSender                    // link sending telemetry messages.
+		twinSender     amqpSender                    // link sending twin requests.
+		twinResponses  map[string]chan *amqp.Message // pending twin requests by correlation id.
+		twinDispatcher transport.TwinStateDispatcher // dispatcher of desired property updates, if subscribed.
+		context        context.Context               // context of the connection, canceled when the transport is closed.
+		cancel         context.CancelFunc            // cancels the context of the connection.
+		lock           sync.Mutex                    // lock to synchronize the links and pending twin requests.
+	}
+
+	// amqpSender sends messages on a link.
+	amqpSender interface {
+		Send(ctx context.Context, msg *amqp.Message) error
+	}
+
+	// amqpReceiver receives messages on a link, and accepts them once they are received.
+	amqpReceiver interface {
+		Receive(ctx context.Context) (*amqp.Message, error)
+		Accept(ctx context.Context, msg *amqp.Message) error
+	}
+
+	// amqpLinkReceiver is the receiver of an AMQP link, which accepts messages on the link they were received on.
+	amqpLinkReceiver struct {
+		*amqp.Receiver
+	}
+
+	// webSocketConn is a network connection over a WebSocket, sending and receiving binary messages.
+	webSocketConn struct {
+		*websocket.Conn
+		reader io.Reader // reader of the message being read.
+	}
+)
+
+const (
+	// amqpApiVersion is the version of the IoT Hub device API of the links.
+	amqpApiVersion = "2020-09-30"
+	// amqpTokenLifetime is the lifetime of the SAS tokens authorizing the connection, renewed before they expire.
+	amqpTokenLifetime = time.Hour
+	// amqpTokenRenewal is the time before the SAS tokens expire when they are renewed.
+	amqpTokenRenewal = 10 * time.Minute
+	// amqpWebSocketProtocol is the WebSocket sub protocol of AMQP.
+	amqpWebSocketProtocol = "AMQPWSB10"
+)
+
+// newAmqpTransport creates an AMQP transport, over WebSockets if set.
+func newAmqpTransport(webSocket bool) *amqpTransport {
+	return &amqpTransport{
+		webSocket: webSocket,
+		logger:    logger.New(logger.LevelError, nil),
+	}
+}
+
+// SetLogger sets the logger of the transport.
+func (t *amqpTransport) SetLogger(logger logger.Logger) {
+	t.logger = logger
+}
+
+// Connect connects the device to IoT Hub. Devices authenticated with SAS tokens put their tokens on the CBS node,
+// devices authenticated with X.509 certificates are authenticated by TLS.
+func (t *amqpTransport) Connect(ctx context.Context, creds transport.Credentials) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.conn != nil {
+		return errors.New("already connected")
+	}
+
+	host := creds.GetHostName()
+	tlsConfig := &tls.Config{
+		RootCAs:    common.RootCAs(),
+		ServerName: host,
+	}
+	if crt := creds.GetCertificate(); crt != nil {
+		tlsConfig.Certificates = append(tlsConfig.Certificates, *crt)
+	}
+
+	opts := []amqp.ConnOption{
+		amqp.ConnSASLAnonymous(),
+		amqp.ConnServerHostname(host),
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		opts = append(opts, amqp.ConnConnectTimeout(time.Until(deadline)))
+	}
+
+	var conn *amqp.Client
+	var err error
+	if t.webSocket {
+		dialer := websocket.Dialer{
+			TLSClientConfig: tlsConfig,
+			Subprotocols:    []string{amqpWebSocketProtocol},
+		}
+		ws, _, err := dialer.DialContext(ctx, "wss://"+host+":443/$iothub/websocket", nil)
+		if err != nil {
+			return err
+		}
+		conn, err = amqp.New(&webSocketConn{Conn: ws}, opts...)
+		if err != nil {
+			_ = ws.Close()
+			return err
+		}
+	} else {
+		conn, err = amqp.Dial("amqps://"+host, append(opts, amqp.ConnTLSConfig(tlsConfig))...)
+		if err != nil {
+			return err
+		}
+	}
+
+	t.context, t.cancel = context.WithCancel(context.Background())
+	t.deviceID = creds.GetDeviceID()
+	t.conn = conn
+	if err = t.open(ctx, creds); err != nil {
+		t.cancel()
+		_ = conn.Close()
+		t.conn = nil
+		return err
+	}
+	return nil
+}
+
+// open opens the session of the device and the link sending telemetry, after putting the SAS token of the device.
+func (t *amqpTransport) open(ctx context.Context, creds transport.Credentials) error {
+	var err error
+	if creds.GetCertificate() == nil {
+		cbs, err := t.conn.NewSession()
+		if err != nil {
+			return err
+		}
+		if err = t.putToken(ctx, cbs, creds); err != nil {
+			return err
+		}
+		go t.renewToken(amqpTokenLifetime-amqpTokenRenewal, func(ctx context.Context) error {
+			return t.putToken(ctx, cbs, creds)
+		})
+	}
+
+	t.session, err = t.conn.NewSession()
+	if err != nil {
+		return err
+	}
+	sender, err := t.session.NewSender(
+		amqp.LinkTargetAddress(t.getAddress("messages/events")),
+	)
+	if err != nil {
+		return err
+	}
+	t.sender = sender
+	return nil
+}
+
+// putToken puts a SAS token authorizing the device on the CBS node of IoT Hub.
+func (t *amqpTransport) putToken(ctx context.Context, session *amqp.Session, creds transport.Credentials) error {
+	sender, err := session.NewSender(amqp.LinkTargetAddress("$cbs"))
+	if err != nil {
+		return err
+	}
+	defer sender.Close(context.Background())
+
+	receiver, err := session.NewReceiver(amqp.LinkSourceAddress("$cbs"))
+	if err != nil {
+		return err
+	}
+	defer receiver.Close(context.Background())
+
+	return requestToken(ctx, sender, &amqpLinkReceiver{receiver}, creds)
+}
+
+// requestToken sends a put token request on the links of the CBS node, and waits for its response.
+func requestToken(ctx context.Context, sender amqpSender, receiver amqpReceiver, creds transport.Credentials) error {
+	audience := creds.GetHostName() + "/devices/" + creds.GetDeviceID()
+	sas, err := creds.Token(audience, amqpTokenLifetime)
+	if err != nil {
+		return err
+	}
+	if err = sender.Send(ctx, &amqp.Message{
+		Value: sas.String(),
+		Properties: &amqp.MessageProperties{
+			To:      "$cbs",
+			ReplyTo: "cbs",
+		},
+		ApplicationProperties: map[string]interface{}{
+			"operation": "put-token",
+			"type":      "servicebus.windows.net:sastoken",
+			"name":      audience,
+		},
+	}); err != nil {
+		return err
+	}
+
+	msg, err := receiver.Receive(ctx)
+	if err != nil {
+		return err
+	}
+	if err = receiver.Accept(ctx, msg); err != nil {
+		return err
+	}
+	if code, ok := msg.ApplicationProperties["status-code"].(int32); !ok || code < 200 || code > 299 {
+		description, _ := msg.ApplicationProperties["status-description"].(string)
+		return fmt.Errorf("put token failed with %d response code: %s", code, description)
+	}
+	return nil
+}
+
+// renewToken puts a new SAS token at each renewal interval, before the token of the device expires, till the transport
+// is closed. Tokens that fail to renew are put again at the next interval.
+func (t *amqpTransport) renewToken(interval time.Duration, put func(ctx context.Context) error) {
+	for {
+		select {
+		case <-t.context.Done():
+			return
+		case <-time.After(interval):
+			if err := put(t.context); err != nil {
+				t.logger.Errorf("token renewal error: %s", err)
+			}
+		}
+	}
+}
+
+// Send sends a telemetry message from the device.
+func (t *amqpTransport) Send(ctx context.Context, msg *common.Message) error {
+	t.lock.Lock()
+	sender := t.sender
+	t.lock.Unlock()
+	if sender == nil {
+		return errors.New("not connected")
+	}
+	return sender.Send(ctx, toAmqpMessage(msg))
+}
+
+// SubscribeEvents receives the c2d messages of the device, which are completed on delivery.
+func (t *amqpTransport) SubscribeEvents(_ context.Context, mux transport.MessageDispatcher) error {
+	session, err := t.getSession()
+	if err != nil {
+		return err
+	}
+	receiver, err := session.NewReceiver(
+		amqp.LinkSourceAddress(t.getAddress("messages/devicebound")),
+	)
+	if err != nil {
+		return err
+	}
+
+	go t.receiveEvents(&amqpLinkReceiver{receiver}, mux)
+	return nil
+}
+
+// receiveEvents receives c2d messages till the link is closed. Messages are accepted, so that they are completed,
+// before they are dispatched.
+func (t *amqpTransport) receiveEvents(receiver amqpReceiver, mux transport.MessageDispatcher) {
+	for {
+		msg, err := receiver.Receive(t.context)
+		if err != nil {
+			t.logError("c2d receive error", err)
+			return
+		}
+		if err = receiver.Accept(t.context, msg); err != nil {
+			t.logger.Errorf("c2d accept error: %s", err)
+		}
+		mux.Dispatch(fromAmqpMessage(msg))
+	}
+}
+
+// RegisterDirectMethods receives the direct method requests of the device and sends their responses.
+func (t *amqpTransport) RegisterDirectMethods(_ context.Context, mux transport.MethodDispatcher) error {
+	session, err := t.getSession()
+	if err != nil {
+		return err
+	}
+	address := t.getAddress("methods/devicebound")
+	correlationID := "methods:" + newUUID(nil)
+	receiver, err := session.NewReceiver(
+		amqp.LinkSourceAddress(address),
+		amqp.LinkProperty("com.microsoft:api-version", amqpApiVersion),
+		amqp.LinkProperty("com.microsoft:channel-correlation-id", correlationID),
+	)
+	if err != nil {
+		return err
+	}
+	sender, err := session.NewSender(
+		amqp.LinkTargetAddress(address),
+		amqp.LinkProperty("com.microsoft:api-version", amqpApiVersion),
+		amqp.LinkProperty("com.microsoft:channel-correlation-id", correlationID),
+	)
+	if err != nil {
+		return err
+	}
+
+	go t.receiveMethods(&amqpLinkReceiver{receiver}, sender, mux)
+	return nil
+}
+
+// receiveMethods receives direct method requests till the link is closed, and sends the responses of the methods
+// dispatched with the correlation ids of their requests.
+func (t *amqpTransport) receiveMethods(receiver amqpReceiver, sender amqpSender, mux transport.MethodDispatcher) {
+	for {
+		msg, err := receiver.Receive(t.context)
+		if err != nil {
+			t.logError("direct method receive error", err)
+			return
+		}
+		if err = receiver.Accept(t.context, msg); err != nil {
+			t.logger.Errorf("direct method accept error: %s", err)
+		}
+
+		method, _ := msg.ApplicationProperties["IoThub-methodname"].(string)
+		rc, b, err := mux.Dispatch(method, msg.GetData())
+		if err != nil {
+			t.logger.Errorf("dispatch error: %s", err)
+			continue
+		}
+		var correlation interface{}
+		if msg.Properties != nil {
+			correlation = msg.Properties.CorrelationID
+		}
+		if err = sender.Send(t.context, &amqp.Message{
+			Data: [][]byte{b},
+			Properties: &amqp.MessageProperties{
+				CorrelationID: correlation,
+			},
+			ApplicationProperties: map[string]interface{}{
+				"IoThub-status": int32(rc),
+			},
+		}); err != nil {
+			t.logger.Errorf("method response error: %s", err)
+		}
+	}
+}
+
+// SubscribeTwinUpdates subscribes to the desired property updates of the device.
+func (t *amqpTransport) SubscribeTwinUpdates(ctx context.Context, mux transport.TwinStateDispatcher) error {
+	t.lock.Lock()
+	t.twinDispatcher = mux
+	t.lock.Unlock()
+
+	_, err := t.twinRequest(ctx, "PUT", "/notifications/twin/properties/desired", nil)
+	return err
+}
+
+// RetrieveTwinProperties gets the desired and reported properties of the device.
+func (t *amqpTransport) RetrieveTwinProperties(ctx context.Context) ([]byte, error) {
+	msg, err := t.twinRequest(ctx, "GET", "", nil)
+	if err != nil {
+		return nil, err
+	}
+	return msg.GetData(), nil
+}
+
+// UpdateTwinProperties updates the reported properties of the device, and gets the new version of the reported properties.
+func (t *amqpTransport) UpdateTwinProperties(ctx context.Context, payload []byte) (int, error) {
+	msg, err := t.twinRequest(ctx, "PATCH", "/properties/reported", payload)
+	if err != nil {
+		return 0, err
+	}
+	version, _ := getAmqpInt(msg.Annotations["version"])
+	return int(version), nil
+}
+
+// twinRequest sends a request on the twin links of the device, and waits for its response.
+func (t *amqpTransport) twinRequest(ctx context.Context, operation string, resource string, payload []byte) (*amqp.Message, error) {
+	sender, err := t.openTwinLinks()
+	if err != nil {
+		return nil, err
+	}
+
+	correlationID := newUUID(nil)
+	responses := make(chan *amqp.Message, 1)
+	t.lock.Lock()
+	t.twinResponses[correlationID] = responses
+	t.lock.Unlock()
+	defer func() {
+		t.lock.Lock()
+		delete(t.twinResponses, correlationID)
+		t.lock.Unlock()
+	}()
+
+	annotations := amqp.Annotations{
+		"operation": operation,
+	}
+	if resource != "" {
+		annotations["resource"] = resource
+	}
+	if payload == nil {
+		// requests without a body still need a data section
+		payload = []byte(" ")
+	}
+	if err = sender.Send(ctx, &amqp.Message{
+		Data:        [][]byte{payload},
+		Annotations: annotations,
+		Properties: &amqp.MessageProperties{
+			CorrelationID: correlationID,
+		},
+	}); err != nil {
+		return nil, err
+	}
+
+	select {
+	case msg := <-responses:
+		if status, ok := getAmqpInt(msg.Annotations["status"]); ok && (status < 200 || status > 299) {
+			return nil, fmt.Errorf("request failed with %d response code", status)
+		}
+		return msg, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// openTwinLinks opens the links of the twin requests of the device, unless they are open. Messages received on the twin
+// link are responses to requests, or desired property updates.
+func (t *amqpTransport) openTwinLinks() (amqpSender, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.twinSender != nil {
+		return t.twinSender, nil
+	}
+	if t.session == nil {
+		return nil, errors.New("not connected")
+	}
+
+	address := t.getAddress("twin")
+	correlationID := "twin:" + newUUID(nil)
+	receiver, err := t.session.NewReceiver(
+		amqp.LinkSourceAddress(address),
+		amqp.LinkProperty("com.microsoft:api-version", amqpApiVersion),
+		amqp.LinkProperty("com.microsoft:channel-correlation-id", correlationID),
+	)
+	if err != nil {
+		return nil, err
+	}
+	sender, err := t.session.NewSender(
+		amqp.LinkTargetAddress(address),
+		amqp.LinkProperty("com.microsoft:api-version", amqpApiVersion),
+		amqp.LinkProperty("com.microsoft:channel-correlation-id", correlationID),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	t.twinSender = sender
+	t.twinResponses = make(map[string]chan *amqp.Message)
+	go t.receiveTwin(&amqpLinkReceiver{receiver})
+	return sender, nil
+}
+
+// receiveTwin receives the messages of the twin link till it is closed. Messages correlated with a pending request are
+// its response, others are desired property updates.
+func (t *amqpTransport) receiveTwin(receiver amqpReceiver) {
+	for {
+		msg, err := receiver.Receive(t.context)
+		if err != nil {
+			t.logError("twin receive error", err)
+			return
+		}
+		if err = receiver.Accept(t.context, msg); err != nil {
+			t.logger.Errorf("twin accept error: %s", err)
+		}
+
+		correlationID := ""
+		if msg.Properties != nil {
+			correlationID, _ = msg.Properties.CorrelationID.(string)
+		}
+		t.lock.Lock()
+		responses, ok := t.twinResponses[correlationID]
+		dispatcher := t.twinDispatcher
+		t.lock.Unlock()
+		if ok {
+			responses <- msg
+		} else if dispatcher != nil {
+			dispatcher.Dispatch(msg.GetData())
+		}
+	}
+}
+
+// Close closes the connection of the device.
+func (t *amqpTransport) Close() error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.conn == nil {
+		return nil
+	}
+
+	t.cancel()
+	err := t.conn.Close()
+	t.conn = nil
+	t.session = nil
+	t.sender = nil
+	t.twinSender = nil
+	return err
+}
+
+// getSession gets the session of the links of the device.
+func (t *amqpTransport) getSession() (*amqp.Session, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.session == nil {
+		return nil, errors.New("not connected")
+	}
+	return t.session, nil
+}
+
+// getAddress gets the address of a link of the device.
+func (t *amqpTransport) getAddress(path string) string {
+	return "/devices/" + t.deviceID + "/" + path
+}
+
+// logError logs an error of a link, unless the link was closed with the transport.
+func (t *amqpTransport) logError(msg string, err error) {
+	if t.context.Err() == nil {
+		t.logger.Errorf("%s: %s", msg, err)
+	}
+}
+
+// toAmqpMessage converts a telemetry message into an AMQP message. The content type and encoding, the component and
+// the IoT Hub properties are sent as the AMQP properties and annotations IoT Hub reads them from.
+func toAmqpMessage(msg *common.Message) *amqp.Message {
+	m := &amqp.Message{
+		Data:                  [][]byte{msg.Payload},
+		Properties:            &amqp.MessageProperties{To: msg.To, UserID: []byte(msg.UserID)},
+		Annotations:           amqp.Annotations{},
+		ApplicationProperties: make(map[string]interface{}, len(msg.Properties)),
+	}
+	if msg.MessageID != "" {
+		m.Properties.MessageID = msg.MessageID
+	}
+	if msg.CorrelationID != "" {
+		m.Properties.CorrelationID = msg.CorrelationID
+	}
+	if msg.ExpiryTime != nil {
+		m.Properties.AbsoluteExpiryTime = *msg.ExpiryTime
+	}
+	for name, value := range msg.Properties {
+		switch {
+		case name == "$.ct":
+			m.Properties.ContentType = value
+		case name == "$.ce":
+			m.Properties.ContentEncoding = value
+		case name == "$.sub":
+			m.Annotations["dt-subject"] = value
+		case strings.HasPrefix(name, "iothub-"):
+			m.Annotations[name] = value
+		default:
+			m.ApplicationProperties[name] = value
+		}
+	}
+	return m
+}
+
+// fromAmqpMessage converts a c2d AMQP message into a message of the IoT Hub client.
+func fromAmqpMessage(msg *amqp.Message) *common.Message {
+	m := &common.Message{
+		Payload:    msg.GetData(),
+		Properties: make(map[string]string, len(msg.ApplicationProperties)),
+	}
+	if msg.Properties != nil {
+		if msg.Properties.MessageID != nil {
+			m.MessageID = fmt.Sprint(msg.Properties.MessageID)
+		}
+		if msg.Properties.CorrelationID != nil {
+			m.CorrelationID = fmt.Sprint(msg.Properties.CorrelationID)
+		}
+		m.To = msg.Properties.To
+		m.UserID = string(msg.Properties.UserID)
+	}
+	for name, value := range msg.ApplicationProperties {
+		m.Properties[name] = fmt.Sprint(value)
+	}
+	return m
+}
+
+// getAmqpInt gets the value of an integer annotation.
+func getAmqpInt(value interface{}) (int64, bool) {
+	switch v := value.(type) {
+	case int32:
+		return int64(v), true
+	case int64:
+		return v, true
+	case uint32:
+		return int64(v), true
+	case uint64:
+		return int64(v), true
+	}
+	return 0, false
+}
+
+// Accept accepts a message received on the link.
+func (r *amqpLinkReceiver) Accept(ctx context.Context, msg *amqp.Message) error {
+	return msg.Accept(ctx)
+}
+
+// Read reads the binary messages received over the WebSocket as a stream.
+func (c *webSocketConn) Read(b []byte) (int, error) {
+	for {
+		if c.reader == nil {
+			_, reader, err := c.NextReader()
+			if err != nil {
+				return 0, err
+			}
+			c.reader = reader
+		}
+
+		n, err := c.reader.Read(b)
+		if err == io.EOF {
+			c.reader = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+// Write writes the bytes as a binary message over the WebSocket.
+func (c *webSocketConn) Write(b []byte) (int, error) {
+	if err := c.WriteMessage(websocket.BinaryMessage, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// SetDeadline sets the read and write deadlines of the WebSocket.
+func (c *webSocketConn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
@@ -0,0 +1,577 @@
+package simulating
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Azure/go-amqp"
+	"github.com/amenzhinsky/iothub/common"
+	"github.com/amenzhinsky/iothub/iotdevice"
+)
+
+// fakeAmqpLink is a pair of links receiving the given messages and the responses to the messages it sends.
+type fakeAmqpLink struct {
+	messages chan *amqp.Message                // messages received on the link, closing the link once drained.
+	block    bool                              // wait for messages till the transport is closed instead of closing the link.
+	respond  func(*amqp.Message) *amqp.Message // response received to a message sent, if any.
+	sent     []*amqp.Message                   // messages sent on the link.
+	accepted []*amqp.Message                   // messages received and accepted.
+	lock     sync.Mutex
+}
+
+func newFakeAmqpLink(messages ...*amqp.Message) *fakeAmqpLink {
+	l := &fakeAmqpLink{messages: make(chan *amqp.Message, len(messages)+1)}
+	for _, msg := range messages {
+		l.messages <- msg
+	}
+	return l
+}
+
+func (l *fakeAmqpLink) Send(_ context.Context, msg *amqp.Message) error {
+	l.lock.Lock()
+	l.sent = append(l.sent, msg)
+	l.lock.Unlock()
+	if l.respond != nil {
+		if response := l.respond(msg); response != nil {
+			l.messages <- response
+		}
+	}
+	return nil
+}
+
+func (l *fakeAmqpLink) Receive(ctx context.Context) (*amqp.Message, error) {
+	select {
+	case msg := <-l.messages:
+		return msg, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	default:
+	}
+	if !l.block {
+		return nil, errors.New("link closed")
+	}
+
+	select {
+	case msg := <-l.messages:
+		return msg, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (l *fakeAmqpLink) Accept(_ context.Context, msg *amqp.Message) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.accepted = append(l.accepted, msg)
+	return nil
+}
+
+// fakeDispatcher records the c2d messages, direct method calls and desired property updates it dispatches.
+type fakeDispatcher struct {
+	messages []*common.Message
+	methods  []string
+	twins    []string
+	rc       int
+	err      error
+}
+
+func (d *fakeDispatcher) Dispatch(msg *common.Message) {
+	d.messages = append(d.messages, msg)
+}
+
+func (d *fakeDispatcher) DispatchMethod(method string, b []byte) (int, []byte, error) {
+	d.methods = append(d.methods, method+" "+string(b))
+	return d.rc, []byte(`{"method":"` + method + `"}`), d.err
+}
+
+// methodDispatcher dispatches direct method calls to a fake dispatcher.
+type methodDispatcher struct {
+	*fakeDispatcher
+}
+
+func (d methodDispatcher) Dispatch(method string, b []byte) (int, []byte, error) {
+	return d.DispatchMethod(method, b)
+}
+
+// twinDispatcher dispatches desired property updates to a fake dispatcher.
+type twinDispatcher struct {
+	*fakeDispatcher
+}
+
+func (d twinDispatcher) Dispatch(b []byte) {
+	d.twins = append(d.twins, string(b))
+}
+
+// newTestAmqpTransport creates an AMQP transport connected as a device, without a connection.
+func newTestAmqpTransport() *amqpTransport {
+	t := newAmqpTransport(false)
+	t.deviceID = "device-1"
+	t.context, t.cancel = context.WithCancel(context.Background())
+	return t
+}
+
+func TestAmqpTransportReceiveEvents(t *testing.T) {
+	tests := []struct {
+		name     string
+		messages []*amqp.Message
+		want     []*common.Message
+	}{
+		{
+			name: "c2d messages",
+			messages: []*amqp.Message{
+				{
+					Data:                  [][]byte{[]byte("reboot")},
+					Properties:            &amqp.MessageProperties{MessageID: "m1", CorrelationID: uint64(5), To: "/devices/device-1/messages/devicebound", UserID: []byte("owner")},
+					ApplicationProperties: map[string]interface{}{"priority": int32(1), "kind": "command"},
+				},
+				{Data: [][]byte{[]byte("ping")}},
+			},
+			want: []*common.Message{
+				{
+					Payload:       []byte("reboot"),
+					MessageID:     "m1",
+					CorrelationID: "5",
+					To:            "/devices/device-1/messages/devicebound",
+					UserID:        "owner",
+					Properties:    map[string]string{"priority": "1", "kind": "command"},
+				},
+				{Payload: []byte("ping"), Properties: map[string]string{}},
+			},
+		},
+		{
+			name: "no messages",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			transport := newTestAmqpTransport()
+			defer transport.cancel()
+			link := newFakeAmqpLink(tt.messages...)
+			dispatcher := &fakeDispatcher{}
+
+			transport.receiveEvents(link, dispatcher)
+			if !reflect.DeepEqual(dispatcher.messages, tt.want) {
+				t.Errorf("dispatched %+v, want %+v", dispatcher.messages, tt.want)
+			}
+			// messages are completed on delivery
+			if !reflect.DeepEqual(link.accepted, tt.messages) {
+				t.Errorf("accepted %d messages, want %d", len(link.accepted), len(tt.messages))
+			}
+		})
+	}
+}
+
+func TestAmqpTransportReceiveMethods(t *testing.T) {
+	tests := []struct {
+		name        string
+		request     *amqp.Message
+		rc          int
+		err         error
+		wantMethod  string
+		wantStatus  int32
+		correlation interface{}
+		responded   bool
+	}{
+		{
+			name: "method",
+			request: &amqp.Message{
+				Data:                  [][]byte{[]byte(`{"delay":5}`)},
+				Properties:            &amqp.MessageProperties{CorrelationID: amqp.UUID{1, 2, 3}},
+				ApplicationProperties: map[string]interface{}{"IoThub-methodname": "reboot"},
+			},
+			rc:          200,
+			wantMethod:  `reboot {"delay":5}`,
+			wantStatus:  200,
+			correlation: amqp.UUID{1, 2, 3},
+			responded:   true,
+		},
+		{
+			name: "failed method",
+			request: &amqp.Message{
+				Data:                  [][]byte{[]byte(`{}`)},
+				Properties:            &amqp.MessageProperties{CorrelationID: "c1"},
+				ApplicationProperties: map[string]interface{}{"IoThub-methodname": "unknown"},
+			},
+			rc:          404,
+			wantMethod:  "unknown {}",
+			wantStatus:  404,
+			correlation: "c1",
+			responded:   true,
+		},
+		{
+			name: "dispatch error",
+			request: &amqp.Message{
+				Data:                  [][]byte{[]byte(`{}`)},
+				Properties:            &amqp.MessageProperties{CorrelationID: "c1"},
+				ApplicationProperties: map[string]interface{}{"IoThub-methodname": "reboot"},
+			},
+			err:        errors.New("dispatch failed"),
+			wantMethod: "reboot {}",
+			responded:  false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			transport := newTestAmqpTransport()
+			defer transport.cancel()
+			receiver := newFakeAmqpLink(tt.request)
+			sender := newFakeAmqpLink()
+			dispatcher := &fakeDispatcher{rc: tt.rc, err: tt.err}
+
+			transport.receiveMethods(receiver, sender, methodDispatcher{dispatcher})
+			if !reflect.DeepEqual(dispatcher.methods, []string{tt.wantMethod}) {
+				t.Errorf("dispatched %v, want %s", dispatcher.methods, tt.wantMethod)
+			}
+			if len(receiver.accepted) != 1 {
+				t.Errorf("accepted %d requests, want 1", len(receiver.accepted))
+			}
+			if !tt.responded {
+				if len(sender.sent) != 0 {
+					t.Errorf("sent %d responses, want none", len(sender.sent))
+				}
+				return
+			}
+
+			if len(sender.sent) != 1 {
+				t.Fatalf("sent %d responses, want 1", len(sender.sent))
+			}
+			response := sender.sent[0]
+			if !reflect.DeepEqual(response.Properties.CorrelationID, tt.correlation) {
+				t.Errorf("correlation id = %v, want %v", response.Properties.CorrelationID, tt.correlation)
+			}
+			if status := response.ApplicationProperties["IoThub-status"]; status != tt.wantStatus {
+				t.Errorf("status = %v, want %d", status, tt.wantStatus)
+			}
+			if data := string(response.GetData()); !strings.Contains(data, tt.request.ApplicationProperties["IoThub-methodname"].(string)) {
+				t.Errorf("data = %s, want the result of the method", data)
+			}
+		})
+	}
+}
+
+func TestAmqpTransportTwinRequests(t *testing.T) {
+	tests := []struct {
+		name            string
+		request         func(*amqpTransport) (interface{}, error)
+		status          int32
+		version         interface{}
+		wantAnnotations amqp.Annotations
+		wantData        string
+		want            interface{}
+		wantErr         bool
+	}{
+		{
+			name: "retrieve properties",
+			request: func(t *amqpTransport) (interface{}, error) {
+				b, err := t.RetrieveTwinProperties(context.Background())
+				return string(b), err
+			},
+			status:          200,
+			wantAnnotations: amqp.Annotations{"operation": "GET"},
+			wantData:        " ",
+			want:            `{"desired":{}}`,
+		},
+		{
+			name: "update reported properties",
+			request: func(t *amqpTransport) (interface{}, error) {
+				return t.UpdateTwinProperties(context.Background(), []byte(`{"fan":1}`))
+			},
+			status:          204,
+			version:         int64(7),
+			wantAnnotations: amqp.Annotations{"operation": "PATCH", "resource": "/properties/reported"},
+			wantData:        `{"fan":1}`,
+			want:            7,
+		},
+		{
+			name: "subscribe to desired properties",
+			request: func(t *amqpTransport) (interface{}, error) {
+				return nil, t.SubscribeTwinUpdates(context.Background(), twinDispatcher{&fakeDispatcher{}})
+			},
+			status:          200,
+			wantAnnotations: amqp.Annotations{"operation": "PUT", "resource": "/notifications/twin/properties/desired"},
+			wantData:        " ",
+		},
+		{
+			name: "failed request",
+			request: func(t *amqpTransport) (interface{}, error) {
+				return t.UpdateTwinProperties(context.Background(), []byte(`{"fan":1}`))
+			},
+			status:          400,
+			wantAnnotations: amqp.Annotations{"operation": "PATCH", "resource": "/properties/reported"},
+			wantData:        `{"fan":1}`,
+			wantErr:         true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			transport := newTestAmqpTransport()
+			defer transport.cancel()
+
+			// the twin link responds to requests with their correlation id, and receives desired properties till closed
+			link := newFakeAmqpLink()
+			link.block = true
+			link.respond = func(msg *amqp.Message) *amqp.Message {
+				return &amqp.Message{
+					Data:        [][]byte{[]byte(`{"desired":{}}`)},
+					Properties:  &amqp.MessageProperties{CorrelationID: msg.Properties.CorrelationID},
+					Annotations: amqp.Annotations{"status": tt.status, "version": tt.version},
+				}
+			}
+			transport.twinSender = link
+			transport.twinResponses = make(map[string]chan *amqp.Message)
+			received := make(chan struct{})
+			go func() {
+				transport.receiveTwin(link)
+				close(received)
+			}()
+
+			got, err := tt.request(transport)
+			transport.cancel()
+			<-received
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("request error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && tt.want != nil && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("request = %v, want %v", got, tt.want)
+			}
+
+			if len(link.sent) != 1 {
+				t.Fatalf("sent %d requests, want 1", len(link.sent))
+			}
+			request := link.sent[0]
+			if !reflect.DeepEqual(request.Annotations, tt.wantAnnotations) {
+				t.Errorf("annotations = %v, want %v", request.Annotations, tt.wantAnnotations)
+			}
+			if data := string(request.GetData()); data != tt.wantData {
+				t.Errorf("data = %q, want %q", data, tt.wantData)
+			}
+			if len(transport.twinResponses) != 0 {
+				t.Errorf("%d requests still pending", len(transport.twinResponses))
+			}
+		})
+	}
+}
+
+func TestAmqpTransportDesiredProperties(t *testing.T) {
+	transport := newTestAmqpTransport()
+	defer transport.cancel()
+	dispatcher := &fakeDispatcher{}
+	transport.twinDispatcher = twinDispatcher{dispatcher}
+	transport.twinResponses = map[string]chan *amqp.Message{"pending": make(chan *amqp.Message, 1)}
+
+	tests := []struct {
+		name    string
+		message *amqp.Message
+		want    []string
+	}{
+		{
+			name:    "update",
+			message: &amqp.Message{Data: [][]byte{[]byte(`{"fan":2,"$version":3}`)}},
+			want:    []string{`{"fan":2,"$version":3}`},
+		},
+		{
+			name:    "response of a pending request",
+			message: &amqp.Message{Data: [][]byte{[]byte(`{}`)}, Properties: &amqp.MessageProperties{CorrelationID: "pending"}},
+			want:    nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dispatcher.twins = nil
+			transport.receiveTwin(newFakeAmqpLink(tt.message))
+			if !reflect.DeepEqual(dispatcher.twins, tt.want) {
+				t.Errorf("dispatched %v, want %v", dispatcher.twins, tt.want)
+			}
+		})
+	}
+}
+
+func TestRequestToken(t *testing.T) {
+	creds := &iotdevice.SharedAccessKeyCredentials{
+		DeviceID: "device-1",
+		SharedAccessKey: common.SharedAccessKey{
+			HostName:        "hub.azure-devices.net",
+			SharedAccessKey: "a2V5",
+		},
+	}
+
+	tests := []struct {
+		name    string
+		status  interface{}
+		wantErr bool
+	}{
+		{name: "authorized", status: int32(200)},
+		{name: "unauthorized", status: int32(401), wantErr: true},
+		{name: "no status", status: nil, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			link := newFakeAmqpLink()
+			link.respond = func(*amqp.Message) *amqp.Message {
+				return &amqp.Message{ApplicationProperties: map[string]interface{}{"status-code": tt.status, "status-description": "status"}}
+			}
+
+			start := time.Now()
+			if err := requestToken(context.Background(), link, link, creds); (err != nil) != tt.wantErr {
+				t.Fatalf("requestToken() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if len(link.sent) != 1 || len(link.accepted) != 1 {
+				t.Fatalf("sent %d and accepted %d messages, want 1", len(link.sent), len(link.accepted))
+			}
+
+			request := link.sent[0]
+			wantProperties := map[string]interface{}{
+				"operation": "put-token",
+				"type":      "servicebus.windows.net:sastoken",
+				"name":      "hub.azure-devices.net/devices/device-1",
+			}
+			if !reflect.DeepEqual(request.ApplicationProperties, wantProperties) {
+				t.Errorf("properties = %v, want %v", request.ApplicationProperties, wantProperties)
+			}
+			if request.Properties.To != "$cbs" || request.Properties.ReplyTo != "cbs" {
+				t.Errorf("to = %s and reply to = %s, want the CBS node", request.Properties.To, request.Properties.ReplyTo)
+			}
+
+			// the token expires after its lifetime
+			token, _ := request.Value.(string)
+			values, err := url.ParseQuery(strings.TrimPrefix(token, "SharedAccessSignature "))
+			if err != nil {
+				t.Fatal(err)
+			}
+			expiry, _ := strconv.ParseInt(values.Get("se"), 10, 64)
+			if lifetime := time.Unix(expiry, 0).Sub(start); lifetime < amqpTokenLifetime-time.Second || lifetime > amqpTokenLifetime+time.Second {
+				t.Errorf("token lifetime = %v, want %v", lifetime, amqpTokenLifetime)
+			}
+		})
+	}
+}
+
+func TestAmqpTransportRenewToken(t *testing.T) {
+	if amqpTokenRenewal <= 0 || amqpTokenRenewal >= amqpTokenLifetime {
+		t.Fatalf("tokens renewed %v before they expire, want within their lifetime of %v", amqpTokenRenewal, amqpTokenLifetime)
+	}
+
+	interval := 20 * time.Millisecond
+	tests := []struct {
+		name string
+		err  error
+	}{
+		{name: "renewed"},
+		{name: "renewal failing", err: errors.New("put token failed")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			transport := newTestAmqpTransport()
+			start := time.Now()
+			var lock sync.Mutex
+			var puts []time.Duration
+			done := make(chan struct{})
+			go func() {
+				transport.renewToken(interval, func(context.Context) error {
+					lock.Lock()
+					defer lock.Unlock()
+					puts = append(puts, time.Since(start))
+					return tt.err
+				})
+				close(done)
+			}()
+
+			time.Sleep(5*interval + interval/2)
+			transport.cancel()
+			<-done
+			stopped := time.Since(start)
+			time.Sleep(2 * interval)
+
+			lock.Lock()
+			defer lock.Unlock()
+			if len(puts) < 2 || len(puts) > 5 {
+				t.Fatalf("renewed %d times, want about 5", len(puts))
+			}
+			for i, put := range puts {
+				// renewals wait for the interval after the previous one
+				if put < time.Duration(i+1)*interval {
+					t.Errorf("renewal %d at %v, want after %v", i+1, put, time.Duration(i+1)*interval)
+				}
+				if put > stopped {
+					t.Errorf("renewal %d at %v after the transport closed at %v", i+1, put, stopped)
+				}
+			}
+		})
+	}
+}
+
+func TestToAmqpMessage(t *testing.T) {
+	expiry := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	msg := &common.Message{
+		Payload:       []byte(`{"temperature":21}`),
+		MessageID:     "m1",
+		CorrelationID: "c1",
+		To:            "/devices/device-1/messages/events",
+		UserID:        "owner",
+		ExpiryTime:    &expiry,
+		Properties: map[string]string{
+			"$.ct":                     "application/json",
+			"$.ce":                     "utf-8",
+			"$.sub":                    "sensor",
+			"iothub-creation-time-utc": "2021-01-01T00:00:00Z",
+			"source":                   "starling",
+		},
+	}
+
+	got := toAmqpMessage(msg)
+	want := &amqp.Message{
+		Data: [][]byte{[]byte(`{"temperature":21}`)},
+		Properties: &amqp.MessageProperties{
+			MessageID:          "m1",
+			CorrelationID:      "c1",
+			To:                 "/devices/device-1/messages/events",
+			UserID:             []byte("owner"),
+			AbsoluteExpiryTime: expiry,
+			ContentType:        "application/json",
+			ContentEncoding:    "utf-8",
+		},
+		Annotations:           amqp.Annotations{"dt-subject": "sensor", "iothub-creation-time-utc": "2021-01-01T00:00:00Z"},
+		ApplicationProperties: map[string]interface{}{"source": "starling"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("toAmqpMessage() = %+v, want %+v", got, want)
+	}
+}
+
+func TestGetAmqpInt(t *testing.T) {
+	tests := []struct {
+		name   string
+		value  interface{}
+		want   int64
+		wantOk bool
+	}{
+		{name: "int32", value: int32(-5), want: -5, wantOk: true},
+		{name: "int64", value: int64(7), want: 7, wantOk: true},
+		{name: "uint32", value: uint32(200), want: 200, wantOk: true},
+		{name: "uint64", value: uint64(9), want: 9, wantOk: true},
+		{name: "string", value: "200", want: 0, wantOk: false},
+		{name: "missing", value: nil, want: 0, wantOk: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := getAmqpInt(tt.value)
+			if got != tt.want || ok != tt.wantOk {
+				t.Errorf("getAmqpInt() = %d, %v, want %d, %v", got, ok, tt.want, tt.wantOk)
+			}
+		})
+	}
+}
@@ -0,0 +1,214 @@
+package simulating
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/iot-for-all/starling/pkg/models"
+	"github.com/iot-for-all/starling/pkg/storing"
+	"github.com/rs/zerolog/log"
+)
+
+type (
+	// backfillWave tracks the telemetry requests sent to devices at a virtual time of a backfill.
+	backfillWave struct {
+		done   sync.WaitGroup       // signaled when each request is handled.
+		failed []*backfillTelemetry // telemetry of the devices that failed to send it.
+		lock   sync.Mutex           // lock to synchronize the failures of devices sending telemetry in parallel.
+	}
+
+	// backfillTelemetry represents the telemetry a device sends in a backfill wave.
+	backfillTelemetry struct {
+		device   *device             // device sending the telemetry.
+		messages []*telemetryMessage // messages that failed to send and are sent again; nil if the telemetry is not generated yet.
+	}
+)
+
+const (
+	// maxBackfillWaveAttempts is the number of times devices failing to send the telemetry of a wave send it, before the
+	// backfill stops. Devices failing twice are provisioned again, in case they moved to another hub.
+	maxBackfillWaveAttempts = 5
+	// backfillRetryDelay is the time to wait before failed devices send the telemetry of a wave again.
+	backfillRetryDelay = 5 * time.Second
+)
+
+// loadBackfillCheckpoint loads the checkpoint from which the backfill of a simulation resumes. The backfill starts over when
+// there is no checkpoint, or the virtual time range of the simulation changed since the checkpoint was saved.
+func loadBackfillCheckpoint(simulation *models.Simulation) (*models.BackfillCheckpoint, error) {
+	config := simulation.Backfill
+	if simulation.TelemetryInterval <= 0 {
+		return nil, errors.New(fmt.Sprintf("backfill of simulation '%s' needs a telemetry interval", simulation.ID))
+	}
+
+	checkpoint, err := storing.BackfillCheckpoints.Get(simulation.ID)
+	if err != nil {
+		return nil, err
+	}
+	if checkpoint != nil && checkpoint.Start.Equal(config.Start) && (config.End.IsZero() || checkpoint.End.Equal(config.End)) {
+		log.Debug().
+			Str("simID", simulation.ID).
+			Time("time", checkpoint.Time).
+			Float64("progress", checkpoint.Progress).
+			Msg("resuming backfill from checkpoint")
+		return checkpoint, nil
+	}
+
+	end := config.End
+	if end.IsZero() {
+		end = time.Now().UTC()
+	}
+	if !end.After(config.Start) {
+		return nil, errors.New(fmt.Sprintf("backfill of simulation '%s' ends at %s before it starts at %s", simulation.ID, end, config.Start))
+	}
+
+	return &models.BackfillCheckpoint{
+		SimulationID: simulation.ID,
+		Start:        config.Start,
+		End:          end,
+	}, nil
+}
+
+// startBackfillPump starts the pump that sends telemetry requests to all devices at each telemetry interval of the virtual
+// time range, from the checkpoint till the end of the range. The first wave is sent at the start of the range, and the last
+// one at its end, with the messages still held back by the clocks of the devices. Instead of sleeping between waves, the virtual time advances as
+// soon as every device sent the telemetry of a wave, so telemetry is sent as fast as the concurrent connections allow.
+// Devices that failed to send their telemetry send the messages that failed again, without generating them again, and the
+// checkpoint is only saved after all devices sent the telemetry of a wave, so that a stopped backfill resumes from the last
+// wave sent by all devices.
+func (s *Simulator) startBackfillPump() {
+	log.Debug().Msg("backfill request generator pump starting")
+
+	var devices []*device
+	for _, waveGroup := range s.getWaveGroups() {
+		devices = append(devices, s.deviceGroups[waveGroup].devices...)
+	}
+	telemetry := make([]*backfillTelemetry, len(devices))
+
+	checkpoint := s.checkpoint
+	interval := time.Second * time.Duration(s.simulation.TelemetryInterval)
+	for t := checkpoint.Time; t.IsZero() || t.Before(checkpoint.End); {
+		t = getNextBackfillTime(checkpoint, t, interval)
+
+		// send telemetry at the virtual time for all devices, and again for the devices that failed
+		for i, dev := range devices {
+			telemetry[i] = &backfillTelemetry{device: dev}
+		}
+		pending := telemetry
+		for attempt := 1; len(pending) > 0; attempt++ {
+			if attempt > 1 {
+				log.Warn().
+					Str("simID", s.simulation.ID).
+					Time("time", t).
+					Int("failed", len(pending)).
+					Int("attempt", attempt).
+					Msg("sending backfill telemetry again for devices that failed")
+				sleep(s.context, backfillRetryDelay)
+			}
+
+			wave := s.sendBackfillWave(pending, t, t.Equal(checkpoint.End))
+			if wave == nil {
+				return
+			}
+			pending = wave.failed
+
+			if len(pending) > 0 && attempt == maxBackfillWaveAttempts {
+				log.Error().
+					Str("simID", s.simulation.ID).
+					Time("time", t).
+					Int("failed", len(pending)).
+					Msg("backfill stopped as devices failed to send telemetry; it resumes from the checkpoint when the simulation starts again")
+				return
+			}
+		}
+
+		checkpoint.Time = t
+		checkpoint.Progress = getBackfillProgress(checkpoint, t)
+		if err := storing.BackfillCheckpoints.Set(checkpoint); err != nil {
+			log.Error().Err(err).Str("simID", s.simulation.ID).Msg("error saving backfill checkpoint")
+		}
+		backfillProgressGauge.WithLabelValues(s.simulation.ID, s.simulation.TargetID).Set(checkpoint.Progress)
+
+		log.Debug().
+			Str("simID", s.simulation.ID).
+			Time("time", t).
+			Float64("progress", checkpoint.Progress).
+			Msg("sent backfill telemetry")
+	}
+
+	backfillProgressGauge.WithLabelValues(s.simulation.ID, s.simulation.TargetID).Set(100)
+	log.Info().
+		Str("simID", s.simulation.ID).
+		Time("start", checkpoint.Start).
+		Time("end", checkpoint.End).
+		Msg("backfill completed")
+}
+
+// getNextBackfillTime gets the virtual time of the wave after the one sent at the given time, the start of the range if no
+// wave was sent yet. The last wave is sent at the end of the range, even if it is less than an interval after the one before.
+func getNextBackfillTime(checkpoint *models.BackfillCheckpoint, t time.Time, interval time.Duration) time.Time {
+	if t.IsZero() {
+		return checkpoint.Start
+	}
+	t = t.Add(interval)
+	if t.After(checkpoint.End) {
+		return checkpoint.End
+	}
+	return t
+}
+
+// getBackfillProgress gets the percentage of the virtual time range of the backfill that was sent till the given time.
+func getBackfillProgress(checkpoint *models.BackfillCheckpoint, t time.Time) float64 {
+	return 100 * float64(t.Sub(checkpoint.Start)) / float64(checkpoint.End.Sub(checkpoint.Start))
+}
+
+// sendBackfillWave sends telemetry requests at the virtual time to the devices of the given telemetry, without waiting
+// between their wave groups, and waits till all devices sent their telemetry. Returns nil if the simulation stopped.
+func (s *Simulator) sendBackfillWave(telemetry []*backfillTelemetry, t time.Time, last bool) *backfillWave {
+	wave := &backfillWave{}
+	for _, tel := range telemetry {
+		wave.done.Add(1)
+		select {
+		case <-s.context.Done():
+			return nil
+		case s.deviceSimulator.telemetryRequests <- &telemetryRequest{
+			device:   tel.device,
+			context:  nil,
+			time:     t,
+			wave:     wave,
+			flush:    last,
+			messages: tel.messages,
+		}:
+		}
+	}
+
+	sent := make(chan struct{})
+	go func() {
+		wave.done.Wait()
+		close(sent)
+	}()
+	select {
+	case <-s.context.Done():
+		return nil
+	case <-sent:
+		return wave
+	}
+}
+
+// fail records that a device failed to send the given messages of the wave, or to generate its telemetry if there are none.
+func (w *backfillWave) fail(device *device, messages ...*telemetryMessage) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	for _, tel := range w.failed {
+		if tel.device == device {
+			tel.messages = append(tel.messages, messages...)
+			return
+		}
+	}
+	w.failed = append(w.failed, &backfillTelemetry{
+		device:   device,
+		messages: messages,
+	})
+}
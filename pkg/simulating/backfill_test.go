@@ -0,0 +1,201 @@
+package simulating
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/iot-for-all/starling/pkg/models"
+	"github.com/iot-for-all/starling/pkg/storing"
+)
+
+func TestLoadBackfillCheckpoint(t *testing.T) {
+	if err := storing.Open(&storing.Config{DataDirectory: t.TempDir()}); err != nil {
+		t.Fatal(err)
+	}
+	defer storing.Close()
+
+	start := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	end := start.Add(24 * time.Hour)
+	saved := &models.BackfillCheckpoint{
+		SimulationID: "saved",
+		Start:        start,
+		End:          end,
+		Time:         start.Add(6 * time.Hour),
+		Progress:     25,
+	}
+	if err := storing.BackfillCheckpoints.Set(saved); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		simulation *models.Simulation
+		want       *models.BackfillCheckpoint
+		wantErr    bool
+	}{
+		{
+			name:       "no checkpoint",
+			simulation: &models.Simulation{ID: "new", TelemetryInterval: 60, Backfill: &models.BackfillConfig{Start: start, End: end}},
+			want:       &models.BackfillCheckpoint{SimulationID: "new", Start: start, End: end},
+		},
+		{
+			name:       "resumed",
+			simulation: &models.Simulation{ID: "saved", TelemetryInterval: 60, Backfill: &models.BackfillConfig{Start: start, End: end}},
+			want:       saved,
+		},
+		{
+			name:       "resumed without an end",
+			simulation: &models.Simulation{ID: "saved", TelemetryInterval: 60, Backfill: &models.BackfillConfig{Start: start}},
+			want:       saved,
+		},
+		{
+			name:       "start changed",
+			simulation: &models.Simulation{ID: "saved", TelemetryInterval: 60, Backfill: &models.BackfillConfig{Start: start.Add(time.Hour), End: end}},
+			want:       &models.BackfillCheckpoint{SimulationID: "saved", Start: start.Add(time.Hour), End: end},
+		},
+		{
+			name:       "end changed",
+			simulation: &models.Simulation{ID: "saved", TelemetryInterval: 60, Backfill: &models.BackfillConfig{Start: start, End: end.Add(time.Hour)}},
+			want:       &models.BackfillCheckpoint{SimulationID: "saved", Start: start, End: end.Add(time.Hour)},
+		},
+		{
+			name:       "end before start",
+			simulation: &models.Simulation{ID: "new", TelemetryInterval: 60, Backfill: &models.BackfillConfig{Start: end, End: start}},
+			wantErr:    true,
+		},
+		{
+			name:       "no telemetry interval",
+			simulation: &models.Simulation{ID: "new", Backfill: &models.BackfillConfig{Start: start, End: end}},
+			wantErr:    true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := loadBackfillCheckpoint(tt.simulation)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("loadBackfillCheckpoint() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("loadBackfillCheckpoint() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetNextBackfillTime(t *testing.T) {
+	start := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	checkpoint := &models.BackfillCheckpoint{Start: start, End: start.Add(150 * time.Second)}
+
+	tests := []struct {
+		name       string
+		checkpoint *models.BackfillCheckpoint
+		times      []int
+	}{
+		{
+			name:       "from the start",
+			checkpoint: checkpoint,
+			times:      []int{0, 60, 120, 150},
+		},
+		{
+			name:       "resumed",
+			checkpoint: &models.BackfillCheckpoint{Start: start, End: checkpoint.End, Time: start.Add(60 * time.Second)},
+			times:      []int{120, 150},
+		},
+		{
+			name:       "range of an interval",
+			checkpoint: &models.BackfillCheckpoint{Start: start, End: start.Add(60 * time.Second)},
+			times:      []int{0, 60},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// the virtual times of the waves sent by the pump
+			var got []int
+			for wave := tt.checkpoint.Time; wave.IsZero() || wave.Before(tt.checkpoint.End); {
+				wave = getNextBackfillTime(tt.checkpoint, wave, time.Minute)
+				got = append(got, int(wave.Sub(start).Seconds()))
+			}
+			if !reflect.DeepEqual(got, tt.times) {
+				t.Errorf("getNextBackfillTime() = %v, want %v", got, tt.times)
+			}
+		})
+	}
+}
+
+func TestGetBackfillProgress(t *testing.T) {
+	start := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	checkpoint := &models.BackfillCheckpoint{Start: start, End: start.Add(4 * time.Hour)}
+
+	tests := []struct {
+		name string
+		time time.Time
+		want float64
+	}{
+		{name: "start", time: start, want: 0},
+		{name: "quarter", time: start.Add(time.Hour), want: 25},
+		{name: "end", time: checkpoint.End, want: 100},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := getBackfillProgress(checkpoint, tt.time); got != tt.want {
+				t.Errorf("getBackfillProgress() = %g, want %g", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBackfillWaveFail(t *testing.T) {
+	devices := []*device{{deviceID: "device-0"}, {deviceID: "device-1"}}
+	messages := []*telemetryMessage{{body: []byte("a")}, {body: []byte("b")}, {body: []byte("c")}}
+
+	// failure of a device sending messages, or generating its telemetry if there are none
+	type failure struct {
+		device   int
+		messages []int
+	}
+
+	tests := []struct {
+		name     string
+		failures []failure
+		want     []*backfillTelemetry
+	}{
+		{
+			name:     "not generated",
+			failures: []failure{{device: 0}},
+			want:     []*backfillTelemetry{{device: devices[0]}},
+		},
+		{
+			name:     "messages of a device",
+			failures: []failure{{device: 0, messages: []int{0}}, {device: 0, messages: []int{2}}},
+			want:     []*backfillTelemetry{{device: devices[0], messages: []*telemetryMessage{messages[0], messages[2]}}},
+		},
+		{
+			name:     "messages of devices",
+			failures: []failure{{device: 1, messages: []int{1}}, {device: 0, messages: []int{0, 2}}},
+			want: []*backfillTelemetry{
+				{device: devices[1], messages: []*telemetryMessage{messages[1]}},
+				{device: devices[0], messages: []*telemetryMessage{messages[0], messages[2]}},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			wave := &backfillWave{}
+			for _, f := range tt.failures {
+				var failed []*telemetryMessage
+				for _, i := range f.messages {
+					failed = append(failed, messages[i])
+				}
+				wave.fail(devices[f.device], failed...)
+			}
+			if !reflect.DeepEqual(wave.failed, tt.want) {
+				t.Errorf("failed = %+v, want %+v", wave.failed, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,155 @@
+package simulating
+
+import (
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/iot-for-all/starling/pkg/models"
+	"github.com/iot-for-all/starling/pkg/storing"
+	"github.com/iot-for-all/starling/pkg/util"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// rootCAValidity is the validity of generated root CA certificates.
+	rootCAValidity = 10 * 365 * 24 * time.Hour
+	// intermediateCAValidity is the validity of generated intermediate CA certificates.
+	intermediateCAValidity = 5 * 365 * 24 * time.Hour
+	// deviceCertificateValidity is the validity of device certificates.
+	deviceCertificateValidity = 365 * 24 * time.Hour
+	// deviceCertificateRenewal is how long before they expire cached device certificates are minted again.
+	deviceCertificateRenewal = 30 * 24 * time.Hour
+)
+
+var (
+	// targetCertificatesLock serializes the generation of the CA of targets, so that all devices share the same CA.
+	targetCertificatesLock sync.Mutex
+)
+
+// GetTargetCertificates gets the CA hierarchy of a target, generating a root and an intermediate CA if it has none.
+func GetTargetCertificates(target *models.SimulationTarget) (*models.SimulationTargetCertificates, error) {
+	targetCertificatesLock.Lock()
+	defer targetCertificatesLock.Unlock()
+
+	certs, err := storing.TargetCertificates.Get(target.ID)
+	if err != nil || certs != nil {
+		return certs, err
+	}
+
+	certs = &models.SimulationTargetCertificates{
+		TargetID: target.ID,
+	}
+	certs.RootCertificate, certs.RootKey, err = util.CreateCertificate(
+		fmt.Sprintf("starling %s root CA", target.ID), true, rootCAValidity, "", "")
+	if err != nil {
+		return nil, err
+	}
+	certs.IntermediateCertificate, certs.IntermediateKey, err = util.CreateCertificate(
+		fmt.Sprintf("starling %s intermediate CA", target.ID), true, intermediateCAValidity, certs.RootCertificate, certs.RootKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = storing.TargetCertificates.Set(certs); err != nil {
+		return nil, err
+	}
+	log.Info().Str("targetID", target.ID).Msg("generated CA certificates of target")
+	return certs, nil
+}
+
+// ImportTargetCertificates saves the CA hierarchy of a target after checking that the intermediate CA is signed by the
+// root CA and can sign device certificates with its private key. Device certificates signed by the previous CA are minted
+// again on their next use.
+func ImportTargetCertificates(certs *models.SimulationTargetCertificates) error {
+	root, err := util.ParseCertificate(certs.RootCertificate)
+	if err != nil {
+		return errors.New(fmt.Sprintf("could not parse root CA certificate: %s", err.Error()))
+	}
+	intermediate, err := util.ParseCertificate(certs.IntermediateCertificate)
+	if err != nil {
+		return errors.New(fmt.Sprintf("could not parse intermediate CA certificate: %s", err.Error()))
+	}
+	if !intermediate.IsCA {
+		return errors.New("intermediate certificate is not a CA certificate")
+	}
+	if err = intermediate.CheckSignatureFrom(root); err != nil {
+		return errors.New(fmt.Sprintf("intermediate CA certificate is not signed by the root CA: %s", err.Error()))
+	}
+	key, err := util.ParsePrivateKey(certs.IntermediateKey)
+	if err != nil {
+		return errors.New(fmt.Sprintf("could not parse intermediate CA private key: %s", err.Error()))
+	}
+	if pub, ok := key.Public().(interface{ Equal(crypto.PublicKey) bool }); !ok || !pub.Equal(intermediate.PublicKey) {
+		return errors.New("intermediate CA private key does not match its certificate")
+	}
+
+	targetCertificatesLock.Lock()
+	defer targetCertificatesLock.Unlock()
+	return storing.TargetCertificates.Set(certs)
+}
+
+// getDeviceCertificate gets the certificate of a device, signed by the intermediate CA of the target. Certificates are
+// minted on their first use and cached, till they are about to expire or the CA of the target changes.
+func getDeviceCertificate(target *models.SimulationTarget, deviceID string) (*tls.Certificate, error) {
+	certs, err := GetTargetCertificates(target)
+	if err != nil {
+		return nil, err
+	}
+	intermediate, err := util.ParseCertificate(certs.IntermediateCertificate)
+	if err != nil {
+		return nil, err
+	}
+
+	cached, err := storing.TargetDeviceCertificates.Get(target.ID, deviceID)
+	if err != nil {
+		return nil, err
+	}
+	if cached != nil {
+		if crt, err := parseDeviceCertificate(cached, intermediate); err == nil {
+			return crt, nil
+		}
+		log.Debug().Str("deviceID", deviceID).Msg("device certificate expires or is not signed by the CA of the target")
+	}
+
+	leaf, key, err := util.CreateCertificate(deviceID, false, deviceCertificateValidity, certs.IntermediateCertificate, certs.IntermediateKey)
+	if err != nil {
+		return nil, err
+	}
+	cached = &models.SimulationTargetDeviceCertificate{
+		TargetID:    target.ID,
+		DeviceID:    deviceID,
+		Certificate: leaf + certs.IntermediateCertificate,
+		PrivateKey:  key,
+	}
+	if err = storing.TargetDeviceCertificates.Set(cached); err != nil {
+		return nil, err
+	}
+	log.Trace().Str("deviceID", deviceID).Msg("minted device certificate")
+	return parseDeviceCertificate(cached, intermediate)
+}
+
+// parseDeviceCertificate parses the certificate chain and the private key of a device, checking that the certificate
+// is signed by the intermediate CA and does not expire soon.
+func parseDeviceCertificate(cert *models.SimulationTargetDeviceCertificate, intermediate *x509.Certificate) (*tls.Certificate, error) {
+	crt, err := tls.X509KeyPair([]byte(cert.Certificate), []byte(cert.PrivateKey))
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(crt.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	if err = leaf.CheckSignatureFrom(intermediate); err != nil {
+		return nil, err
+	}
+	if time.Now().Add(deviceCertificateRenewal).After(leaf.NotAfter) {
+		return nil, errors.New("device certificate expires soon")
+	}
+	crt.Leaf = leaf
+	return &crt, nil
+}
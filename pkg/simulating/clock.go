@@ -0,0 +1,168 @@
+package simulating
+
+import (
+	"sync"
+	"time"
+
+	"github.com/iot-for-all/starling/pkg/models"
+)
+
+type (
+	// deviceClock is the clock of a device, which is skewed and drifts from the real time.
+	// The clock also holds back the telemetry messages of the device that arrive late or out of order.
+	deviceClock struct {
+		config *models.ClockConfig     // the clock configuration of the device.
+		random randomSource            // source of random clock behaviors, the shared source if not set.
+		offset time.Duration           // offset of the clock from the real time.
+		drift  float64                 // drift of the clock in seconds per second.
+		start  time.Time               // real time when the clock started drifting.
+		held   []*heldTelemetryMessage // telemetry messages held back till they are due.
+		lock   sync.Mutex              // lock to synchronize the clock between telemetry and event sends.
+	}
+
+	// heldTelemetryMessage is a telemetry message held back till it is due.
+	heldTelemetryMessage struct {
+		msg *telemetryMessage // the late message.
+		due time.Time         // real time after which the message is sent.
+	}
+)
+
+const (
+	// defaultFutureTime is the maximum number of seconds by which timestamps are in the future.
+	defaultFutureTime = 60
+	// defaultDelay is the maximum delay in seconds of delayed messages.
+	defaultDelay = 60
+
+	// clockFaultFuture is the fault label of messages with timestamps in the future.
+	clockFaultFuture = "future"
+	// clockFaultDelayed is the fault label of delayed messages.
+	clockFaultDelayed = "delayed"
+	// clockFaultReordered is the fault label of messages sent after the messages created after them.
+	clockFaultReordered = "reordered"
+)
+
+// newDeviceClock creates the clock of a device with a random offset and drift within the configured limits.
+func newDeviceClock(config *models.ClockConfig, random randomSource) *deviceClock {
+	c := deviceClock{
+		config: config,
+		random: random,
+	}
+	c.offset = time.Duration(c.getSpread(float64(config.Skew)) * float64(time.Second))
+	c.drift = c.getSpread(config.Drift) / 3600
+	return &c
+}
+
+// getTime gets the time of the device clock at the given real time.
+func (c *deviceClock) getTime(t time.Time) time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.start.IsZero() {
+		c.start = t
+	}
+	drift := c.drift * t.Sub(c.start).Seconds()
+	return t.Add(c.offset + time.Duration(drift*float64(time.Second)))
+}
+
+// getSpread gets a random value between -max and max.
+func (c *deviceClock) getSpread(max float64) float64 {
+	return max * (2*c.rand().Float64() - 1)
+}
+
+// isDue checks whether a clock fault with the given rate happens.
+func (c *deviceClock) isDue(rate float64) bool {
+	return rate > 0 && 100*c.rand().Float64() < rate
+}
+
+// getSeconds gets a random duration of up to the given maximum seconds, or up to the default if not set.
+func (c *deviceClock) getSeconds(max int, defaultMax int) time.Duration {
+	if max <= 0 {
+		max = defaultMax
+	}
+	return time.Duration(c.rand().Float64() * float64(max) * float64(time.Second))
+}
+
+// rand gets the random source of the clock.
+func (c *deviceClock) rand() randomSource {
+	return getRandom(c.random)
+}
+
+// getTimestamp gets the timestamp of a telemetry message created at the given real time by the device clock.
+// A percentage of the timestamps is in the future, if configured.
+func (d *DataGenerator) getTimestamp(device *device, t time.Time) time.Time {
+	if d.clock == nil {
+		return t
+	}
+
+	timestamp := d.clock.getTime(t)
+	if d.clock.isDue(d.clock.config.FutureRate) {
+		timestamp = timestamp.Add(d.clock.getSeconds(d.clock.config.Future, defaultFutureTime))
+		countClockFault(device, clockFaultFuture)
+	}
+	return timestamp
+}
+
+// ScheduleTelemetryMessages gets the telemetry messages of a batch that are sent now, along with the messages held back from
+// earlier batches that are due. Delayed messages are held back for a random delay, and reordered messages till the next batch,
+// so that they arrive after the messages created after them.
+func (d *DataGenerator) ScheduleTelemetryMessages(device *device, messages []*telemetryMessage, now time.Time) []*telemetryMessage {
+	if d.clock == nil {
+		return messages
+	}
+
+	d.clock.lock.Lock()
+	defer d.clock.lock.Unlock()
+
+	var held []*heldTelemetryMessage
+	var scheduled []*telemetryMessage
+	for _, h := range d.clock.held {
+		if now.Before(h.due) {
+			held = append(held, h)
+		} else {
+			scheduled = append(scheduled, h.msg)
+		}
+	}
+
+	for _, msg := range messages {
+		if d.clock.isDue(d.clock.config.DelayRate) {
+			held = append(held, &heldTelemetryMessage{
+				msg: msg,
+				due: now.Add(d.clock.getSeconds(d.clock.config.Delay, defaultDelay)),
+			})
+			countClockFault(device, clockFaultDelayed)
+		} else if d.clock.isDue(d.clock.config.ReorderRate) {
+			held = append(held, &heldTelemetryMessage{
+				msg: msg,
+				due: now,
+			})
+			countClockFault(device, clockFaultReordered)
+		} else {
+			scheduled = append(scheduled, msg)
+		}
+	}
+	d.clock.held = held
+	return scheduled
+}
+
+// FlushTelemetryMessages gets the telemetry messages held back by the device clock, whether they are due or not, e.g. with the
+// last batch of a backfill since no batch follows it.
+func (d *DataGenerator) FlushTelemetryMessages() []*telemetryMessage {
+	if d.clock == nil {
+		return nil
+	}
+
+	d.clock.lock.Lock()
+	defer d.clock.lock.Unlock()
+
+	messages := make([]*telemetryMessage, 0, len(d.clock.held))
+	for _, h := range d.clock.held {
+		messages = append(messages, h.msg)
+	}
+	d.clock.held = nil
+	return messages
+}
+
+// countClockFault counts a late, out of order or future telemetry message of a device.
+func countClockFault(device *device, fault string) {
+	telemetryFaultsTotal.WithLabelValues(device.simulation.ID, device.simulation.TargetID, device.model.ID, fault).Add(1)
+}
@@ -0,0 +1,194 @@
+package simulating
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/iot-for-all/starling/pkg/models"
+)
+
+// fixedRandom is a random source that always draws the same fraction of its range.
+type fixedRandom float64
+
+func (r fixedRandom) Intn(n int) int       { return int(float64(r) * float64(n)) }
+func (r fixedRandom) Int31n(n int32) int32 { return int32(float64(r) * float64(n)) }
+func (r fixedRandom) Int63n(n int64) int64 { return int64(float64(r) * float64(n)) }
+func (r fixedRandom) Float32() float32     { return float32(r) }
+func (r fixedRandom) Float64() float64     { return float64(r) }
+
+// newClockDevice creates a device with the clock of the given configuration.
+func newClockDevice(config *models.ClockConfig, random fixedRandom) (*device, *DataGenerator) {
+	dev := &device{
+		deviceID:   "device-1",
+		model:      &models.DeviceModel{ID: "thermostat"},
+		simulation: &models.Simulation{ID: "sim", TargetID: "target"},
+	}
+	return dev, &DataGenerator{clock: newDeviceClock(config, random)}
+}
+
+func TestDeviceClockGetTime(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  *models.ClockConfig
+		random  fixedRandom
+		seconds []int
+		want    []time.Duration
+	}{
+		{
+			name:    "none",
+			config:  &models.ClockConfig{},
+			random:  1,
+			seconds: []int{0, 3600},
+			want:    []time.Duration{0, 0},
+		},
+		{
+			name:    "skewed ahead",
+			config:  &models.ClockConfig{Skew: 10},
+			random:  1,
+			seconds: []int{0, 3600},
+			want:    []time.Duration{10 * time.Second, 10 * time.Second},
+		},
+		{
+			name:    "skewed behind",
+			config:  &models.ClockConfig{Skew: 10},
+			random:  0,
+			seconds: []int{0, 3600},
+			want:    []time.Duration{-10 * time.Second, -10 * time.Second},
+		},
+		{
+			name:    "drifting ahead",
+			config:  &models.ClockConfig{Drift: 36},
+			random:  1,
+			seconds: []int{0, 100, 3600},
+			want:    []time.Duration{0, time.Second, 36 * time.Second},
+		},
+		{
+			name:    "skewed and drifting behind",
+			config:  &models.ClockConfig{Skew: 10, Drift: 36},
+			random:  0.25,
+			seconds: []int{0, 3600},
+			want:    []time.Duration{-5 * time.Second, -23 * time.Second},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newDeviceClock(tt.config, tt.random)
+			start := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+			var got []time.Duration
+			for _, s := range tt.seconds {
+				now := start.Add(time.Duration(s) * time.Second)
+				got = append(got, c.getTime(now).Sub(now).Round(time.Millisecond))
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("getTime() offsets = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetTimestamp(t *testing.T) {
+	tests := []struct {
+		name   string
+		config *models.ClockConfig
+		random fixedRandom
+		want   time.Duration
+	}{
+		{name: "on time", config: &models.ClockConfig{FutureRate: 40}, random: 0.5, want: 0},
+		{name: "future", config: &models.ClockConfig{FutureRate: 60, Future: 30}, random: 0.5, want: 15 * time.Second},
+		{name: "future by default", config: &models.ClockConfig{FutureRate: 100}, random: 0.5, want: defaultFutureTime / 2 * time.Second},
+		{name: "future and skewed", config: &models.ClockConfig{Skew: 10, FutureRate: 100, Future: 30}, random: 0.75, want: 5*time.Second + 22500*time.Millisecond},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dev, d := newClockDevice(tt.config, tt.random)
+			now := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+			if got := d.getTimestamp(dev, now).Sub(now); got != tt.want {
+				t.Errorf("getTimestamp() offset = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestScheduleTelemetryMessages(t *testing.T) {
+	// batch is a batch of telemetry messages created at the given second, and the messages sent with it
+	type batch struct {
+		seconds  int
+		messages []string
+		want     []string
+	}
+
+	tests := []struct {
+		name    string
+		config  *models.ClockConfig
+		batches []batch
+		flushed []string
+	}{
+		{
+			name:   "on time",
+			config: &models.ClockConfig{},
+			batches: []batch{
+				{seconds: 0, messages: []string{"a", "b"}, want: []string{"a", "b"}},
+				{seconds: 10, messages: []string{"c"}, want: []string{"c"}},
+			},
+		},
+		{
+			name:   "delayed",
+			config: &models.ClockConfig{DelayRate: 100, Delay: 20},
+			batches: []batch{
+				{seconds: 0, messages: []string{"a", "b"}},
+				{seconds: 5},
+				{seconds: 10, messages: []string{"c"}, want: []string{"a", "b"}},
+			},
+			flushed: []string{"c"},
+		},
+		{
+			name:   "reordered",
+			config: &models.ClockConfig{ReorderRate: 100},
+			batches: []batch{
+				{seconds: 0, messages: []string{"a"}},
+				{seconds: 1, messages: []string{"b"}, want: []string{"a"}},
+				{seconds: 2, want: []string{"b"}},
+			},
+		},
+		{
+			name:   "delayed rather than reordered",
+			config: &models.ClockConfig{DelayRate: 100, Delay: 20, ReorderRate: 100},
+			batches: []batch{
+				{seconds: 0, messages: []string{"a"}},
+				{seconds: 1, messages: []string{"b"}},
+			},
+			flushed: []string{"a", "b"},
+		},
+	}
+
+	names := func(messages []*telemetryMessage) []string {
+		var names []string
+		for _, msg := range messages {
+			names = append(names, string(msg.body))
+		}
+		return names
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dev, d := newClockDevice(tt.config, 0.5)
+			start := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+			for _, b := range tt.batches {
+				var messages []*telemetryMessage
+				for _, name := range b.messages {
+					messages = append(messages, &telemetryMessage{body: []byte(name)})
+				}
+				got := names(d.ScheduleTelemetryMessages(dev, messages, start.Add(time.Duration(b.seconds)*time.Second)))
+				if !reflect.DeepEqual(got, b.want) {
+					t.Errorf("ScheduleTelemetryMessages() at %ds = %v, want %v", b.seconds, got, b.want)
+				}
+			}
+			if got := names(d.FlushTelemetryMessages()); !reflect.DeepEqual(got, tt.flushed) {
+				t.Errorf("FlushTelemetryMessages() = %v, want %v", got, tt.flushed)
+			}
+		})
+	}
+}
@@ -11,8 +11,11 @@ type Config struct {
 	MaxConcurrentRegistrations int  `yaml:"maxConcurrentRegistrations" json:"maxConcurrentRegistrations"`
 	MaxConcurrentDeletes       int  `yaml:"maxConcurrentDeletes" json:"maxConcurrentDeletes"`
 	MaxRegistrationAttempts    int  `yaml:"maxRegistrationAttempts" json:"maxRegistrationAttempts"`
+	RegistrationBackoff        int  `yaml:"registrationBackoff" json:"registrationBackoff"`
+	MaxRegistrationBackoff     int  `yaml:"maxRegistrationBackoff" json:"maxRegistrationBackoff"`
 	EnableTelemetry            bool `yaml:"enableTelemetry" json:"enableTelemetry"`
 	EnableReportedProps        bool `yaml:"enableReportedProps" json:"enableReportedProps"`
 	EnableTwinUpdateAcks       bool `yaml:"enableTwinUpdateAcks" json:"enableTwinUpdateAcks"`
 	EnableCommandAcks          bool `yaml:"enableCommandAcks" json:"enableCommandAcks"`
+	C2DPollInterval            int  `yaml:"c2dPollInterval" json:"c2dPollInterval"`
 }
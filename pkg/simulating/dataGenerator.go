@@ -5,18 +5,61 @@ import (
 	"fmt"
 	"github.com/amenzhinsky/iothub/common"
 	"github.com/amenzhinsky/iothub/iotdevice"
-	"github.com/hashicorp/go-uuid"
 	"github.com/iot-for-all/starling/pkg/models"
+	"github.com/iot-for-all/starling/pkg/storing"
 	"math/rand"
+	"reflect"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 )
 
 type (
+	// twinUpdateAck represents reported properties acknowledging desired properties after a delay.
+	twinUpdateAck struct {
+		delay    time.Duration       // time after receiving the desired properties when the ACK is sent.
+		reported iotdevice.TwinState // reported properties of the ACK.
+	}
+
+	// twinUpdateAckKey identifies ACKs that are due together; steps order the ACKs of a property that are due at the same time.
+	twinUpdateAckKey struct {
+		delay time.Duration
+		step  int
+	}
+
 	// DataGenerator generates telemetry messages and reported property updates based on the device capability model.
 	DataGenerator struct {
-		CapabilityModel *models.DeviceCapabilityModel // the capability model of the device.
-		nextGeoPoint    int                           // geo point to be used next from the geopointRoute
+		CapabilityModel             *models.DeviceCapabilityModel          // the capability model of the device.
+		Generators                  map[string]*models.ValueGenerator      // value generator configurations by telemetry or property name.
+		Commands                    map[string]*models.CommandBehavior     // command behaviors by command name.
+		PropertyAcks                map[string]*models.PropertyAckBehavior // acknowledgement behaviors by writable property name.
+		ReportChangedPropertiesOnly bool                                   // send only the read-only properties whose values changed since they were last reported.
+		Faults                      []*models.TelemetryFault               // faults injected into telemetry.
+		EventRates                  map[string]float64                     // average number of events or state transitions per hour by telemetry name.
+		TelemetryIntervals          map[string]int                         // intervals in seconds between sends by telemetry or component name.
+		seed                        int64                                  // seed of the random sources of the device, 0 if the simulation is not seeded.
+		random                      randomSource                           // source of random values and message ids, the shared source if not set.
+		behaviorRandom              randomSource                           // source of random command and acknowledgement behaviors, the shared source if not set.
+		faultRandom                 randomSource                           // source of random telemetry faults, the shared source if not set.
+		eventRandom                 randomSource                           // source of random event and state transition arrivals, the shared source if not set.
+		propertyRandom              randomSource                           // source of random values picked by the message templates, the shared source if not set.
+		messageTemplates            *messageTemplates                      // templates of the application properties and content type of telemetry messages, if configured.
+		messageCount                int64                                  // number of telemetry messages created by the device.
+		eventSources                []*eventSource                         // event and state telemetry sent when events or transitions occur.
+		stateValues                 map[string]interface{}                 // current values of state telemetry by component qualified telemetry name.
+		telemetrySentTimes          map[string]time.Time                   // creation times of the last messages containing telemetry with an interval.
+		clock                       *deviceClock                           // skewed and drifting clock of the device, if configured.
+		stuckTelemetry              map[string]*stuckTelemetry             // telemetry of stuck sensors by component qualified telemetry name.
+		personality                 map[string]interface{}                 // persistent values of the read-only properties of the device.
+		reportedValues              map[string]interface{}                 // values of the read-only properties last reported by the device.
+		nextGeoPoint                int                                    // geo point to be used next from the geopointRoute
+		stateMachine                *deviceStateMachine                    // state machine of the device, if the model has one.
+		mover                       *mover                                 // mover of the device along its route, if the device moves.
+		replayer                    *replayer                              // replayer of recorded telemetry, if the device replays a recording.
+		script                      *deviceScript                          // script defining the behavior of the device, if the model has a script.
+		valueGenerators             map[string]*valueGenerator             // value generators by component qualified telemetry or property name.
+		lock                        sync.Mutex                             // lock to synchronize the value generators between telemetry and reported property sends.
 	}
 )
 
@@ -47,160 +90,655 @@ var (
 )
 
 // GenerateTelemetryMessage generate a telemetry messages based on the device capability model.
-func (d *DataGenerator) GenerateTelemetryMessage(device *device, creationTime time.Time) ([]*telemetryMessage, error) {
-	// TODO: Handle components
+// Telemetry of the root interface and the interfaces it extends is sent in one message, while telemetry of
+// each component is sent in its own message following IoT Plug and Play conventions.
+// Devices with a state machine send only the telemetry of their active state. Event telemetry is sent separately when events occur.
+// Telemetry with its own interval is only included in the messages created when it is due, so messages can be sparse.
+// The active state, the position of moving devices, recorded values, if any, and values returned by the device script
+// are sent instead of generated values, in increasing order of precedence.
+// Messages are timestamped by the clock of the device, which may be skewed from the creation time.
+func (d *DataGenerator) GenerateTelemetryMessage(device *device, creationTime time.Time, recorded map[string]interface{}) ([]*telemetryMessage, error) {
+	var state map[string]interface{}
+	if d.stateMachine != nil {
+		active := d.stateMachine.getState(creationTime)
+		if d.stateMachine.machine.StateTelemetry != "" {
+			state = map[string]interface{}{
+				d.stateMachine.machine.StateTelemetry: active.Name,
+			}
+		}
+	}
+	var moved map[string]interface{}
+	if d.mover != nil {
+		moved = d.mover.getValues(d.CapabilityModel, creationTime)
+	}
+	var scripted map[string]interface{}
+	if d.script != nil {
+		scripted = d.script.onTelemetry()
+	}
 
-	telemetryMessages := make([]*telemetryMessage, 1)
+	var overrides map[string]interface{}
+	for _, values := range []map[string]interface{}{state, moved, recorded, scripted} {
+		if len(values) == 0 {
+			continue
+		}
+		if overrides == nil {
+			overrides = make(map[string]interface{})
+		}
+		for name, value := range values {
+			overrides[name] = value
+		}
+	}
 
-	dataPointCount := 0
-	var body []byte
-	var err error
+	timestamp := d.getTimestamp(device, creationTime)
 	if device.simulation.TelemetryFormat == models.TelemetryFormatOpcua {
-		// OPCUA device sending JSON payload
-		msgGuid, _ := uuid.GenerateUUID()
-		payload := make(map[string]interface{})
-		msgList := make([]map[string]interface{}, 1)
-		device.telemetrySequenceNumber++
-		msgList[0] = map[string]interface{}{
-			"DataSetWriterId": fmt.Sprintf("%s-%s", device.deviceID, msgGuid),
-			"MetaDataVersion": map[string]interface{}{
-				"MajorVersion": 1,
-				"MinorVersion": 0,
-			},
-			"SequenceNumber": device.telemetrySequenceNumber, //  rand.Intn(100000),
-			"Status":         nil,
-			"Timestamp":      d.getDateTime(),
-			"Payload":        payload,
-		}
-
-		eventId, _ := uuid.GenerateUUID()
-		telemetryValues := map[string]interface{}{
-			"DataSetClassId":     nil,
-			"DataSetWriterGroup": device.deviceID,
-			"EventId":            eventId,
-			"MessageId":          d.getString(5),
-			"MessageType":        "ua-data",
-			"PublisherId":        "Standalone_IIOTEdgeServer_opcpublisher",
-			"Messages":           msgList,
-		}
-
-		for _, comp := range d.CapabilityModel.Components {
+		return d.generateOpcuaTelemetryMessage(device, creationTime, timestamp, overrides)
+	}
+
+	// typical device sending plain JSON payload confirming the DTDL model
+	var telemetryMessages []*telemetryMessage
+	rootMsg := make(map[string]interface{})
+	rootDataPointCount := 0
+	notDue := false
+	for _, comp := range d.CapabilityModel.Components {
+		if !comp.IsComponent {
 			for _, telemetry := range comp.Telemetry {
-				opcuaNodeId := fmt.Sprintf("nsu=%s;s=%s", d.getString(20), d.getString(20))
-				telemetryName := telemetry.Name
-				telemetryValue := d.getRandomValue(telemetry.Schema)
-				payload[opcuaNodeId] = map[string]interface{}{
-					"ServerTimestamp": time.Now().UTC(),
-					"SourceTimestamp": time.Now().UTC(),
-					"StatusCode":      nil,
-					//"Name":            telemetryName,
-					"Value": telemetryValue,
+				if !d.isPeriodicTelemetry(comp, telemetry) {
+					continue
+				}
+				if !d.isTelemetryDue(comp, telemetry, creationTime) {
+					notDue = true
+					continue
 				}
-				telemetryValues[telemetryName] = telemetryValue
-				dataPointCount++
+				rootMsg[telemetry.Name] = d.getTelemetryValue(comp, telemetry, creationTime, overrides)
+				rootDataPointCount++
 			}
+			continue
 		}
 
-		body, err = json.Marshal(telemetryValues)
-		if err != nil {
-			return nil, err
+		if len(comp.Telemetry) == 0 {
+			continue
 		}
-	} else {
-		// typical device sending plain JSON payload confirming the DTDL model
-		msg := make(map[string]interface{})
-		for _, comp := range d.CapabilityModel.Components {
-			for _, telemetry := range comp.Telemetry {
-				msg[telemetry.Name] = d.getRandomValue(telemetry.Schema)
-				dataPointCount++
+		compMsg := make(map[string]interface{})
+		for _, telemetry := range comp.Telemetry {
+			if d.isPeriodicTelemetry(comp, telemetry) && d.isTelemetryDue(comp, telemetry, creationTime) {
+				compMsg[telemetry.Name] = d.getTelemetryValue(comp, telemetry, creationTime, overrides)
 			}
 		}
-		body, err = json.Marshal(msg)
+		if len(compMsg) == 0 {
+			continue
+		}
+		d.injectValueFaults(device, comp.ComponentName, compMsg)
+		tm, err := d.newTelemetryMessage(device, compMsg, comp.ComponentName, len(compMsg), timestamp)
 		if err != nil {
 			return nil, err
 		}
+		telemetryMessages = append(telemetryMessages, tm)
+	}
+
+	// always send the root interface telemetry, unless all the telemetry is sent by components or is not due yet
+	if rootDataPointCount > 0 || (len(telemetryMessages) == 0 && !notDue) {
+		d.injectValueFaults(device, "", rootMsg)
+		tm, err := d.newTelemetryMessage(device, rootMsg, "", len(rootMsg), timestamp)
+		if err != nil {
+			return nil, err
+		}
+		telemetryMessages = append([]*telemetryMessage{tm}, telemetryMessages...)
+	}
+
+	return telemetryMessages, nil
+}
+
+// generateOpcuaTelemetryMessage generates a telemetry message in the format sent by OPC UA publisher.
+func (d *DataGenerator) generateOpcuaTelemetryMessage(device *device, creationTime time.Time, timestamp time.Time, overrides map[string]interface{}) ([]*telemetryMessage, error) {
+	// OPCUA device sending JSON payload
+	msgGuid := newUUID(d.random)
+	payload := make(map[string]interface{})
+	msgList := make([]map[string]interface{}, 1)
+	device.telemetrySequenceNumber++
+	msgList[0] = map[string]interface{}{
+		"DataSetWriterId": fmt.Sprintf("%s-%s", device.deviceID, msgGuid),
+		"MetaDataVersion": map[string]interface{}{
+			"MajorVersion": 1,
+			"MinorVersion": 0,
+		},
+		"SequenceNumber": device.telemetrySequenceNumber, //  rand.Intn(100000),
+		"Status":         nil,
+		"Timestamp":      timestamp.Format(time.RFC3339),
+		"Payload":        payload,
+	}
+
+	eventId := newUUID(d.random)
+	telemetryValues := map[string]interface{}{
+		"DataSetClassId":     nil,
+		"DataSetWriterGroup": device.deviceID,
+		"EventId":            eventId,
+		"MessageId":          d.getString(5),
+		"MessageType":        "ua-data",
+		"PublisherId":        "Standalone_IIOTEdgeServer_opcpublisher",
+		"Messages":           msgList,
+	}
+
+	dataPointCount := 0
+	notDue := false
+	for _, comp := range d.CapabilityModel.Components {
+		var names []string
+		opcuaNodeIds := make(map[string]string)
+		compValues := make(map[string]interface{})
+		for _, telemetry := range comp.Telemetry {
+			if !d.isPeriodicTelemetry(comp, telemetry) {
+				continue
+			}
+			if !d.isTelemetryDue(comp, telemetry, creationTime) {
+				notDue = true
+				continue
+			}
+			names = append(names, telemetry.Name)
+			opcuaNodeIds[telemetry.Name] = fmt.Sprintf("nsu=%s;s=%s", d.getString(20), d.getString(20))
+			compValues[telemetry.Name] = d.getTelemetryValue(comp, telemetry, creationTime, overrides)
+		}
+
+		if len(compValues) == 0 {
+			continue
+		}
+
+		// value faults are injected into the values of each component, like in the messages of the other formats
+		componentName := ""
+		if comp.IsComponent {
+			componentName = comp.ComponentName
+		}
+		d.injectValueFaults(device, componentName, compValues)
+
+		for _, telemetryName := range names {
+			telemetryValue, ok := compValues[telemetryName]
+			if !ok {
+				continue
+			}
+			payload[opcuaNodeIds[telemetryName]] = map[string]interface{}{
+				"ServerTimestamp": time.Now().UTC(),
+				"SourceTimestamp": timestamp,
+				"StatusCode":      nil,
+				//"Name":            telemetryName,
+				"Value": telemetryValue,
+			}
+			telemetryValues[telemetryName] = telemetryValue
+			dataPointCount++
+		}
+	}
+
+	if dataPointCount == 0 && notDue {
+		return nil, nil
+	}
+
+	tm, err := d.newTelemetryMessage(device, telemetryValues, "", dataPointCount, timestamp)
+	if err != nil {
+		return nil, err
+	}
+	return []*telemetryMessage{tm}, nil
+}
+
+// newTelemetryMessage creates a telemetry message with the given values encoded in the telemetry format of the simulation.
+// Oversized and malformed message faults configured for the device are injected into the message.
+func (d *DataGenerator) newTelemetryMessage(device *device, values map[string]interface{}, componentName string, dataPointCount int, creationTime time.Time) (*telemetryMessage, error) {
+	d.injectOversizedFault(device, values)
+	body, err := d.encodeTelemetry(device, componentName, values)
+	if err != nil {
+		return nil, err
 	}
-	correlationID, _ := uuid.GenerateUUID()
-	messageID, _ := uuid.GenerateUUID()
-	tm := telemetryMessage{
+	body = d.injectMalformedFault(device, body)
+	contentType, contentEncoding := getContentType(device.simulation.TelemetryFormat)
+
+	correlationID := newUUID(d.random)
+	messageID := newUUID(d.random)
+	msg := &telemetryMessage{
 		body:               body,
 		interfaceId:        "",
+		componentName:      componentName,
 		connectionDeviceID: device.deviceID,
 		connectionModuleID: "",
-		contentEncoding:    "",
-		contentType:        "Content-Type: application/json",
+		contentEncoding:    contentEncoding,
+		contentType:        contentType,
 		correlationID:      correlationID,
 		messageID:          messageID,
 		creationTimeUtc:    creationTime, // distribute the messages in the batch evenly
 		properties:         nil,
 		dataPointCount:     dataPointCount,
 	}
-	telemetryMessages[0] = &tm
-
-	return telemetryMessages, nil
+	d.applyMessageTemplates(device, msg)
+	return msg, nil
 }
 
 // GenerateReportedProperties generate reported property update based on the device capability model.
+// Read-only properties without value generators keep the persistent values of the device personality.
 func (d *DataGenerator) GenerateReportedProperties(device *device) (iotdevice.TwinState, error) {
+	personality, err := d.getPersonality(device)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
 	reportedProps := make(iotdevice.TwinState)
 	for _, comp := range d.CapabilityModel.Components {
+		// properties of a component are wrapped in a component object marked with "__t": "c"
+		props := map[string]interface{}(reportedProps)
+		if comp.IsComponent {
+			props = map[string]interface{}{
+				"__t": "c",
+			}
+		}
+
+		hasProps := false
 		for _, prop := range comp.Properties {
 			if prop.Writable == false {
-				reportedProps[prop.Name] = d.getRandomValue(prop.Schema)
+				key := getPropertyKey(comp, prop.Name)
+				value, ok := personality[key]
+				if !ok {
+					value = d.getValue(comp, prop.Name, prop.Schema, now)
+				}
+
+				if d.ReportChangedPropertiesOnly {
+					if last, reported := d.reportedValues[key]; reported && reflect.DeepEqual(last, value) {
+						continue
+					}
+					if d.reportedValues == nil {
+						d.reportedValues = make(map[string]interface{})
+					}
+					d.reportedValues[key] = value
+				}
+
+				props[prop.Name] = value
+				hasProps = true
 			}
 		}
+
+		if comp.IsComponent && hasProps {
+			reportedProps[comp.ComponentName] = props
+		}
 	}
 	return reportedProps, nil
 }
 
-// GenerateTwinUpdate creates a reported properties ACK based on the desired properties
-func (d *DataGenerator) GenerateTwinUpdateAck(desiredTwin iotdevice.TwinState) iotdevice.TwinState {
-	reportedTwin := make(iotdevice.TwinState)
-	desiredVersion := desiredTwin.Version()
+// ResetReportedProperties forgets the values last reported by the device, so that all properties are reported again.
+func (d *DataGenerator) ResetReportedProperties() {
+	d.reportedValues = nil
+}
+
+// getPersonality gets the persistent values of the read-only properties without value generators of the device.
+// Values are generated once from a random source seeded with the device id and are stored with the device in the target.
+func (d *DataGenerator) getPersonality(device *device) (map[string]interface{}, error) {
+	if d.personality != nil {
+		return d.personality, nil
+	}
+
+	item, err := storing.TargetDeviceProperties.Get(device.target.ID, device.deviceID)
+	if err != nil {
+		return nil, fmt.Errorf("error reading properties of device %s (%s)", device.deviceID, err.Error())
+	}
+	if item == nil {
+		item = &models.SimulationTargetDeviceProperties{
+			TargetID: device.target.ID,
+			DeviceID: device.deviceID,
+		}
+	}
+	if item.Properties == nil {
+		item.Properties = make(map[string]interface{})
+	}
+
+	// generate values of the properties added to the model since the personality was stored
+	generator := &DataGenerator{
+		random: rand.New(rand.NewSource(hashSeed(device.deviceID))),
+	}
+	added := false
+	for _, comp := range d.CapabilityModel.Components {
+		for _, prop := range comp.Properties {
+			key := getPropertyKey(comp, prop.Name)
+			if prop.Writable || d.hasGenerator(comp, prop.Name) {
+				continue
+			}
+
+			// generate the value even if it is stored, so that values of added properties do not depend on the stored ones
+			value := generator.getRandomValue(prop.Schema)
+			if _, ok := item.Properties[key]; !ok {
+				item.Properties[key] = value
+				added = true
+			}
+		}
+	}
+
+	if added {
+		if err = storing.TargetDeviceProperties.Set(item); err != nil {
+			return nil, fmt.Errorf("error saving properties of device %s (%s)", device.deviceID, err.Error())
+		}
+	}
+	d.personality = item.Properties
+	return d.personality, nil
+}
+
+// HandleDesiredProperties lets the state machine and the script of the device react to the desired properties it received.
+func (d *DataGenerator) HandleDesiredProperties(desiredTwin iotdevice.TwinState) {
+	if d.stateMachine == nil && d.script == nil {
+		return
+	}
+
+	desired := make(map[string]interface{}, len(desiredTwin))
 	for key, value := range desiredTwin {
 		if key != "$version" {
-			responseTwin := map[string]interface{}{
-				"value": value,
-				"ac":    200,
-				"ad":    "completed",
-				"av":    desiredVersion,
-			}
-			reportedTwin[key] = responseTwin
-
-			values, ok := value.(map[string]interface{})
-			if ok {
-				_, ok := values["__t"]
-				if ok {
-					delete(values, "__t")
-
-					componentTwin := map[string]interface{}{}
-					componentTwin["__t"] = "c"
-					for compKey, val := range values {
-						componentTwin[compKey] = map[string]interface{}{
-							"value": val,
-							"ac":    200,
-							"ad":    "completed",
-							"av":    desiredVersion,
-						}
-					}
+			desired[key] = value
+		}
+	}
+	if d.stateMachine != nil {
+		d.stateMachine.onDesired(desired)
+	}
+	if d.script != nil {
+		d.script.onDesired(desired)
+	}
+}
 
-					reportedTwin[key] = componentTwin
+// GenerateTwinUpdateAck creates reported properties ACKs based on the desired properties and the acknowledgement
+// behaviors configured for them. ACKs that are due at the same time are combined and returned in the order they are due.
+func (d *DataGenerator) GenerateTwinUpdateAck(desiredTwin iotdevice.TwinState) []*twinUpdateAck {
+	acks := make(map[twinUpdateAckKey]iotdevice.TwinState)
+	desiredVersion := desiredTwin.Version()
+	for key, value := range desiredTwin {
+		if key == "$version" {
+			continue
+		}
+
+		// properties of a component are wrapped in a component object marked with "__t": "c"
+		if values, ok := value.(map[string]interface{}); ok {
+			if _, ok := values["__t"]; ok {
+				for compKey, val := range values {
+					if compKey != "__t" {
+						d.addTwinUpdateAcks(acks, key, compKey, val, desiredVersion)
+					}
 				}
+				continue
 			}
 		}
+		d.addTwinUpdateAcks(acks, "", key, value, desiredVersion)
 	}
 
-	return reportedTwin
+	keys := make([]twinUpdateAckKey, 0, len(acks))
+	for key := range acks {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].delay == keys[j].delay {
+			return keys[i].step < keys[j].step
+		}
+		return keys[i].delay < keys[j].delay
+	})
+
+	result := make([]*twinUpdateAck, len(keys))
+	for i, key := range keys {
+		result[i] = &twinUpdateAck{
+			delay:    key.delay,
+			reported: acks[key],
+		}
+	}
+	return result
+}
+
+// addTwinUpdateAcks adds the ACKs of a desired property of a component, based on the acknowledgement behavior of the property.
+func (d *DataGenerator) addTwinUpdateAcks(acks map[twinUpdateAckKey]iotdevice.TwinState, component string, name string, value interface{}, version int) {
+	behavior, ok := d.PropertyAcks[name]
+	if component != "" {
+		if b, found := d.PropertyAcks[fmt.Sprintf("%s.%s", component, name)]; found {
+			behavior, ok = b, found
+		}
+	}
+	if !ok || behavior == nil {
+		addTwinUpdateAck(acks, twinUpdateAckKey{}, component, name, value, 200, "completed", version)
+		return
+	}
+
+	if behavior.IgnoreRate > 0 && 100*getRandom(d.behaviorRandom).Float64() < behavior.IgnoreRate {
+		return
+	}
+
+	status := behavior.Status
+	if status == 0 {
+		status = 200
+	}
+	description := behavior.Description
+	if description == "" {
+		description = "completed"
+	}
+	delay := behavior.Delay
+	if behavior.Jitter > 0 {
+		delay += getRandom(d.behaviorRandom).Intn(behavior.Jitter)
+	}
+
+	key := twinUpdateAckKey{
+		delay: time.Millisecond * time.Duration(delay),
+	}
+	if behavior.Pending {
+		addTwinUpdateAck(acks, twinUpdateAckKey{}, component, name, value, 202, "pending", version)
+		key.step = 1
+	}
+	addTwinUpdateAck(acks, key, component, name, value, status, description, version)
+}
+
+// addTwinUpdateAck adds the ACK of a desired property of a component to the reported properties that are due together.
+func addTwinUpdateAck(acks map[twinUpdateAckKey]iotdevice.TwinState, key twinUpdateAckKey, component string, name string, value interface{}, status int, description string, version int) {
+	reportedTwin, ok := acks[key]
+	if !ok {
+		reportedTwin = make(iotdevice.TwinState)
+		acks[key] = reportedTwin
+	}
+
+	props := map[string]interface{}(reportedTwin)
+	if component != "" {
+		componentTwin, ok := reportedTwin[component].(map[string]interface{})
+		if !ok {
+			componentTwin = map[string]interface{}{
+				"__t": "c",
+			}
+			reportedTwin[component] = componentTwin
+		}
+		props = componentTwin
+	}
+
+	props[name] = map[string]interface{}{
+		"value": value,
+		"ac":    status,
+		"ad":    description,
+		"av":    version,
+	}
+}
+
+// GenerateCommandResponse generates the status and the response payload of a command based on the command behavior
+// configured for the command. The response payload is returned by the device script, if it handles the command, or
+// is generated from the response schema of the command otherwise.
+func (d *DataGenerator) GenerateCommandResponse(comp *models.Component, command *models.CommandType, payload interface{}) (int, interface{}) {
+	behavior := d.getCommandBehavior(comp, command)
+	if behavior != nil && behavior.FailureRate > 0 && 100*getRandom(d.behaviorRandom).Float64() < behavior.FailureRate {
+		status := behavior.FailureStatus
+		if status == 0 {
+			status = 500
+		}
+		return status, map[string]interface{}{
+			"error": "simulated command failure",
+		}
+	}
+
+	status := 200
+	if behavior != nil && behavior.Status != 0 {
+		status = behavior.Status
+	}
+
+	if d.stateMachine != nil {
+		d.stateMachine.onCommand(getScriptCommandName(comp.CommandName(command)))
+	}
+	if d.script != nil {
+		if result, ok := d.script.onCommand(getScriptCommandName(comp.CommandName(command)), payload); ok {
+			return status, result
+		}
+	}
+	if behavior != nil && behavior.Response != nil {
+		return status, behavior.Response
+	}
+	if command.Response != nil {
+		// responses are generated from the behaviors stream, so that commands do not change the telemetry values
+		responses := &DataGenerator{
+			random: d.behaviorRandom,
+		}
+		return status, responses.getRandomValue(command.Response)
+	}
+	return status, map[string]interface{}{}
+}
+
+// GetCommandDelay gets the time the device takes to process a command based on the command behavior configured for the command.
+func (d *DataGenerator) GetCommandDelay(comp *models.Component, command *models.CommandType) time.Duration {
+	behavior := d.getCommandBehavior(comp, command)
+	if behavior == nil {
+		return 0
+	}
+
+	delay := behavior.Delay
+	if behavior.Jitter > 0 {
+		delay += getRandom(d.behaviorRandom).Intn(behavior.Jitter)
+	}
+	return time.Millisecond * time.Duration(delay)
+}
+
+// getCommandBehavior gets the behavior configured for a command of a component, nil if none was configured.
+func (d *DataGenerator) getCommandBehavior(comp *models.Component, command *models.CommandType) *models.CommandBehavior {
+	if comp.IsComponent {
+		if behavior, ok := d.Commands[fmt.Sprintf("%s.%s", comp.ComponentName, command.Name)]; ok {
+			return behavior
+		}
+	}
+	return d.Commands[command.Name]
+}
+
+// GenerateC2DAck decides how to settle the cloud to device message of an asynchronous command based on the command
+// behavior configured for the command. Failed commands are abandoned, so that they are delivered again.
+func (d *DataGenerator) GenerateC2DAck(c2dMsg *common.Message) models.C2DOutcome {
+	methodName := c2dMsg.Properties["method-name"]
+	comp, command := d.CapabilityModel.FindCommand(methodName)
+	if command == nil {
+		return models.C2DOutcomeReject
+	}
+
+	behavior := d.getCommandBehavior(comp, command)
+	if behavior != nil && behavior.FailureRate > 0 && 100*getRandom(d.behaviorRandom).Float64() < behavior.FailureRate {
+		return models.C2DOutcomeAbandon
+	}
+
+	if d.stateMachine != nil {
+		d.stateMachine.onCommand(getScriptCommandName(methodName))
+	}
+	if d.script != nil {
+		var payload interface{}
+		if err := json.Unmarshal(c2dMsg.Payload, &payload); err != nil {
+			payload = string(c2dMsg.Payload)
+		}
+		d.script.onCommand(getScriptCommandName(methodName), payload)
+	}
+
+	if behavior != nil && behavior.Outcome != "" {
+		return behavior.Outcome
+	}
+	return models.C2DOutcomeComplete
+}
+
+// HasC2DBehaviors returns true if command behaviors are configured for any of the asynchronous commands.
+func (d *DataGenerator) HasC2DBehaviors() bool {
+	for _, comp := range d.CapabilityModel.Components {
+		for _, command := range comp.Commands {
+			if !command.IsSync && d.getCommandBehavior(comp, command) != nil {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isTelemetrySent checks whether a telemetry of a component is sent in the active state of the device.
+func (d *DataGenerator) isTelemetrySent(comp *models.Component, telemetry *models.TelemetryType) bool {
+	return d.stateMachine == nil || d.stateMachine.isTelemetrySent(comp, telemetry.Name)
+}
+
+// getTelemetryValue gets the recorded or scripted value of a telemetry of a component, or the next generated value otherwise.
+// State telemetry keeps its value till its next transition.
+func (d *DataGenerator) getTelemetryValue(comp *models.Component, telemetry *models.TelemetryType, t time.Time, overrides map[string]interface{}) interface{} {
+	if overrides != nil {
+		var value interface{}
+		ok := false
+		if comp.IsComponent {
+			value, ok = overrides[fmt.Sprintf("%s.%s", comp.ComponentName, telemetry.Name)]
+		}
+		if !ok {
+			value, ok = overrides[telemetry.Name]
+		}
+		if ok {
+			return convertRecordedValue(value, telemetry.Schema)
+		}
+	}
+	if telemetry.IsState() {
+		return d.getStateValue(comp, telemetry, t)
+	}
+	return d.getValue(comp, telemetry.Name, telemetry.Schema, t)
 }
 
-// GenerateTwinUpdate creates a reported properties ACK based on the desired properties
-func (d *DataGenerator) GenerateC2DAck(c2dMsg *common.Message) *common.Message {
-	var response common.Message
+// getValue gets the next value of a telemetry or property of a component at the given time.
+// Values are generated by the value generator configured for the telemetry or property, or are random otherwise.
+func (d *DataGenerator) getValue(comp *models.Component, name string, schema *models.Schema, t time.Time) interface{} {
+	key := getPropertyKey(comp, name)
+	spec := d.getGenerator(comp, name)
+	if d.stateMachine != nil {
+		// generators of the active state take precedence, each state generates its own values
+		if stateSpec, state := d.stateMachine.getGenerator(comp, name); stateSpec != nil {
+			spec = stateSpec
+			key = fmt.Sprintf("%s/%s", state, key)
+		}
+	}
+	if spec == nil {
+		return d.getRandomValue(schema)
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.valueGenerators == nil {
+		d.valueGenerators = make(map[string]*valueGenerator)
+	}
+	g, ok := d.valueGenerators[key]
+	if !ok {
+		g = newValueGenerator(spec, newRandomSource(d.seed, fmt.Sprintf("%s.%s", randomStreamValues, key)))
+		d.valueGenerators[key] = g
+	}
+	return g.next(schema, t)
+}
 
-	return &response
+// hasGenerator checks whether a value generator is configured for a telemetry or property of a component.
+func (d *DataGenerator) hasGenerator(comp *models.Component, name string) bool {
+	return d.getGenerator(comp, name) != nil
 }
 
-func (d *DataGenerator) getRandomValue(schema string) interface{} {
-	switch strings.ToLower(schema) {
+// getGenerator gets the value generator configured for a telemetry or property of a component, nil if there is none.
+func (d *DataGenerator) getGenerator(comp *models.Component, name string) *models.ValueGenerator {
+	spec, ok := d.Generators[getPropertyKey(comp, name)]
+	if !ok {
+		spec = d.Generators[name]
+	}
+	return spec
+}
+
+// getRandomValue gets a random value conforming to the given schema.
+func (d *DataGenerator) getRandomValue(schema *models.Schema) interface{} {
+	if schema == nil {
+		return ""
+	}
+
+	switch schema.Type {
+	case models.SchemaTypeObject:
+		return d.getObject(schema)
+	case models.SchemaTypeEnum:
+		return d.getEnum(schema)
+	case models.SchemaTypeMap:
+		return d.getMap(schema)
+	case models.SchemaTypeArray:
+		return d.getArray(schema)
 	case "boolean":
 		return d.getBool()
 	case "date":
@@ -223,13 +761,62 @@ func (d *DataGenerator) getRandomValue(schema string) interface{} {
 		return d.getString(10)
 	case "time":
 		return d.getTime()
+	case "vector":
+		return d.getVector()
 	}
 	return ""
 }
 
+// getObject gets an object with random values for all the fields in the object schema.
+func (d *DataGenerator) getObject(schema *models.Schema) map[string]interface{} {
+	obj := make(map[string]interface{}, len(schema.Fields))
+	for _, field := range schema.Fields {
+		obj[field.Name] = d.getRandomValue(field.Schema)
+	}
+	return obj
+}
+
+// getEnum gets a random value from the values of the enum schema.
+func (d *DataGenerator) getEnum(schema *models.Schema) interface{} {
+	if len(schema.EnumValues) == 0 {
+		return nil
+	}
+	return schema.EnumValues[d.rand().Intn(len(schema.EnumValues))].Value
+}
+
+// getMap gets a map with a few entries with random values for the map schema.
+func (d *DataGenerator) getMap(schema *models.Schema) map[string]interface{} {
+	m := make(map[string]interface{})
+	if schema.MapKey == nil || schema.MapValue == nil {
+		return m
+	}
+
+	// use a stable set of keys, so that the values of the same keys keep changing
+	count := 1 + d.rand().Intn(3)
+	for i := 1; i <= count; i++ {
+		m[fmt.Sprintf("%s%d", schema.MapKey.Name, i)] = d.getRandomValue(schema.MapValue.Schema)
+	}
+	return m
+}
+
+// getArray gets an array with a few random elements for the array schema.
+func (d *DataGenerator) getArray(schema *models.Schema) []interface{} {
+	count := 1 + d.rand().Intn(5)
+	arr := make([]interface{}, count)
+	for i := 0; i < count; i++ {
+		arr[i] = d.getRandomValue(schema.ElementSchema)
+	}
+	return arr
+}
+
+// rand gets the source of random values of the data generator.
+func (d *DataGenerator) rand() randomSource {
+	return getRandom(d.random)
+}
+
 // getBool get a random boolean value.
 func (d *DataGenerator) getBool() bool {
-	return rand.Intn(100) < 50
+	return d.rand().Intn(100) < 50
 }
 
 // getDate gets the current date as a string.
@@ -244,22 +831,22 @@ func (d *DataGenerator) getDateTime() string {
 
 // getDouble gets a random double.
 func (d *DataGenerator) getDouble() float64 {
-	return 100 * rand.Float64()
+	return 100 * d.rand().Float64()
 }
 
 // getDuration gets a random duration in ISO 8601 format.
 func (d *DataGenerator) getDuration() string {
 	// ISO 8601 format
 	// P3Y6M4DT12H30M5S = three years, six months, four days, twelve hours, thirty minutes, and five seconds
-	hr := rand.Int31n(12)
-	min := rand.Int31n(60)
-	sec := rand.Int31n(60)
+	hr := d.rand().Int31n(12)
+	min := d.rand().Int31n(60)
+	sec := d.rand().Int31n(60)
 	return fmt.Sprintf("P0Y0M0DT%dH%dM%dS", hr, min, sec)
 }
 
 // getFloat gets a random floating point number.
 func (d *DataGenerator) getFloat() float32 {
-	return 100 * rand.Float32()
+	return 100 * d.rand().Float32()
 }
 
 // getInt gets a a geopoint along a predefined route in Redmond.
@@ -274,12 +861,12 @@ func (d *DataGenerator) getGeopoint() map[string]interface{} {
 
 // getInt gets a random integer.
 func (d *DataGenerator) getInt() int {
-	return rand.Intn(100)
+	return d.rand().Intn(100)
 }
 
 // getLong gets a random 64 bit integer.
 func (d *DataGenerator) getLong() int64 {
-	return rand.Int63n(1000)
+	return d.rand().Int63n(1000)
 }
 
 // getString gets a random string.
@@ -287,13 +874,30 @@ func (d *DataGenerator) getString(length int) string {
 	var charSet string = "abcdefghijklmnopqrstuvwxyzACBDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
 	var val strings.Builder
 	for i := 0; i < length; i++ {
-		val.WriteString(string(charSet[rand.Intn(len(charSet))]))
+		val.WriteString(string(charSet[d.rand().Intn(len(charSet))]))
 	}
 
 	return val.String()
 }
 
-//getTime gets the current time as string.
+// getTime gets the current time as string.
 func (d *DataGenerator) getTime() string {
 	return time.Now().UTC().Format(time.RFC3339)
 }
+
+// getVector gets a random vector.
+func (d *DataGenerator) getVector() map[string]interface{} {
+	return map[string]interface{}{
+		"x": d.getDouble(),
+		"y": d.getDouble(),
+		"z": d.getDouble(),
+	}
+}
+
+// getPropertyKey gets the key of a telemetry or property of a component in the device configuration.
+func getPropertyKey(comp *models.Component, name string) string {
+	if comp.IsComponent {
+		return fmt.Sprintf("%s.%s", comp.ComponentName, name)
+	}
+	return name
+}
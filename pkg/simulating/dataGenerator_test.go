@@ -0,0 +1,137 @@
+package simulating
+
+import (
+	"testing"
+
+	"github.com/iot-for-all/starling/pkg/models"
+)
+
+func TestGetRandomValueNestedSchemas(t *testing.T) {
+	point := &models.Schema{Type: models.SchemaTypeObject, Fields: []*models.SchemaField{
+		{Name: "x", Schema: &models.Schema{Type: "double"}},
+		{Name: "y", Schema: &models.Schema{Type: "integer"}},
+	}}
+	status := &models.Schema{Type: models.SchemaTypeEnum, ValueSchema: "integer", EnumValues: []*models.EnumValue{
+		{Name: "off", Value: 0},
+		{Name: "on", Value: 1},
+	}}
+
+	tests := []struct {
+		name   string
+		schema *models.Schema
+		check  func(t *testing.T, v interface{})
+	}{
+		{
+			name:   "no schema",
+			schema: nil,
+			check: func(t *testing.T, v interface{}) {
+				if v != "" {
+					t.Errorf("got %v, want an empty string", v)
+				}
+			},
+		},
+		{
+			name:   "object",
+			schema: point,
+			check: func(t *testing.T, v interface{}) {
+				checkPoint(t, v)
+			},
+		},
+		{
+			name:   "enum",
+			schema: status,
+			check: func(t *testing.T, v interface{}) {
+				if v != 0 && v != 1 {
+					t.Errorf("got %v, want one of the enum values", v)
+				}
+			},
+		},
+		{
+			name:   "enum without values",
+			schema: &models.Schema{Type: models.SchemaTypeEnum},
+			check: func(t *testing.T, v interface{}) {
+				if v != nil {
+					t.Errorf("got %v, want nil", v)
+				}
+			},
+		},
+		{
+			name: "map of objects",
+			schema: &models.Schema{
+				Type:     models.SchemaTypeMap,
+				MapKey:   &models.SchemaField{Name: "sensor", Schema: &models.Schema{Type: "string"}},
+				MapValue: &models.SchemaField{Name: "position", Schema: point},
+			},
+			check: func(t *testing.T, v interface{}) {
+				m, ok := v.(map[string]interface{})
+				if !ok || len(m) < 1 || len(m) > 3 {
+					t.Fatalf("got %v, want a map of 1 to 3 entries", v)
+				}
+				for key, value := range m {
+					if key != "sensor1" && key != "sensor2" && key != "sensor3" {
+						t.Errorf("got key %s, want sensor1 to sensor3", key)
+					}
+					checkPoint(t, value)
+				}
+			},
+		},
+		{
+			name:   "array of enums",
+			schema: &models.Schema{Type: models.SchemaTypeArray, ElementSchema: status},
+			check: func(t *testing.T, v interface{}) {
+				a, ok := v.([]interface{})
+				if !ok || len(a) < 1 || len(a) > 5 {
+					t.Fatalf("got %v, want an array of 1 to 5 elements", v)
+				}
+				for _, e := range a {
+					if e != 0 && e != 1 {
+						t.Errorf("got element %v, want one of the enum values", e)
+					}
+				}
+			},
+		},
+		{
+			name: "object of arrays",
+			schema: &models.Schema{Type: models.SchemaTypeObject, Fields: []*models.SchemaField{
+				{Name: "path", Schema: &models.Schema{Type: models.SchemaTypeArray, ElementSchema: point}},
+			}},
+			check: func(t *testing.T, v interface{}) {
+				obj, ok := v.(map[string]interface{})
+				if !ok {
+					t.Fatalf("got %v, want an object", v)
+				}
+				path, ok := obj["path"].([]interface{})
+				if !ok || len(path) == 0 {
+					t.Fatalf("got path %v, want an array", obj["path"])
+				}
+				for _, p := range path {
+					checkPoint(t, p)
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &DataGenerator{random: newRandomSource(1, randomStreamValues)}
+			for i := 0; i < 10; i++ {
+				tt.check(t, d.getRandomValue(tt.schema))
+			}
+		})
+	}
+}
+
+// checkPoint checks that a value is an object with the fields of the point schema of the tests.
+func checkPoint(t *testing.T, v interface{}) {
+	t.Helper()
+	obj, ok := v.(map[string]interface{})
+	if !ok || len(obj) != 2 {
+		t.Fatalf("got %v, want an object with x and y", v)
+	}
+	if _, ok := obj["x"].(float64); !ok {
+		t.Errorf("got x %v, want a double", obj["x"])
+	}
+	if _, ok := obj["y"].(int); !ok {
+		t.Errorf("got y %v, want an integer", obj["y"])
+	}
+}
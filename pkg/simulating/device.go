@@ -2,6 +2,7 @@ package simulating
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"reflect"
@@ -12,6 +13,7 @@ import (
 
 	"github.com/amenzhinsky/iothub/common"
 	"github.com/amenzhinsky/iothub/iotdevice"
+	"github.com/amenzhinsky/iothub/iotdevice/transport"
 	iotmqtt "github.com/amenzhinsky/iothub/iotdevice/transport/mqtt"
 	"github.com/amenzhinsky/iothub/logger"
 	"github.com/iot-for-all/starling/pkg/models"
@@ -25,16 +27,22 @@ type (
 	device struct {
 		deviceID                string                   // unique id of the device.
 		model                   *models.DeviceModel      // model of the device.
+		provisioningPayload     *ProvisioningPayload     // custom payload sent to DPS when registering, if configured.
 		target                  *models.SimulationTarget // target application of the device.
 		connectionString        string                   // IoT Hub connectionString of the device.
+		certificate             *tls.Certificate         // X.509 certificate the device authenticates with, nil for symmetric keys.
 		isConnected             bool                     // is the device connected.
 		isConnecting            bool                     // is the device connecting now.
 		telemetrySentTime       time.Time                // last time telemetry was sent from this device.
 		sendingTelemetry        bool                     // is the device sending telemetry now.
 		sendingReportedProps    bool                     // is the device sending reported properties now.
 		iotHubClient            *iotdevice.Client        // IoT Hub connection MQTT client.
+		transport               transport.Transport      // transport of the IoT Hub connection.
+		transportType           models.DeviceTransport   // protocol of the IoT Hub connection.
+		pollInterval            time.Duration            // interval between c2d polls over HTTPS, the interval of the config if 0.
 		twinSub                 *iotdevice.TwinStateSub  // subscription to listen for twin updates.
 		c2dSub                  *iotdevice.EventSub      // subscription to listen for c2d commands
+		c2dClient               *httpDeviceClient        // HTTPS client receiving c2d commands that are settled explicitly.
 		dataGenerator           *DataGenerator           // data generator used to generate telemetry and reported property updates.
 		retryCount              int                      // number of retries for sending telemetry
 		telemetrySequenceNumber int                      // monotonically increasing sequence number for telemetry
@@ -62,14 +70,19 @@ type (
 
 	// telemetryRequest represents the request to send telemetry by the device simulator.
 	telemetryRequest struct {
-		device  *device         // device the device which sends telemetry.
-		context context.Context // context of the telemetry request.
+		device   *device             // device the device which sends telemetry.
+		context  context.Context     // context of the telemetry request.
+		time     time.Time           // virtual time at which the telemetry is sent when backfilling, the real time if not set.
+		wave     *backfillWave       // backfill wave the request belongs to, if backfilling.
+		flush    bool                // whether the messages held back by the device clock are sent with the batch, at the end of a backfill.
+		messages []*telemetryMessage // messages of the backfill wave that failed to send, sent again instead of a new batch.
 	}
 
 	// telemetryMessage represents the telemetry message sent from the device.
 	telemetryMessage struct {
 		body               []byte            // body of the telemetry message.
 		interfaceId        string            // interface id of the component that is sending telemetry.
+		componentName      string            // name of the component that is sending telemetry; empty for the root interface.
 		connectionDeviceID string            // id of the device sending telemetry.
 		connectionModuleID string            // edge module that is sending telemetry.
 		contentEncoding    string            // encoding of the message content.
@@ -167,12 +180,17 @@ func (s *deviceSimulator) stop() {
 
 // sendTelemetry sends a telemetry batch from the device
 func (s *deviceSimulator) sendTelemetry(req *telemetryRequest) {
+	if req.wave != nil {
+		defer req.wave.done.Done()
+	}
+
 	// if the device is in the middle of sending a telemetry, skip this request
 	if req.device.sendingTelemetry {
 		log.Trace().
 			Str("deviceID", req.device.deviceID).
 			Msg("skipping telemetry as it is already sending one")
-		telemetryBatchSkippedTotal.WithLabelValues(s.simulation.ID, s.simulation.TargetID, req.device.model.ID).Add(1)
+		telemetryBatchSkippedTotal.WithLabelValues(s.simulation.ID, s.simulation.TargetID, req.device.model.ID, string(req.device.transportType)).Add(1)
+		req.fail(req.messages...)
 		return
 	}
 
@@ -194,17 +212,30 @@ func (s *deviceSimulator) sendTelemetry(req *telemetryRequest) {
 	if req.device.isConnected == false {
 		if s.connectDevice(req.device) == false {
 			req.device.sendingTelemetry = false
+			req.fail(req.messages...)
 			return
 		}
 
 		// device failed over successfully
 		if failureDetected {
-			deviceFailoverTotal.WithLabelValues(s.simulation.ID, s.simulation.TargetID, req.device.model.ID).Inc()
+			deviceFailoverTotal.WithLabelValues(s.simulation.ID, s.simulation.TargetID, req.device.model.ID, string(req.device.transportType)).Inc()
 		}
 	}
 
-	// generate a batch of telemetry messages
-	batch := s.getNextTelemetryBatch(req.device)
+	// generate a batch of telemetry messages, unless the messages of a backfill wave that failed are sent again
+	batch := &telemetryBatch{messages: req.messages}
+	if req.messages == nil {
+		now := req.time
+		if now.IsZero() {
+			now = time.Now().UTC()
+		}
+		batch = s.getNextTelemetryBatch(req.device, now)
+		batch.messages = req.device.dataGenerator.ScheduleTelemetryMessages(req.device, batch.messages, now)
+		if req.flush {
+			batch.messages = append(batch.messages, req.device.dataGenerator.FlushTelemetryMessages()...)
+		}
+		batch.messages = req.device.dataGenerator.PackTelemetryMessages(req.device, batch.messages)
+	}
 	start := time.Now()
 
 	// send all messages in a batch in parallel.
@@ -217,9 +248,9 @@ func (s *deviceSimulator) sendTelemetry(req *telemetryRequest) {
 	// wait till all messages in the batch are sent.
 	wg.Wait()
 
-	now := time.Now()
-	req.device.telemetrySentTime = now
-	latency := float64(now.UnixNano()-start.UnixNano()) / float64(time.Second)
+	end := time.Now()
+	req.device.telemetrySentTime = end
+	latency := float64(end.UnixNano()-start.UnixNano()) / float64(time.Second)
 
 	log.Trace().
 		Str("deviceID", req.device.deviceID).
@@ -228,8 +259,8 @@ func (s *deviceSimulator) sendTelemetry(req *telemetryRequest) {
 		Int("numGoroutines", runtime.NumGoroutine()).
 		Msg("sent telemetry")
 
-	telemetryBatchSendLatency.WithLabelValues(s.simulation.ID, s.simulation.TargetID, req.device.model.ID).Observe(latency)
-	telemetryBatchSuccessTotal.WithLabelValues(s.simulation.ID, s.simulation.TargetID, req.device.model.ID).Add(1)
+	telemetryBatchSendLatency.WithLabelValues(s.simulation.ID, s.simulation.TargetID, req.device.model.ID, string(req.device.transportType)).Observe(latency)
+	telemetryBatchSuccessTotal.WithLabelValues(s.simulation.ID, s.simulation.TargetID, req.device.model.ID, string(req.device.transportType)).Add(1)
 
 	// disconnect device based on the disconnect behavior
 	if s.simulation.DisconnectBehavior == models.DeviceDisconnectAfterTelemetrySend {
@@ -243,38 +274,114 @@ func (s *deviceSimulator) sendTelemetry(req *telemetryRequest) {
 func (s *deviceSimulator) sendTelemetryMessage(msg *telemetryMessage, req *telemetryRequest, wg *sync.WaitGroup) bool {
 	defer wg.Done()
 
+	if !s.sendMessage(req.device.context, req.device, req.device.iotHubClient, msg) {
+		req.fail(msg)
+		return false
+	}
+	return true
+}
+
+// fail records that the device failed to send the given messages of the request, so that they are sent again in a backfill
+// wave. If there are no messages, the telemetry of the wave is generated again as it was not generated.
+func (r *telemetryRequest) fail(messages ...*telemetryMessage) {
+	if r.wave != nil {
+		r.wave.fail(r.device, messages...)
+	}
+}
+
+// sendEvents sends the events and state transitions of the device when they occur, till the device is disconnected.
+// Events occur in real time, so they are not sent when backfilling.
+func (s *deviceSimulator) sendEvents(device *device) {
+	if s.simulation.Backfill != nil {
+		return
+	}
+
+	ctx := device.context
+	client := device.iotHubClient
+	go func() {
+		for {
+			wait, source := device.dataGenerator.NextEvent()
+			if source == nil {
+				return
+			}
+			sleep(ctx, wait)
+			select {
+			case <-ctx.Done():
+				log.Trace().Str("deviceID", device.deviceID).Msg("device events stopped")
+				return
+			default:
+			}
+
+			msg, err := device.dataGenerator.GenerateEventMessage(device, source, time.Now().UTC())
+			if err != nil {
+				log.Error().Err(err).Str("deviceID", device.deviceID).Msg("error generating event")
+				continue
+			}
+			if msg != nil {
+				s.sendMessage(ctx, device, client, msg)
+			}
+		}
+	}()
+}
+
+// sendMessage sends a telemetry message from the device to IoT hub using the given client
+func (s *deviceSimulator) sendMessage(ctx context.Context, device *device, client *iotdevice.Client, msg *telemetryMessage) bool {
+	if err := compressTelemetryMessage(device.simulation.TelemetryEncoding, msg); err != nil {
+		log.Error().Err(err).Str("deviceID", device.deviceID).Msg("error compressing telemetry message")
+		return false
+	}
+
 	start := time.Now()
 	var err error
 	if useMock {
-		randSleep(req.device.context, 500, 5000)
+		randSleep(ctx, device.dataGenerator.behaviorRandom, 500, 5000)
 	} else {
 		// send telemetry to IoT Central
 		log.Trace().Str("payload", string(msg.body)).Int("size", len(msg.body)).Msg("about to send telemetry message")
-		timeoutCtx, _ := context.WithTimeout(req.device.context, time.Millisecond*time.Duration(s.config.TelemetryTimeout))
-		err = req.device.iotHubClient.SendEvent(timeoutCtx, msg.body,
+		props := map[string]string{
+			"iothub-creation-time-utc":    msg.creationTimeUtc.Format("2006-01-02T15:04:05"),
+			"iothub-connection-device-id": msg.connectionDeviceID,
+			"iothub-interface-id":         msg.interfaceId,
+		}
+		if msg.componentName != "" {
+			// IoT Plug and Play component telemetry is identified by the component name system property
+			props["$.sub"] = msg.componentName
+		}
+		// content type and encoding system properties let IoT Hub route on the message body and consumers decode it
+		if msg.contentType != "" {
+			props["$.ct"] = msg.contentType
+		}
+		if msg.contentEncoding != "" {
+			props["$.ce"] = msg.contentEncoding
+		}
+		// application properties let IoT Hub route messages with queries on them; they do not override system properties
+		for name, value := range msg.properties {
+			if _, ok := props[name]; !ok {
+				props[name] = value
+			}
+		}
+		timeoutCtx, cancel := context.WithTimeout(ctx, time.Millisecond*time.Duration(s.config.TelemetryTimeout))
+		defer cancel()
+		err = client.SendEvent(timeoutCtx, msg.body,
 			iotdevice.WithSendCorrelationID(msg.correlationID),
 			iotdevice.WithSendMessageID(msg.messageID),
-			iotdevice.WithSendProperties(map[string]string{
-				"iothub-creation-time-utc":    msg.creationTimeUtc.Format("2006-01-02T15:04:05"),
-				"iothub-connection-device-id": msg.connectionDeviceID,
-				"iothub-interface-id":         msg.interfaceId,
-			}))
+			iotdevice.WithSendProperties(props))
 	}
 	if err != nil {
 		log.Error().
-			Str("deviceID", req.device.deviceID).
+			Str("deviceID", device.deviceID).
 			Err(err).
 			Msg("error sending telemetry to hub")
-		telemetryMessageFailureTotal.WithLabelValues(s.simulation.ID, s.simulation.TargetID, req.device.model.ID, s.getErrorType(err)).Add(1)
-		req.device.retryCount++
+		telemetryMessageFailureTotal.WithLabelValues(s.simulation.ID, s.simulation.TargetID, device.model.ID, string(device.transportType), s.getErrorType(err)).Add(1)
+		device.retryCount++
 		return false
 	} else {
-		req.device.retryCount = 0
-		telemetryMessageSuccessTotal.WithLabelValues(s.simulation.ID, s.simulation.TargetID, req.device.model.ID).Add(1)
+		device.retryCount = 0
+		telemetryMessageSuccessTotal.WithLabelValues(s.simulation.ID, s.simulation.TargetID, device.model.ID, string(device.transportType)).Add(1)
 		latency := float64(time.Now().UnixNano()-start.UnixNano()) / float64(time.Second)
-		telemetryMessageSendLatency.WithLabelValues(s.simulation.ID, s.simulation.TargetID, req.device.model.ID).Observe(latency)
-		telemetrySentBytes.WithLabelValues(s.simulation.ID, s.simulation.TargetID, req.device.model.ID).Add(float64(len(msg.body)))
-		telemetryDataPointsSentTotal.WithLabelValues(s.simulation.ID, s.simulation.TargetID, req.device.model.ID).Add(float64(msg.dataPointCount))
+		telemetryMessageSendLatency.WithLabelValues(s.simulation.ID, s.simulation.TargetID, device.model.ID, string(device.transportType)).Observe(latency)
+		telemetrySentBytes.WithLabelValues(s.simulation.ID, s.simulation.TargetID, device.model.ID, string(device.transportType)).Add(float64(len(msg.body)))
+		telemetryDataPointsSentTotal.WithLabelValues(s.simulation.ID, s.simulation.TargetID, device.model.ID, string(device.transportType)).Add(float64(msg.dataPointCount))
 	}
 	return true
 }
@@ -286,7 +393,7 @@ func (s *deviceSimulator) sendReportedProps(req *reportedPropsRequest) {
 		log.Trace().
 			Str("deviceID", req.device.deviceID).
 			Msg("skipping reported properties as it is already sending one")
-		reportedPropsSkippedTotal.WithLabelValues(s.simulation.ID, s.simulation.TargetID, req.device.model.ID).Add(1)
+		reportedPropsSkippedTotal.WithLabelValues(s.simulation.ID, s.simulation.TargetID, req.device.model.ID, string(req.device.transportType)).Add(1)
 		return
 	}
 
@@ -307,23 +414,29 @@ func (s *deviceSimulator) sendReportedProps(req *reportedPropsRequest) {
 	start := time.Now()
 	reportedProps, err := req.device.dataGenerator.GenerateReportedProperties(req.device)
 	if err != nil {
-		reportedPropsFailureTotal.WithLabelValues(s.simulation.ID, s.simulation.TargetID, req.device.model.ID, s.getErrorType(err)).Add(1)
+		reportedPropsFailureTotal.WithLabelValues(s.simulation.ID, s.simulation.TargetID, req.device.model.ID, string(req.device.transportType), s.getErrorType(err)).Add(1)
 		log.Debug().Err(err).Str("deviceID", req.device.deviceID).Msg("error generating reported property update")
 	}
+	if err == nil && len(reportedProps) == 0 {
+		log.Trace().Str("deviceID", req.device.deviceID).Msg("skipping reported properties as none of them changed")
+		req.device.sendingReportedProps = false
+		return
+	}
 	log.Trace().Str("deviceID", req.device.deviceID).Msg(fmt.Sprintf("about to update reported props: %v", reportedProps))
 
 	// send the reported properties to IoT Central
 	timeoutCtx, _ := context.WithTimeout(req.device.context, time.Millisecond*time.Duration(s.config.TwinUpdateTimeout))
 	_, err = req.device.iotHubClient.UpdateTwinState(timeoutCtx, reportedProps)
 	if err != nil {
-		reportedPropsFailureTotal.WithLabelValues(s.simulation.ID, s.simulation.TargetID, req.device.model.ID, s.getErrorType(err)).Add(1)
+		reportedPropsFailureTotal.WithLabelValues(s.simulation.ID, s.simulation.TargetID, req.device.model.ID, string(req.device.transportType), s.getErrorType(err)).Add(1)
 		log.Debug().Err(err).Str("deviceID", req.device.deviceID).Msg("error sending reported properties update")
+		req.device.dataGenerator.ResetReportedProperties()
 		req.device.retryCount++
 	} else {
 		end := time.Now()
 		latency := float64(end.UnixNano()-start.UnixNano()) / float64(time.Second)
-		reportedPropsSuccessTotal.WithLabelValues(s.simulation.ID, s.simulation.TargetID, req.device.model.ID).Add(1)
-		reportedPropsSendLatency.WithLabelValues(s.simulation.ID, s.simulation.TargetID, req.device.model.ID).Observe(latency)
+		reportedPropsSuccessTotal.WithLabelValues(s.simulation.ID, s.simulation.TargetID, req.device.model.ID, string(req.device.transportType)).Add(1)
+		reportedPropsSendLatency.WithLabelValues(s.simulation.ID, s.simulation.TargetID, req.device.model.ID, string(req.device.transportType)).Observe(latency)
 		log.Trace().
 			Str("deviceID", req.device.deviceID).
 			Float64("latency", latency).
@@ -343,6 +456,14 @@ func (s *deviceSimulator) provisionDevice(device *device, useCache bool) bool {
 		if td != nil {
 			log.Trace().Str("deviceId", device.deviceID).Msg("found device in cache")
 			device.connectionString = td.ConnectionString
+			device.certificate = nil
+			if device.target.AuthType == models.TargetAuthX509 {
+				var err error
+				if device.certificate, err = getDeviceCertificate(device.target, device.deviceID); err != nil {
+					log.Error().Err(err).Str("deviceID", device.deviceID).Msg("error getting device certificate")
+					return false
+				}
+			}
 			return true
 		}
 	}
@@ -357,6 +478,7 @@ func (s *deviceSimulator) provisionDevice(device *device, useCache bool) bool {
 		Target:     device.target,
 		Simulation: s.simulation,
 		Model:      device.model,
+		Payload:    device.provisioningPayload,
 	}
 	result := s.provisioner.Provision(req)
 	if result == nil {
@@ -365,12 +487,14 @@ func (s *deviceSimulator) provisionDevice(device *device, useCache bool) bool {
 		return false
 	}
 	device.connectionString = result.ConnectionString
+	device.certificate = result.Certificate
 
 	// cache the device for future use
 	newDevice := models.SimulationTargetDevice{
 		TargetID:         req.Target.ID,
 		DeviceID:         req.DeviceID,
 		ConnectionString: result.ConnectionString,
+		Payload:          result.Payload,
 	}
 	if err := storing.TargetDevices.Set(&newDevice); err != nil {
 		// remove provisioning throttle
@@ -401,21 +525,18 @@ func (s *deviceSimulator) connectDevice(device *device) bool {
 
 	device.isConnecting = true
 
-	connectTimer := prometheus.NewTimer(deviceConnectLatency.WithLabelValues(s.simulation.ID, s.simulation.TargetID, device.model.ID))
+	connectTimer := prometheus.NewTimer(deviceConnectLatency.WithLabelValues(s.simulation.ID, s.simulation.TargetID, device.model.ID, string(device.transportType)))
 	defer connectTimer.ObserveDuration()
 
 	hub := getHubName(device.connectionString)
 
 	if useMock {
-		randSleep(device.context, 500, 1000)
+		randSleep(device.context, device.dataGenerator.behaviorRandom, 500, 1000)
 	} else {
 		var err error
 
 		// connect the device to IoT Central
-		device.iotHubClient, err = iotdevice.NewFromConnectionString(iotmqtt.New(), device.connectionString,
-			iotdevice.WithLogger(logger.New(logger.LevelDebug, func(lvl logger.Level, s string) {
-				log.Trace().Msg(s)
-			})))
+		err = s.newIotHubClient(device)
 		if err != nil {
 			device.isConnecting = false
 			log.Error().Err(err).Str("deviceID", device.deviceID).Str("connectionString", device.connectionString).Msg("error parsing connection string")
@@ -430,7 +551,7 @@ func (s *deviceSimulator) connectDevice(device *device) bool {
 
 			// device might have moved to a different hub, provision and connect to hub again
 			errMsg := strings.ToLower(err.Error())
-			if errMsg == "not authorized" || errMsg == "server unavailable" || strings.Contains(errMsg, "network error") {
+			if errMsg == "not authorized" || errMsg == "server unavailable" || strings.Contains(errMsg, "network error") || strings.Contains(errMsg, "unauthorized-access") {
 				log.Trace().Str("deviceID", device.deviceID).Msg("detected hub fail over, re-provisioning device")
 
 				if s.provisionDevice(device, false) == false {
@@ -444,16 +565,13 @@ func (s *deviceSimulator) connectDevice(device *device) bool {
 				device.iotHubClient = nil
 
 				hub = getHubName(device.connectionString)
-				device.iotHubClient, _ = iotdevice.NewFromConnectionString(iotmqtt.New(), device.connectionString,
-					iotdevice.WithLogger(logger.New(logger.LevelDebug, func(lvl logger.Level, s string) {
-						log.Trace().Msg(s)
-					})))
+				_ = s.newIotHubClient(device)
 				timeoutCtx, _ := context.WithTimeout(device.context, time.Millisecond*time.Duration(s.config.ConnectionTimeout))
 				if err = device.iotHubClient.Connect(timeoutCtx); err != nil {
 					log.Error().Err(err).Str("deviceID", device.deviceID).Str("connectionString", device.connectionString).Msg("error connecting to IoT Hub")
 					return false
 				}
-				deviceFailoverTotal.WithLabelValues(s.simulation.ID, s.simulation.TargetID, device.model.ID).Inc()
+				deviceFailoverTotal.WithLabelValues(s.simulation.ID, s.simulation.TargetID, device.model.ID, string(device.transportType)).Inc()
 				log.Debug().Str("deviceID", device.deviceID).Msg("detected hub fail over, reconnected to IoT Hub")
 			} else {
 				return false
@@ -461,8 +579,8 @@ func (s *deviceSimulator) connectDevice(device *device) bool {
 		}
 		log.Trace().Err(err).Str("deviceID", device.deviceID).Msg("device connected to IoT Hub")
 
-		// register for twin updates
-		if s.config.EnableTwinUpdateAcks {
+		// register for twin updates, unless the device has no twin over HTTPS
+		if s.config.EnableTwinUpdateAcks && device.transportType != models.DeviceTransportHttp {
 			if s.subscribeTwinUpdates(device) == false {
 				device.isConnecting = false
 				return false
@@ -478,20 +596,51 @@ func (s *deviceSimulator) connectDevice(device *device) bool {
 		}
 	}
 
+	// send events and state transitions as they occur, apart from the periodic telemetry
+	if device.dataGenerator.HasEvents() {
+		s.sendEvents(device)
+	}
+
 	device.isConnected = true
 	device.isConnecting = false
-	connectedDeviceGauge.WithLabelValues(s.simulation.ID, s.simulation.TargetID, device.model.ID, hub).Inc()
+	connectedDeviceGauge.WithLabelValues(s.simulation.ID, s.simulation.TargetID, device.model.ID, string(device.transportType), hub).Inc()
 
 	return true
 }
 
+// newIotHubClient creates the IoT Hub client of the device using its connection string, or its X.509 certificate, over the
+// transport of the device.
+func (s *deviceSimulator) newIotHubClient(device *device) error {
+	switch device.transportType {
+	case models.DeviceTransportMqttWs:
+		device.transport = iotmqtt.New(iotmqtt.WithWebSocket(true))
+	case models.DeviceTransportAmqp:
+		device.transport = newAmqpTransport(false)
+	case models.DeviceTransportAmqpWs:
+		device.transport = newAmqpTransport(true)
+	case models.DeviceTransportHttp:
+		device.transport = newHttpTransport(time.Millisecond * time.Duration(s.config.TelemetryTimeout))
+	default:
+		device.transport = iotmqtt.New()
+	}
+	creds, err := getDeviceCredentials(device)
+	if err != nil {
+		return err
+	}
+	device.iotHubClient, err = iotdevice.New(device.transport, creds,
+		iotdevice.WithLogger(logger.New(logger.LevelDebug, func(lvl logger.Level, s string) {
+			log.Trace().Msg(s)
+		})))
+	return err
+}
+
 // disconnectDevice disconnects a given device from IoT Central
 func (s *deviceSimulator) disconnectDevice(device *device) bool {
 
 	hub := getHubName(device.connectionString)
 
 	if useMock {
-		randSleep(device.context, 500, 1000)
+		randSleep(device.context, device.dataGenerator.behaviorRandom, 500, 1000)
 	} else {
 		if device.iotHubClient != nil {
 			// stop all go functions e.g.: twin update acknowledgements, command acknowledgements
@@ -508,7 +657,12 @@ func (s *deviceSimulator) disconnectDevice(device *device) bool {
 			}
 
 			_ = device.iotHubClient.Close()
+			if device.c2dClient != nil {
+				device.c2dClient.close()
+			}
 			device.iotHubClient = nil
+			device.transport = nil
+			device.c2dClient = nil
 			device.context, device.cancel = context.WithCancel(s.context)
 
 		}
@@ -519,7 +673,7 @@ func (s *deviceSimulator) disconnectDevice(device *device) bool {
 	// we reuse the connection string until we get a failure
 
 	if device.isConnected {
-		connectedDeviceGauge.WithLabelValues(s.simulation.ID, s.simulation.TargetID, device.model.ID, hub).Dec()
+		connectedDeviceGauge.WithLabelValues(s.simulation.ID, s.simulation.TargetID, device.model.ID, string(device.transportType), hub).Dec()
 	}
 	device.isConnected = false
 
@@ -537,10 +691,12 @@ func (s *deviceSimulator) subscribeTwinUpdates(device *device) bool {
 		return false
 	}
 
+	ctx := device.context
+	client := device.iotHubClient
 	go func() {
 		for {
 			select {
-			case <-device.context.Done():
+			case <-ctx.Done():
 				log.Trace().Str("deviceID", device.deviceID).Msg("device twin subscription stopped")
 				return
 			case desiredTwin := <-device.twinSub.C():
@@ -549,25 +705,22 @@ func (s *deviceSimulator) subscribeTwinUpdates(device *device) bool {
 					Str("desiredTwin", fmt.Sprintf("%s", dt)).
 					Msg("got twin update")
 
-				// acknowledge twin update by echoing reported properties
-				reportedTwin := device.dataGenerator.GenerateTwinUpdateAck(desiredTwin)
-				start := time.Now()
-				timeoutCtx, _ := context.WithTimeout(device.context, time.Millisecond*time.Duration(s.config.TwinUpdateTimeout))
-				_, err := device.iotHubClient.UpdateTwinState(timeoutCtx, reportedTwin)
-				end := time.Now()
-				latency := float64(end.UnixNano()-start.UnixNano()) / float64(time.Second)
+				// let the device state machine and script react to the desired properties
+				device.dataGenerator.HandleDesiredProperties(desiredTwin)
 
-				if err != nil {
-					twinUpdateFailureTotal.WithLabelValues(s.simulation.ID, s.simulation.TargetID, device.model.ID, s.getErrorType(err)).Add(1)
-					log.Err(err).Str("deviceID", device.deviceID).Msg("twin update failed")
-				} else {
-					twinUpdateSendLatency.WithLabelValues(s.simulation.ID, s.simulation.TargetID, device.model.ID).Observe(latency)
-					twinUpdateSuccessTotal.WithLabelValues(s.simulation.ID, s.simulation.TargetID, device.model.ID).Add(1)
-					rt, _ := json.Marshal(reportedTwin)
-					log.Trace().Str("deviceID", device.deviceID).
-						//Int("reportedVersion", reportedVersion).
-						Str("reportedProperties", fmt.Sprintf("%s", rt)).
-						Msg("acknowledged twin update")
+				// acknowledge twin update by echoing reported properties, some of the ACKs may be delayed
+				for _, ack := range device.dataGenerator.GenerateTwinUpdateAck(desiredTwin) {
+					if ack.delay == 0 {
+						s.sendTwinUpdateAck(ctx, device, client, ack.reported)
+						continue
+					}
+
+					go func(ack *twinUpdateAck) {
+						sleep(ctx, ack.delay)
+						if ctx.Err() == nil {
+							s.sendTwinUpdateAck(ctx, device, client, ack.reported)
+						}
+					}(ack)
 				}
 			}
 		}
@@ -576,6 +729,29 @@ func (s *deviceSimulator) subscribeTwinUpdates(device *device) bool {
 	return true
 }
 
+// sendTwinUpdateAck sends reported properties acknowledging a twin update (desired properties) for a given device
+func (s *deviceSimulator) sendTwinUpdateAck(ctx context.Context, device *device, client *iotdevice.Client, reportedTwin iotdevice.TwinState) {
+	start := time.Now()
+	timeoutCtx, cancel := context.WithTimeout(ctx, time.Millisecond*time.Duration(s.config.TwinUpdateTimeout))
+	defer cancel()
+	_, err := client.UpdateTwinState(timeoutCtx, reportedTwin)
+	end := time.Now()
+	latency := float64(end.UnixNano()-start.UnixNano()) / float64(time.Second)
+
+	if err != nil {
+		twinUpdateFailureTotal.WithLabelValues(s.simulation.ID, s.simulation.TargetID, device.model.ID, string(device.transportType), s.getErrorType(err)).Add(1)
+		log.Err(err).Str("deviceID", device.deviceID).Msg("twin update failed")
+	} else {
+		twinUpdateSendLatency.WithLabelValues(s.simulation.ID, s.simulation.TargetID, device.model.ID, string(device.transportType)).Observe(latency)
+		twinUpdateSuccessTotal.WithLabelValues(s.simulation.ID, s.simulation.TargetID, device.model.ID, string(device.transportType)).Add(1)
+		rt, _ := json.Marshal(reportedTwin)
+		log.Trace().Str("deviceID", device.deviceID).
+			//Int("reportedVersion", reportedVersion).
+			Str("reportedProperties", fmt.Sprintf("%s", rt)).
+			Msg("acknowledged twin update")
+	}
+}
+
 // unsubscribeTwinUpdates unsubscribe from twin updates for a given device
 func (s *deviceSimulator) unsubscribeTwinUpdates(device *device) bool {
 	if device.twinSub != nil {
@@ -588,31 +764,35 @@ func (s *deviceSimulator) unsubscribeTwinUpdates(device *device) bool {
 func (s *deviceSimulator) subscribeCommands(device *device) bool {
 	// register for (Sync) Direct Methods
 	hasAsyncCommands := false
+	dispatcher := newDirectMethodDispatcher(s, device)
 	for _, component := range device.dataGenerator.CapabilityModel.Components {
 		for _, command := range component.Commands {
 			if command.IsSync {
-				timeoutCtx, _ := context.WithTimeout(device.context, time.Millisecond*time.Duration(s.config.CommandTimeout))
-				err := device.iotHubClient.RegisterMethod(timeoutCtx, command.Name, func(p map[string]interface{}) (map[string]interface{}, error) {
-					// acknowledge the c2d command by a reply
-					// TODO: need to figure out how to respond with proper return types based on the DCM
-					resp := make(map[string]interface{})
-					commandsSuccessTotal.WithLabelValues(s.simulation.ID, s.simulation.TargetID, device.model.ID).Add(1)
-					log.Trace().Str("deviceID", device.deviceID).Str("Method", command.Name).Msg("direct method acknowledged")
-					return resp, nil
-				})
-
-				if err != nil {
-					log.Err(err).Str("deviceID", device.deviceID).Str("Method", command.Name).Msg("failed to register direct method")
-					return false
-				}
+				dispatcher.handle(component, command)
 			} else {
 				hasAsyncCommands = true
 			}
 		}
 	}
 
+	if len(dispatcher.methods) > 0 && device.transportType == models.DeviceTransportHttp {
+		log.Warn().Str("deviceID", device.deviceID).Msg("direct methods are not available over the HTTPS device API")
+	} else if len(dispatcher.methods) > 0 {
+		// the transport sends the responses of direct methods with the context of the registration
+		if err := device.transport.RegisterDirectMethods(device.context, dispatcher); err != nil {
+			log.Err(err).Str("deviceID", device.deviceID).Msg("failed to register direct methods")
+			return false
+		}
+	}
+
 	// register for C2D (Async) Commands
 	if hasAsyncCommands {
+		// c2d commands received over MQTT are completed on delivery, so receive them over HTTPS to settle them explicitly;
+		// devices without a connection always poll them
+		if device.dataGenerator.HasC2DBehaviors() || device.transportType == models.DeviceTransportHttp {
+			return s.pollC2DCommands(device)
+		}
+
 		var err error
 		timeoutCtx, _ := context.WithTimeout(device.context, time.Millisecond*time.Duration(s.config.CommandTimeout))
 		device.c2dSub, err = device.iotHubClient.SubscribeEvents(timeoutCtx)
@@ -620,19 +800,20 @@ func (s *deviceSimulator) subscribeCommands(device *device) bool {
 			log.Err(err).Str("deviceID", device.deviceID).Msg("c2d command subscription failed")
 			return false
 		}
+		ctx := device.context
 		go func() {
 			for {
 				select {
-				case <-device.context.Done():
+				case <-ctx.Done():
 					log.Trace().Str("deviceID", device.deviceID).Msg("c2d subscription stopped")
 					return
 				case msg := <-device.c2dSub.C():
 					if msg != nil {
 						log.Trace().Str("msg", string(msg.Properties["method-name"])).Str("msg", fmt.Sprintf("%v", msg)).Msg("received c2d command")
-						commandsSuccessTotal.WithLabelValues(s.simulation.ID, s.simulation.TargetID, device.model.ID).Add(1)
+						commandsSuccessTotal.WithLabelValues(s.simulation.ID, s.simulation.TargetID, device.model.ID, string(device.transportType)).Add(1)
 
 						// send ack to c2d command
-						//s.sendC2DAck(device, msg)
+						go s.sendC2DAck(ctx, nil, device, msg, "")
 					}
 				}
 			}
@@ -641,23 +822,95 @@ func (s *deviceSimulator) subscribeCommands(device *device) bool {
 	return true
 }
 
-func (s *deviceSimulator) sendC2DAck(device *device, msg *common.Message) {
-	//log.Debug().Str("msg", string(msg.Properties["method-name"])).Msg("received c2d command")
+// pollC2DCommands polls c2d command requests over HTTPS for a given device
+func (s *deviceSimulator) pollC2DCommands(device *device) bool {
+	creds, err := getDeviceCredentials(device)
+	if err != nil {
+		log.Err(err).Str("deviceID", device.deviceID).Msg("c2d command subscription failed")
+		return false
+	}
+	device.c2dClient = newHttpDeviceClient(creds, time.Millisecond*time.Duration(s.config.CommandTimeout))
+
+	interval := device.pollInterval
+	if interval <= 0 {
+		interval = time.Millisecond * time.Duration(s.config.C2DPollInterval)
+	}
+
+	ctx := device.context
+	client := device.c2dClient
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				log.Trace().Str("deviceID", device.deviceID).Msg("c2d polling stopped")
+				return
+			default:
+				msg, lockToken, err := client.receive(ctx)
+				if err != nil {
+					log.Err(err).Str("deviceID", device.deviceID).Msg("c2d command receive failed")
+				}
+				if msg == nil {
+					sleep(ctx, interval)
+					continue
+				}
+
+				log.Trace().Str("msg", string(msg.Properties["method-name"])).Str("msg", fmt.Sprintf("%v", msg)).Msg("received c2d command")
+				commandsSuccessTotal.WithLabelValues(s.simulation.ID, s.simulation.TargetID, device.model.ID, string(device.transportType)).Add(1)
+				go s.sendC2DAck(ctx, client, device, msg, lockToken)
+			}
+		}
+	}()
+	return true
 }
 
-// unsubscribeCommands unsubscribe from c2d command requests for a given device
-func (s *deviceSimulator) unsubscribeCommands(device *device) bool {
-	for _, component := range device.dataGenerator.CapabilityModel.Components {
-		for _, command := range component.Commands {
-			device.iotHubClient.UnregisterMethod(command.Name)
+// sendC2DAck settles a c2d command after its processing delay based on the command behavior.
+// Messages received without a lock token (over MQTT) are completed on delivery and cannot be settled.
+// The command is settled with the client that received it, and not at all once the device disconnected.
+// Commands are acknowledged on their own goroutine, so that slow commands do not hold the following ones, and their delay
+// is capped so that they are settled before the lock of the message expires and IoT Hub delivers it again.
+func (s *deviceSimulator) sendC2DAck(ctx context.Context, client *httpDeviceClient, device *device, msg *common.Message, lockToken string) {
+	if comp, command := device.dataGenerator.CapabilityModel.FindCommand(msg.Properties["method-name"]); command != nil {
+		delay := device.dataGenerator.GetCommandDelay(comp, command)
+		if lockToken != "" && delay > c2dMaxSettleDelay {
+			log.Debug().Str("deviceID", device.deviceID).Dur("delay", delay).Msg("c2d command delay capped below the lock timeout")
+			delay = c2dMaxSettleDelay
 		}
+		sleep(ctx, delay)
+	}
+	if ctx.Err() != nil {
+		log.Trace().Str("deviceID", device.deviceID).Msg("c2d command not settled, device disconnected")
+		return
 	}
+
+	outcome := device.dataGenerator.GenerateC2DAck(msg)
+	if lockToken == "" {
+		outcome = models.C2DOutcomeComplete
+	} else if err := client.settle(ctx, lockToken, outcome); err != nil {
+		commandsFailureTotal.WithLabelValues(s.simulation.ID, s.simulation.TargetID, device.model.ID, string(device.transportType)).Add(1)
+		log.Err(err).Str("deviceID", device.deviceID).Str("outcome", string(outcome)).Msg("c2d command settlement failed")
+		return
+	}
+
+	switch outcome {
+	case models.C2DOutcomeReject:
+		commandsRejectedTotal.WithLabelValues(s.simulation.ID, s.simulation.TargetID, device.model.ID, string(device.transportType)).Add(1)
+	case models.C2DOutcomeAbandon:
+		commandsAbandonedTotal.WithLabelValues(s.simulation.ID, s.simulation.TargetID, device.model.ID, string(device.transportType)).Add(1)
+	default:
+		commandsCompletedTotal.WithLabelValues(s.simulation.ID, s.simulation.TargetID, device.model.ID, string(device.transportType)).Add(1)
+	}
+	log.Trace().Str("deviceID", device.deviceID).Str("outcome", string(outcome)).Msg("c2d command settled")
+}
+
+// unsubscribeCommands unsubscribe from c2d command requests for a given device
+func (s *deviceSimulator) unsubscribeCommands(device *device) bool {
+	// direct methods are dispatched by the device until its connection is closed
 	return true
 }
 
-// getNextTelemetryBatch creates a batch of telemetry messages evenly distributed since last time telemetry was sent
-func (s *deviceSimulator) getNextTelemetryBatch(device *device) *telemetryBatch {
-	now := time.Now().UTC()
+// getNextTelemetryBatch creates a batch of telemetry messages evenly distributed since last time telemetry was sent,
+// up to the given real or virtual time.
+func (s *deviceSimulator) getNextTelemetryBatch(device *device, now time.Time) *telemetryBatch {
 	batchSize := s.simulation.TelemetryBatchSize
 	var batch telemetryBatch
 
@@ -670,9 +923,18 @@ func (s *deviceSimulator) getNextTelemetryBatch(device *device) *telemetryBatch
 		multiplier = ((interval - 1) * 1000) / batchSize
 	}
 
-	for i := 0; i < batchSize; i++ {
+	replayer := device.dataGenerator.replayer
+	if replayer != nil {
+		return s.getNextReplayedTelemetryBatch(device, now, multiplier)
+	}
+
+	// generate the messages in chronological order, so that telemetry with its own interval is included when it is due
+	for i := batchSize - 1; i >= 0; i-- {
 		creationTime := now.Add(time.Millisecond * time.Duration(-(i * multiplier))) // distribute the messages in the batch evenly
-		messages, err := device.dataGenerator.GenerateTelemetryMessage(device, creationTime)
+		if s.isBeforeBackfill(creationTime) {
+			continue
+		}
+		messages, err := device.dataGenerator.GenerateTelemetryMessage(device, creationTime, nil)
 		if err != nil {
 			log.Error().Err(err).Msg("error generating telemetry messages")
 		} else {
@@ -683,6 +945,57 @@ func (s *deviceSimulator) getNextTelemetryBatch(device *device) *telemetryBatch
 	return &batch
 }
 
+// getNextReplayedTelemetryBatch creates a batch of telemetry messages from the next rows of the recording replayed by the device.
+// Timestamped recordings send all the rows that are due by now, otherwise each message of the batch replays the next row.
+func (s *deviceSimulator) getNextReplayedTelemetryBatch(device *device, now time.Time, multiplier int) *telemetryBatch {
+	var batch telemetryBatch
+	replayer := device.dataGenerator.replayer
+
+	var rows []*replayedRow
+	if replayer.recording.timed {
+		rows = replayer.nextTimedRows(now)
+	} else {
+		batchSize := s.simulation.TelemetryBatchSize
+		for i := batchSize - 1; i >= 0; i-- {
+			creationTime := now.Add(time.Millisecond * time.Duration(-(i * multiplier))) // keep the recorded order of the rows
+			if s.isBeforeBackfill(creationTime) {
+				continue
+			}
+			values, ok := replayer.nextRow()
+			if !ok {
+				break
+			}
+			rows = append(rows, &replayedRow{
+				creationTime: creationTime,
+				values:       values,
+			})
+		}
+	}
+
+	if len(rows) == 0 && replayer.done() {
+		log.Trace().
+			Str("deviceID", device.deviceID).
+			Msg("replay of recorded telemetry completed")
+	}
+
+	for _, row := range rows {
+		messages, err := device.dataGenerator.GenerateTelemetryMessage(device, row.creationTime, row.values)
+		if err != nil {
+			log.Error().Err(err).Msg("error generating telemetry messages")
+		} else {
+			batch.messages = append(batch.messages, messages...)
+		}
+	}
+
+	return &batch
+}
+
+// isBeforeBackfill checks whether a creation time is before the start of the backfill, so that the first batch of a
+// backfill, sent at its start, has no messages created before it.
+func (s *deviceSimulator) isBeforeBackfill(t time.Time) bool {
+	return s.simulation.Backfill != nil && t.Before(s.simulation.Backfill.Start)
+}
+
 // getErrorType groups the error messages into meaningful errors for metrics
 func (s *deviceSimulator) getErrorType(err error) string {
 	errMsg := "error"
@@ -705,6 +1018,28 @@ func (s *deviceSimulator) getErrorType(err error) string {
 	return reflect.TypeOf(err).String()
 }
 
+// getScriptCommandName gets the name of a command passed to the device script; commands of a component are named component.command.
+func getScriptCommandName(methodName string) string {
+	return strings.Replace(methodName, "*", ".", 1)
+}
+
+// getDeviceCredentials gets the credentials of a device from its connection string, and its X.509 certificate if it has one.
+func getDeviceCredentials(device *device) (transport.Credentials, error) {
+	if device.certificate == nil {
+		return iotdevice.ParseConnectionString(device.connectionString)
+	}
+
+	cs, err := common.ParseConnectionString(device.connectionString, "HostName", "DeviceId")
+	if err != nil {
+		return nil, err
+	}
+	return &iotdevice.X509Credentials{
+		HostName:    cs["HostName"],
+		DeviceID:    cs["DeviceId"],
+		Certificate: device.certificate,
+	}, nil
+}
+
 func getHubName(connectionString string) string {
 	pairs := strings.Split(connectionString, ";")
 	for _, pair := range pairs {
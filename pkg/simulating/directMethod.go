@@ -0,0 +1,91 @@
+package simulating
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/iot-for-all/starling/pkg/models"
+	"github.com/rs/zerolog/log"
+)
+
+type (
+	// directMethodDispatcher dispatches the direct methods invoked on a device to its synchronous commands.
+	// Unlike the dispatcher of the IoT Hub client, it can respond with any status code and JSON payload.
+	directMethodDispatcher struct {
+		simulator *deviceSimulator         // the simulator of the device.
+		device    *device                  // the device on which the methods are invoked.
+		methods   map[string]*directMethod // commands by method name.
+	}
+
+	// directMethod represents a synchronous command of a component invoked as a direct method.
+	directMethod struct {
+		component *models.Component   // the component of the command.
+		command   *models.CommandType // the command.
+	}
+)
+
+const (
+	// directMethodResponseTimeout is the default time IoT Hub waits for the response of a direct method.
+	directMethodResponseTimeout = 30 * time.Second
+	// directMethodMaxDelay is the maximum processing delay of direct methods, leaving time to respond before they time out.
+	directMethodMaxDelay = directMethodResponseTimeout - 5*time.Second
+)
+
+// newDirectMethodDispatcher creates a direct method dispatcher for a device.
+func newDirectMethodDispatcher(simulator *deviceSimulator, device *device) *directMethodDispatcher {
+	return &directMethodDispatcher{
+		simulator: simulator,
+		device:    device,
+		methods:   make(map[string]*directMethod),
+	}
+}
+
+// handle registers a command of a component to be dispatched.
+func (d *directMethodDispatcher) handle(component *models.Component, command *models.CommandType) {
+	d.methods[component.CommandName(command)] = &directMethod{
+		component: component,
+		command:   command,
+	}
+}
+
+// Dispatch responds to a direct method invoked on the device, after the processing delay of the command.
+// The transport responds with the result of Dispatch, so the delay holds the callback of the transport: over MQTT, the
+// other messages received by the device wait for it. The delay is capped below the response timeout of direct methods.
+func (d *directMethodDispatcher) Dispatch(methodName string, b []byte) (int, []byte, error) {
+	s := d.simulator
+	device := d.device
+	method, ok := d.methods[methodName]
+	if !ok {
+		log.Trace().Str("deviceID", device.deviceID).Str("Method", methodName).Msg("unknown direct method invoked")
+		return 404, []byte(fmt.Sprintf(`{"error":%q}`, "method "+methodName+" is not implemented")), nil
+	}
+
+	var payload interface{}
+	if len(b) > 0 {
+		if err := json.Unmarshal(b, &payload); err != nil {
+			payload = string(b)
+		}
+	}
+
+	delay := device.dataGenerator.GetCommandDelay(method.component, method.command)
+	if delay > directMethodMaxDelay {
+		log.Debug().Str("deviceID", device.deviceID).Str("Method", methodName).Dur("delay", delay).Msg("direct method delay capped below the response timeout")
+		delay = directMethodMaxDelay
+	}
+	sleep(device.context, delay)
+	status, resp := device.dataGenerator.GenerateCommandResponse(method.component, method.command, payload)
+	body, err := json.Marshal(resp)
+	if err != nil {
+		status = 500
+		body = []byte(fmt.Sprintf(`{"error":%q}`, err.Error()))
+	}
+
+	if status >= 200 && status < 300 {
+		commandsSuccessTotal.WithLabelValues(s.simulation.ID, s.simulation.TargetID, device.model.ID, string(device.transportType)).Add(1)
+	} else {
+		commandsFailureTotal.WithLabelValues(s.simulation.ID, s.simulation.TargetID, device.model.ID, string(device.transportType)).Add(1)
+	}
+	log.Trace().Str("deviceID", device.deviceID).Str("Method", methodName).Int("status", status).Msg("direct method acknowledged")
+	return status, body, nil
+}
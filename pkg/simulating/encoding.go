@@ -0,0 +1,303 @@
+package simulating
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/iot-for-all/starling/pkg/models"
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const (
+	// contentTypeJson is the content type of JSON telemetry messages.
+	contentTypeJson = "application/json"
+	// contentTypeCbor is the content type of CBOR telemetry messages.
+	contentTypeCbor = "application/cbor"
+	// contentTypeMsgpack is the content type of MessagePack telemetry messages.
+	contentTypeMsgpack = "application/x-msgpack"
+	// contentTypeProtobuf is the content type of Protobuf telemetry messages.
+	contentTypeProtobuf = "application/x-protobuf"
+	// contentEncodingUtf8 is the content encoding of uncompressed JSON telemetry messages.
+	contentEncodingUtf8 = "utf-8"
+)
+
+// encodeTelemetry encodes the values of a telemetry message of the root interface, or of a component, in the telemetry
+// format of the simulation. Protobuf messages only contain the telemetry declared in the device model.
+func (d *DataGenerator) encodeTelemetry(device *device, componentName string, values map[string]interface{}) ([]byte, error) {
+	switch device.simulation.TelemetryFormat {
+	case models.TelemetryFormatCbor:
+		return cbor.Marshal(values)
+	case models.TelemetryFormatMsgpack:
+		return msgpack.Marshal(values)
+	case models.TelemetryFormatProtobuf:
+		return appendProtoMessage(nil, d.CapabilityModel.TelemetryFields(componentName), values), nil
+	default:
+		return json.Marshal(values)
+	}
+}
+
+// getContentType gets the content type and the content encoding of uncompressed telemetry messages in the given format.
+func getContentType(format models.TelemetryFormat) (string, string) {
+	switch format {
+	case models.TelemetryFormatCbor:
+		return contentTypeCbor, ""
+	case models.TelemetryFormatMsgpack:
+		return contentTypeMsgpack, ""
+	case models.TelemetryFormatProtobuf:
+		return contentTypeProtobuf, ""
+	default:
+		return contentTypeJson, contentEncodingUtf8
+	}
+}
+
+// packRecords packs encoded telemetry records into the body of a single message in the given format.
+// Records are packed as they were encoded, so that malformed records remain malformed.
+func packRecords(format models.TelemetryFormat, packing models.TelemetryPacking, records []*telemetryMessage) ([]byte, error) {
+	switch format {
+	case models.TelemetryFormatCbor:
+		return packRawRecords(packing, records, cbor.Marshal, func(body []byte) interface{} { return cbor.RawMessage(body) })
+	case models.TelemetryFormatMsgpack:
+		return packRawRecords(packing, records, msgpack.Marshal, func(body []byte) interface{} { return msgpack.RawMessage(body) })
+	case models.TelemetryFormatProtobuf:
+		return packProtoRecords(packing, records), nil
+	default:
+		return packJsonRecords(packing, records), nil
+	}
+}
+
+// packJsonRecords packs JSON records into a JSON array, or an envelope with their timestamps.
+func packJsonRecords(packing models.TelemetryPacking, records []*telemetryMessage) []byte {
+	var body bytes.Buffer
+	if packing == models.TelemetryPackingEnvelope {
+		body.WriteString(`{"records":`)
+	}
+	body.WriteString("[")
+	for i, record := range records {
+		if i > 0 {
+			body.WriteString(",")
+		}
+		if packing == models.TelemetryPackingEnvelope {
+			body.WriteString(fmt.Sprintf(`{"timestamp":"%s","values":%s}`, getRecordTimestamp(record), record.body))
+		} else {
+			body.Write(record.body)
+		}
+	}
+	body.WriteString("]")
+	if packing == models.TelemetryPackingEnvelope {
+		body.WriteString("}")
+	}
+	return body.Bytes()
+}
+
+// packRawRecords packs CBOR or MessagePack records into an array, or an envelope with their timestamps.
+func packRawRecords(packing models.TelemetryPacking, records []*telemetryMessage, marshal func(interface{}) ([]byte, error), raw func([]byte) interface{}) ([]byte, error) {
+	packed := make([]interface{}, 0, len(records))
+	for _, record := range records {
+		if packing == models.TelemetryPackingEnvelope {
+			packed = append(packed, map[string]interface{}{
+				"timestamp": getRecordTimestamp(record),
+				"values":    raw(record.body),
+			})
+		} else {
+			packed = append(packed, raw(record.body))
+		}
+	}
+
+	if packing == models.TelemetryPackingEnvelope {
+		return marshal(map[string]interface{}{
+			"records": packed,
+		})
+	}
+	return marshal(packed)
+}
+
+// packProtoRecords packs Protobuf records into the array or envelope message of their telemetry message.
+func packProtoRecords(packing models.TelemetryPacking, records []*telemetryMessage) []byte {
+	var body []byte
+	for _, record := range records {
+		value := record.body
+		if packing == models.TelemetryPackingEnvelope {
+			value = protowire.AppendTag(nil, models.ProtoTimestampField, protowire.BytesType)
+			value = protowire.AppendString(value, getRecordTimestamp(record))
+			value = protowire.AppendTag(value, models.ProtoRecordValuesField, protowire.BytesType)
+			value = protowire.AppendBytes(value, record.body)
+		}
+		body = protowire.AppendTag(body, models.ProtoRecordsField, protowire.BytesType)
+		body = protowire.AppendBytes(body, value)
+	}
+	return body
+}
+
+// getRecordTimestamp gets the timestamp of a record of a telemetry envelope.
+func getRecordTimestamp(record *telemetryMessage) string {
+	return record.creationTimeUtc.UTC().Format(time.RFC3339Nano)
+}
+
+// compressTelemetryMessage compresses the body of a telemetry message with the telemetry encoding of the simulation.
+func compressTelemetryMessage(encoding models.TelemetryEncoding, msg *telemetryMessage) error {
+	if encoding != models.TelemetryEncodingGzip && encoding != models.TelemetryEncodingDeflate {
+		return nil
+	}
+
+	var body bytes.Buffer
+	var err error
+	if encoding == models.TelemetryEncodingGzip {
+		w := gzip.NewWriter(&body)
+		if _, err = w.Write(msg.body); err == nil {
+			err = w.Close()
+		}
+	} else {
+		var w *flate.Writer
+		if w, err = flate.NewWriter(&body, flate.DefaultCompression); err == nil {
+			if _, err = w.Write(msg.body); err == nil {
+				err = w.Close()
+			}
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	msg.body = body.Bytes()
+	msg.contentEncoding = string(encoding)
+	return nil
+}
+
+// appendProtoMessage appends the fields of a Protobuf message with the given values, numbered in the order of the fields.
+// Values missing from the message or that cannot be converted to the schema of their field are skipped.
+func appendProtoMessage(b []byte, fields []*models.SchemaField, values map[string]interface{}) []byte {
+	for i, field := range fields {
+		if value, ok := values[field.Name]; ok && value != nil {
+			b = appendProtoField(b, protowire.Number(i+1), field.Schema, value)
+		}
+	}
+	return b
+}
+
+// appendProtoField appends a field of a Protobuf message with a value of the given schema.
+func appendProtoField(b []byte, num protowire.Number, schema *models.Schema, value interface{}) []byte {
+	if schema == nil {
+		return appendProtoString(b, num, value)
+	}
+
+	switch schema.Type {
+	case "boolean":
+		if v, ok := value.(bool); ok {
+			b = protowire.AppendTag(b, num, protowire.VarintType)
+			b = protowire.AppendVarint(b, protowire.EncodeBool(v))
+		}
+	case "double":
+		if v, ok := getProtoNumber(value); ok {
+			b = protowire.AppendTag(b, num, protowire.Fixed64Type)
+			b = protowire.AppendFixed64(b, math.Float64bits(v))
+		}
+	case "float":
+		if v, ok := getProtoNumber(value); ok {
+			b = protowire.AppendTag(b, num, protowire.Fixed32Type)
+			b = protowire.AppendFixed32(b, math.Float32bits(float32(v)))
+		}
+	case "integer":
+		if v, ok := getProtoInteger(value); ok {
+			b = protowire.AppendTag(b, num, protowire.VarintType)
+			b = protowire.AppendVarint(b, uint64(int64(int32(v))))
+		}
+	case "long":
+		if v, ok := getProtoInteger(value); ok {
+			b = protowire.AppendTag(b, num, protowire.VarintType)
+			b = protowire.AppendVarint(b, uint64(v))
+		}
+	case models.SchemaTypeEnum:
+		if schema.ValueSchema == "integer" {
+			return appendProtoField(b, num, &models.Schema{Type: "integer"}, value)
+		}
+		return appendProtoString(b, num, value)
+	case models.SchemaTypeObject, "geopoint", "vector":
+		if v, ok := value.(map[string]interface{}); ok {
+			b = protowire.AppendTag(b, num, protowire.BytesType)
+			b = protowire.AppendBytes(b, appendProtoMessage(nil, models.GetProtoFields(schema), v))
+		}
+	case models.SchemaTypeArray:
+		if v, ok := value.([]interface{}); ok {
+			for _, element := range v {
+				b = appendProtoElement(b, num, schema.ElementSchema, element)
+			}
+		}
+	case models.SchemaTypeMap:
+		if v, ok := value.(map[string]interface{}); ok {
+			var valueSchema *models.Schema
+			if schema.MapValue != nil {
+				valueSchema = schema.MapValue.Schema
+			}
+			for key, mapValue := range v {
+				entry := appendProtoString(nil, models.ProtoMapKeyField, key)
+				entry = appendProtoElement(entry, models.ProtoMapValueField, valueSchema, mapValue)
+				b = protowire.AppendTag(b, num, protowire.BytesType)
+				b = protowire.AppendBytes(b, entry)
+			}
+		}
+	default:
+		return appendProtoString(b, num, value)
+	}
+	return b
+}
+
+// appendProtoElement appends an element of an array or a value of a map, wrapping nested arrays and maps in a message.
+func appendProtoElement(b []byte, num protowire.Number, schema *models.Schema, value interface{}) []byte {
+	if !models.IsProtoWrapped(schema) {
+		return appendProtoField(b, num, schema, value)
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, appendProtoField(nil, models.ProtoValuesField, schema, value))
+}
+
+// appendProtoString appends a string field of a Protobuf message.
+func appendProtoString(b []byte, num protowire.Number, value interface{}) []byte {
+	v, ok := value.(string)
+	if !ok {
+		v = fmt.Sprintf("%v", value)
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, v)
+}
+
+// getProtoNumber gets the value of a numeric field, converting numbers in strings.
+func getProtoNumber(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case float32:
+		return float64(v), true
+	case int:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case string:
+		f, err := strconv.ParseFloat(v, 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// getProtoInteger gets the value of an integer field, keeping the precision of integer values.
+func getProtoInteger(value interface{}) (int64, bool) {
+	switch v := value.(type) {
+	case int:
+		return int64(v), true
+	case int32:
+		return int64(v), true
+	case int64:
+		return v, true
+	}
+	f, ok := getProtoNumber(value)
+	return int64(f), ok
+}
@@ -0,0 +1,295 @@
+package simulating
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/iot-for-all/starling/pkg/models"
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func TestAppendProtoField(t *testing.T) {
+	integer := &models.Schema{Type: "integer"}
+
+	tests := []struct {
+		name   string
+		schema *models.Schema
+		value  interface{}
+		want   []byte
+	}{
+		{name: "boolean", schema: &models.Schema{Type: "boolean"}, value: true, want: []byte{0x08, 0x01}},
+		{name: "invalid boolean", schema: &models.Schema{Type: "boolean"}, value: "true", want: nil},
+		{name: "double", schema: &models.Schema{Type: "double"}, value: 1.5, want: []byte{0x09, 0, 0, 0, 0, 0, 0, 0xf8, 0x3f}},
+		{name: "double in a string", schema: &models.Schema{Type: "double"}, value: "1.5", want: []byte{0x09, 0, 0, 0, 0, 0, 0, 0xf8, 0x3f}},
+		{name: "float", schema: &models.Schema{Type: "float"}, value: 1.5, want: []byte{0x0d, 0, 0, 0xc0, 0x3f}},
+		{name: "integer", schema: integer, value: int64(300), want: []byte{0x08, 0xac, 0x02}},
+		{name: "negative integer", schema: integer, value: -1, want: []byte{0x08, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01}},
+		{name: "integer truncated to 32 bits", schema: integer, value: int64(1<<32 + 5), want: []byte{0x08, 0x05}},
+		{name: "long", schema: &models.Schema{Type: "long"}, value: int64(1 << 32), want: []byte{0x08, 0x80, 0x80, 0x80, 0x80, 0x10}},
+		{name: "string", schema: &models.Schema{Type: "string"}, value: "ab", want: []byte{0x0a, 0x02, 'a', 'b'}},
+		{name: "no schema", schema: nil, value: 5, want: []byte{0x0a, 0x01, '5'}},
+		{name: "integer enum", schema: &models.Schema{Type: models.SchemaTypeEnum, ValueSchema: "integer"}, value: 2, want: []byte{0x08, 0x02}},
+		{name: "string enum", schema: &models.Schema{Type: models.SchemaTypeEnum, ValueSchema: "string"}, value: "on", want: []byte{0x0a, 0x02, 'o', 'n'}},
+		{
+			name:   "object",
+			schema: &models.Schema{Type: models.SchemaTypeObject, Fields: []*models.SchemaField{{Name: "a", Schema: integer}, {Name: "b", Schema: integer}}},
+			value:  map[string]interface{}{"b": 1},
+			want:   []byte{0x0a, 0x02, 0x10, 0x01},
+		},
+		{
+			name:   "geopoint",
+			schema: &models.Schema{Type: "geopoint"},
+			value:  map[string]interface{}{"lat": 1.0},
+			want:   []byte{0x0a, 0x09, 0x09, 0, 0, 0, 0, 0, 0, 0xf0, 0x3f},
+		},
+		{
+			name:   "array",
+			schema: &models.Schema{Type: models.SchemaTypeArray, ElementSchema: integer},
+			value:  []interface{}{1, 2},
+			want:   []byte{0x08, 0x01, 0x08, 0x02},
+		},
+		{
+			name:   "nested array",
+			schema: &models.Schema{Type: models.SchemaTypeArray, ElementSchema: &models.Schema{Type: models.SchemaTypeArray, ElementSchema: integer}},
+			value:  []interface{}{[]interface{}{1, 2}},
+			want:   []byte{0x0a, 0x04, 0x08, 0x01, 0x08, 0x02},
+		},
+		{
+			name:   "map",
+			schema: &models.Schema{Type: models.SchemaTypeMap, MapValue: &models.SchemaField{Name: "value", Schema: integer}},
+			value:  map[string]interface{}{"k": 1},
+			want:   []byte{0x0a, 0x05, 0x0a, 0x01, 'k', 0x10, 0x01},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := appendProtoField(nil, 1, tt.schema, tt.value); !bytes.Equal(got, tt.want) {
+				t.Errorf("appendProtoField() = %x, want %x", got, tt.want)
+			}
+		})
+	}
+}
+
+// packedRecord is a decoded record of a packed telemetry message, with a timestamp if it was packed in an envelope.
+type packedRecord struct {
+	Timestamp string           `json:"timestamp" cbor:"timestamp" msgpack:"timestamp"`
+	Values    map[string]int64 `json:"values" cbor:"values" msgpack:"values"`
+}
+
+// decodeProtoRecords decodes packed Protobuf records of telemetry messages with a single value field.
+func decodeProtoRecords(packing models.TelemetryPacking, body []byte) ([]*packedRecord, error) {
+	var records []*packedRecord
+	for len(body) > 0 {
+		_, _, n := protowire.ConsumeTag(body)
+		value, m := protowire.ConsumeBytes(body[n:])
+		if m < 0 {
+			return nil, protowire.ParseError(m)
+		}
+		body = body[n+m:]
+
+		record := &packedRecord{}
+		if packing == models.TelemetryPackingEnvelope {
+			_, _, n = protowire.ConsumeTag(value)
+			timestamp, m := protowire.ConsumeString(value[n:])
+			record.Timestamp = timestamp
+			value = value[n+m:]
+			_, _, n = protowire.ConsumeTag(value)
+			value, _ = protowire.ConsumeBytes(value[n:])
+		}
+		_, _, n = protowire.ConsumeTag(value)
+		v, _ := protowire.ConsumeVarint(value[n:])
+		record.Values = map[string]int64{"value": int64(v)}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+func TestPackRecords(t *testing.T) {
+	start := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	values := []map[string]interface{}{{"value": 1}, {"value": 2}}
+	fields := []*models.SchemaField{{Name: "value", Schema: &models.Schema{Type: "integer"}}}
+
+	// decoders of packed records, which are either arrays or envelopes of values
+	decode := func(unmarshal func([]byte, interface{}) error) func(models.TelemetryPacking, []byte) ([]*packedRecord, error) {
+		return func(packing models.TelemetryPacking, body []byte) ([]*packedRecord, error) {
+			if packing == models.TelemetryPackingEnvelope {
+				var envelope struct {
+					Records []*packedRecord `json:"records" cbor:"records" msgpack:"records"`
+				}
+				err := unmarshal(body, &envelope)
+				return envelope.Records, err
+			}
+
+			var array []map[string]int64
+			err := unmarshal(body, &array)
+			var records []*packedRecord
+			for _, v := range array {
+				records = append(records, &packedRecord{Values: v})
+			}
+			return records, err
+		}
+	}
+
+	tests := []struct {
+		name    string
+		format  models.TelemetryFormat
+		encode  func(map[string]interface{}) ([]byte, error)
+		decode  func(models.TelemetryPacking, []byte) ([]*packedRecord, error)
+		packing models.TelemetryPacking
+	}{
+		{
+			name:    "json array",
+			format:  models.TelemetryFormatDefault,
+			encode:  func(v map[string]interface{}) ([]byte, error) { return json.Marshal(v) },
+			decode:  decode(json.Unmarshal),
+			packing: models.TelemetryPackingArray,
+		},
+		{
+			name:    "json envelope",
+			format:  models.TelemetryFormatDefault,
+			encode:  func(v map[string]interface{}) ([]byte, error) { return json.Marshal(v) },
+			decode:  decode(json.Unmarshal),
+			packing: models.TelemetryPackingEnvelope,
+		},
+		{
+			name:    "cbor array",
+			format:  models.TelemetryFormatCbor,
+			encode:  func(v map[string]interface{}) ([]byte, error) { return cbor.Marshal(v) },
+			decode:  decode(cbor.Unmarshal),
+			packing: models.TelemetryPackingArray,
+		},
+		{
+			name:    "cbor envelope",
+			format:  models.TelemetryFormatCbor,
+			encode:  func(v map[string]interface{}) ([]byte, error) { return cbor.Marshal(v) },
+			decode:  decode(cbor.Unmarshal),
+			packing: models.TelemetryPackingEnvelope,
+		},
+		{
+			name:    "msgpack array",
+			format:  models.TelemetryFormatMsgpack,
+			encode:  func(v map[string]interface{}) ([]byte, error) { return msgpack.Marshal(v) },
+			decode:  decode(msgpack.Unmarshal),
+			packing: models.TelemetryPackingArray,
+		},
+		{
+			name:    "msgpack envelope",
+			format:  models.TelemetryFormatMsgpack,
+			encode:  func(v map[string]interface{}) ([]byte, error) { return msgpack.Marshal(v) },
+			decode:  decode(msgpack.Unmarshal),
+			packing: models.TelemetryPackingEnvelope,
+		},
+		{
+			name:    "protobuf array",
+			format:  models.TelemetryFormatProtobuf,
+			encode:  func(v map[string]interface{}) ([]byte, error) { return appendProtoMessage(nil, fields, v), nil },
+			decode:  decodeProtoRecords,
+			packing: models.TelemetryPackingArray,
+		},
+		{
+			name:    "protobuf envelope",
+			format:  models.TelemetryFormatProtobuf,
+			encode:  func(v map[string]interface{}) ([]byte, error) { return appendProtoMessage(nil, fields, v), nil },
+			decode:  decodeProtoRecords,
+			packing: models.TelemetryPackingEnvelope,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var records []*telemetryMessage
+			var want []*packedRecord
+			for i, v := range values {
+				body, err := tt.encode(v)
+				if err != nil {
+					t.Fatal(err)
+				}
+				record := &telemetryMessage{body: body, creationTimeUtc: start.Add(time.Duration(i) * 1500 * time.Millisecond)}
+				records = append(records, record)
+
+				packed := &packedRecord{Values: map[string]int64{"value": int64(v["value"].(int))}}
+				if tt.packing == models.TelemetryPackingEnvelope {
+					packed.Timestamp = getRecordTimestamp(record)
+				}
+				want = append(want, packed)
+			}
+
+			body, err := packRecords(tt.format, tt.packing, records)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := tt.decode(tt.packing, body)
+			if err != nil {
+				t.Fatalf("invalid packed records %x (%s)", body, err.Error())
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("packRecords() = %+v, want %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestCompressTelemetryMessage(t *testing.T) {
+	body := []byte(`{"temperature":21.5,"humidity":40}`)
+
+	tests := []struct {
+		name         string
+		encoding     models.TelemetryEncoding
+		decompress   func(io.Reader) (io.Reader, error)
+		wantEncoding string
+	}{
+		{
+			name:         "none",
+			encoding:     models.TelemetryEncodingNone,
+			wantEncoding: contentEncodingUtf8,
+		},
+		{
+			name:         "gzip",
+			encoding:     models.TelemetryEncodingGzip,
+			decompress:   func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) },
+			wantEncoding: "gzip",
+		},
+		{
+			name:         "deflate",
+			encoding:     models.TelemetryEncodingDeflate,
+			decompress:   func(r io.Reader) (io.Reader, error) { return flate.NewReader(r), nil },
+			wantEncoding: "deflate",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := &telemetryMessage{body: body, contentEncoding: contentEncodingUtf8}
+			if err := compressTelemetryMessage(tt.encoding, msg); err != nil {
+				t.Fatal(err)
+			}
+			if msg.contentEncoding != tt.wantEncoding {
+				t.Errorf("contentEncoding = %s, want %s", msg.contentEncoding, tt.wantEncoding)
+			}
+
+			got := msg.body
+			if tt.decompress != nil {
+				r, err := tt.decompress(bytes.NewReader(msg.body))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got, err = ioutil.ReadAll(r); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if !bytes.Equal(got, body) {
+				t.Errorf("body = %s, want %s", got, body)
+			}
+		})
+	}
+}
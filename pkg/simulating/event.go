@@ -0,0 +1,153 @@
+package simulating
+
+import (
+	"math"
+	"reflect"
+	"time"
+
+	"github.com/iot-for-all/starling/pkg/models"
+)
+
+type (
+	// eventSource is a telemetry sent sporadically, an event or a state changing on transitions.
+	eventSource struct {
+		comp      *models.Component     // the component of the telemetry.
+		telemetry *models.TelemetryType // the event or state telemetry.
+		rate      float64               // average number of events or state transitions per hour.
+	}
+)
+
+const (
+	// maxStateValueAttempts is the maximum number of values generated to find a state that differs from the current one.
+	maxStateValueAttempts = 10
+)
+
+// HasEvents checks whether the device sends event telemetry or state telemetry changing on transitions.
+func (d *DataGenerator) HasEvents() bool {
+	return len(d.getEventSources()) > 0
+}
+
+// NextEvent gets the time till the next event or state transition of the device, and its telemetry.
+// Arrivals of each telemetry follow a Poisson process with the configured rate, so the time till the next arrival of any
+// telemetry is exponentially distributed with the total rate, and the arriving telemetry is picked in proportion to its rate.
+func (d *DataGenerator) NextEvent() (time.Duration, *eventSource) {
+	sources := d.getEventSources()
+	total := 0.0
+	for _, source := range sources {
+		total += source.rate
+	}
+	if total <= 0 {
+		return 0, nil
+	}
+
+	random := getRandom(d.eventRandom)
+	wait := -math.Log(1-random.Float64()) / total
+	pick := random.Float64() * total
+	for _, source := range sources {
+		if pick < source.rate {
+			return time.Duration(wait * float64(time.Hour)), source
+		}
+		pick -= source.rate
+	}
+	return time.Duration(wait * float64(time.Hour)), sources[len(sources)-1]
+}
+
+// GenerateEventMessage generates a message with the value of an event, or the new value of a state after a transition.
+// Nothing is generated when the telemetry is not sent in the active state of the device.
+func (d *DataGenerator) GenerateEventMessage(device *device, source *eventSource, creationTime time.Time) (*telemetryMessage, error) {
+	if !d.isTelemetrySent(source.comp, source.telemetry) {
+		return nil, nil
+	}
+
+	var value interface{}
+	if source.telemetry.IsState() {
+		value = d.changeStateValue(source.comp, source.telemetry, creationTime)
+	} else {
+		value = d.getValue(source.comp, source.telemetry.Name, source.telemetry.Schema, creationTime)
+	}
+
+	componentName := ""
+	if source.comp.IsComponent {
+		componentName = source.comp.ComponentName
+	}
+	values := map[string]interface{}{
+		source.telemetry.Name: value,
+	}
+	return d.newTelemetryMessage(device, values, componentName, len(values), d.getTimestamp(device, creationTime))
+}
+
+// isPeriodicTelemetry checks whether a telemetry of a component is sent in the periodic telemetry batches.
+// Events are sent only when they occur, while states are sent periodically with the value of their last transition.
+func (d *DataGenerator) isPeriodicTelemetry(comp *models.Component, telemetry *models.TelemetryType) bool {
+	return !telemetry.IsEvent() && d.isTelemetrySent(comp, telemetry)
+}
+
+// getStateValue gets the current value of a state telemetry of a component, which changes only on transitions.
+func (d *DataGenerator) getStateValue(comp *models.Component, telemetry *models.TelemetryType, t time.Time) interface{} {
+	key := getPropertyKey(comp, telemetry.Name)
+	d.lock.Lock()
+	value, ok := d.stateValues[key]
+	d.lock.Unlock()
+	if ok {
+		return value
+	}
+
+	value = d.getValue(comp, telemetry.Name, telemetry.Schema, t)
+	d.setStateValue(key, value)
+	return value
+}
+
+// changeStateValue transitions a state telemetry of a component to a new value that differs from the current one, if possible.
+func (d *DataGenerator) changeStateValue(comp *models.Component, telemetry *models.TelemetryType, t time.Time) interface{} {
+	current := d.getStateValue(comp, telemetry, t)
+	var value interface{}
+	for i := 0; i < maxStateValueAttempts; i++ {
+		value = d.getValue(comp, telemetry.Name, telemetry.Schema, t)
+		if !reflect.DeepEqual(value, current) {
+			break
+		}
+	}
+	d.setStateValue(getPropertyKey(comp, telemetry.Name), value)
+	return value
+}
+
+// setStateValue sets the current value of a state telemetry by component qualified telemetry name.
+func (d *DataGenerator) setStateValue(key string, value interface{}) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.stateValues == nil {
+		d.stateValues = make(map[string]interface{})
+	}
+	d.stateValues[key] = value
+}
+
+// getEventSources gets the event and state telemetry of the device with their rates, skipping telemetry without a rate
+// configured or with a rate of 0.
+func (d *DataGenerator) getEventSources() []*eventSource {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.eventSources != nil {
+		return d.eventSources
+	}
+
+	d.eventSources = make([]*eventSource, 0)
+	for _, comp := range d.CapabilityModel.Components {
+		for _, telemetry := range comp.Telemetry {
+			if !telemetry.IsEvent() && !telemetry.IsState() {
+				continue
+			}
+			rate, ok := d.EventRates[getPropertyKey(comp, telemetry.Name)]
+			if !ok {
+				rate, ok = d.EventRates[telemetry.Name]
+			}
+			if ok && rate > 0 {
+				d.eventSources = append(d.eventSources, &eventSource{
+					comp:      comp,
+					telemetry: telemetry,
+					rate:      rate,
+				})
+			}
+		}
+	}
+	return d.eventSources
+}
@@ -0,0 +1,217 @@
+package simulating
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/iot-for-all/starling/pkg/models"
+)
+
+type (
+	// stuckTelemetry represents a telemetry of a stuck sensor repeating its value.
+	stuckTelemetry struct {
+		value     interface{} // the repeated value.
+		remaining int         // number of messages in which the value is still repeated.
+	}
+)
+
+const (
+	// defaultSpikeMagnitude is the factor by which spikes multiply values.
+	defaultSpikeMagnitude = 10
+	// defaultStuckDuration is the number of messages in which a stuck sensor repeats its value.
+	defaultStuckDuration = 10
+	// defaultOversizedPadding is the padding added to oversized messages, the maximum IoT Hub message size.
+	defaultOversizedPadding = 256 * 1024
+)
+
+// injectValueFaults injects the value faults configured for the device into the values of a telemetry message.
+func (d *DataGenerator) injectValueFaults(device *device, componentName string, values map[string]interface{}) {
+	if len(d.Faults) == 0 {
+		return
+	}
+
+	// stuck sensors keep repeating their values till they recover
+	for name := range values {
+		key := getTelemetryKey(componentName, name)
+		stuck, ok := d.stuckTelemetry[key]
+		if !ok {
+			continue
+		}
+		values[name] = stuck.value
+		stuck.remaining--
+		if stuck.remaining <= 0 {
+			delete(d.stuckTelemetry, key)
+		}
+		countTelemetryFault(device, models.TelemetryFaultStuck)
+	}
+
+	for _, fault := range d.Faults {
+		if fault.Type == models.TelemetryFaultMalformed || fault.Type == models.TelemetryFaultOversized || !d.isFaultDue(fault) {
+			continue
+		}
+
+		numeric := fault.Type == models.TelemetryFaultSpike || fault.Type == models.TelemetryFaultOutOfRange
+		name, ok := d.getFaultTelemetry(fault, componentName, values, numeric)
+		if !ok {
+			continue
+		}
+
+		key := getTelemetryKey(componentName, name)
+		value := values[name]
+		switch fault.Type {
+		case models.TelemetryFaultSpike:
+			magnitude := fault.Magnitude
+			if magnitude == 0 {
+				magnitude = defaultSpikeMagnitude
+			}
+			v, _ := getFaultNumber(value)
+			values[name] = v * magnitude
+		case models.TelemetryFaultOutOfRange:
+			values[name] = d.getOutOfRangeValue(key, name)
+		case models.TelemetryFaultMissing:
+			delete(values, name)
+		case models.TelemetryFaultWrongType:
+			if _, ok := value.(string); ok {
+				values[name] = 100 * d.faultRand().Float64()
+			} else {
+				values[name] = fmt.Sprintf("%v", value)
+			}
+		case models.TelemetryFaultStuck:
+			// the sensor gets stuck at its current value, which is repeated in the following messages
+			if _, ok := d.stuckTelemetry[key]; ok {
+				continue
+			}
+			duration := fault.Duration
+			if duration == 0 {
+				duration = defaultStuckDuration
+			}
+			if d.stuckTelemetry == nil {
+				d.stuckTelemetry = make(map[string]*stuckTelemetry)
+			}
+			d.stuckTelemetry[key] = &stuckTelemetry{
+				value:     value,
+				remaining: duration,
+			}
+			continue
+		}
+		countTelemetryFault(device, fault.Type)
+	}
+}
+
+// injectOversizedFault pads the values of a telemetry message beyond the maximum message size, if the fault is due.
+func (d *DataGenerator) injectOversizedFault(device *device, values map[string]interface{}) {
+	for _, fault := range d.Faults {
+		if fault.Type != models.TelemetryFaultOversized || !d.isFaultDue(fault) {
+			continue
+		}
+
+		size := fault.Size
+		if size == 0 {
+			size = defaultOversizedPadding
+		}
+		values["padding"] = strings.Repeat("x", size)
+		countTelemetryFault(device, fault.Type)
+		return
+	}
+}
+
+// injectMalformedFault truncates the JSON body of a telemetry message, if the fault is due.
+func (d *DataGenerator) injectMalformedFault(device *device, body []byte) []byte {
+	for _, fault := range d.Faults {
+		if fault.Type != models.TelemetryFaultMalformed || !d.isFaultDue(fault) {
+			continue
+		}
+
+		countTelemetryFault(device, fault.Type)
+		return body[:len(body)/2]
+	}
+	return body
+}
+
+// isFaultDue decides whether a fault is injected into the current message based on its rate.
+func (d *DataGenerator) isFaultDue(fault *models.TelemetryFault) bool {
+	return fault.Rate > 0 && 100*d.faultRand().Float64() < fault.Rate
+}
+
+// getFaultTelemetry picks a random telemetry of the message affected by the fault.
+func (d *DataGenerator) getFaultTelemetry(fault *models.TelemetryFault, componentName string, values map[string]interface{}, numeric bool) (string, bool) {
+	names := make([]string, 0, len(values))
+	for name, value := range values {
+		if len(fault.Telemetry) > 0 && !containsString(fault.Telemetry, getTelemetryKey(componentName, name)) && !containsString(fault.Telemetry, name) {
+			continue
+		}
+		if _, ok := getFaultNumber(value); numeric && !ok {
+			continue
+		}
+		names = append(names, name)
+	}
+	if len(names) == 0 {
+		return "", false
+	}
+
+	// sort the names, so that seeded simulations pick the same telemetry
+	sort.Strings(names)
+	return names[d.faultRand().Intn(len(names))], true
+}
+
+// getOutOfRangeValue gets a value outside the range of the value generator of a telemetry, or of random values otherwise.
+func (d *DataGenerator) getOutOfRangeValue(key string, name string) float64 {
+	min, max := 0.0, 100.0
+	spec, ok := d.Generators[key]
+	if !ok {
+		spec = d.Generators[name]
+	}
+	if spec != nil && spec.Max > spec.Min {
+		min, max = spec.Min, spec.Max
+	}
+
+	offset := (max - min) * (1 + d.faultRand().Float64())
+	if d.faultRand().Intn(2) == 0 {
+		return min - offset
+	}
+	return max + offset
+}
+
+// faultRand gets the source of random faults of the data generator.
+func (d *DataGenerator) faultRand() randomSource {
+	return getRandom(d.faultRandom)
+}
+
+// getTelemetryKey gets the key of a telemetry of a component in the device configuration.
+func getTelemetryKey(componentName string, name string) string {
+	if componentName != "" {
+		return fmt.Sprintf("%s.%s", componentName, name)
+	}
+	return name
+}
+
+// getFaultNumber gets the numeric value of a telemetry, if the value is a number.
+func getFaultNumber(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case float32:
+		return float64(v), true
+	case int:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	}
+	return 0, false
+}
+
+// containsString checks whether the list contains the string.
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// countTelemetryFault counts a fault injected into the telemetry of a device.
+func countTelemetryFault(device *device, faultType models.TelemetryFaultType) {
+	telemetryFaultsTotal.WithLabelValues(device.simulation.ID, device.simulation.TargetID, device.model.ID, string(faultType)).Add(1)
+}
@@ -0,0 +1,207 @@
+package simulating
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/amenzhinsky/iothub/common"
+	"github.com/amenzhinsky/iothub/iotdevice/transport"
+	"github.com/iot-for-all/starling/pkg/models"
+	"github.com/iot-for-all/starling/pkg/util"
+)
+
+type (
+	// httpDeviceClient interacts with IoT Hub using the HTTPS device API.
+	// Unlike MQTT, the HTTPS API lets the device complete, reject or abandon cloud to device messages.
+	httpDeviceClient struct {
+		hostName string       // host name of the IoT Hub.
+		deviceID string       // id of the device.
+		key      string       // shared access key of the device, empty for devices with X.509 certificates.
+		client   *http.Client // http client used to interact with IoT Hub.
+	}
+)
+
+const (
+	// httpDeviceAPIVersion is the version of the IoT Hub HTTPS device API.
+	httpDeviceAPIVersion = "2020-09-30"
+	// httpAppPropertyPrefix is the prefix of the headers carrying the application properties of messages.
+	httpAppPropertyPrefix = "iothub-app-"
+	// c2dLockTimeout is how long IoT Hub locks a c2d message received over HTTPS, before delivering it again.
+	c2dLockTimeout = time.Minute
+	// c2dMaxSettleDelay is the maximum processing delay of c2d commands, leaving time to settle them before their lock expires.
+	c2dMaxSettleDelay = c2dLockTimeout - 10*time.Second
+	// httpIdleConnTimeout is how long idle keep-alive connections to IoT Hub are kept open.
+	httpIdleConnTimeout = 90 * time.Second
+)
+
+// newHttpDeviceClient creates an HTTPS client for the device with the given credentials, authorized with SAS tokens
+// signed with the key of the device, or with the X.509 certificate of the device.
+func newHttpDeviceClient(creds transport.Credentials, timeout time.Duration) *httpDeviceClient {
+	tlsConfig := &tls.Config{
+		RootCAs: common.RootCAs(),
+	}
+	if crt := creds.GetCertificate(); crt != nil {
+		tlsConfig.Certificates = append(tlsConfig.Certificates, *crt)
+	}
+
+	return &httpDeviceClient{
+		hostName: creds.GetHostName(),
+		deviceID: creds.GetDeviceID(),
+		key:      creds.GetSAK(),
+		client: &http.Client{
+			Timeout: timeout,
+			Transport: &http.Transport{
+				TLSClientConfig: tlsConfig,
+				IdleConnTimeout: httpIdleConnTimeout,
+			},
+		},
+	}
+}
+
+// close closes the idle connections of the client.
+func (c *httpDeviceClient) close() {
+	c.client.CloseIdleConnections()
+}
+
+// receive receives the next cloud to device message, nil if there are no messages.
+// The message is locked for the device till it is completed, rejected or abandoned using the returned lock token.
+func (c *httpDeviceClient) receive(ctx context.Context) (*common.Message, string, error) {
+	res, err := c.do(ctx, http.MethodGet, "messages/deviceBound", nil, nil, nil)
+	if err != nil {
+		return nil, "", fmt.Errorf("error receiving c2d message (%s)", err.Error())
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNoContent {
+		return nil, "", nil
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("error receiving c2d message (%s)", res.Status)
+	}
+
+	payload, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, "", fmt.Errorf("error reading c2d message (%s)", err.Error())
+	}
+
+	msg := common.Message{
+		MessageID:     res.Header.Get("iothub-messageid"),
+		To:            res.Header.Get("iothub-to"),
+		CorrelationID: res.Header.Get("iothub-correlationid"),
+		UserID:        res.Header.Get("iothub-userid"),
+		Payload:       payload,
+		Properties:    make(map[string]string),
+	}
+	for name, values := range res.Header {
+		name = strings.ToLower(name)
+		if strings.HasPrefix(name, httpAppPropertyPrefix) && len(values) > 0 {
+			msg.Properties[strings.TrimPrefix(name, httpAppPropertyPrefix)] = values[0]
+		}
+	}
+
+	return &msg, strings.Trim(res.Header.Get("ETag"), `"`), nil
+}
+
+// settle completes, rejects or abandons a received cloud to device message.
+func (c *httpDeviceClient) settle(ctx context.Context, lockToken string, outcome models.C2DOutcome) error {
+	path := fmt.Sprintf("messages/deviceBound/%s", url.PathEscape(lockToken))
+	var query url.Values
+	method := http.MethodDelete
+	switch outcome {
+	case models.C2DOutcomeReject:
+		query = url.Values{"reject": []string{""}}
+	case models.C2DOutcomeAbandon:
+		method = http.MethodPost
+		path += "/abandon"
+	}
+
+	res, err := c.do(ctx, method, path, query, nil, nil)
+	if err != nil {
+		return fmt.Errorf("error settling c2d message (%s)", err.Error())
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusNoContent && res.StatusCode != http.StatusOK {
+		return fmt.Errorf("error settling c2d message (%s)", res.Status)
+	}
+	return nil
+}
+
+// send sends a device to cloud message. The system properties of the message are sent as IoT Hub headers,
+// and the other properties as application properties.
+func (c *httpDeviceClient) send(ctx context.Context, msg *common.Message) error {
+	header := http.Header{}
+	if msg.MessageID != "" {
+		header.Set("iothub-messageid", msg.MessageID)
+	}
+	if msg.CorrelationID != "" {
+		header.Set("iothub-correlationid", msg.CorrelationID)
+	}
+	for name, value := range msg.Properties {
+		switch {
+		case name == "$.ct":
+			header.Set("iothub-contenttype", value)
+			header.Set("Content-Type", value)
+		case name == "$.ce":
+			header.Set("iothub-contentencoding", value)
+		case name == "$.sub":
+			header.Set("dt-subject", value)
+		case strings.HasPrefix(name, "iothub-"):
+			header.Set(name, value)
+		default:
+			header.Set(httpAppPropertyPrefix+name, value)
+		}
+	}
+
+	res, err := c.do(ctx, http.MethodPost, "messages/events", nil, msg.Payload, header)
+	if err != nil {
+		return fmt.Errorf("error sending message (%s)", err.Error())
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusNoContent && res.StatusCode != http.StatusOK {
+		return fmt.Errorf("error sending message (%s)", res.Status)
+	}
+	return nil
+}
+
+// do sends a request to the given path of the device resource, authorized with the device key, or by the certificate
+// of the client if the device has no key.
+func (c *httpDeviceClient) do(ctx context.Context, method string, path string, query url.Values, body []byte, header http.Header) (*http.Response, error) {
+	resource := fmt.Sprintf("%s/devices/%s", c.hostName, url.PathEscape(c.deviceID))
+
+	if query == nil {
+		query = url.Values{}
+	}
+	query.Set("api-version", httpDeviceAPIVersion)
+	u := fmt.Sprintf("https://%s/%s?%s", resource, path, query.Encode())
+
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, reader)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if c.key != "" {
+		token, err := util.CreateSasToken(c.key, resource, "", time.Hour)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Add("Authorization", token)
+	}
+
+	return c.client.Do(req)
+}
@@ -0,0 +1,85 @@
+package simulating
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/amenzhinsky/iothub/common"
+	"github.com/amenzhinsky/iothub/iotdevice/transport"
+	"github.com/amenzhinsky/iothub/logger"
+)
+
+type (
+	// httpTransport is the HTTPS transport of the IoT Hub device client, for devices that never hold a connection.
+	// Each telemetry message is posted to the HTTPS device API, while c2d messages are polled by the device simulator.
+	// The HTTPS device API has no direct methods and no twin, which need a connection to the device.
+	httpTransport struct {
+		timeout time.Duration     // timeout of the requests to IoT Hub.
+		client  *httpDeviceClient // client of the HTTPS device API, once connected.
+	}
+)
+
+var (
+	// errHttpTransportUnsupported is the error of the operations the HTTPS device API does not have.
+	errHttpTransportUnsupported = errors.New("direct methods and twins are not available over the HTTPS device API")
+)
+
+// newHttpTransport creates an HTTPS transport with the given request timeout.
+func newHttpTransport(timeout time.Duration) *httpTransport {
+	return &httpTransport{
+		timeout: timeout,
+	}
+}
+
+// SetLogger sets the logger of the transport, which logs nothing since errors are returned by each request.
+func (t *httpTransport) SetLogger(logger.Logger) {
+}
+
+// Connect creates the client of the HTTPS device API without connecting, since each request is sent on its own.
+// Devices are authorized with SAS tokens signed with their key, or with their X.509 certificate.
+func (t *httpTransport) Connect(_ context.Context, creds transport.Credentials) error {
+	t.client = newHttpDeviceClient(creds, t.timeout)
+	return nil
+}
+
+// Send posts a telemetry message from the device.
+func (t *httpTransport) Send(ctx context.Context, msg *common.Message) error {
+	if t.client == nil {
+		return errors.New("not connected")
+	}
+	return t.client.send(ctx, msg)
+}
+
+// RegisterDirectMethods fails, since direct methods need a connection to the device.
+func (t *httpTransport) RegisterDirectMethods(context.Context, transport.MethodDispatcher) error {
+	return errHttpTransportUnsupported
+}
+
+// SubscribeEvents fails, since c2d messages are polled and settled by the device simulator.
+func (t *httpTransport) SubscribeEvents(context.Context, transport.MessageDispatcher) error {
+	return errors.New("c2d messages are polled over the HTTPS device API")
+}
+
+// SubscribeTwinUpdates fails, since the HTTPS device API has no twin.
+func (t *httpTransport) SubscribeTwinUpdates(context.Context, transport.TwinStateDispatcher) error {
+	return errHttpTransportUnsupported
+}
+
+// RetrieveTwinProperties fails, since the HTTPS device API has no twin.
+func (t *httpTransport) RetrieveTwinProperties(context.Context) ([]byte, error) {
+	return nil, errHttpTransportUnsupported
+}
+
+// UpdateTwinProperties fails, since the HTTPS device API has no twin.
+func (t *httpTransport) UpdateTwinProperties(context.Context, []byte) (int, error) {
+	return 0, errHttpTransportUnsupported
+}
+
+// Close closes the idle connections of the client.
+func (t *httpTransport) Close() error {
+	if t.client != nil {
+		t.client.close()
+	}
+	return nil
+}
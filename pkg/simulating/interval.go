@@ -0,0 +1,52 @@
+package simulating
+
+import (
+	"time"
+
+	"github.com/iot-for-all/starling/pkg/models"
+)
+
+// isTelemetryDue checks whether a telemetry of a component is due in a message created at the given time,
+// recording the time of the send if it is. Telemetry without an interval is sent in every message.
+// The recorded time is the slot of the telemetry, so that a message generated again for the same or an earlier time,
+// e.g. after a failed send, still carries the telemetry.
+func (d *DataGenerator) isTelemetryDue(comp *models.Component, telemetry *models.TelemetryType, t time.Time) bool {
+	interval := d.getTelemetryInterval(comp, telemetry)
+	if interval <= 0 {
+		return true
+	}
+
+	key := getPropertyKey(comp, telemetry.Name)
+	sent, ok := d.telemetrySentTimes[key]
+	if ok && !t.After(sent) {
+		return true
+	}
+	if ok && t.Before(sent.Add(interval)) {
+		return false
+	}
+	if d.telemetrySentTimes == nil {
+		d.telemetrySentTimes = make(map[string]time.Time)
+	}
+	d.telemetrySentTimes[key] = t
+	return true
+}
+
+// getTelemetryInterval gets the interval between sends of a telemetry of a component.
+// Intervals of the device configuration, by "component.name", telemetry name or component name, take precedence over
+// the intervals annotated on the telemetry or the component in the model.
+func (d *DataGenerator) getTelemetryInterval(comp *models.Component, telemetry *models.TelemetryType) time.Duration {
+	interval, ok := d.TelemetryIntervals[getPropertyKey(comp, telemetry.Name)]
+	if !ok {
+		interval, ok = d.TelemetryIntervals[telemetry.Name]
+	}
+	if !ok && comp.IsComponent {
+		interval, ok = d.TelemetryIntervals[comp.ComponentName]
+	}
+	if !ok {
+		interval = telemetry.Interval
+	}
+	if !ok && interval == 0 {
+		interval = comp.Interval
+	}
+	return time.Second * time.Duration(interval)
+}
@@ -0,0 +1,117 @@
+package simulating
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/iot-for-all/starling/pkg/models"
+)
+
+func TestGetTelemetryInterval(t *testing.T) {
+	root := &models.Component{ComponentName: "Default", Interval: 0}
+	sensor := &models.Component{ComponentName: "sensor", IsComponent: true, Interval: 30}
+	temperature := &models.TelemetryType{Name: "temperature"}
+	humidity := &models.TelemetryType{Name: "humidity", Interval: 20}
+
+	tests := []struct {
+		name      string
+		intervals map[string]int
+		comp      *models.Component
+		telemetry *models.TelemetryType
+		want      time.Duration
+	}{
+		{name: "none", comp: root, telemetry: temperature, want: 0},
+		{name: "telemetry in the model", comp: root, telemetry: humidity, want: 20 * time.Second},
+		{name: "component in the model", comp: sensor, telemetry: temperature, want: 30 * time.Second},
+		{name: "telemetry over component in the model", comp: sensor, telemetry: humidity, want: 20 * time.Second},
+		{
+			name:      "component telemetry in the config",
+			intervals: map[string]int{"sensor.humidity": 5, "humidity": 10, "sensor": 15},
+			comp:      sensor,
+			telemetry: humidity,
+			want:      5 * time.Second,
+		},
+		{
+			name:      "telemetry in the config",
+			intervals: map[string]int{"humidity": 10, "sensor": 15},
+			comp:      sensor,
+			telemetry: humidity,
+			want:      10 * time.Second,
+		},
+		{
+			name:      "component in the config",
+			intervals: map[string]int{"sensor": 15},
+			comp:      sensor,
+			telemetry: humidity,
+			want:      15 * time.Second,
+		},
+		{
+			name:      "disabled in the config",
+			intervals: map[string]int{"humidity": 0},
+			comp:      root,
+			telemetry: humidity,
+			want:      0,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &DataGenerator{TelemetryIntervals: tt.intervals}
+			if got := d.getTelemetryInterval(tt.comp, tt.telemetry); got != tt.want {
+				t.Errorf("getTelemetryInterval() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsTelemetryDue(t *testing.T) {
+	comp := &models.Component{ComponentName: "Default"}
+	start := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name     string
+		interval int
+		seconds  []int
+		want     []bool
+	}{
+		{
+			name:     "no interval",
+			interval: 0,
+			seconds:  []int{0, 1, 2},
+			want:     []bool{true, true, true},
+		},
+		{
+			name:     "interval",
+			interval: 10,
+			seconds:  []int{0, 5, 9, 10, 15, 25},
+			want:     []bool{true, false, false, true, false, true},
+		},
+		{
+			name:     "generated again at the same time",
+			interval: 10,
+			seconds:  []int{0, 0, 5, 10, 10},
+			want:     []bool{true, true, false, true, true},
+		},
+		{
+			name:     "generated again at an earlier time",
+			interval: 10,
+			seconds:  []int{0, 10, 5, 15, 20},
+			want:     []bool{true, true, true, false, true},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			telemetry := &models.TelemetryType{Name: "temperature", Interval: tt.interval}
+			d := &DataGenerator{}
+			var got []bool
+			for _, s := range tt.seconds {
+				got = append(got, d.isTelemetryDue(comp, telemetry, start.Add(time.Duration(s)*time.Second)))
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("isTelemetryDue() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,128 @@
+package simulating
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/iot-for-all/starling/pkg/models"
+	"github.com/rs/zerolog/log"
+)
+
+type (
+	// messageTemplates are the templates of the application properties and the content type of the telemetry messages
+	// sent by the devices of a device config. Templates are parsed once and shared by the devices.
+	messageTemplates struct {
+		properties  map[string]*template.Template // templates of the application properties by property name.
+		contentType *template.Template            // template of the content type, overriding the content type of the format.
+	}
+
+	// messageTemplateData is the data the message templates are executed with, e.g. {{.DeviceID}} or {{.Pick "a" "b"}}.
+	messageTemplateData struct {
+		DeviceID   string    // id of the device sending the message.
+		Model      string    // id of the model of the device.
+		Simulation string    // id of the simulation.
+		Target     string    // id of the target application.
+		Component  string    // name of the component of the telemetry, empty for the root interface.
+		Seq        int64     // sequence number of the message sent by the device, starting from 1.
+		Time       time.Time // creation time of the message.
+
+		random randomSource // source of the random values picked by the templates.
+	}
+)
+
+// parseMessageTemplates parses the templates of the application properties and the content type of a device config.
+func parseMessageTemplates(config *models.SimulationDeviceConfig) (*messageTemplates, error) {
+	if len(config.MessageProperties) == 0 && config.ContentType == "" {
+		return nil, nil
+	}
+
+	templates := messageTemplates{
+		properties: make(map[string]*template.Template),
+	}
+	for name, text := range config.MessageProperties {
+		t, err := template.New(name).Option("missingkey=error").Parse(text)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("could not parse the template of message property '%s' of device config '%s': %s", name, config.ID, err.Error()))
+		}
+		templates.properties[name] = t
+	}
+	if config.ContentType != "" {
+		t, err := template.New("contentType").Option("missingkey=error").Parse(config.ContentType)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("could not parse the content type template of device config '%s': %s", config.ID, err.Error()))
+		}
+		templates.contentType = t
+	}
+	return &templates, nil
+}
+
+// applyMessageTemplates sets the application properties of a telemetry message, and overrides its content type,
+// with the message templates of the device. Properties whose templates fail are left out of the message.
+func (d *DataGenerator) applyMessageTemplates(device *device, msg *telemetryMessage) {
+	if d.messageTemplates == nil {
+		return
+	}
+
+	d.lock.Lock()
+	d.messageCount++
+	seq := d.messageCount
+	d.lock.Unlock()
+
+	data := &messageTemplateData{
+		DeviceID:   device.deviceID,
+		Model:      device.model.ID,
+		Simulation: device.simulation.ID,
+		Target:     device.simulation.TargetID,
+		Component:  msg.componentName,
+		Seq:        seq,
+		Time:       msg.creationTimeUtc,
+		random:     d.propertyRandom,
+	}
+
+	msg.properties = make(map[string]string, len(d.messageTemplates.properties))
+	for name, t := range d.messageTemplates.properties {
+		value, err := executeMessageTemplate(t, data)
+		if err != nil {
+			log.Error().Err(err).Str("deviceID", device.deviceID).Str("property", name).Msg("error executing message property template")
+			continue
+		}
+		msg.properties[name] = value
+	}
+
+	if d.messageTemplates.contentType != nil {
+		contentType, err := executeMessageTemplate(d.messageTemplates.contentType, data)
+		if err != nil {
+			log.Error().Err(err).Str("deviceID", device.deviceID).Msg("error executing content type template")
+		} else if contentType != "" {
+			msg.contentType = contentType
+		}
+	}
+}
+
+// executeMessageTemplate executes a message template with the given data.
+func executeMessageTemplate(t *template.Template, data *messageTemplateData) (string, error) {
+	var b strings.Builder
+	if err := t.Execute(&b, data); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// Pick picks a random value from the given values, e.g. {{.Pick "north" "south"}}.
+func (m *messageTemplateData) Pick(values ...interface{}) interface{} {
+	if len(values) == 0 {
+		return ""
+	}
+	return values[getRandom(m.random).Intn(len(values))]
+}
+
+// RandInt gets a random integer between min and max inclusive, e.g. {{.RandInt 1 5}}.
+func (m *messageTemplateData) RandInt(min int, max int) int {
+	if max <= min {
+		return min
+	}
+	return min + getRandom(m.random).Intn(max-min+1)
+}
@@ -0,0 +1,164 @@
+package simulating
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/iot-for-all/starling/pkg/models"
+)
+
+func TestParseMessageTemplates(t *testing.T) {
+	tests := []struct {
+		name        string
+		config      *models.SimulationDeviceConfig
+		want        []string
+		contentType bool
+		wantErr     bool
+	}{
+		{
+			name:   "none",
+			config: &models.SimulationDeviceConfig{ID: "config"},
+		},
+		{
+			name:   "properties",
+			config: &models.SimulationDeviceConfig{ID: "config", MessageProperties: map[string]string{"source": "{{.DeviceID}}", "kind": "telemetry"}},
+			want:   []string{"kind", "source"},
+		},
+		{
+			name:        "content type",
+			config:      &models.SimulationDeviceConfig{ID: "config", ContentType: "application/vnd.{{.Model}}+json"},
+			contentType: true,
+		},
+		{
+			name:    "invalid property",
+			config:  &models.SimulationDeviceConfig{ID: "config", MessageProperties: map[string]string{"source": "{{.DeviceID"}},
+			wantErr: true,
+		},
+		{
+			name:    "invalid content type",
+			config:  &models.SimulationDeviceConfig{ID: "config", ContentType: "{{if}}"},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseMessageTemplates(tt.config)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseMessageTemplates() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if got == nil {
+				if tt.want != nil || tt.contentType {
+					t.Errorf("parseMessageTemplates() = nil, want templates")
+				}
+				return
+			}
+
+			var names []string
+			for _, name := range []string{"kind", "source"} {
+				if _, ok := got.properties[name]; ok {
+					names = append(names, name)
+				}
+			}
+			if len(got.properties) != len(names) || !reflect.DeepEqual(names, tt.want) {
+				t.Errorf("properties = %v, want %v", got.properties, tt.want)
+			}
+			if (got.contentType != nil) != tt.contentType {
+				t.Errorf("contentType = %v, want %v", got.contentType, tt.contentType)
+			}
+		})
+	}
+}
+
+func TestApplyMessageTemplates(t *testing.T) {
+	tests := []struct {
+		name            string
+		properties      map[string]string
+		contentType     string
+		messages        int
+		wantProperties  map[string]string
+		wantContentType string
+	}{
+		{
+			name: "device data",
+			properties: map[string]string{
+				"source":    "{{.Simulation}}/{{.Target}}/{{.Model}}/{{.DeviceID}}",
+				"component": "{{.Component}}",
+				"time":      "{{.Time.Unix}}",
+			},
+			messages:        1,
+			wantProperties:  map[string]string{"source": "sim/target/thermostat/device-1", "component": "sensor", "time": "1609459200"},
+			wantContentType: contentTypeJson,
+		},
+		{
+			name:            "sequence number",
+			properties:      map[string]string{"seq": "{{.Seq}}"},
+			messages:        3,
+			wantProperties:  map[string]string{"seq": "3"},
+			wantContentType: contentTypeJson,
+		},
+		{
+			name:            "random values",
+			properties:      map[string]string{"direction": `{{.Pick "north" "east" "south" "west"}}`, "level": "{{.RandInt 1 5}}", "none": "{{.Pick}}"},
+			messages:        1,
+			wantProperties:  map[string]string{"direction": "south", "level": "3", "none": ""},
+			wantContentType: contentTypeJson,
+		},
+		{
+			name:            "failed template",
+			properties:      map[string]string{"seq": "{{.Seq}}", "missing": "{{.Missing}}"},
+			messages:        1,
+			wantProperties:  map[string]string{"seq": "1"},
+			wantContentType: contentTypeJson,
+		},
+		{
+			name:            "content type",
+			contentType:     "application/vnd.{{.Model}}+json",
+			messages:        1,
+			wantProperties:  map[string]string{},
+			wantContentType: "application/vnd.thermostat+json",
+		},
+		{
+			name:            "empty content type",
+			contentType:     `{{if eq .Component "light"}}text/plain{{end}}`,
+			messages:        1,
+			wantProperties:  map[string]string{},
+			wantContentType: contentTypeJson,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			templates, err := parseMessageTemplates(&models.SimulationDeviceConfig{ID: "config", MessageProperties: tt.properties, ContentType: tt.contentType})
+			if err != nil {
+				t.Fatal(err)
+			}
+			dev := &device{
+				deviceID:   "device-1",
+				model:      &models.DeviceModel{ID: "thermostat"},
+				simulation: &models.Simulation{ID: "sim", TargetID: "target"},
+			}
+			d := &DataGenerator{messageTemplates: templates, propertyRandom: fixedRandom(0.5)}
+
+			var msg *telemetryMessage
+			for i := 0; i < tt.messages; i++ {
+				msg = &telemetryMessage{
+					componentName:   "sensor",
+					creationTimeUtc: time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC),
+					contentType:     contentTypeJson,
+				}
+				d.applyMessageTemplates(dev, msg)
+			}
+			if !reflect.DeepEqual(msg.properties, tt.wantProperties) {
+				t.Errorf("properties = %v, want %v", msg.properties, tt.wantProperties)
+			}
+			if msg.contentType != tt.wantContentType {
+				t.Errorf("contentType = %s, want %s", msg.contentType, tt.wantContentType)
+			}
+		})
+	}
+}
@@ -9,6 +9,7 @@ var (
 	deviceFailoverTotal          *prometheus.CounterVec
 	provisionSuccessTotal        *prometheus.CounterVec
 	provisionFailuresTotal       *prometheus.CounterVec
+	provisionRetriesTotal        *prometheus.CounterVec
 	provisionLatency             *prometheus.HistogramVec
 	telemetryBatchSuccessTotal   *prometheus.CounterVec
 	telemetryBatchSkippedTotal   *prometheus.CounterVec
@@ -26,6 +27,13 @@ var (
 	reportedPropsFailureTotal    *prometheus.CounterVec
 	reportedPropsSendLatency     *prometheus.HistogramVec
 	commandsSuccessTotal         *prometheus.CounterVec
+	commandsFailureTotal         *prometheus.CounterVec
+	commandsCompletedTotal       *prometheus.CounterVec
+	commandsRejectedTotal        *prometheus.CounterVec
+	commandsAbandonedTotal       *prometheus.CounterVec
+	telemetryFaultsTotal         *prometheus.CounterVec
+	telemetryRecordsPerMessage   *prometheus.HistogramVec
+	backfillProgressGauge        *prometheus.GaugeVec
 )
 
 // init initializes the metrics used in simulation
@@ -47,7 +55,7 @@ func init() {
 			Name:      "connect_total",
 			Help:      "Total number of devices connected",
 		},
-		[]string{"sim", "target", "model", "hub"},
+		[]string{"sim", "target", "model", "transport", "hub"},
 	)
 
 	deviceConnectLatency = prometheus.NewHistogramVec(
@@ -58,7 +66,7 @@ func init() {
 			Help:      "Latency of device connecting to IoT Central",
 			Buckets:   []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 20, 30, 60, 120, 240, 480, 960},
 		},
-		[]string{"sim", "target", "model"},
+		[]string{"sim", "target", "model", "transport"},
 	)
 
 	deviceFailoverTotal = prometheus.NewCounterVec(
@@ -68,7 +76,7 @@ func init() {
 			Name:      "failover_total",
 			Help:      "Total devices failed over to a new hub",
 		},
-		[]string{"sim", "target", "model"})
+		[]string{"sim", "target", "model", "transport"})
 
 	provisionSuccessTotal = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
@@ -86,7 +94,17 @@ func init() {
 			Name:      "failure_total",
 			Help:      "Total devices failed provisioning",
 		},
-		[]string{"sim", "target", "model"},
+		[]string{"sim", "target", "model", "reason"},
+	)
+
+	provisionRetriesTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "starling",
+			Subsystem: "provisioning",
+			Name:      "retries_total",
+			Help:      "Total device registration requests sent again",
+		},
+		[]string{"sim", "target", "model", "reason"},
 	)
 
 	provisionLatency = prometheus.NewHistogramVec(
@@ -107,7 +125,7 @@ func init() {
 			Name:      "telemetry_batches_success_total",
 			Help:      "Total telemetry batches sent successfully.",
 		},
-		[]string{"sim", "target", "model"},
+		[]string{"sim", "target", "model", "transport"},
 	)
 
 	telemetryBatchSkippedTotal = prometheus.NewCounterVec(
@@ -117,7 +135,7 @@ func init() {
 			Name:      "telemetry_batches_skipped_total",
 			Help:      "Total telemetry batches skipped.",
 		},
-		[]string{"sim", "target", "model"},
+		[]string{"sim", "target", "model", "transport"},
 	)
 
 	telemetryBatchSendLatency = prometheus.NewHistogramVec(
@@ -128,7 +146,7 @@ func init() {
 			Help:      "Latency of sending telemetry batch from client to IoT Central",
 			Buckets:   []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 20, 30, 60, 120, 240, 480, 960},
 		},
-		[]string{"sim", "target", "model"},
+		[]string{"sim", "target", "model", "transport"},
 	)
 
 	telemetryMessageSuccessTotal = prometheus.NewCounterVec(
@@ -138,7 +156,7 @@ func init() {
 			Name:      "telemetry_messages_success_total",
 			Help:      "Total telemetry messages sent successfully.",
 		},
-		[]string{"sim", "target", "model"},
+		[]string{"sim", "target", "model", "transport"},
 	)
 
 	telemetryMessageFailureTotal = prometheus.NewCounterVec(
@@ -148,7 +166,7 @@ func init() {
 			Name:      "telemetry_messages_failure_total",
 			Help:      "Total telemetry messages send failures.",
 		},
-		[]string{"sim", "target", "model", "error"},
+		[]string{"sim", "target", "model", "transport", "error"},
 	)
 
 	telemetryMessageSendLatency = prometheus.NewHistogramVec(
@@ -159,7 +177,7 @@ func init() {
 			Help:      "Latency of sending telemetry messages from Starling to IoT Central",
 			Buckets:   []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 20, 30, 60, 120, 240, 480, 960},
 		},
-		[]string{"sim", "target", "model"},
+		[]string{"sim", "target", "model", "transport"},
 	)
 
 	telemetrySentBytes = prometheus.NewCounterVec(
@@ -169,7 +187,7 @@ func init() {
 			Name:      "telemetry_sent_bytes",
 			Help:      "Total telemetry data bytes sent.",
 		},
-		[]string{"sim", "target", "model"},
+		[]string{"sim", "target", "model", "transport"},
 	)
 
 	telemetryDataPointsSentTotal = prometheus.NewCounterVec(
@@ -179,7 +197,7 @@ func init() {
 			Name:      "telemetry_datapoints_sent_total",
 			Help:      "Total telemetry data points sent.",
 		},
-		[]string{"sim", "target", "model"},
+		[]string{"sim", "target", "model", "transport"},
 	)
 
 	twinUpdateSuccessTotal = prometheus.NewCounterVec(
@@ -189,7 +207,7 @@ func init() {
 			Name:      "twin_updates_success_total",
 			Help:      "Total twin updates sent successfully to IoT Central.",
 		},
-		[]string{"sim", "target", "model"},
+		[]string{"sim", "target", "model", "transport"},
 	)
 
 	twinUpdateFailureTotal = prometheus.NewCounterVec(
@@ -199,7 +217,7 @@ func init() {
 			Name:      "twin_updates_failure_total",
 			Help:      "Total twin update failures.",
 		},
-		[]string{"sim", "target", "model", "error"},
+		[]string{"sim", "target", "model", "transport", "error"},
 	)
 
 	twinUpdateSendLatency = prometheus.NewHistogramVec(
@@ -210,7 +228,7 @@ func init() {
 			Help:      "Latency of sending twin update from client to IoT Central",
 			Buckets:   []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 20, 30, 60, 120, 240, 480, 960},
 		},
-		[]string{"sim", "target", "model"},
+		[]string{"sim", "target", "model", "transport"},
 	)
 
 	reportedPropsSkippedTotal = prometheus.NewCounterVec(
@@ -220,7 +238,7 @@ func init() {
 			Name:      "reported_props_skipped_total",
 			Help:      "Total reported property updates skipped.",
 		},
-		[]string{"sim", "target", "model"},
+		[]string{"sim", "target", "model", "transport"},
 	)
 
 	reportedPropsSuccessTotal = prometheus.NewCounterVec(
@@ -230,7 +248,7 @@ func init() {
 			Name:      "reported_props_success_total",
 			Help:      "Total reported properties sent successfully to IoT Central.",
 		},
-		[]string{"sim", "target", "model"},
+		[]string{"sim", "target", "model", "transport"},
 	)
 
 	reportedPropsFailureTotal = prometheus.NewCounterVec(
@@ -240,7 +258,7 @@ func init() {
 			Name:      "reported_props_failure_total",
 			Help:      "Total reported properties send failures.",
 		},
-		[]string{"sim", "target", "model", "error"},
+		[]string{"sim", "target", "model", "transport", "error"},
 	)
 
 	reportedPropsSendLatency = prometheus.NewHistogramVec(
@@ -251,7 +269,7 @@ func init() {
 			Help:      "Latency of sending reported properties from client to IoT Central",
 			Buckets:   []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 20, 30, 60, 120, 240, 480, 960},
 		},
-		[]string{"sim", "target", "model"},
+		[]string{"sim", "target", "model", "transport"},
 	)
 
 	commandsSuccessTotal = prometheus.NewCounterVec(
@@ -261,9 +279,80 @@ func init() {
 			Name:      "commands_success_total",
 			Help:      "Total successful commands received.",
 		},
+		[]string{"sim", "target", "model", "transport"},
+	)
+
+	commandsFailureTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "starling",
+			Subsystem: "simulating",
+			Name:      "commands_failure_total",
+			Help:      "Total commands received that the device failed to process.",
+		},
+		[]string{"sim", "target", "model", "transport"},
+	)
+
+	commandsCompletedTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "starling",
+			Subsystem: "simulating",
+			Name:      "commands_completed_total",
+			Help:      "Total c2d commands completed.",
+		},
+		[]string{"sim", "target", "model", "transport"},
+	)
+
+	commandsRejectedTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "starling",
+			Subsystem: "simulating",
+			Name:      "commands_rejected_total",
+			Help:      "Total c2d commands rejected.",
+		},
+		[]string{"sim", "target", "model", "transport"},
+	)
+
+	commandsAbandonedTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "starling",
+			Subsystem: "simulating",
+			Name:      "commands_abandoned_total",
+			Help:      "Total c2d commands abandoned.",
+		},
+		[]string{"sim", "target", "model", "transport"},
+	)
+
+	telemetryFaultsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "starling",
+			Subsystem: "simulating",
+			Name:      "telemetry_faults_total",
+			Help:      "Total faults injected into telemetry messages.",
+		},
+		[]string{"sim", "target", "model", "fault"},
+	)
+
+	telemetryRecordsPerMessage = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "starling",
+			Subsystem: "simulating",
+			Name:      "telemetry_records_per_message",
+			Help:      "Number of telemetry records packed into a message.",
+			Buckets:   []float64{1, 2, 5, 10, 20, 50, 100, 200, 500, 1000},
+		},
 		[]string{"sim", "target", "model"},
 	)
 
+	backfillProgressGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "starling",
+			Subsystem: "simulating",
+			Name:      "backfill_progress_percent",
+			Help:      "Percentage of the virtual time range of a backfill that was sent.",
+		},
+		[]string{"sim", "target"},
+	)
+
 	prometheus.MustRegister(
 		simulatedDeviceGauge,
 		deviceConnectLatency,
@@ -271,6 +360,7 @@ func init() {
 		deviceFailoverTotal,
 		provisionSuccessTotal,
 		provisionFailuresTotal,
+		provisionRetriesTotal,
 		provisionLatency,
 		telemetryBatchSuccessTotal,
 		telemetryBatchSkippedTotal,
@@ -288,5 +378,12 @@ func init() {
 		reportedPropsFailureTotal,
 		reportedPropsSendLatency,
 		commandsSuccessTotal,
+		commandsFailureTotal,
+		commandsCompletedTotal,
+		commandsRejectedTotal,
+		commandsAbandonedTotal,
+		telemetryFaultsTotal,
+		telemetryRecordsPerMessage,
+		backfillProgressGauge,
 	)
 }
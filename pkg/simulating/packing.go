@@ -0,0 +1,108 @@
+package simulating
+
+import (
+	"github.com/iot-for-all/starling/pkg/models"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// defaultMaxMessageSize is the maximum size of packed telemetry messages, the maximum IoT Hub message size.
+	defaultMaxMessageSize = 256 * 1024
+	// packedRecordOverhead is the maximum size of the separator, length or header of a record in a packed message.
+	packedRecordOverhead = 10
+	// packedMessageOverhead is the maximum size of the array or envelope of a packed message without its records.
+	packedMessageOverhead = len(`{"records":[]}`) + 2*packedRecordOverhead
+)
+
+// PackTelemetryMessages packs the telemetry messages of a batch into multi-record messages based on the telemetry packing
+// of the simulation. Records of the root interface and of each component are packed separately, since component telemetry
+// is identified by a message property. Packed messages are split when they would exceed the maximum message size.
+func (d *DataGenerator) PackTelemetryMessages(device *device, messages []*telemetryMessage) []*telemetryMessage {
+	packing := device.simulation.TelemetryPacking
+	if packing != models.TelemetryPackingArray && packing != models.TelemetryPackingEnvelope {
+		return messages
+	}
+
+	maxSize := device.simulation.MaxMessageSize
+	if maxSize <= 0 {
+		maxSize = defaultMaxMessageSize
+	}
+
+	var components []string
+	records := make(map[string][]*telemetryMessage)
+	for _, msg := range messages {
+		if _, ok := records[msg.componentName]; !ok {
+			components = append(components, msg.componentName)
+		}
+		records[msg.componentName] = append(records[msg.componentName], msg)
+	}
+
+	var packed []*telemetryMessage
+	for _, componentName := range components {
+		var pending []*telemetryMessage
+		size := 0
+		for _, record := range records[componentName] {
+			recordSize := getPackedRecordSize(packing, record)
+			// a record exceeding the maximum size on its own is still sent in its own message
+			if len(pending) > 0 && packedMessageOverhead+size+recordSize > maxSize {
+				packed = appendPackedMessage(packed, d.newPackedMessage(device, packing, pending))
+				pending = nil
+				size = 0
+			}
+			pending = append(pending, record)
+			size += recordSize
+		}
+		if len(pending) > 0 {
+			packed = appendPackedMessage(packed, d.newPackedMessage(device, packing, pending))
+		}
+	}
+	return packed
+}
+
+// newPackedMessage creates a message with the given records packed into its body.
+func (d *DataGenerator) newPackedMessage(device *device, packing models.TelemetryPacking, records []*telemetryMessage) *telemetryMessage {
+	body, err := packRecords(device.simulation.TelemetryFormat, packing, records)
+	if err != nil {
+		log.Error().Err(err).Str("deviceID", device.deviceID).Msg("error packing telemetry records")
+		return nil
+	}
+
+	dataPointCount := 0
+	for _, record := range records {
+		dataPointCount += record.dataPointCount
+	}
+	telemetryRecordsPerMessage.WithLabelValues(device.simulation.ID, device.simulation.TargetID, device.model.ID).Observe(float64(len(records)))
+
+	last := records[len(records)-1]
+	return &telemetryMessage{
+		body:               body,
+		interfaceId:        last.interfaceId,
+		componentName:      last.componentName,
+		connectionDeviceID: last.connectionDeviceID,
+		connectionModuleID: last.connectionModuleID,
+		contentEncoding:    last.contentEncoding,
+		contentType:        last.contentType,
+		correlationID:      newUUID(d.random),
+		messageID:          newUUID(d.random),
+		creationTimeUtc:    last.creationTimeUtc,
+		properties:         last.properties,
+		dataPointCount:     dataPointCount,
+	}
+}
+
+// getPackedRecordSize gets the maximum size of a record in a packed message, including the array or envelope around it.
+func getPackedRecordSize(packing models.TelemetryPacking, record *telemetryMessage) int {
+	size := len(record.body) + packedRecordOverhead
+	if packing == models.TelemetryPackingEnvelope {
+		size += len(`{"timestamp":"","values":}`) + len(getRecordTimestamp(record))
+	}
+	return size
+}
+
+// appendPackedMessage appends a packed message to the messages of a batch, unless the records could not be packed.
+func appendPackedMessage(messages []*telemetryMessage, msg *telemetryMessage) []*telemetryMessage {
+	if msg == nil {
+		return messages
+	}
+	return append(messages, msg)
+}
@@ -0,0 +1,125 @@
+package simulating
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/iot-for-all/starling/pkg/models"
+)
+
+func TestPackTelemetryMessages(t *testing.T) {
+	// record is a telemetry message of a component with a JSON body of the given size
+	type record struct {
+		component string
+		size      int
+	}
+	// packed is a packed message of a component with the given number of records
+	type packed struct {
+		component string
+		records   int
+	}
+
+	tests := []struct {
+		name    string
+		packing models.TelemetryPacking
+		maxSize int
+		records []record
+		want    []packed
+	}{
+		{
+			name:    "not packed",
+			packing: "",
+			records: []record{{"", 20}, {"", 20}},
+			want:    []packed{{"", 1}, {"", 1}},
+		},
+		{
+			name:    "array",
+			packing: models.TelemetryPackingArray,
+			records: []record{{"", 20}, {"", 20}, {"", 20}},
+			want:    []packed{{"", 3}},
+		},
+		{
+			name:    "components packed separately",
+			packing: models.TelemetryPackingArray,
+			records: []record{{"sensor", 20}, {"", 20}, {"sensor", 20}, {"light", 20}, {"", 20}},
+			want:    []packed{{"sensor", 2}, {"", 2}, {"light", 1}},
+		},
+		{
+			name:    "split at the maximum size",
+			packing: models.TelemetryPackingArray,
+			maxSize: packedMessageOverhead + 2*(100+packedRecordOverhead),
+			records: []record{{"", 100}, {"", 100}, {"", 100}, {"", 100}, {"", 100}},
+			want:    []packed{{"", 2}, {"", 2}, {"", 1}},
+		},
+		{
+			name:    "record exceeding the maximum size",
+			packing: models.TelemetryPackingArray,
+			maxSize: packedMessageOverhead + 2*(50+packedRecordOverhead),
+			records: []record{{"", 50}, {"", 200}, {"", 50}, {"", 50}},
+			want:    []packed{{"", 1}, {"", 1}, {"", 2}},
+		},
+		{
+			name:    "envelope records include their timestamps",
+			packing: models.TelemetryPackingEnvelope,
+			maxSize: packedMessageOverhead + 2*(100+packedRecordOverhead),
+			records: []record{{"", 100}, {"", 100}, {"", 100}},
+			want:    []packed{{"", 1}, {"", 1}, {"", 1}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dev := &device{
+				deviceID: "device-1",
+				model:    &models.DeviceModel{ID: "thermostat"},
+				simulation: &models.Simulation{
+					ID:               "sim",
+					TargetID:         "target",
+					TelemetryFormat:  models.TelemetryFormatDefault,
+					TelemetryPacking: tt.packing,
+					MaxMessageSize:   tt.maxSize,
+				},
+			}
+			start := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+			var messages []*telemetryMessage
+			for i, r := range tt.records {
+				// a JSON string of the given size
+				body := `"` + strings.Repeat("x", r.size-2) + `"`
+				messages = append(messages, &telemetryMessage{
+					body:            []byte(body),
+					componentName:   r.component,
+					creationTimeUtc: start.Add(time.Duration(i) * time.Second),
+					dataPointCount:  1,
+				})
+			}
+
+			d := &DataGenerator{}
+			var got []packed
+			for _, msg := range d.PackTelemetryMessages(dev, messages) {
+				got = append(got, packed{msg.componentName, msg.dataPointCount})
+				if tt.packing == "" {
+					continue
+				}
+
+				// packed bodies are valid JSON within the maximum size, unless they hold a single record exceeding it
+				var body interface{}
+				if err := json.Unmarshal(msg.body, &body); err != nil {
+					t.Errorf("invalid packed body %s (%s)", msg.body, err.Error())
+				}
+				if tt.maxSize > 0 && msg.dataPointCount > 1 && len(msg.body) > tt.maxSize {
+					t.Errorf("packed body of %d bytes exceeds the maximum size of %d bytes", len(msg.body), tt.maxSize)
+				}
+				if tt.packing == models.TelemetryPackingEnvelope && !bytes.HasPrefix(msg.body, []byte(`{"records":[{"timestamp":"2021-01-01T`)) {
+					t.Errorf("got packed body %s, want an envelope", msg.body)
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("PackTelemetryMessages() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -3,14 +3,17 @@ package simulating
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/rs/zerolog/log"
+	"io"
 	"net/http"
-	"strconv"
 	"time"
 
 	"github.com/iot-for-all/starling/pkg/models"
+	"github.com/iot-for-all/starling/pkg/storing"
 	"github.com/iot-for-all/starling/pkg/util"
 )
 
@@ -22,12 +25,15 @@ type (
 		Simulation *models.Simulation       // simulation that is requesting the device provision.
 		Target     *models.SimulationTarget // target to provision the device with.
 		Model      *models.DeviceModel      // model to associate with the device.
+		Payload    *ProvisioningPayload     // custom registration payload of the device config of the device, if any.
 	}
 
 	// ProvisioningResponse represents the response for a given provision request.
 	ProvisioningResponse struct {
-		*ProvisioningRequest        // the request to which this response is generated.
-		ConnectionString     string // Result of the provision request.
+		*ProvisioningRequest                        // the request to which this response is generated.
+		ConnectionString     string                 // Result of the provision request.
+		Certificate          *tls.Certificate       // certificate the device authenticates with, nil for symmetric keys.
+		Payload              map[string]interface{} // payload returned by DPS in the registration result, if any.
 	}
 
 	// DeviceProvisioner responsible for provisioning devices via DPS.
@@ -51,10 +57,13 @@ type (
 
 	// registrationResult is the result of the registration request
 	registrationResult struct {
+		Status            string `json:"status"`
 		RegistrationState struct {
-			AssignedHub string `json:"assignedHub"`
-			DeviceID    string `json:"deviceId"`
-			Status      string `json:"status"`
+			AssignedHub  string                 `json:"assignedHub"`
+			DeviceID     string                 `json:"deviceId"`
+			Status       string                 `json:"status"`
+			ErrorMessage string                 `json:"errorMessage"`
+			Payload      map[string]interface{} `json:"payload"`
 		} `json:"registrationState"`
 	}
 )
@@ -76,17 +85,37 @@ func NewProvisioner(ctx context.Context, cfg *Config) *DeviceProvisioner {
 func (p *DeviceProvisioner) Provision(req *ProvisioningRequest) *ProvisioningResponse {
 	log.Trace().Str("deviceID", req.DeviceID).Msg("provisioning device")
 
-	key, err := util.ComputeHmac(req.Target.MasterKey, req.DeviceID)
-	if err != nil {
-		log.Error().Err(err).Str("deviceId", req.DeviceID).Msg("failed to compute device key for device")
-		return nil
+	ctx := req.Context
+	if ctx == nil {
+		ctx = p.context
 	}
 
-	keyRes := fmt.Sprintf("%s/registrations/%s", req.Target.IDScope, req.DeviceID)
-	token, err := util.CreateSasToken(key, keyRes, "registration", 1*time.Minute)
-	if err != nil {
-		log.Error().Err(err).Str("deviceId", req.DeviceID).Msg("failed to compute sas key for device")
-		return nil
+	// devices with X.509 certificates authenticate with their certificate in the TLS handshake instead of a token
+	var key string
+	var cert *tls.Certificate
+	var err error
+	client := p.client
+	if req.Target.AuthType == models.TargetAuthX509 {
+		cert, err = getDeviceCertificate(req.Target, req.DeviceID)
+		if err != nil {
+			return p.fail(req, &registrationError{reason: registrationReasonCredentials, err: err}, "failed to get certificate for device")
+		}
+		client = p.newX509Client(cert)
+		defer client.CloseIdleConnections()
+	} else {
+		// devices with an individual enrollment use its key, the others derive their key from the master key of the group
+		enrollment, err := storing.TargetEnrollments.Get(req.Target.ID, req.DeviceID)
+		if err != nil {
+			return p.fail(req, &registrationError{reason: registrationReasonCredentials, err: err}, "failed to get individual enrollment for device")
+		}
+		if enrollment != nil {
+			key = enrollment.PrimaryKey
+		} else {
+			key, err = util.ComputeHmac(req.Target.MasterKey, req.DeviceID)
+			if err != nil {
+				return p.fail(req, &registrationError{reason: registrationReasonCredentials, err: err}, "failed to compute device key for device")
+			}
+		}
 	}
 
 	start := time.Now()
@@ -96,37 +125,32 @@ func (p *DeviceProvisioner) Provision(req *ProvisioningRequest) *ProvisioningRes
 		modelID = id.(string)
 	}
 
-	opdID, err := p.sendRegisterRequest(
-		req.Target.ProvisioningURL,
-		req.Target.IDScope,
-		req.DeviceID,
-		modelID,
-		token)
+	payload, err := getRegistrationPayload(req, modelID)
+	if err != nil {
+		return p.fail(req, &registrationError{reason: registrationReasonPayload, err: err}, "failed to create registration payload for device")
+	}
 
+	opdID, err := p.sendRegisterRequest(ctx, client, req, payload, key)
 	if err != nil {
-		log.Error().Err(err).Str("deviceId", req.DeviceID).Msg("failed to register device")
-		provisionFailuresTotal.WithLabelValues(req.Simulation.ID, req.Simulation.TargetID, req.Model.ID).Add(1)
-		return nil
+		return p.fail(req, err, "failed to register device")
 	}
 
 	log.Trace().Str("deviceID", req.DeviceID).Msg("checking registration status")
 
-	reg, err := p.getRegistrationStatus(
-		req.Target.ProvisioningURL,
-		req.Target.IDScope,
-		req.DeviceID,
-		opdID, token)
-
+	reg, err := p.getRegistrationStatus(ctx, client, req, opdID, key)
 	if err != nil {
-		log.Error().Err(err).Str("deviceId", req.DeviceID).Msg("failed to get device registration result")
-		provisionFailuresTotal.WithLabelValues(req.Simulation.ID, req.Simulation.TargetID, req.Model.ID).Add(1)
-		return nil
+		return p.fail(req, err, "failed to get device registration result")
 	}
 
 	connStr := fmt.Sprintf("HostName=%s;DeviceId=%s;SharedAccessKey=%s",
 		reg.RegistrationState.AssignedHub,
 		req.DeviceID,
 		key)
+	if cert != nil {
+		connStr = fmt.Sprintf("HostName=%s;DeviceId=%s;x509=true",
+			reg.RegistrationState.AssignedHub,
+			req.DeviceID)
+	}
 
 	end := time.Now()
 	latency := float64(end.UnixNano()-start.UnixNano()) / float64(time.Second)
@@ -138,106 +162,205 @@ func (p *DeviceProvisioner) Provision(req *ProvisioningRequest) *ProvisioningRes
 	return &ProvisioningResponse{
 		ProvisioningRequest: req,
 		ConnectionString:    connStr,
+		Certificate:         cert,
+		Payload:             reg.RegistrationState.Payload,
 	}
 }
 
-// sendRegisterRequest sends the registration request to DPS for registering the device
-// host is the target DPS host to send the request to.
-// scopeID is the DPS scope to register the device with.
-// deviceID is the id of the device to register.
-// modelID is the id of the model to register the device as.
-// token is the shared access token used for authorization.
-func (p *DeviceProvisioner) sendRegisterRequest(
-	host string,
-	idScope string,
-	deviceID string,
-	modelID string,
-	token string) (string, error) {
-	// todo: handle error conditions
-	// todo: handle retry
-	path := fmt.Sprintf("https://%s/%s/registrations/%s/register?api-version=2019-03-31", host, idScope, deviceID)
-
-	reqData, err := json.Marshal(registrationRequest{
-		RegistrationID: deviceID,
-		Payload: map[string]interface{}{
-			"modelId": modelID,
-		},
-	})
-	if err != nil {
-		return "", fmt.Errorf("error creating device registration object (%s)", err.Error())
+// fail logs the failure to provision a device, and counts it by its reason.
+func (p *DeviceProvisioner) fail(req *ProvisioningRequest, err error, msg string) *ProvisioningResponse {
+	reason := getRegistrationErrorReason(err)
+	if reason == registrationReasonCancelled {
+		log.Debug().Err(err).Str("deviceId", req.DeviceID).Msg(msg)
+	} else {
+		log.Error().Err(err).Str("deviceId", req.DeviceID).Str("reason", reason).Msg(msg)
 	}
+	provisionFailuresTotal.WithLabelValues(req.Simulation.ID, req.Simulation.TargetID, req.Model.ID, reason).Add(1)
+	return nil
+}
 
-	req, err := http.NewRequestWithContext(p.context, "PUT", path, bytes.NewReader(reqData))
-	if err != nil {
-		return "", fmt.Errorf("error creating device registration request to DPS (%s)", err.Error())
+// getRegistrationPayload gets the payload sent to DPS to register a device, with the custom payload of its device config.
+// The model id of the device is always sent, so that IoT Central associates the device with its model.
+func getRegistrationPayload(req *ProvisioningRequest, modelID string) (map[string]interface{}, error) {
+	payload := map[string]interface{}{}
+	if req.Payload != nil {
+		var err error
+		payload, err = req.Payload.render(&provisioningPayloadData{
+			DeviceID:   req.DeviceID,
+			Model:      req.Model.ID,
+			Simulation: req.Simulation.ID,
+			Target:     req.Target.ID,
+		})
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	req.Header.Add("Content-Type", "application/json")
-	req.Header.Add("Encoding", "utf-8")
-	req.Header.Add("Authorization", token)
+	payload["modelId"] = modelID
+	return payload, nil
+}
 
-	res, err := p.client.Do(req)
-	if err != nil {
-		return "", fmt.Errorf("error sending device registration request to DPS (%s)", err.Error())
+// newX509Client creates an HTTP client authenticating with the certificate of a device to register it with DPS.
+func (p *DeviceProvisioner) newX509Client(cert *tls.Certificate) *http.Client {
+	return &http.Client{
+		Timeout: p.client.Timeout,
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{
+				Certificates: []tls.Certificate{*cert},
+			},
+		},
 	}
+}
+
+// sendRegisterRequest sends the registration request to DPS for registering the device, and gets the id of the
+// registration operation.
+// client is the http client used to send the request.
+// req is the provisioning request of the device, with the target DPS to register the device with.
+// payload is the registration payload, with the id of the model to register the device as.
+// key is the key signing the shared access token of each attempt, empty for devices with X.509 certificates.
+func (p *DeviceProvisioner) sendRegisterRequest(
+	ctx context.Context,
+	client *http.Client,
+	req *ProvisioningRequest,
+	payload map[string]interface{},
+	key string) (string, error) {
 
-	var resData registrationResponse
-	err = json.NewDecoder(res.Body).Decode(&resData)
+	path := fmt.Sprintf("https://%s/%s/registrations/%s/register?api-version=2019-03-31", req.Target.ProvisioningURL, req.Target.IDScope, req.DeviceID)
+	reqData, err := json.Marshal(registrationRequest{
+		RegistrationID: req.DeviceID,
+		Payload:        payload,
+	})
 	if err != nil {
-		return "", fmt.Errorf("error parsing device registration response from DPS (%s)", err.Error())
+		return "", &registrationError{
+			reason: registrationReasonPayload,
+			err:    fmt.Errorf("error creating device registration object (%s)", err.Error()),
+		}
 	}
 
-	return resData.OperationID, nil
+	var operationID string
+	err = p.withRetries(ctx, req, func() error {
+		res, err := p.sendRequest(ctx, client, req, http.MethodPut, path, reqData, key)
+		if err != nil {
+			return err
+		}
+		defer res.Body.Close()
+
+		var resData registrationResponse
+		if err = json.NewDecoder(res.Body).Decode(&resData); err != nil {
+			return &registrationError{
+				reason: registrationReasonInvalidResponse,
+				err:    fmt.Errorf("error parsing device registration response from DPS (%s)", err.Error()),
+			}
+		}
+		if resData.OperationID == "" {
+			return &registrationError{
+				reason: registrationReasonInvalidResponse,
+				err:    errors.New("device registration response from DPS has no operation id"),
+			}
+		}
+
+		operationID = resData.OperationID
+		return nil
+	})
+	return operationID, err
 }
 
-// getRegistrationStatus get the registration status of a registration request
+// getRegistrationStatus polls the status of a registration operation till the device is assigned to a hub.
 func (p *DeviceProvisioner) getRegistrationStatus(
-	host string,
-	idScope string,
-	deviceID string,
+	ctx context.Context,
+	client *http.Client,
+	req *ProvisioningRequest,
 	operationID string,
-	token string) (*registrationResult, error) {
+	key string) (*registrationResult, error) {
 
-	path := fmt.Sprintf("https://%s/%s/registrations/%s/operations/%s?api-version=2019-03-31", host, idScope, deviceID, operationID)
-	req, err := http.NewRequestWithContext(p.context, "GET", path, nil)
-	if err != nil {
-		return nil, err
-	}
+	path := fmt.Sprintf("https://%s/%s/registrations/%s/operations/%s?api-version=2019-03-31", req.Target.ProvisioningURL, req.Target.IDScope, req.DeviceID, operationID)
 
-	req.Header.Add("Content-Type", "application/json")
-	req.Header.Add("Encoding", "utf-8")
-	req.Header.Add("Authorization", token)
+	var result *registrationResult
+	err := p.withRetries(ctx, req, func() error {
+		res, err := p.sendRequest(ctx, client, req, http.MethodGet, path, nil, key)
+		if err != nil {
+			return err
+		}
+		defer res.Body.Close()
 
-	for i := 1; i <= p.config.MaxRegistrationAttempts; i++ {
-		select {
-		case <-p.context.Done():
-			return nil, fmt.Errorf("operation cancelled")
-		default:
-			res, err := p.client.Do(req)
-			if err != nil {
-				return nil, err
+		var resData registrationResult
+		if err = json.NewDecoder(res.Body).Decode(&resData); err != nil {
+			return &registrationError{
+				reason: registrationReasonInvalidResponse,
+				err:    fmt.Errorf("error parsing device registration status from DPS (%s)", err.Error()),
 			}
+		}
 
-			if res.StatusCode == http.StatusAccepted {
-				backoff, err := strconv.Atoi(res.Header.Get("Retry-After"))
-				if err != nil {
-					backoff = 3
-				}
-
-				log.Trace().Str("deviceID", deviceID).Int("backoff", backoff).Int("attempt", i).Msg("Registration status")
-				time.Sleep(time.Duration(backoff) * time.Second)
-				continue
+		// the registration is being assigned, poll its status again after the time requested by DPS
+		if res.StatusCode == http.StatusAccepted || resData.Status == "assigning" {
+			retryAfter := parseRetryAfter(res.Header.Get("Retry-After"))
+			if retryAfter <= 0 {
+				retryAfter = registrationStatusInterval
 			}
+			return &registrationError{
+				reason:     registrationReasonAssigning,
+				retry:      true,
+				retryAfter: retryAfter,
+				err:        errors.New("device registration is still being assigned"),
+			}
+		}
 
-			var resData registrationResult
-			err = json.NewDecoder(res.Body).Decode(&resData)
-			if err != nil {
-				return nil, err
+		if resData.RegistrationState.Status != "assigned" {
+			return &registrationError{
+				reason: registrationReasonFailed,
+				err: fmt.Errorf("device registration is %s (%s)",
+					resData.RegistrationState.Status,
+					resData.RegistrationState.ErrorMessage),
 			}
+		}
+
+		result = &resData
+		return nil
+	})
+	return result, err
+}
 
-			return &resData, nil
+// sendRequest sends a request to DPS, authorized with a new shared access token signed with the key of the device, if any.
+// Unsuccessful responses are returned as errors classified by their status code.
+func (p *DeviceProvisioner) sendRequest(
+	ctx context.Context,
+	client *http.Client,
+	req *ProvisioningRequest,
+	method string,
+	path string,
+	body []byte,
+	key string) (*http.Response, error) {
+
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, method, path, reader)
+	if err != nil {
+		return nil, fmt.Errorf("error creating device registration request to DPS (%s)", err.Error())
+	}
+
+	httpReq.Header.Add("Content-Type", "application/json")
+	httpReq.Header.Add("Encoding", "utf-8")
+	if key != "" {
+		keyRes := fmt.Sprintf("%s/registrations/%s", req.Target.IDScope, req.DeviceID)
+		token, err := util.CreateSasToken(key, keyRes, "registration", 1*time.Minute)
+		if err != nil {
+			return nil, &registrationError{
+				reason: registrationReasonCredentials,
+				err:    fmt.Errorf("error computing sas token for device (%s)", err.Error()),
+			}
 		}
+		httpReq.Header.Add("Authorization", token)
 	}
 
-	return nil, fmt.Errorf("failed to evaluate registration status. all retry attempts failed")
+	res, err := client.Do(httpReq)
+	if err != nil {
+		return nil, newRequestError(ctx, err)
+	}
+	if res.StatusCode >= http.StatusMultipleChoices {
+		defer res.Body.Close()
+		return nil, newResponseError(res)
+	}
+	return res, nil
 }
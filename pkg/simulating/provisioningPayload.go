@@ -0,0 +1,126 @@
+package simulating
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"strings"
+	"text/template"
+
+	"github.com/iot-for-all/starling/pkg/models"
+)
+
+type (
+	// ProvisioningPayload is the custom payload sent to DPS when registering the devices of a device config, e.g. for the
+	// custom allocation functions of DPS. String values of the payload are templates, parsed once per device config.
+	ProvisioningPayload struct {
+		value interface{} // payload with templates in place of strings, in nested objects and arrays too.
+	}
+
+	// provisioningPayloadData is the data the payload templates are executed with, e.g. {{.DeviceID}} or {{.Pick "eu" "us"}}.
+	provisioningPayloadData struct {
+		DeviceID   string // id of the device registering.
+		Model      string // id of the model of the device.
+		Simulation string // id of the simulation.
+		Target     string // id of the target application.
+	}
+)
+
+// ParseProvisioningPayload parses the custom provisioning payload of a device config, nil if it has none.
+func ParseProvisioningPayload(config *models.SimulationDeviceConfig) (*ProvisioningPayload, error) {
+	if config == nil || len(config.ProvisioningPayload) == 0 {
+		return nil, nil
+	}
+
+	value, err := parsePayloadValue("provisioningPayload", config.ProvisioningPayload)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("could not parse the provisioning payload of device config '%s': %s", config.ID, err.Error()))
+	}
+	return &ProvisioningPayload{
+		value: value,
+	}, nil
+}
+
+// parsePayloadValue parses the string values of a payload value as templates, named after their path in the payload.
+func parsePayloadValue(name string, value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case string:
+		return template.New(name).Option("missingkey=error").Parse(v)
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			parsed, err := parsePayloadValue(name+"."+key, item)
+			if err != nil {
+				return nil, err
+			}
+			m[key] = parsed
+		}
+		return m, nil
+	case []interface{}:
+		a := make([]interface{}, len(v))
+		for i, item := range v {
+			parsed, err := parsePayloadValue(fmt.Sprintf("%s[%d]", name, i), item)
+			if err != nil {
+				return nil, err
+			}
+			a[i] = parsed
+		}
+		return a, nil
+	default:
+		return v, nil
+	}
+}
+
+// render executes the templates of the payload for a device.
+func (p *ProvisioningPayload) render(data *provisioningPayloadData) (map[string]interface{}, error) {
+	value, err := renderPayloadValue(p.value, data)
+	if err != nil {
+		return nil, err
+	}
+	return value.(map[string]interface{}), nil
+}
+
+// renderPayloadValue executes the templates of a payload value.
+func renderPayloadValue(value interface{}, data *provisioningPayloadData) (interface{}, error) {
+	switch v := value.(type) {
+	case *template.Template:
+		var b strings.Builder
+		if err := v.Execute(&b, data); err != nil {
+			return nil, err
+		}
+		return b.String(), nil
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			rendered, err := renderPayloadValue(item, data)
+			if err != nil {
+				return nil, err
+			}
+			m[key] = rendered
+		}
+		return m, nil
+	case []interface{}:
+		a := make([]interface{}, len(v))
+		for i, item := range v {
+			rendered, err := renderPayloadValue(item, data)
+			if err != nil {
+				return nil, err
+			}
+			a[i] = rendered
+		}
+		return a, nil
+	default:
+		return v, nil
+	}
+}
+
+// Pick picks one of the given values by the id of the device, e.g. {{.Pick "eu" "us"}}.
+// Unlike random values, a device always picks the same value, so that it is allocated to the same hub when registering again.
+func (p *provisioningPayloadData) Pick(values ...interface{}) interface{} {
+	if len(values) == 0 {
+		return ""
+	}
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(p.DeviceID))
+	return values[h.Sum32()%uint32(len(values))]
+}
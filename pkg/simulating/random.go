@@ -0,0 +1,159 @@
+package simulating
+
+import (
+	"hash/fnv"
+	"math/rand"
+	"sync"
+
+	"github.com/hashicorp/go-uuid"
+)
+
+type (
+	// randomSource is the source of the random values generated for a device.
+	randomSource interface {
+		Intn(n int) int
+		Int31n(n int32) int32
+		Int63n(n int64) int64
+		Float32() float32
+		Float64() float64
+	}
+
+	// sharedRandom is the random source shared by all devices of simulations that are not seeded.
+	sharedRandom struct{}
+
+	// seededRandom is a random source of a device derived from the seed of the simulation.
+	// Random sources are used by the telemetry, twin update and command handlers of a device, so access is synchronized.
+	seededRandom struct {
+		rand *rand.Rand // the seeded random number generator.
+		lock sync.Mutex // lock to synchronize access to the random number generator.
+	}
+)
+
+const (
+	// randomStreamValues is the stream of random telemetry and property values and message ids of a device.
+	randomStreamValues = "values"
+	// randomStreamBehaviors is the stream of random command and property acknowledgement behaviors of a device.
+	randomStreamBehaviors = "behaviors"
+	// randomStreamFaults is the stream of random telemetry faults of a device.
+	randomStreamFaults = "faults"
+	// randomStreamEvents is the stream of random event and state transition arrivals of a device.
+	randomStreamEvents = "events"
+	// randomStreamClock is the stream of random clock skews, drifts and late messages of a device.
+	randomStreamClock = "clock"
+	// randomStreamRoute is the stream of random speeds and area points of a moving device.
+	randomStreamRoute = "route"
+	// randomStreamScript is the stream of random numbers of the device script.
+	randomStreamScript = "script"
+	// randomStreamProperties is the stream of random values picked by the message property templates of a device.
+	randomStreamProperties = "properties"
+)
+
+// getDeviceSeed derives the seed of the random sources of a device from the seed of the simulation and the device id.
+// Devices of simulations that are not seeded share a random source, so their seed is 0.
+func getDeviceSeed(simulationSeed int64, deviceID string) int64 {
+	if simulationSeed == 0 {
+		return 0
+	}
+	return simulationSeed ^ hashSeed(deviceID)
+}
+
+// newRandomSource creates the random source of a stream of a device, nil if the device is not seeded.
+// Each kind of randomness has its own stream, so that random values do not depend on the order of unrelated events.
+func newRandomSource(deviceSeed int64, stream string) randomSource {
+	if deviceSeed == 0 {
+		return nil
+	}
+	return &seededRandom{
+		rand: rand.New(rand.NewSource(deviceSeed ^ hashSeed(stream))),
+	}
+}
+
+// hashSeed hashes a string into a seed.
+func hashSeed(s string) int64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(s))
+	return int64(h.Sum64())
+}
+
+// newUUID generates a UUID from the random source, or a cryptographically random UUID if there is no source.
+func newUUID(random randomSource) string {
+	if random == nil {
+		id, _ := uuid.GenerateUUID()
+		return id
+	}
+
+	buf := make([]byte, 16)
+	for i := range buf {
+		buf[i] = byte(random.Intn(256))
+	}
+	id, _ := uuid.FormatUUID(buf)
+	return id
+}
+
+// Intn returns a random int in [0,n) from the shared source.
+func (sharedRandom) Intn(n int) int {
+	return rand.Intn(n)
+}
+
+// Int31n returns a random int32 in [0,n) from the shared source.
+func (sharedRandom) Int31n(n int32) int32 {
+	return rand.Int31n(n)
+}
+
+// Int63n returns a random int64 in [0,n) from the shared source.
+func (sharedRandom) Int63n(n int64) int64 {
+	return rand.Int63n(n)
+}
+
+// Float32 returns a random float32 in [0.0,1.0) from the shared source.
+func (sharedRandom) Float32() float32 {
+	return rand.Float32()
+}
+
+// Float64 returns a random float64 in [0.0,1.0) from the shared source.
+func (sharedRandom) Float64() float64 {
+	return rand.Float64()
+}
+
+// Intn returns a random int in [0,n) from the seeded source.
+func (r *seededRandom) Intn(n int) int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.rand.Intn(n)
+}
+
+// Int31n returns a random int32 in [0,n) from the seeded source.
+func (r *seededRandom) Int31n(n int32) int32 {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.rand.Int31n(n)
+}
+
+// Int63n returns a random int64 in [0,n) from the seeded source.
+func (r *seededRandom) Int63n(n int64) int64 {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.rand.Int63n(n)
+}
+
+// Float32 returns a random float32 in [0.0,1.0) from the seeded source.
+func (r *seededRandom) Float32() float32 {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.rand.Float32()
+}
+
+// Float64 returns a random float64 in [0.0,1.0) from the seeded source.
+func (r *seededRandom) Float64() float64 {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.rand.Float64()
+}
+
+// getRandom gets the random source, the shared source if there is none.
+func getRandom(random randomSource) randomSource {
+	if random == nil {
+		return sharedRandom{}
+	}
+	return random
+}
@@ -0,0 +1,207 @@
+package simulating
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+type (
+	// registrationError is an error registering a device with DPS, with the reason it failed and whether it is retried.
+	registrationError struct {
+		reason     string        // reason of the failure, labeling the provisioning metrics.
+		retry      bool          // whether the request is sent again.
+		retryAfter time.Duration // time to wait before sending the request again as requested by DPS, 0 if not requested.
+		err        error         // the error.
+	}
+)
+
+const (
+	// defaultRegistrationBackoff is the backoff before the second registration attempt when none is configured.
+	defaultRegistrationBackoff = time.Second
+	// defaultMaxRegistrationBackoff is the maximum backoff between registration attempts when none is configured.
+	defaultMaxRegistrationBackoff = time.Minute
+	// registrationStatusInterval is the interval between polls of the registration status when DPS does not request one.
+	registrationStatusInterval = 3 * time.Second
+
+	// registrationReasonThrottled is the reason of requests throttled by DPS (429).
+	registrationReasonThrottled = "throttled"
+	// registrationReasonUnauthorized is the reason of requests with a token or certificate not accepted by DPS (401, 403).
+	registrationReasonUnauthorized = "unauthorized"
+	// registrationReasonServerError is the reason of requests failed by DPS (5xx).
+	registrationReasonServerError = "server error"
+	// registrationReasonBadRequest is the reason of requests rejected by DPS (other 4xx).
+	registrationReasonBadRequest = "bad request"
+	// registrationReasonNetworkError is the reason of requests that could not be sent or answered.
+	registrationReasonNetworkError = "network error"
+	// registrationReasonTimeout is the reason of requests not answered in time.
+	registrationReasonTimeout = "timeout"
+	// registrationReasonCancelled is the reason of registrations cancelled, e.g. by stopping the simulation.
+	registrationReasonCancelled = "cancelled"
+	// registrationReasonAssigning is the reason of registrations still being assigned after all attempts.
+	registrationReasonAssigning = "assigning"
+	// registrationReasonFailed is the reason of registrations that DPS failed or disabled.
+	registrationReasonFailed = "registration failed"
+	// registrationReasonInvalidResponse is the reason of responses that could not be parsed.
+	registrationReasonInvalidResponse = "invalid response"
+	// registrationReasonCredentials is the reason of devices without a key or a certificate to register with.
+	registrationReasonCredentials = "credentials"
+	// registrationReasonPayload is the reason of devices whose registration payload could not be created.
+	registrationReasonPayload = "payload"
+)
+
+// Error gets the message of the error.
+func (e *registrationError) Error() string {
+	return e.err.Error()
+}
+
+// Unwrap gets the wrapped error.
+func (e *registrationError) Unwrap() error {
+	return e.err
+}
+
+// getRegistrationErrorReason gets the reason a device failed to register, labeling the provisioning metrics.
+func getRegistrationErrorReason(err error) string {
+	var re *registrationError
+	if errors.As(err, &re) {
+		return re.reason
+	}
+	return "error"
+}
+
+// newRequestError classifies an error sending a request to DPS. Requests are sent again after network errors and
+// timeouts, unless the registration was cancelled.
+func newRequestError(ctx context.Context, err error) *registrationError {
+	if ctx.Err() != nil {
+		return &registrationError{
+			reason: registrationReasonCancelled,
+			err:    ctx.Err(),
+		}
+	}
+
+	reason := registrationReasonNetworkError
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		reason = registrationReasonTimeout
+	}
+	return &registrationError{
+		reason: reason,
+		retry:  true,
+		err:    fmt.Errorf("error sending request to DPS (%s)", err.Error()),
+	}
+}
+
+// newResponseError classifies an unsuccessful response of DPS, with the error message of its body. Throttled requests and
+// server errors are sent again after the time requested by DPS, if any. Requests that DPS did not authorize or rejected
+// fail the registration, since they would fail again.
+func newResponseError(res *http.Response) *registrationError {
+	body, _ := ioutil.ReadAll(io.LimitReader(res.Body, 4096))
+	err := fmt.Errorf("DPS responded with %s (%s)", res.Status, strings.TrimSpace(string(body)))
+	retryAfter := parseRetryAfter(res.Header.Get("Retry-After"))
+
+	switch {
+	case res.StatusCode == http.StatusTooManyRequests:
+		return &registrationError{reason: registrationReasonThrottled, retry: true, retryAfter: retryAfter, err: err}
+	case res.StatusCode >= http.StatusInternalServerError:
+		return &registrationError{reason: registrationReasonServerError, retry: true, retryAfter: retryAfter, err: err}
+	case res.StatusCode == http.StatusUnauthorized || res.StatusCode == http.StatusForbidden:
+		return &registrationError{reason: registrationReasonUnauthorized, err: err}
+	default:
+		return &registrationError{reason: registrationReasonBadRequest, err: err}
+	}
+}
+
+// parseRetryAfter parses the Retry-After header of a response, in seconds or as an HTTP date; 0 if not set or invalid.
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil && t.After(time.Now()) {
+		return time.Until(t)
+	}
+	return 0
+}
+
+// withRetries makes attempts to send a request to DPS, till an attempt succeeds, fails with an error that is not retried,
+// or the maximum number of registration attempts is reached. Waits between attempts end when the context is cancelled.
+func (p *DeviceProvisioner) withRetries(ctx context.Context, req *ProvisioningRequest, attempt func() error) error {
+	maxAttempts := p.config.MaxRegistrationAttempts
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
+
+	var err error
+	for i := 1; i <= maxAttempts; i++ {
+		err = attempt()
+		var re *registrationError
+		if err == nil || !errors.As(err, &re) || !re.retry || i == maxAttempts {
+			break
+		}
+
+		wait := p.getRegistrationBackoff(i, re.retryAfter)
+		if re.reason != registrationReasonAssigning {
+			provisionRetriesTotal.WithLabelValues(req.Simulation.ID, req.Simulation.TargetID, req.Model.ID, re.reason).Add(1)
+		}
+		log.Trace().
+			Err(err).
+			Str("deviceID", req.DeviceID).
+			Str("reason", re.reason).
+			Int("attempt", i).
+			Dur("backoff", wait).
+			Msg("retrying device registration request")
+
+		sleep(ctx, wait)
+		if ctx.Err() != nil {
+			return &registrationError{
+				reason: registrationReasonCancelled,
+				err:    ctx.Err(),
+			}
+		}
+	}
+	return err
+}
+
+// getRegistrationBackoff gets the time to wait after a failed registration attempt. The backoff doubles after each attempt up
+// to the maximum backoff, and half of it is random so that devices throttled together do not retry together. When DPS
+// requests a time to wait, it is waited, with a random delay of up to the initial backoff, but no longer than the maximum
+// backoff.
+func (p *DeviceProvisioner) getRegistrationBackoff(attempt int, retryAfter time.Duration) time.Duration {
+	backoff := time.Millisecond * time.Duration(p.config.RegistrationBackoff)
+	if backoff <= 0 {
+		backoff = defaultRegistrationBackoff
+	}
+	maxBackoff := time.Millisecond * time.Duration(p.config.MaxRegistrationBackoff)
+	if maxBackoff <= 0 {
+		maxBackoff = defaultMaxRegistrationBackoff
+	}
+
+	if retryAfter > 0 {
+		wait := retryAfter + time.Duration(rand.Int63n(int64(backoff)))
+		if wait > maxBackoff {
+			wait = maxBackoff
+		}
+		return wait
+	}
+
+	ceiling := backoff
+	for i := 1; i < attempt && ceiling < maxBackoff; i++ {
+		ceiling *= 2
+	}
+	if ceiling > maxBackoff {
+		ceiling = maxBackoff
+	}
+	return ceiling/2 + time.Duration(rand.Int63n(int64(ceiling/2)+1))
+}
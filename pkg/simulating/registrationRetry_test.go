@@ -0,0 +1,210 @@
+package simulating
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/iot-for-all/starling/pkg/models"
+)
+
+// timeoutError is a network error that timed out.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestNewRequestError(t *testing.T) {
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	tests := []struct {
+		name       string
+		ctx        context.Context
+		err        error
+		wantReason string
+		wantRetry  bool
+	}{
+		{name: "network error", ctx: context.Background(), err: errors.New("connection refused"), wantReason: registrationReasonNetworkError, wantRetry: true},
+		{name: "timeout", ctx: context.Background(), err: fmt.Errorf("post: %w", timeoutError{}), wantReason: registrationReasonTimeout, wantRetry: true},
+		{name: "cancelled", ctx: cancelled, err: errors.New("connection refused"), wantReason: registrationReasonCancelled, wantRetry: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := newRequestError(tt.ctx, tt.err)
+			if got.reason != tt.wantReason || got.retry != tt.wantRetry {
+				t.Errorf("newRequestError() = %s, %v, want %s, %v", got.reason, got.retry, tt.wantReason, tt.wantRetry)
+			}
+		})
+	}
+}
+
+func TestNewResponseError(t *testing.T) {
+	tests := []struct {
+		name           string
+		status         int
+		retryAfter     string
+		wantReason     string
+		wantRetry      bool
+		wantRetryAfter time.Duration
+	}{
+		{name: "throttled", status: http.StatusTooManyRequests, retryAfter: "5", wantReason: registrationReasonThrottled, wantRetry: true, wantRetryAfter: 5 * time.Second},
+		{name: "throttled without retry after", status: http.StatusTooManyRequests, wantReason: registrationReasonThrottled, wantRetry: true},
+		{name: "server error", status: http.StatusServiceUnavailable, retryAfter: "2", wantReason: registrationReasonServerError, wantRetry: true, wantRetryAfter: 2 * time.Second},
+		{name: "unauthorized", status: http.StatusUnauthorized, wantReason: registrationReasonUnauthorized},
+		{name: "forbidden", status: http.StatusForbidden, retryAfter: "5", wantReason: registrationReasonUnauthorized},
+		{name: "bad request", status: http.StatusBadRequest, wantReason: registrationReasonBadRequest},
+		{name: "not found", status: http.StatusNotFound, wantReason: registrationReasonBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := &http.Response{
+				StatusCode: tt.status,
+				Status:     fmt.Sprintf("%d %s", tt.status, http.StatusText(tt.status)),
+				Header:     http.Header{},
+				Body:       ioutil.NopCloser(strings.NewReader(`{"message": "registration failed"}` + "\n")),
+			}
+			if tt.retryAfter != "" {
+				res.Header.Set("Retry-After", tt.retryAfter)
+			}
+
+			got := newResponseError(res)
+			if got.reason != tt.wantReason || got.retry != tt.wantRetry || got.retryAfter != tt.wantRetryAfter {
+				t.Errorf("newResponseError() = %s, %v, %v, want %s, %v, %v", got.reason, got.retry, got.retryAfter, tt.wantReason, tt.wantRetry, tt.wantRetryAfter)
+			}
+			if want := fmt.Sprintf(`DPS responded with %s ({"message": "registration failed"})`, res.Status); got.Error() != want {
+				t.Errorf("Error() = %s, want %s", got.Error(), want)
+			}
+		})
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		min   time.Duration
+		max   time.Duration
+	}{
+		{name: "not set", value: "", min: 0, max: 0},
+		{name: "seconds", value: "30", min: 30 * time.Second, max: 30 * time.Second},
+		{name: "zero seconds", value: "0", min: 0, max: 0},
+		{name: "negative seconds", value: "-5", min: 0, max: 0},
+		{name: "date", value: time.Now().Add(time.Minute).UTC().Format(http.TimeFormat), min: 58 * time.Second, max: time.Minute},
+		{name: "past date", value: time.Now().Add(-time.Minute).UTC().Format(http.TimeFormat), min: 0, max: 0},
+		{name: "invalid", value: "soon", min: 0, max: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseRetryAfter(tt.value); got < tt.min || got > tt.max {
+				t.Errorf("parseRetryAfter() = %v, want between %v and %v", got, tt.min, tt.max)
+			}
+		})
+	}
+}
+
+func TestGetRegistrationBackoff(t *testing.T) {
+	tests := []struct {
+		name       string
+		backoff    int
+		maxBackoff int
+		attempt    int
+		retryAfter time.Duration
+		min        time.Duration
+		max        time.Duration
+	}{
+		{name: "default", attempt: 1, min: defaultRegistrationBackoff / 2, max: defaultRegistrationBackoff},
+		{name: "first attempt", backoff: 100, maxBackoff: 1000, attempt: 1, min: 50 * time.Millisecond, max: 100 * time.Millisecond},
+		{name: "doubled", backoff: 100, maxBackoff: 1000, attempt: 3, min: 200 * time.Millisecond, max: 400 * time.Millisecond},
+		{name: "maximum", backoff: 300, maxBackoff: 1000, attempt: 3, min: 500 * time.Millisecond, max: time.Second},
+		{name: "many attempts", backoff: 100, maxBackoff: 1000, attempt: 100, min: 500 * time.Millisecond, max: time.Second},
+		{name: "retry after", backoff: 100, maxBackoff: 60000, attempt: 1, retryAfter: 2 * time.Second, min: 2 * time.Second, max: 2100 * time.Millisecond},
+		{name: "retry after clamped", backoff: 100, maxBackoff: 60000, attempt: 1, retryAfter: 2 * time.Minute, min: time.Minute, max: time.Minute},
+		{name: "retry after clamped by default", attempt: 1, retryAfter: time.Hour, min: defaultMaxRegistrationBackoff, max: defaultMaxRegistrationBackoff},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &DeviceProvisioner{config: &Config{RegistrationBackoff: tt.backoff, MaxRegistrationBackoff: tt.maxBackoff}}
+			// backoffs are random, so check a number of them
+			for i := 0; i < 100; i++ {
+				if got := p.getRegistrationBackoff(tt.attempt, tt.retryAfter); got < tt.min || got > tt.max {
+					t.Fatalf("getRegistrationBackoff() = %v, want between %v and %v", got, tt.min, tt.max)
+				}
+			}
+		})
+	}
+}
+
+func TestWithRetries(t *testing.T) {
+	retried := &registrationError{reason: registrationReasonThrottled, retry: true, err: errors.New("throttled")}
+	failed := &registrationError{reason: registrationReasonBadRequest, err: errors.New("bad request")}
+
+	tests := []struct {
+		name         string
+		maxAttempts  int
+		errs         []error
+		wantAttempts int
+		wantErr      error
+	}{
+		{name: "succeeded", maxAttempts: 3, errs: []error{nil}, wantAttempts: 1},
+		{name: "succeeded after retries", maxAttempts: 3, errs: []error{retried, retried, nil}, wantAttempts: 3},
+		{name: "not retried", maxAttempts: 3, errs: []error{failed}, wantAttempts: 1, wantErr: failed},
+		{name: "other error", maxAttempts: 3, errs: []error{errors.New("error")}, wantAttempts: 1},
+		{name: "all attempts failed", maxAttempts: 2, errs: []error{retried, retried}, wantAttempts: 2, wantErr: retried},
+		{name: "no attempts configured", maxAttempts: 0, errs: []error{retried}, wantAttempts: 1, wantErr: retried},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &DeviceProvisioner{config: &Config{MaxRegistrationAttempts: tt.maxAttempts, RegistrationBackoff: 1, MaxRegistrationBackoff: 1}}
+			req := &ProvisioningRequest{
+				DeviceID:   "device-1",
+				Simulation: &models.Simulation{ID: "sim", TargetID: "target"},
+				Model:      &models.DeviceModel{ID: "thermostat"},
+			}
+
+			attempts := 0
+			err := p.withRetries(context.Background(), req, func() error {
+				attempts++
+				return tt.errs[attempts-1]
+			})
+			if attempts != tt.wantAttempts {
+				t.Errorf("attempts = %d, want %d", attempts, tt.wantAttempts)
+			}
+			if tt.wantErr != nil && err != tt.wantErr {
+				t.Errorf("withRetries() error = %v, want %v", err, tt.wantErr)
+			}
+			if (err == nil) != (tt.errs[len(tt.errs)-1] == nil) {
+				t.Errorf("withRetries() error = %v, want %v", err, tt.errs[len(tt.errs)-1])
+			}
+		})
+	}
+}
+
+func TestWithRetriesCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &DeviceProvisioner{config: &Config{MaxRegistrationAttempts: 3, RegistrationBackoff: 60000}}
+	req := &ProvisioningRequest{
+		DeviceID:   "device-1",
+		Simulation: &models.Simulation{ID: "sim", TargetID: "target"},
+		Model:      &models.DeviceModel{ID: "thermostat"},
+	}
+
+	err := p.withRetries(ctx, req, func() error {
+		cancel()
+		return &registrationError{reason: registrationReasonServerError, retry: true, err: errors.New("server error")}
+	})
+	if reason := getRegistrationErrorReason(err); reason != registrationReasonCancelled {
+		t.Errorf("withRetries() reason = %s, want %s", reason, registrationReasonCancelled)
+	}
+}
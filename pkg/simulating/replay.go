@@ -0,0 +1,305 @@
+package simulating
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/iot-for-all/starling/pkg/models"
+	"github.com/iot-for-all/starling/pkg/storing"
+)
+
+type (
+	// recording represents telemetry recorded from a real device, shared by all devices replaying it.
+	recording struct {
+		rows  []*recordedRow // recorded rows in the order of the recording.
+		timed bool           // are the rows timestamped.
+		cycle time.Duration  // duration of a full replay of all rows, used when looping.
+	}
+
+	// recordedRow represents a row of recorded telemetry.
+	recordedRow struct {
+		offset time.Duration          // time since the first row of the recording.
+		values map[string]interface{} // recorded values by telemetry name.
+	}
+
+	// replayedRow represents a recorded row replayed by a device at a given time.
+	replayedRow struct {
+		creationTime time.Time              // time at which the row is replayed.
+		values       map[string]interface{} // recorded values by telemetry name.
+	}
+
+	// replayer replays the rows of a recording for a single device.
+	replayer struct {
+		recording *recording // the recording being replayed.
+		loop      bool       // restart from the first row after the last row.
+		speed     float64    // factor by which the recorded inter-arrival times are shortened.
+		start     int        // position of the first row replayed by the device.
+		position  int        // position of the next row to replay; positions beyond the last row wrap around when looping.
+		started   time.Time  // time when the device started replaying.
+	}
+)
+
+const (
+	// maxReplayedRowsPerBatch is the maximum number of rows sent in a telemetry batch; remaining due rows are sent in the next batch.
+	maxReplayedRowsPerBatch = 1000
+)
+
+// loadRecording loads and parses the recording configured for replay from the device model files.
+func loadRecording(modelID string, cfg *models.ReplayConfig) (*recording, error) {
+	file, err := storing.DeviceModelFiles.Get(modelID, cfg.File)
+	if err != nil {
+		return nil, err
+	}
+	if file == nil {
+		return nil, fmt.Errorf("could not find recording '%s' of model '%s'", cfg.File, modelID)
+	}
+
+	format := cfg.Format
+	if format == "" {
+		format = models.ReplayFormat(strings.TrimPrefix(strings.ToLower(path.Ext(cfg.File)), "."))
+	}
+
+	var records []map[string]interface{}
+	switch format {
+	case models.ReplayFormatCsv:
+		records, err = parseCsvRecording(file.Content)
+	case models.ReplayFormatJsonl:
+		records, err = parseJsonlRecording(file.Content)
+	default:
+		err = fmt.Errorf("unknown format of recording '%s', specify either csv or jsonl", cfg.File)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, fmt.Errorf("recording '%s' of model '%s' has no rows", cfg.File, modelID)
+	}
+
+	rec := recording{
+		timed: cfg.TimestampColumn != "",
+	}
+	var first time.Time
+	for i, record := range records {
+		row := recordedRow{
+			values: make(map[string]interface{}),
+		}
+		for column, value := range record {
+			if column == cfg.TimestampColumn {
+				t, err := parseRecordedTime(value)
+				if err != nil {
+					return nil, fmt.Errorf("invalid timestamp in row %d of recording '%s': %w", i+1, cfg.File, err)
+				}
+				if i == 0 {
+					first = t
+				}
+				row.offset = t.Sub(first)
+				continue
+			}
+
+			name, ok := cfg.Columns[column]
+			if !ok {
+				name = column
+			}
+			row.values[name] = value
+		}
+		rec.rows = append(rec.rows, &row)
+	}
+
+	// a full cycle lasts till the last row plus the average time between rows
+	if rec.timed && len(rec.rows) > 1 {
+		last := rec.rows[len(rec.rows)-1].offset
+		rec.cycle = last + last/time.Duration(len(rec.rows)-1)
+	}
+	if rec.cycle <= 0 {
+		rec.cycle = time.Second
+	}
+
+	return &rec, nil
+}
+
+// parseCsvRecording parses a comma separated recording with a header row.
+func parseCsvRecording(content string) ([]map[string]interface{}, error) {
+	reader := csv.NewReader(strings.NewReader(content))
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("error reading recording header (%s)", err.Error())
+	}
+
+	var records []map[string]interface{}
+	for {
+		line, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading recording (%s)", err.Error())
+		}
+
+		record := make(map[string]interface{}, len(header))
+		for i, column := range header {
+			if i < len(line) && line[i] != "" {
+				record[strings.TrimSpace(column)] = line[i]
+			}
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// parseJsonlRecording parses a recording with a JSON object on each line.
+func parseJsonlRecording(content string) ([]map[string]interface{}, error) {
+	var records []map[string]interface{}
+	scanner := bufio.NewScanner(strings.NewReader(content))
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		var record map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			return nil, fmt.Errorf("error parsing line %d of recording (%s)", lineNumber, err.Error())
+		}
+		records = append(records, record)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading recording (%s)", err.Error())
+	}
+	return records, nil
+}
+
+// parseRecordedTime parses a recorded timestamp in RFC3339 format or as unix epoch seconds or milliseconds.
+func parseRecordedTime(value interface{}) (time.Time, error) {
+	var epoch float64
+	switch v := value.(type) {
+	case float64:
+		epoch = v
+	case string:
+		if t, err := time.Parse(time.RFC3339Nano, v); err == nil {
+			return t, nil
+		}
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("unsupported time format '%s'", v)
+		}
+		epoch = f
+	default:
+		return time.Time{}, fmt.Errorf("unsupported time value %v", value)
+	}
+
+	// anything beyond year 33658 in seconds must be in milliseconds
+	if epoch > 1e12 {
+		epoch /= 1000
+	}
+	sec, frac := math.Modf(epoch)
+	return time.Unix(int64(sec), int64(frac*float64(time.Second))).UTC(), nil
+}
+
+// newReplayer creates a replayer of the recording for the device with the given index in the device config.
+func newReplayer(rec *recording, cfg *models.ReplayConfig, deviceIndex int) *replayer {
+	speed := cfg.Speed
+	if speed <= 0 {
+		speed = 1
+	}
+
+	start := 0
+	if cfg.DeviceOffset > 0 {
+		start = (deviceIndex * cfg.DeviceOffset) % len(rec.rows)
+	}
+
+	return &replayer{
+		recording: rec,
+		loop:      cfg.Loop,
+		speed:     speed,
+		start:     start,
+		position:  start,
+	}
+}
+
+// done returns true if all the rows were replayed.
+func (r *replayer) done() bool {
+	return !r.loop && r.position >= len(r.recording.rows)
+}
+
+// offset gets the recorded time of the row at the given position since the first row of the recording.
+func (r *replayer) offset(position int) time.Duration {
+	rows := r.recording.rows
+	return rows[position%len(rows)].offset + time.Duration(position/len(rows))*r.recording.cycle
+}
+
+// nextRow gets the values of the next row to replay.
+func (r *replayer) nextRow() (map[string]interface{}, bool) {
+	if r.done() {
+		return nil, false
+	}
+
+	row := r.recording.rows[r.position%len(r.recording.rows)]
+	r.position++
+	return row.values, true
+}
+
+// nextTimedRows gets all rows that are due by the given time based on their rescaled recorded times.
+func (r *replayer) nextTimedRows(now time.Time) []*replayedRow {
+	if r.started.IsZero() {
+		r.started = now
+	}
+
+	var rows []*replayedRow
+	for len(rows) < maxReplayedRowsPerBatch && !r.done() {
+		elapsed := float64(r.offset(r.position)-r.offset(r.start)) / r.speed
+		creationTime := r.started.Add(time.Duration(elapsed))
+		if creationTime.After(now) {
+			break
+		}
+
+		values, _ := r.nextRow()
+		rows = append(rows, &replayedRow{
+			creationTime: creationTime,
+			values:       values,
+		})
+	}
+	return rows
+}
+
+// convertRecordedValue converts a recorded value to the given schema, e.g. numbers recorded as text in csv recordings.
+func convertRecordedValue(value interface{}, schema *models.Schema) interface{} {
+	s, ok := value.(string)
+	if !ok || schema == nil {
+		return value
+	}
+
+	switch schema.Type {
+	case "double", "float", "integer", "long":
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return value
+		}
+		if schema.Type == "integer" || schema.Type == "long" {
+			return int64(math.Round(f))
+		}
+		return f
+	case "boolean":
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return value
+		}
+		return b
+	case models.SchemaTypeObject, models.SchemaTypeMap, models.SchemaTypeArray, "geopoint", "vector":
+		// complex values are recorded as JSON text in csv recordings
+		var v interface{}
+		if err := json.Unmarshal([]byte(s), &v); err != nil {
+			return value
+		}
+		return v
+	}
+	return value
+}
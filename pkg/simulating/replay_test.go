@@ -0,0 +1,345 @@
+package simulating
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/iot-for-all/starling/pkg/models"
+	"github.com/iot-for-all/starling/pkg/storing"
+)
+
+func TestParseCsvRecording(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    []map[string]interface{}
+		wantErr bool
+	}{
+		{
+			name:    "rows",
+			content: "time, temperature,status\n2021-01-01T00:00:00Z,21.5,ok\n2021-01-01T00:01:00Z,22,\"a, b\"\n",
+			want: []map[string]interface{}{
+				{"time": "2021-01-01T00:00:00Z", "temperature": "21.5", "status": "ok"},
+				{"time": "2021-01-01T00:01:00Z", "temperature": "22", "status": "a, b"},
+			},
+		},
+		{
+			name:    "empty cells are left out",
+			content: "temperature,humidity\n,40\n21,\n",
+			want: []map[string]interface{}{
+				{"humidity": "40"},
+				{"temperature": "21"},
+			},
+		},
+		{
+			name:    "header only",
+			content: "temperature,humidity\n",
+			want:    nil,
+		},
+		{
+			name:    "no header",
+			content: "",
+			wantErr: true,
+		},
+		{
+			name:    "missing cells",
+			content: "temperature,humidity\n21\n",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseCsvRecording(tt.content)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseCsvRecording() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseCsvRecording() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseJsonlRecording(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    []map[string]interface{}
+		wantErr bool
+	}{
+		{
+			name:    "rows",
+			content: "{\"temperature\": 21.5, \"location\": {\"lat\": 47.6}}\n{\"temperature\": 22}",
+			want: []map[string]interface{}{
+				{"temperature": 21.5, "location": map[string]interface{}{"lat": 47.6}},
+				{"temperature": 22.0},
+			},
+		},
+		{
+			name:    "blank lines are skipped",
+			content: "\n{\"temperature\": 21}\r\n   \n{\"temperature\": 22}\n\n",
+			want: []map[string]interface{}{
+				{"temperature": 21.0},
+				{"temperature": 22.0},
+			},
+		},
+		{
+			name:    "invalid line",
+			content: "{\"temperature\": 21}\n{temperature: 22}\n",
+			wantErr: true,
+		},
+		{
+			name:    "not an object",
+			content: "[21, 22]\n",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseJsonlRecording(tt.content)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseJsonlRecording() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseJsonlRecording() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseRecordedTime(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   interface{}
+		want    time.Time
+		wantErr bool
+	}{
+		{
+			name:  "rfc3339",
+			value: "2021-03-04T05:06:07.5+01:00",
+			want:  time.Date(2021, 3, 4, 4, 6, 7, 500000000, time.UTC),
+		},
+		{
+			name:  "epoch seconds",
+			value: 1614834367.0,
+			want:  time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC),
+		},
+		{
+			name:  "epoch milliseconds",
+			value: "1614834367250",
+			want:  time.Date(2021, 3, 4, 5, 6, 7, 250000000, time.UTC),
+		},
+		{
+			name:    "invalid text",
+			value:   "yesterday",
+			wantErr: true,
+		},
+		{
+			name:    "invalid value",
+			value:   true,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseRecordedTime(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseRecordedTime() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !got.Equal(tt.want) {
+				t.Errorf("parseRecordedTime() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConvertRecordedValue(t *testing.T) {
+	tests := []struct {
+		name   string
+		value  interface{}
+		schema *models.Schema
+		want   interface{}
+	}{
+		{name: "double", value: "21.5", schema: &models.Schema{Type: "double"}, want: 21.5},
+		{name: "integer", value: "21.5", schema: &models.Schema{Type: "integer"}, want: int64(22)},
+		{name: "boolean", value: "true", schema: &models.Schema{Type: "boolean"}, want: true},
+		{name: "object", value: `{"lat": 47.6}`, schema: &models.Schema{Type: models.SchemaTypeObject}, want: map[string]interface{}{"lat": 47.6}},
+		{name: "invalid number", value: "n/a", schema: &models.Schema{Type: "double"}, want: "n/a"},
+		{name: "string", value: "21", schema: &models.Schema{Type: "string"}, want: "21"},
+		{name: "not text", value: 21.5, schema: &models.Schema{Type: "integer"}, want: 21.5},
+		{name: "no schema", value: "21", schema: nil, want: "21"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := convertRecordedValue(tt.value, tt.schema); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("convertRecordedValue() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadRecording(t *testing.T) {
+	if err := storing.Open(&storing.Config{DataDirectory: t.TempDir()}); err != nil {
+		t.Fatal(err)
+	}
+	defer storing.Close()
+
+	files := []*models.DeviceModelFile{
+		{ModelID: "thermostat", Name: "timed.csv", Content: "ts,temp\n100,20\n110,21\n130,22\n"},
+		{ModelID: "thermostat", Name: "untimed.jsonl", Content: "{\"temp\": 20}\n{\"temp\": 21}\n"},
+		{ModelID: "thermostat", Name: "empty.csv", Content: "ts,temp\n"},
+		{ModelID: "thermostat", Name: "recording.txt", Content: "temp\n20\n"},
+	}
+	for _, file := range files {
+		if err := storing.DeviceModelFiles.Set(file); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name    string
+		cfg     *models.ReplayConfig
+		offsets []time.Duration
+		values  []map[string]interface{}
+		cycle   time.Duration
+		wantErr bool
+	}{
+		{
+			name:    "timed",
+			cfg:     &models.ReplayConfig{File: "timed.csv", TimestampColumn: "ts", Columns: map[string]string{"temp": "temperature"}},
+			offsets: []time.Duration{0, 10 * time.Second, 30 * time.Second},
+			values:  []map[string]interface{}{{"temperature": "20"}, {"temperature": "21"}, {"temperature": "22"}},
+			cycle:   45 * time.Second,
+		},
+		{
+			name:    "untimed",
+			cfg:     &models.ReplayConfig{File: "untimed.jsonl"},
+			offsets: []time.Duration{0, 0},
+			values:  []map[string]interface{}{{"temp": 20.0}, {"temp": 21.0}},
+			cycle:   time.Second,
+		},
+		{
+			name:    "format overriding the extension",
+			cfg:     &models.ReplayConfig{File: "recording.txt", Format: models.ReplayFormatCsv},
+			offsets: []time.Duration{0},
+			values:  []map[string]interface{}{{"temp": "20"}},
+			cycle:   time.Second,
+		},
+		{
+			name:    "unknown format",
+			cfg:     &models.ReplayConfig{File: "recording.txt"},
+			wantErr: true,
+		},
+		{
+			name:    "no rows",
+			cfg:     &models.ReplayConfig{File: "empty.csv"},
+			wantErr: true,
+		},
+		{
+			name:    "missing file",
+			cfg:     &models.ReplayConfig{File: "missing.csv"},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec, err := loadRecording("thermostat", tt.cfg)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("loadRecording() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			var offsets []time.Duration
+			var values []map[string]interface{}
+			for _, row := range rec.rows {
+				offsets = append(offsets, row.offset)
+				values = append(values, row.values)
+			}
+			if !reflect.DeepEqual(offsets, tt.offsets) {
+				t.Errorf("offsets = %v, want %v", offsets, tt.offsets)
+			}
+			if !reflect.DeepEqual(values, tt.values) {
+				t.Errorf("values = %v, want %v", values, tt.values)
+			}
+			if rec.cycle != tt.cycle {
+				t.Errorf("cycle = %v, want %v", rec.cycle, tt.cycle)
+			}
+		})
+	}
+}
+
+func TestReplayerNextTimedRows(t *testing.T) {
+	rec := &recording{
+		rows: []*recordedRow{
+			{offset: 0, values: map[string]interface{}{"temp": 1}},
+			{offset: 10 * time.Second, values: map[string]interface{}{"temp": 2}},
+			{offset: 30 * time.Second, values: map[string]interface{}{"temp": 3}},
+		},
+		timed: true,
+		cycle: 45 * time.Second,
+	}
+	start := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name    string
+		cfg     *models.ReplayConfig
+		seconds []int
+		want    [][]int
+	}{
+		{
+			name:    "recorded times",
+			cfg:     &models.ReplayConfig{},
+			seconds: []int{0, 5, 10, 40},
+			want:    [][]int{{0}, nil, {10}, {30}},
+		},
+		{
+			name:    "twice as fast",
+			cfg:     &models.ReplayConfig{Speed: 2},
+			seconds: []int{0, 5, 15},
+			want:    [][]int{{0}, {5}, {15}},
+		},
+		{
+			name:    "looping",
+			cfg:     &models.ReplayConfig{Loop: true},
+			seconds: []int{0, 30, 55},
+			want:    [][]int{{0}, {10, 30}, {45, 55}},
+		},
+		{
+			name:    "device offset",
+			cfg:     &models.ReplayConfig{DeviceOffset: 1},
+			seconds: []int{0, 20},
+			want:    [][]int{{0}, {20}},
+		},
+		{
+			name:    "done",
+			cfg:     &models.ReplayConfig{},
+			seconds: []int{0, 60, 120},
+			want:    [][]int{{0}, {10, 30}, nil},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newReplayer(rec, tt.cfg, 1)
+			var got [][]int
+			for _, s := range tt.seconds {
+				var times []int
+				for _, row := range r.nextTimedRows(start.Add(time.Duration(s) * time.Second)) {
+					times = append(times, int(row.creationTime.Sub(start).Seconds()))
+				}
+				got = append(got, times)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("nextTimedRows() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
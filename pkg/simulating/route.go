@@ -0,0 +1,424 @@
+package simulating
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"math"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/iot-for-all/starling/pkg/models"
+	"github.com/iot-for-all/starling/pkg/storing"
+)
+
+type (
+	// route represents a path that devices follow, or an area inside which devices wander, shared by all devices moving along it.
+	route struct {
+		points []models.GeoPoint // points of the path in the order they are visited, or vertices of the area polygon.
+		area   bool              // is the route an area.
+		length float64           // length of the path in km, including the way back to the first point.
+	}
+
+	// mover moves a single device along its route at its speed.
+	mover struct {
+		route    *route              // the route of the device.
+		config   *models.RouteConfig // the route configuration of the device.
+		random   randomSource        // source of random speeds and area points.
+		next     int                 // index of the next point of a path.
+		position models.GeoPoint     // current position of the device.
+		target   models.GeoPoint     // point the device is moving to.
+		speed    float64             // current speed in km/h.
+		heading  float64             // current heading in degrees.
+		updated  time.Time           // time of the current position.
+	}
+
+	// gpxFile represents the tracks and routes of a GPX file.
+	gpxFile struct {
+		Tracks []struct {
+			Segments []struct {
+				Points []gpxPoint `xml:"trkpt"`
+			} `xml:"trkseg"`
+		} `xml:"trk"`
+		Routes []struct {
+			Points []gpxPoint `xml:"rtept"`
+		} `xml:"rte"`
+	}
+
+	// gpxPoint represents a point of a GPX track or route.
+	gpxPoint struct {
+		Lat float64 `xml:"lat,attr"`
+		Lon float64 `xml:"lon,attr"`
+		Ele float64 `xml:"ele"`
+	}
+
+	// geoJsonObject represents a GeoJSON feature collection, feature or geometry.
+	geoJsonObject struct {
+		Type        string          `json:"type"`
+		Features    []geoJsonObject `json:"features"`
+		Geometry    *geoJsonObject  `json:"geometry"`
+		Geometries  []geoJsonObject `json:"geometries"`
+		Coordinates json.RawMessage `json:"coordinates"`
+	}
+)
+
+const (
+	// defaultRouteSpeed is the average speed of devices in km/h.
+	defaultRouteSpeed = 50
+	// earthRadius is the mean radius of earth in km.
+	earthRadius = 6371.0
+	// maxRouteSteps is the maximum number of points passed in a single move, protecting devices from degenerate routes.
+	maxRouteSteps = 10000
+	// goldenRatio spreads the starting positions of devices sharing a route evenly along the route.
+	goldenRatio = 0.6180339887498949
+)
+
+// loadRoutes loads and parses the routes configured for the devices from the device model files.
+// Open paths are followed back and forth, so that devices do not jump from the end of the path to its start.
+func loadRoutes(modelID string, cfg *models.RouteConfig) ([]*route, error) {
+	var routes []*route
+	for _, name := range cfg.Files {
+		file, err := storing.DeviceModelFiles.Get(modelID, name)
+		if err != nil {
+			return nil, err
+		}
+		if file == nil {
+			return nil, fmt.Errorf("could not find route '%s' of model '%s'", name, modelID)
+		}
+
+		var fileRoutes []*route
+		switch strings.ToLower(path.Ext(name)) {
+		case ".gpx":
+			fileRoutes, err = parseGpxRoutes(file.Content)
+		case ".geojson", ".json":
+			fileRoutes, err = parseGeoJsonRoutes(file.Content)
+		default:
+			err = fmt.Errorf("unknown format of route '%s', use a .gpx or .geojson file", name)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error parsing route '%s' of model '%s' (%s)", name, modelID, err.Error())
+		}
+		if len(fileRoutes) == 0 {
+			return nil, fmt.Errorf("route '%s' of model '%s' has no routes or areas", name, modelID)
+		}
+		routes = append(routes, fileRoutes...)
+	}
+
+	if len(cfg.Files) == 0 {
+		if len(cfg.Area) < 3 {
+			return nil, fmt.Errorf("route of model '%s' needs either route files or an area of at least 3 points", modelID)
+		}
+		routes = append(routes, &route{
+			points: cfg.Area,
+			area:   true,
+		})
+	}
+
+	for _, r := range routes {
+		if !r.area {
+			r.close()
+		}
+	}
+	return routes, nil
+}
+
+// close closes an open path by following it back to the first point, and calculates the length of the path.
+func (r *route) close() {
+	first, last := r.points[0], r.points[len(r.points)-1]
+	if first.Lat != last.Lat || first.Lon != last.Lon {
+		for i := len(r.points) - 2; i > 0; i-- {
+			r.points = append(r.points, r.points[i])
+		}
+	}
+
+	r.length = 0
+	for i := range r.points {
+		r.length += getDistance(r.points[i], r.points[(i+1)%len(r.points)])
+	}
+}
+
+// parseGpxRoutes parses the tracks and routes of a GPX file; the segments of a track form a single route.
+func parseGpxRoutes(content string) ([]*route, error) {
+	var gpx gpxFile
+	if err := xml.Unmarshal([]byte(content), &gpx); err != nil {
+		return nil, err
+	}
+
+	var routes []*route
+	add := func(points []gpxPoint) {
+		r := route{}
+		for _, p := range points {
+			r.points = append(r.points, models.GeoPoint{Lat: p.Lat, Lon: p.Lon, Alt: p.Ele})
+		}
+		if len(r.points) >= 2 {
+			routes = append(routes, &r)
+		}
+	}
+	for _, track := range gpx.Tracks {
+		var points []gpxPoint
+		for _, segment := range track.Segments {
+			points = append(points, segment.Points...)
+		}
+		add(points)
+	}
+	for _, rte := range gpx.Routes {
+		add(rte.Points)
+	}
+	return routes, nil
+}
+
+// parseGeoJsonRoutes parses the line strings of a GeoJSON file as routes and its polygons as areas.
+func parseGeoJsonRoutes(content string) ([]*route, error) {
+	var obj geoJsonObject
+	if err := json.Unmarshal([]byte(content), &obj); err != nil {
+		return nil, err
+	}
+
+	var routes []*route
+	if err := obj.collectRoutes(&routes); err != nil {
+		return nil, err
+	}
+	return routes, nil
+}
+
+// collectRoutes collects the routes and areas of a GeoJSON object and the objects it contains.
+func (o *geoJsonObject) collectRoutes(routes *[]*route) error {
+	var lines [][][]float64
+	area := false
+	switch o.Type {
+	case "FeatureCollection":
+		for i := range o.Features {
+			if err := o.Features[i].collectRoutes(routes); err != nil {
+				return err
+			}
+		}
+		return nil
+	case "Feature":
+		if o.Geometry == nil {
+			return nil
+		}
+		return o.Geometry.collectRoutes(routes)
+	case "GeometryCollection":
+		for i := range o.Geometries {
+			if err := o.Geometries[i].collectRoutes(routes); err != nil {
+				return err
+			}
+		}
+		return nil
+	case "LineString":
+		var line [][]float64
+		if err := json.Unmarshal(o.Coordinates, &line); err != nil {
+			return err
+		}
+		lines = append(lines, line)
+	case "MultiLineString":
+		if err := json.Unmarshal(o.Coordinates, &lines); err != nil {
+			return err
+		}
+	case "Polygon":
+		// devices wander inside the outer ring of the polygon
+		var rings [][][]float64
+		if err := json.Unmarshal(o.Coordinates, &rings); err != nil {
+			return err
+		}
+		if len(rings) > 0 {
+			lines = append(lines, rings[0])
+		}
+		area = true
+	case "MultiPolygon":
+		var polygons [][][][]float64
+		if err := json.Unmarshal(o.Coordinates, &polygons); err != nil {
+			return err
+		}
+		for _, rings := range polygons {
+			if len(rings) > 0 {
+				lines = append(lines, rings[0])
+			}
+		}
+		area = true
+	}
+
+	for _, line := range lines {
+		r := route{
+			area: area,
+		}
+		for _, position := range line {
+			// GeoJSON positions are [longitude, latitude, altitude]
+			if len(position) < 2 {
+				return fmt.Errorf("invalid position %v", position)
+			}
+			p := models.GeoPoint{Lat: position[1], Lon: position[0]}
+			if len(position) > 2 {
+				p.Alt = position[2]
+			}
+			r.points = append(r.points, p)
+		}
+		if (area && len(r.points) >= 3) || (!area && len(r.points) >= 2) {
+			*routes = append(*routes, &r)
+		}
+	}
+	return nil
+}
+
+// newMover creates a mover for a device, starting at a position along the route that depends on the index of the device.
+func newMover(r *route, cfg *models.RouteConfig, index int, routeCount int, random randomSource) *mover {
+	m := mover{
+		route:  r,
+		config: cfg,
+		random: getRandom(random),
+	}
+
+	if r.area {
+		m.position = m.getAreaPoint()
+		m.nextTarget()
+		return &m
+	}
+
+	m.position = r.points[0]
+	m.nextTarget()
+
+	// spread the devices sharing the route along the route
+	_, offset := math.Modf(float64(index/routeCount) * goldenRatio)
+	m.advance(offset * r.length)
+	return &m
+}
+
+// getValues gets the position, heading and speed of the device at the given time as telemetry values by name,
+// or by "component.name" for components.
+func (m *mover) getValues(capabilityModel *models.DeviceCapabilityModel, t time.Time) map[string]interface{} {
+	if m.updated.IsZero() {
+		m.updated = t
+	}
+	if t.After(m.updated) {
+		m.advance(m.speed * t.Sub(m.updated).Hours())
+		m.updated = t
+	}
+
+	values := make(map[string]interface{})
+	for _, comp := range capabilityModel.Components {
+		for _, telemetry := range comp.Telemetry {
+			key := getPropertyKey(comp, telemetry.Name)
+			switch {
+			case isRouteTelemetry(m.config.Telemetry, key, telemetry.Name) ||
+				(m.config.Telemetry == "" && telemetry.Schema != nil && telemetry.Schema.Type == "geopoint"):
+				values[key] = map[string]interface{}{
+					"lat": m.position.Lat,
+					"lon": m.position.Lon,
+					"alt": m.position.Alt,
+				}
+			case isRouteTelemetry(m.config.HeadingTelemetry, key, telemetry.Name):
+				values[key] = convertRouteValue(m.heading, telemetry.Schema)
+			case isRouteTelemetry(m.config.SpeedTelemetry, key, telemetry.Name):
+				values[key] = convertRouteValue(m.speed, telemetry.Schema)
+			}
+		}
+	}
+	return values
+}
+
+// advance moves the device the given distance in km towards its target, picking new targets as they are reached.
+func (m *mover) advance(distance float64) {
+	for step := 0; step < maxRouteSteps && distance > 0; step++ {
+		remaining := getDistance(m.position, m.target)
+		if distance < remaining {
+			f := distance / remaining
+			m.position = models.GeoPoint{
+				Lat: m.position.Lat + (m.target.Lat-m.position.Lat)*f,
+				Lon: m.position.Lon + (m.target.Lon-m.position.Lon)*f,
+				Alt: m.position.Alt + (m.target.Alt-m.position.Alt)*f,
+			}
+			return
+		}
+
+		m.position = m.target
+		distance -= remaining
+		m.nextTarget()
+	}
+}
+
+// nextTarget picks the next point the device moves to along with its speed and heading.
+func (m *mover) nextTarget() {
+	if m.route.area {
+		m.target = m.getAreaPoint()
+	} else {
+		m.next = (m.next + 1) % len(m.route.points)
+		m.target = m.route.points[m.next]
+	}
+
+	speed := m.config.Speed
+	if speed <= 0 {
+		speed = defaultRouteSpeed
+	}
+	if m.config.SpeedVariation > 0 {
+		speed *= 1 + m.config.SpeedVariation/100*(2*m.random.Float64()-1)
+	}
+	m.speed = math.Max(0, speed)
+	m.heading = getHeading(m.position, m.target)
+}
+
+// getAreaPoint gets a random point inside the area of the device.
+func (m *mover) getAreaPoint() models.GeoPoint {
+	points := m.route.points
+	minLat, maxLat, minLon, maxLon := points[0].Lat, points[0].Lat, points[0].Lon, points[0].Lon
+	for _, p := range points {
+		minLat, maxLat = math.Min(minLat, p.Lat), math.Max(maxLat, p.Lat)
+		minLon, maxLon = math.Min(minLon, p.Lon), math.Max(maxLon, p.Lon)
+	}
+
+	// pick random points in the bounding box till one is inside the polygon
+	for i := 0; i < 1000; i++ {
+		p := models.GeoPoint{
+			Lat: minLat + (maxLat-minLat)*m.random.Float64(),
+			Lon: minLon + (maxLon-minLon)*m.random.Float64(),
+		}
+		if isInsidePolygon(p, points) {
+			return p
+		}
+	}
+	return points[0]
+}
+
+// isRouteTelemetry checks whether a telemetry is the configured telemetry.
+func isRouteTelemetry(configured string, key string, name string) bool {
+	return configured != "" && (configured == key || configured == name)
+}
+
+// convertRouteValue converts the heading or speed to the schema of the telemetry receiving it.
+func convertRouteValue(v float64, schema *models.Schema) interface{} {
+	if schema != nil && (schema.Type == "integer" || schema.Type == "long") {
+		return int64(math.Round(v))
+	}
+	return math.Round(v*100) / 100
+}
+
+// isInsidePolygon checks whether a point is inside a polygon using ray casting.
+func isInsidePolygon(p models.GeoPoint, polygon []models.GeoPoint) bool {
+	inside := false
+	for i, j := 0, len(polygon)-1; i < len(polygon); j, i = i, i+1 {
+		a, b := polygon[i], polygon[j]
+		if (a.Lat > p.Lat) != (b.Lat > p.Lat) &&
+			p.Lon < (b.Lon-a.Lon)*(p.Lat-a.Lat)/(b.Lat-a.Lat)+a.Lon {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+// getDistance gets the great circle distance between two points in km.
+func getDistance(a models.GeoPoint, b models.GeoPoint) float64 {
+	lat1, lat2 := a.Lat*math.Pi/180, b.Lat*math.Pi/180
+	dLat := lat2 - lat1
+	dLon := (b.Lon - a.Lon) * math.Pi / 180
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadius * math.Asin(math.Min(1, math.Sqrt(h)))
+}
+
+// getHeading gets the initial bearing from one point to another in degrees clockwise from north.
+func getHeading(a models.GeoPoint, b models.GeoPoint) float64 {
+	lat1, lat2 := a.Lat*math.Pi/180, b.Lat*math.Pi/180
+	dLon := (b.Lon - a.Lon) * math.Pi / 180
+	y := math.Sin(dLon) * math.Cos(lat2)
+	x := math.Cos(lat1)*math.Sin(lat2) - math.Sin(lat1)*math.Cos(lat2)*math.Cos(dLon)
+	return math.Mod(math.Atan2(y, x)*180/math.Pi+360, 360)
+}
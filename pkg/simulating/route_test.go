@@ -0,0 +1,262 @@
+package simulating
+
+import (
+	"math"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/iot-for-all/starling/pkg/models"
+)
+
+// kmPerDegree is the length of a degree of a great circle in km.
+const kmPerDegree = earthRadius * math.Pi / 180
+
+func TestGetDistance(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b models.GeoPoint
+		want float64
+	}{
+		{name: "same point", a: models.GeoPoint{Lat: 47.6, Lon: -122.3}, b: models.GeoPoint{Lat: 47.6, Lon: -122.3}, want: 0},
+		{name: "degree of latitude", a: models.GeoPoint{Lat: 10, Lon: 20}, b: models.GeoPoint{Lat: 11, Lon: 20}, want: kmPerDegree},
+		{name: "degree of longitude at the equator", a: models.GeoPoint{Lon: 0}, b: models.GeoPoint{Lon: -1}, want: kmPerDegree},
+		{name: "degree of longitude at 60 degrees", a: models.GeoPoint{Lat: 60, Lon: 0}, b: models.GeoPoint{Lat: 60, Lon: 1}, want: 55.59},
+		{name: "antipodes", a: models.GeoPoint{Lat: 0, Lon: 0}, b: models.GeoPoint{Lat: 0, Lon: 180}, want: math.Pi * earthRadius},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := getDistance(tt.a, tt.b); math.Abs(got-tt.want) > 0.01 {
+				t.Errorf("getDistance() = %g, want %g", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetHeading(t *testing.T) {
+	origin := models.GeoPoint{Lat: 0, Lon: 0}
+	tests := []struct {
+		name string
+		a, b models.GeoPoint
+		want float64
+	}{
+		{name: "north", a: origin, b: models.GeoPoint{Lat: 1}, want: 0},
+		{name: "east", a: origin, b: models.GeoPoint{Lon: 1}, want: 90},
+		{name: "south", a: origin, b: models.GeoPoint{Lat: -1}, want: 180},
+		{name: "west", a: origin, b: models.GeoPoint{Lon: -1}, want: 270},
+		{name: "north east", a: origin, b: models.GeoPoint{Lat: 0.001, Lon: 0.001}, want: 45},
+		{name: "across the antimeridian", a: models.GeoPoint{Lon: 179.5}, b: models.GeoPoint{Lon: -179.5}, want: 90},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := getHeading(tt.a, tt.b); math.Abs(got-tt.want) > 0.01 {
+				t.Errorf("getHeading() = %g, want %g", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsInsidePolygon(t *testing.T) {
+	// an L shaped area, to check concave polygons
+	polygon := []models.GeoPoint{
+		{Lat: 0, Lon: 0},
+		{Lat: 2, Lon: 0},
+		{Lat: 2, Lon: 1},
+		{Lat: 1, Lon: 1},
+		{Lat: 1, Lon: 2},
+		{Lat: 0, Lon: 2},
+	}
+	tests := []struct {
+		name  string
+		point models.GeoPoint
+		want  bool
+	}{
+		{name: "inside", point: models.GeoPoint{Lat: 0.5, Lon: 0.5}, want: true},
+		{name: "inside the arm", point: models.GeoPoint{Lat: 1.5, Lon: 0.5}, want: true},
+		{name: "in the notch", point: models.GeoPoint{Lat: 1.5, Lon: 1.5}, want: false},
+		{name: "outside", point: models.GeoPoint{Lat: -0.5, Lon: 0.5}, want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isInsidePolygon(tt.point, polygon); got != tt.want {
+				t.Errorf("isInsidePolygon() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRouteClose(t *testing.T) {
+	tests := []struct {
+		name   string
+		points []models.GeoPoint
+		want   []models.GeoPoint
+		length float64
+	}{
+		{
+			name:   "open path",
+			points: []models.GeoPoint{{Lat: 0}, {Lat: 1}, {Lat: 2}},
+			want:   []models.GeoPoint{{Lat: 0}, {Lat: 1}, {Lat: 2}, {Lat: 1}},
+			length: 4 * kmPerDegree,
+		},
+		{
+			name:   "two points",
+			points: []models.GeoPoint{{Lat: 0}, {Lat: 1}},
+			want:   []models.GeoPoint{{Lat: 0}, {Lat: 1}},
+			length: 2 * kmPerDegree,
+		},
+		{
+			name:   "closed path",
+			points: []models.GeoPoint{{Lat: 0}, {Lat: 1}, {Lat: 1, Lon: 1}, {Lat: 0}},
+			want:   []models.GeoPoint{{Lat: 0}, {Lat: 1}, {Lat: 1, Lon: 1}, {Lat: 0}},
+			length: getDistance(models.GeoPoint{Lat: 0}, models.GeoPoint{Lat: 1}) +
+				getDistance(models.GeoPoint{Lat: 1}, models.GeoPoint{Lat: 1, Lon: 1}) +
+				getDistance(models.GeoPoint{Lat: 1, Lon: 1}, models.GeoPoint{Lat: 0}),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &route{points: tt.points}
+			r.close()
+			if !reflect.DeepEqual(r.points, tt.want) {
+				t.Errorf("points = %v, want %v", r.points, tt.want)
+			}
+			if math.Abs(r.length-tt.length) > 0.01 {
+				t.Errorf("length = %g, want %g", r.length, tt.length)
+			}
+		})
+	}
+}
+
+func TestParseRoutes(t *testing.T) {
+	tests := []struct {
+		name    string
+		parse   func(string) ([]*route, error)
+		content string
+		want    []*route
+		wantErr bool
+	}{
+		{
+			name:  "gpx track segments and routes",
+			parse: parseGpxRoutes,
+			content: `<gpx>
+				<trk><trkseg><trkpt lat="1" lon="2"><ele>3</ele></trkpt></trkseg><trkseg><trkpt lat="4" lon="5"></trkpt></trkseg></trk>
+				<rte><rtept lat="6" lon="7"></rtept><rtept lat="8" lon="9"></rtept></rte>
+				<rte><rtept lat="10" lon="11"></rtept></rte>
+			</gpx>`,
+			want: []*route{
+				{points: []models.GeoPoint{{Lat: 1, Lon: 2, Alt: 3}, {Lat: 4, Lon: 5}}},
+				{points: []models.GeoPoint{{Lat: 6, Lon: 7}, {Lat: 8, Lon: 9}}},
+			},
+		},
+		{
+			name:    "invalid gpx",
+			parse:   parseGpxRoutes,
+			content: `<gpx>`,
+			wantErr: true,
+		},
+		{
+			name:  "geojson features",
+			parse: parseGeoJsonRoutes,
+			content: `{"type": "FeatureCollection", "features": [
+				{"type": "Feature", "geometry": {"type": "LineString", "coordinates": [[2, 1, 3], [5, 4]]}},
+				{"type": "Feature", "geometry": {"type": "Polygon", "coordinates": [[[0, 0], [0, 1], [1, 1], [0, 0]], [[0.2, 0.2], [0.2, 0.3], [0.3, 0.3]]]}},
+				{"type": "Feature", "geometry": {"type": "Point", "coordinates": [1, 1]}},
+				{"type": "Feature", "geometry": null}
+			]}`,
+			want: []*route{
+				{points: []models.GeoPoint{{Lat: 1, Lon: 2, Alt: 3}, {Lat: 4, Lon: 5}}},
+				{points: []models.GeoPoint{{Lat: 0, Lon: 0}, {Lat: 1, Lon: 0}, {Lat: 1, Lon: 1}, {Lat: 0, Lon: 0}}, area: true},
+			},
+		},
+		{
+			name:  "geojson multi geometries",
+			parse: parseGeoJsonRoutes,
+			content: `{"type": "GeometryCollection", "geometries": [
+				{"type": "MultiLineString", "coordinates": [[[0, 0], [1, 1]], [[2, 2]]]},
+				{"type": "MultiPolygon", "coordinates": [[[[0, 0], [0, 1], [1, 1]]], [[[5, 5], [5, 6]]]]}
+			]}`,
+			want: []*route{
+				{points: []models.GeoPoint{{Lat: 0, Lon: 0}, {Lat: 1, Lon: 1}}},
+				{points: []models.GeoPoint{{Lat: 0, Lon: 0}, {Lat: 1, Lon: 0}, {Lat: 1, Lon: 1}}, area: true},
+			},
+		},
+		{
+			name:    "geojson invalid position",
+			parse:   parseGeoJsonRoutes,
+			content: `{"type": "LineString", "coordinates": [[0, 0], [1]]}`,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.parse(tt.content)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parse() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parse() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMoverGetValues(t *testing.T) {
+	// a path going north one degree, then east one degree along the equator
+	r := &route{points: []models.GeoPoint{{Lat: -1, Lon: 0}, {Lat: 0, Lon: 0}, {Lat: 0, Lon: 1}}}
+	r.close()
+	capabilityModel := &models.DeviceCapabilityModel{
+		Components: []*models.Component{
+			{
+				Telemetry: []*models.TelemetryType{
+					{Name: "location", Schema: &models.Schema{Type: "geopoint"}},
+					{Name: "heading", Schema: &models.Schema{Type: "integer"}},
+					{Name: "speed", Schema: &models.Schema{Type: "double"}},
+				},
+			},
+		},
+	}
+	start := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	hours := func(h float64) time.Duration {
+		return time.Duration(h * float64(time.Hour))
+	}
+
+	tests := []struct {
+		name    string
+		elapsed time.Duration
+		lat     float64
+		lon     float64
+		heading int64
+	}{
+		{name: "start", elapsed: 0, lat: -1, lon: 0, heading: 0},
+		{name: "half way north", elapsed: hours(0.5), lat: -0.5, lon: 0, heading: 0},
+		{name: "turned east", elapsed: hours(1.5), lat: 0, lon: 0.5, heading: 90},
+		{name: "on the way back", elapsed: hours(2.5), lat: 0, lon: 0.5, heading: 270},
+	}
+
+	// the speed covers a degree per hour
+	m := newMover(r, &models.RouteConfig{
+		Speed:            kmPerDegree,
+		HeadingTelemetry: "heading",
+		SpeedTelemetry:   "speed",
+	}, 0, 1, nil)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			values := m.getValues(capabilityModel, start.Add(tt.elapsed))
+			location := values["location"].(map[string]interface{})
+			if math.Abs(location["lat"].(float64)-tt.lat) > 1e-6 || math.Abs(location["lon"].(float64)-tt.lon) > 1e-6 {
+				t.Errorf("location = %v, want lat %g and lon %g", location, tt.lat, tt.lon)
+			}
+			if values["heading"] != tt.heading {
+				t.Errorf("heading = %v, want %d", values["heading"], tt.heading)
+			}
+			if values["speed"] != math.Round(kmPerDegree*100)/100 {
+				t.Errorf("speed = %v, want %g", values["speed"], kmPerDegree)
+			}
+		})
+	}
+}
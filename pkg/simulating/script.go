@@ -0,0 +1,277 @@
+package simulating
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"go.starlark.net/lib/math"
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+)
+
+type (
+	// deviceScript runs the hooks of the device model script for a single device.
+	// The script is executed once per device, so that the device state persists between the hooks.
+	deviceScript struct {
+		deviceID string              // id of the device running the script.
+		program  *starlark.Program   // the compiled script of the device model.
+		globals  starlark.StringDict // global variables of the script, including the hooks.
+		state    *starlark.Dict      // state of the device, shared by all the hooks.
+		random   randomSource        // source of the random numbers of the script, the shared source if not set.
+		failed   bool                // did the script fail to initialize.
+		lock     sync.Mutex          // lock to synchronize hooks called by telemetry, command and twin update handlers.
+	}
+)
+
+const (
+	// scriptTelemetryHook is called before telemetry is sent, with the state of the device.
+	scriptTelemetryHook = "on_telemetry"
+	// scriptCommandHook is called when the device receives a command, with the name and the payload of the command.
+	scriptCommandHook = "on_command"
+	// scriptDesiredHook is called when the device receives desired property updates, with the updated properties.
+	scriptDesiredHook = "on_desired"
+
+	// maxScriptSteps is the maximum number of computation steps of a script hook, protecting devices from runaway scripts.
+	maxScriptSteps = 1000000
+)
+
+var (
+	// scriptBuiltins are the built-ins available to scripts in addition to the device state and random().
+	scriptBuiltins = starlark.StringDict{
+		"math":   math.Module,
+		"struct": starlark.NewBuiltin("struct", starlarkstruct.Make),
+	}
+)
+
+// compileScript compiles the script of a device model.
+func compileScript(modelID string, script string) (*starlark.Program, error) {
+	_, program, err := starlark.SourceProgram(fmt.Sprintf("%s.star", modelID), script, func(name string) bool {
+		_, ok := scriptBuiltins[name]
+		return ok || name == "state" || name == "random"
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error compiling script of model '%s' (%s)", modelID, err.Error())
+	}
+	return program, nil
+}
+
+// newDeviceScript creates a script for the device using the compiled script of its model.
+func newDeviceScript(deviceID string, program *starlark.Program, random randomSource) *deviceScript {
+	return &deviceScript{
+		deviceID: deviceID,
+		program:  program,
+		random:   getRandom(random),
+	}
+}
+
+// onTelemetry calls the telemetry hook, which returns the values of telemetry by name that replace generated values.
+func (s *deviceScript) onTelemetry() map[string]interface{} {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if !s.init() {
+		return nil
+	}
+	result, ok := s.call(scriptTelemetryHook, s.state)
+	if !ok {
+		return nil
+	}
+	values, _ := fromStarlark(result).(map[string]interface{})
+	return values
+}
+
+// onCommand calls the command hook, which returns the response payload of the command.
+func (s *deviceScript) onCommand(name string, payload interface{}) (interface{}, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if !s.init() {
+		return nil, false
+	}
+	result, ok := s.call(scriptCommandHook, starlark.String(name), toStarlark(payload))
+	if !ok || result == starlark.None {
+		return nil, false
+	}
+	return fromStarlark(result), true
+}
+
+// onDesired calls the desired properties hook with the desired properties received by the device.
+func (s *deviceScript) onDesired(props map[string]interface{}) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if !s.init() {
+		return
+	}
+	s.call(scriptDesiredHook, toStarlark(props))
+}
+
+// init executes the top level statements of the script once for the device.
+func (s *deviceScript) init() bool {
+	if s.globals != nil || s.failed {
+		return !s.failed
+	}
+
+	s.state = starlark.NewDict(0)
+	predeclared := starlark.StringDict{
+		"state":  s.state,
+		"random": starlark.NewBuiltin("random", s.scriptRandom),
+	}
+	for name, value := range scriptBuiltins {
+		predeclared[name] = value
+	}
+
+	globals, err := s.program.Init(s.newThread(), predeclared)
+	if err != nil {
+		s.failed = true
+		log.Error().Err(err).Str("deviceID", s.deviceID).Msg("error initializing device script")
+		return false
+	}
+	s.globals = globals
+	return true
+}
+
+// call calls a hook of the script, if the script defines it.
+func (s *deviceScript) call(hook string, args ...starlark.Value) (starlark.Value, bool) {
+	fn, ok := s.globals[hook]
+	if !ok {
+		return nil, false
+	}
+
+	result, err := starlark.Call(s.newThread(), fn, args, nil)
+	if err != nil {
+		if evalErr, ok := err.(*starlark.EvalError); ok {
+			err = fmt.Errorf("%s", evalErr.Backtrace())
+		}
+		log.Error().Err(err).Str("deviceID", s.deviceID).Str("hook", hook).Msg("error running device script")
+		return nil, false
+	}
+	return result, true
+}
+
+// newThread creates a thread to run the script, limited to the maximum number of steps.
+func (s *deviceScript) newThread() *starlark.Thread {
+	thread := &starlark.Thread{
+		Name: s.deviceID,
+		Print: func(_ *starlark.Thread, msg string) {
+			log.Debug().Str("deviceID", s.deviceID).Msg(msg)
+		},
+	}
+	thread.SetMaxExecutionSteps(maxScriptSteps)
+	return thread
+}
+
+// scriptRandom implements the random() built-in returning a random number in [0.0, 1.0).
+func (s *deviceScript) scriptRandom(_ *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 0); err != nil {
+		return nil, err
+	}
+	return starlark.Float(s.random.Float64()), nil
+}
+
+// toStarlark converts a JSON compatible value to a Starlark value.
+func toStarlark(v interface{}) starlark.Value {
+	switch value := v.(type) {
+	case nil:
+		return starlark.None
+	case bool:
+		return starlark.Bool(value)
+	case string:
+		return starlark.String(value)
+	case int:
+		return starlark.MakeInt(value)
+	case int64:
+		return starlark.MakeInt64(value)
+	case float32:
+		return starlark.Float(value)
+	case float64:
+		if value == float64(int64(value)) {
+			return starlark.MakeInt64(int64(value))
+		}
+		return starlark.Float(value)
+	case []interface{}:
+		list := make([]starlark.Value, len(value))
+		for i, e := range value {
+			list[i] = toStarlark(e)
+		}
+		return starlark.NewList(list)
+	case map[string]interface{}:
+		keys := make([]string, 0, len(value))
+		for k := range value {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		dict := starlark.NewDict(len(value))
+		for _, k := range keys {
+			_ = dict.SetKey(starlark.String(k), toStarlark(value[k]))
+		}
+		return dict
+	case time.Time:
+		return starlark.String(value.Format(time.RFC3339))
+	}
+
+	// convert any other value through its JSON representation
+	b, err := json.Marshal(v)
+	if err != nil {
+		return starlark.None
+	}
+	var value interface{}
+	if err = json.Unmarshal(b, &value); err != nil {
+		return starlark.None
+	}
+	return toStarlark(value)
+}
+
+// fromStarlark converts a Starlark value to a JSON compatible value.
+func fromStarlark(v starlark.Value) interface{} {
+	switch value := v.(type) {
+	case starlark.NoneType:
+		return nil
+	case starlark.Bool:
+		return bool(value)
+	case starlark.String:
+		return string(value)
+	case starlark.Int:
+		if i, ok := value.Int64(); ok {
+			return i
+		}
+		f, _ := starlark.AsFloat(value)
+		return f
+	case starlark.Float:
+		return float64(value)
+	case *starlark.List:
+		list := make([]interface{}, value.Len())
+		for i := 0; i < value.Len(); i++ {
+			list[i] = fromStarlark(value.Index(i))
+		}
+		return list
+	case starlark.Tuple:
+		list := make([]interface{}, len(value))
+		for i, e := range value {
+			list[i] = fromStarlark(e)
+		}
+		return list
+	case *starlark.Dict:
+		dict := make(map[string]interface{}, value.Len())
+		for _, item := range value.Items() {
+			key, ok := starlark.AsString(item[0])
+			if !ok {
+				key = item[0].String()
+			}
+			dict[key] = fromStarlark(item[1])
+		}
+		return dict
+	case *starlarkstruct.Struct:
+		dict := make(map[string]interface{})
+		for _, name := range value.AttrNames() {
+			attr, _ := value.Attr(name)
+			dict[name] = fromStarlark(attr)
+		}
+		return dict
+	}
+	return v.String()
+}
@@ -5,12 +5,13 @@ import (
 	"errors"
 	"fmt"
 	"github.com/rs/zerolog/log"
-	"math/rand"
 	"runtime"
+	"sort"
 	"time"
 
 	"github.com/iot-for-all/starling/pkg/models"
 	"github.com/iot-for-all/starling/pkg/storing"
+	"go.starlark.net/starlark"
 )
 
 type (
@@ -30,12 +31,24 @@ type (
 		deviceConfigs []*models.SimulationDeviceConfig
 		// the models used by the deviceSimulator to simulate.
 		models map[string]*models.DeviceModel
+		// the recordings replayed by the devices, by device config.
+		recordings map[string]*recording
+		// the routes followed by the devices, by device config.
+		routes map[string][]*route
+		// the compiled scripts of the models, by model.
+		scripts map[string]*starlark.Program
+		// the templates of the telemetry messages sent by the devices, by device config.
+		templates map[string]*messageTemplates
+		// the custom payloads sent to DPS when the devices register, by device config.
+		payloads map[string]*ProvisioningPayload
 		// the devices divides into groups used by the deviceSimulator to simulate.
 		deviceGroups map[int]*deviceCollection
 		// the device provisioner handling provisioning deviceSimulator.
 		provisioner *DeviceProvisioner
 		// the device simulator handling simulation of deviceSimulator.
 		deviceSimulator *deviceSimulator
+		// the checkpoint from which the backfill resumes, if the simulation backfills telemetry.
+		checkpoint *models.BackfillCheckpoint
 	}
 )
 
@@ -56,6 +69,11 @@ func Start(
 	}
 
 	deviceModels := map[string]*models.DeviceModel{}
+	recordings := map[string]*recording{}
+	routes := map[string][]*route{}
+	scripts := map[string]*starlark.Program{}
+	templates := map[string]*messageTemplates{}
+	payloads := map[string]*ProvisioningPayload{}
 	for _, deviceConfig := range deviceConfigs {
 		model, err := storing.DeviceModels.Get(deviceConfig.ModelID)
 		if err != nil {
@@ -67,9 +85,68 @@ func Start(
 
 		deviceModels[model.ID] = model
 
+		// the HTTPS device API has no twin, so HTTPS devices cannot send the reported properties of the simulation
+		if config.EnableReportedProps && deviceConfig.Transport == models.DeviceTransportHttp {
+			return nil, errors.New(fmt.Sprintf("device config '%s' of simulation '%s' uses the http transport, which cannot send reported properties; disable enableReportedProps or use another transport", deviceConfig.ID, simulation.ID))
+		}
+
+		if _, ok := scripts[model.ID]; !ok && model.Script != "" {
+			program, err := compileScript(model.ID, model.Script)
+			if err != nil {
+				return nil, err
+			}
+			scripts[model.ID] = program
+		}
+
+		if model.StateMachine != nil {
+			if err := validateStateMachine(model.ID, model.StateMachine); err != nil {
+				return nil, err
+			}
+		}
+
+		if deviceConfig.Replay != nil {
+			rec, err := loadRecording(model.ID, deviceConfig.Replay)
+			if err != nil {
+				return nil, err
+			}
+			recordings[deviceConfig.ID] = rec
+		}
+
+		if deviceConfig.Route != nil {
+			r, err := loadRoutes(model.ID, deviceConfig.Route)
+			if err != nil {
+				return nil, err
+			}
+			routes[deviceConfig.ID] = r
+		}
+
+		t, err := parseMessageTemplates(deviceConfig)
+		if err != nil {
+			return nil, err
+		}
+		if t != nil {
+			templates[deviceConfig.ID] = t
+		}
+
+		p, err := ParseProvisioningPayload(deviceConfig)
+		if err != nil {
+			return nil, err
+		}
+		if p != nil {
+			payloads[deviceConfig.ID] = p
+		}
+
 		simulatedDeviceGauge.WithLabelValues(simulation.ID, simulation.TargetID, deviceConfig.ModelID).Set(float64(deviceConfig.DeviceCount))
 	}
 
+	var checkpoint *models.BackfillCheckpoint
+	if simulation.Backfill != nil {
+		checkpoint, err = loadBackfillCheckpoint(simulation)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	simContext, cancel := context.WithCancel(ctx)
 	simulator := &Simulator{
 		cancel:          cancel,
@@ -79,9 +156,15 @@ func Start(
 		target:          target,
 		deviceConfigs:   deviceConfigs,
 		models:          deviceModels,
+		recordings:      recordings,
+		routes:          routes,
+		scripts:         scripts,
+		templates:       templates,
+		payloads:        payloads,
 		deviceGroups:    make(map[int]*deviceCollection),
 		provisioner:     NewProvisioner(simContext, config),
 		deviceSimulator: newDeviceSimulator(simContext, config, simulation),
+		checkpoint:      checkpoint,
 	}
 
 	// distribute all the devices into groups
@@ -117,9 +200,13 @@ func (s *Simulator) start() {
 	// start device simulator
 	s.deviceSimulator.start(totalDevices)
 
-	// start telemetry request generator pump
+	// start telemetry request generator pump, sending telemetry in real time or over the virtual time range of the backfill
 	if s.config.EnableTelemetry {
-		go s.startTelemetryRequestPump()
+		if s.checkpoint != nil {
+			go s.startBackfillPump()
+		} else {
+			go s.startTelemetryRequestPump()
+		}
 	}
 
 	// start reported props request generator pump
@@ -143,7 +230,8 @@ func (s *Simulator) startTelemetryRequestPump() {
 			return
 		default:
 			// generate a wave of telemetry messages across all device groups
-			for waveGroup, devs := range s.deviceGroups {
+			for _, waveGroup := range s.getWaveGroups() {
+				devs := s.deviceGroups[waveGroup]
 				select {
 				case <-s.context.Done():
 					return
@@ -212,7 +300,8 @@ func (s *Simulator) startReportedPropertyRequestPump() {
 			return
 		default:
 			// generate a wave of reported property messages across all device groups
-			for waveGroup, devs := range s.deviceGroups {
+			for _, waveGroup := range s.getWaveGroups() {
+				devs := s.deviceGroups[waveGroup]
 				select {
 				case <-s.context.Done():
 					return
@@ -332,10 +421,41 @@ func (s *Simulator) distributeDeviceGroups() {
 				s.deviceGroups[group] = new(deviceCollection)
 			}
 
+			var r *replayer
+			if rec, ok := s.recordings[deviceCfg.ID]; ok {
+				r = newReplayer(rec, deviceCfg.Replay, i-1)
+			}
+
+			seed := getDeviceSeed(s.simulation.Seed, deviceID)
+			var stateMachine *deviceStateMachine
+			if model.StateMachine != nil {
+				stateMachine = newDeviceStateMachine(deviceID, model.StateMachine, s.simulation.Backfill != nil)
+			}
+			var m *mover
+			if routes, ok := s.routes[deviceCfg.ID]; ok {
+				m = newMover(routes[(i-1)%len(routes)], deviceCfg.Route, i-1, len(routes), newRandomSource(seed, randomStreamRoute))
+			}
+
+			var clock *deviceClock
+			if deviceCfg.Clock != nil {
+				clock = newDeviceClock(deviceCfg.Clock, newRandomSource(seed, randomStreamClock))
+			}
+
+			var script *deviceScript
+			if program, ok := s.scripts[model.ID]; ok {
+				script = newDeviceScript(deviceID, program, newRandomSource(seed, randomStreamScript))
+			}
+
+			transportType := deviceCfg.Transport
+			if transportType == "" {
+				transportType = models.DeviceTransportMqtt
+			}
+
 			deviceContext, deviceCancel := context.WithCancel(s.context)
 			d := device{
 				deviceID:             deviceID,
 				model:                model,
+				provisioningPayload:  s.payloads[deviceCfg.ID],
 				target:               s.target,
 				connectionString:     "",
 				isConnected:          false,
@@ -344,6 +464,8 @@ func (s *Simulator) distributeDeviceGroups() {
 				sendingTelemetry:     false,
 				sendingReportedProps: false,
 				iotHubClient:         nil,
+				transportType:        transportType,
+				pollInterval:         time.Millisecond * time.Duration(deviceCfg.PollInterval),
 				twinSub:              nil,
 				c2dSub:               nil,
 				retryCount:           0,
@@ -351,7 +473,27 @@ func (s *Simulator) distributeDeviceGroups() {
 				context:              deviceContext,
 				simulation:           s.simulation,
 				dataGenerator: &DataGenerator{
-					CapabilityModel: model.ParseDeviceCapabilityModel(),
+					CapabilityModel:             model.ParseDeviceCapabilityModel(),
+					Generators:                  deviceCfg.Generators,
+					Commands:                    deviceCfg.Commands,
+					PropertyAcks:                deviceCfg.PropertyAcks,
+					ReportChangedPropertiesOnly: deviceCfg.ReportChangedPropertiesOnly,
+					Faults:                      deviceCfg.Faults,
+					EventRates:                  deviceCfg.EventRates,
+					TelemetryIntervals:          deviceCfg.TelemetryIntervals,
+					seed:                        seed,
+					random:                      newRandomSource(seed, randomStreamValues),
+					behaviorRandom:              newRandomSource(seed, randomStreamBehaviors),
+					faultRandom:                 newRandomSource(seed, randomStreamFaults),
+					eventRandom:                 newRandomSource(seed, randomStreamEvents),
+					propertyRandom:              newRandomSource(seed, randomStreamProperties),
+					messageTemplates:            s.templates[deviceCfg.ID],
+					stateMachine:                stateMachine,
+					mover:                       m,
+					clock:                       clock,
+					replayer:                    r,
+					nextGeoPoint:                (i - 1) % len(geopointRoute),
+					script:                      script,
 				},
 				telemetrySequenceNumber: 0,
 			}
@@ -361,6 +503,16 @@ func (s *Simulator) distributeDeviceGroups() {
 	}
 }
 
+// getWaveGroups gets the wave groups of the devices in order, so that devices are simulated in the same order in every wave.
+func (s *Simulator) getWaveGroups() []int {
+	groups := make([]int, 0, len(s.deviceGroups))
+	for group := range s.deviceGroups {
+		groups = append(groups, group)
+	}
+	sort.Ints(groups)
+	return groups
+}
+
 // sleep sleeps for the given duration with cancellation context
 func sleep(ctx context.Context, duration time.Duration) {
 	select {
@@ -371,8 +523,8 @@ func sleep(ctx context.Context, duration time.Duration) {
 }
 
 // randSleep sleeps for random time within the given min/max range with cancellation context
-func randSleep(ctx context.Context, minMs int, maxMs int) {
-	sleep(ctx, time.Millisecond*time.Duration(minMs+rand.Intn(maxMs)))
+func randSleep(ctx context.Context, random randomSource, minMs int, maxMs int) {
+	sleep(ctx, time.Millisecond*time.Duration(minMs+getRandom(random).Intn(maxMs)))
 }
 
 func updateSimulationStatus(simulation *models.Simulation, status models.SimulationStatus) error {
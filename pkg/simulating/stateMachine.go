@@ -0,0 +1,219 @@
+package simulating
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/iot-for-all/starling/pkg/models"
+	"github.com/rs/zerolog/log"
+)
+
+type (
+	// deviceStateMachine tracks the active state of a single device, moving it between the states of its model.
+	deviceStateMachine struct {
+		deviceID string                         // id of the device.
+		machine  *models.StateMachine           // the state machine of the device model.
+		states   map[string]*models.DeviceState // states by name.
+		state    *models.DeviceState            // the active state.
+		entered  time.Time                      // time when the device entered the active state.
+		virtual  bool                           // whether the device runs on the virtual clock of a backfill.
+		latest   time.Time                      // latest time the active state was got at, the virtual time of the device.
+		lock     sync.Mutex                     // lock to synchronize transitions triggered by telemetry, command and twin update handlers.
+	}
+)
+
+const (
+	// maxTimerTransitions is the maximum number of timer transitions taken at once, protecting devices from timer loops.
+	maxTimerTransitions = 100
+)
+
+// validateStateMachine checks that the state machine of a device model has states and that all transitions lead to existing states.
+func validateStateMachine(modelID string, machine *models.StateMachine) error {
+	if len(machine.States) == 0 {
+		return fmt.Errorf("state machine of model '%s' has no states", modelID)
+	}
+
+	names := make(map[string]bool, len(machine.States))
+	for _, state := range machine.States {
+		names[state.Name] = true
+	}
+	if machine.Initial != "" && !names[machine.Initial] {
+		return fmt.Errorf("initial state '%s' of model '%s' does not exist", machine.Initial, modelID)
+	}
+	for _, state := range machine.States {
+		for _, transition := range state.Transitions {
+			if !names[transition.To] {
+				return fmt.Errorf("state '%s' of model '%s' has a transition to state '%s' that does not exist", state.Name, modelID, transition.To)
+			}
+		}
+	}
+	return nil
+}
+
+// newDeviceStateMachine creates a state machine for the device in the initial state of the model.
+// Devices backfilling history run on a virtual clock, which their commands and desired properties are received at.
+func newDeviceStateMachine(deviceID string, machine *models.StateMachine, virtual bool) *deviceStateMachine {
+	m := deviceStateMachine{
+		deviceID: deviceID,
+		machine:  machine,
+		virtual:  virtual,
+		states:   make(map[string]*models.DeviceState, len(machine.States)),
+		state:    machine.States[0],
+	}
+	for _, state := range machine.States {
+		m.states[state.Name] = state
+	}
+	if initial, ok := m.states[machine.Initial]; ok {
+		m.state = initial
+	}
+	return &m
+}
+
+// getState gets the active state at the given time, taking the timer transitions that are due.
+func (m *deviceStateMachine) getState(t time.Time) *models.DeviceState {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.entered.IsZero() {
+		m.entered = t
+	}
+	if t.After(m.latest) {
+		m.latest = t
+	}
+
+	for i := 0; i < maxTimerTransitions; i++ {
+		transition := m.getTimerTransition(t)
+		if transition == nil {
+			break
+		}
+		// the next state is entered when the timer fired, so that timers of the next state fire on time
+		m.enter(transition, m.entered.Add(time.Second*time.Duration(transition.After)))
+	}
+	return m.state
+}
+
+// getCurrentState gets the active state without taking timer transitions.
+func (m *deviceStateMachine) getCurrentState() *models.DeviceState {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	return m.state
+}
+
+// onCommand takes the transition triggered by the command with the given name, "component.name" for components.
+func (m *deviceStateMachine) onCommand(name string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for _, transition := range m.state.Transitions {
+		if transition.Trigger == models.StateTriggerCommand && isStateCommand(transition.Command, name) {
+			m.enter(transition, m.now())
+			return
+		}
+	}
+}
+
+// onDesired takes the transition triggered by the desired properties received by the device.
+func (m *deviceStateMachine) onDesired(props map[string]interface{}) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for _, transition := range m.state.Transitions {
+		if transition.Trigger != models.StateTriggerProperty {
+			continue
+		}
+		value, ok := getDesiredValue(props, transition.Property)
+		if ok && (transition.Value == nil || reflect.DeepEqual(transition.Value, value)) {
+			m.enter(transition, m.now())
+			return
+		}
+	}
+}
+
+// now gets the time at which commands and desired properties are received: the real time, or the virtual time of the latest
+// telemetry of devices backfilling history. Before their first telemetry, the state is entered when it is first got.
+func (m *deviceStateMachine) now() time.Time {
+	if m.virtual {
+		return m.latest
+	}
+	return time.Now().UTC()
+}
+
+// isTelemetrySent checks whether a telemetry of a component is sent in the active state.
+func (m *deviceStateMachine) isTelemetrySent(comp *models.Component, name string) bool {
+	state := m.getCurrentState()
+	if len(state.Telemetry) == 0 || m.isStateTelemetry(comp, name) {
+		return true
+	}
+	return containsString(state.Telemetry, getPropertyKey(comp, name)) || containsString(state.Telemetry, name)
+}
+
+// isStateTelemetry checks whether a telemetry of a component receives the name of the active state.
+func (m *deviceStateMachine) isStateTelemetry(comp *models.Component, name string) bool {
+	return m.machine.StateTelemetry != "" &&
+		(m.machine.StateTelemetry == getPropertyKey(comp, name) || m.machine.StateTelemetry == name)
+}
+
+// getGenerator gets the value generator of a telemetry or property of a component in the active state, and the state.
+func (m *deviceStateMachine) getGenerator(comp *models.Component, name string) (*models.ValueGenerator, string) {
+	state := m.getCurrentState()
+	spec, ok := state.Generators[getPropertyKey(comp, name)]
+	if !ok {
+		spec = state.Generators[name]
+	}
+	return spec, state.Name
+}
+
+// getTimerTransition gets the first timer transition of the active state that is due at the given time.
+func (m *deviceStateMachine) getTimerTransition(t time.Time) *models.StateTransition {
+	for _, transition := range m.state.Transitions {
+		if transition.Trigger == models.StateTriggerTimer &&
+			!t.Before(m.entered.Add(time.Second*time.Duration(transition.After))) {
+			return transition
+		}
+	}
+	return nil
+}
+
+// enter enters the next state of the transition at the given time.
+func (m *deviceStateMachine) enter(transition *models.StateTransition, t time.Time) {
+	log.Debug().
+		Str("deviceID", m.deviceID).
+		Str("from", m.state.Name).
+		Str("to", transition.To).
+		Str("trigger", string(transition.Trigger)).
+		Msg("device state changed")
+	m.state = m.states[transition.To]
+	m.entered = t
+}
+
+// isStateCommand checks whether the command of a transition is the received command, "component.name" for components.
+func isStateCommand(command string, name string) bool {
+	if command == name {
+		return true
+	}
+	// commands of components can be referred to by name only
+	i := strings.LastIndex(name, ".")
+	return i >= 0 && command == name[i+1:]
+}
+
+// getDesiredValue gets the desired value of a writable property by name, or by "component.name" for components.
+func getDesiredValue(props map[string]interface{}, property string) (interface{}, bool) {
+	if value, ok := props[property]; ok {
+		return value, true
+	}
+
+	i := strings.Index(property, ".")
+	if i < 0 {
+		return nil, false
+	}
+	comp, ok := props[property[:i]].(map[string]interface{})
+	if !ok {
+		return nil, false
+	}
+	value, ok := comp[property[i+1:]]
+	return value, ok
+}
@@ -0,0 +1,100 @@
+package simulating
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/iot-for-all/starling/pkg/models"
+)
+
+type (
+	// valueGenerator generates the values of a single telemetry or property based on its value generator configuration.
+	valueGenerator struct {
+		spec    *models.ValueGenerator // configuration of the generator.
+		started time.Time              // time when the first value was generated, used to calculate the drift.
+		value   float64                // last value of a random walk.
+		index   int                    // index of the next value of a sequence.
+		random  randomSource           // source of random values, the shared source if not set.
+	}
+)
+
+// newValueGenerator creates a new value generator for the given configuration.
+func newValueGenerator(spec *models.ValueGenerator, random randomSource) *valueGenerator {
+	return &valueGenerator{
+		spec:   spec,
+		value:  (spec.Min + spec.Max) / 2,
+		random: getRandom(random),
+	}
+}
+
+// next gets the value generated at the given time, converted to the given schema.
+func (g *valueGenerator) next(schema *models.Schema, t time.Time) interface{} {
+	if g.started.IsZero() {
+		g.started = t
+	}
+
+	var v float64
+	switch g.spec.Type {
+	case models.ValueGeneratorConstant:
+		return g.spec.Value
+	case models.ValueGeneratorSequence:
+		if len(g.spec.Values) == 0 {
+			return nil
+		}
+		value := g.spec.Values[g.index%len(g.spec.Values)]
+		g.index = (g.index + 1) % len(g.spec.Values)
+		return value
+	case models.ValueGeneratorSine:
+		amplitude := (g.spec.Max - g.spec.Min) / 2
+		phase := 0.0
+		if g.spec.Period > 0 {
+			// the phase is based on the wall clock, so that all devices peak at the same predictable times
+			period := float64(g.spec.Period)
+			phase = 2 * math.Pi * math.Mod(float64(t.UnixNano())/float64(time.Second), period) / period
+		}
+		v = g.spec.Min + amplitude + amplitude*math.Sin(phase)
+	case models.ValueGeneratorRandomWalk:
+		g.value += (2*g.random.Float64() - 1) * g.spec.Step
+		g.value = math.Max(g.spec.Min, math.Min(g.spec.Max, g.value))
+		v = g.value
+	case models.ValueGeneratorStep:
+		steps := 0
+		if g.spec.Period > 0 {
+			steps = int(t.Sub(g.started).Seconds()) / g.spec.Period
+		}
+		if g.spec.Step != 0 && g.spec.Max > g.spec.Min {
+			levels := int(math.Abs((g.spec.Max-g.spec.Min)/g.spec.Step)) + 1
+			steps %= levels
+		}
+		v = g.spec.Min + float64(steps)*g.spec.Step
+	default:
+		v = g.spec.Min + (g.spec.Max-g.spec.Min)*g.random.Float64()
+	}
+
+	v += g.spec.Drift * t.Sub(g.started).Hours()
+	if g.spec.Noise != 0 {
+		v += (2*g.random.Float64() - 1) * g.spec.Noise
+	}
+
+	return g.convert(v, schema)
+}
+
+// convert converts the generated numeric value to the given schema.
+func (g *valueGenerator) convert(v float64, schema *models.Schema) interface{} {
+	if schema == nil {
+		return v
+	}
+
+	switch schema.Type {
+	case "integer", "long":
+		return int64(math.Round(v))
+	case "float":
+		return float32(v)
+	case "boolean":
+		return v >= (g.spec.Min+g.spec.Max)/2
+	case "string":
+		return fmt.Sprintf("%g", v)
+	}
+	return v
+}
@@ -0,0 +1,160 @@
+package simulating
+
+import (
+	"math"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/iot-for-all/starling/pkg/models"
+)
+
+func TestValueGeneratorNext(t *testing.T) {
+	start := time.Unix(0, 0).UTC()
+	double := &models.Schema{Type: "double"}
+
+	tests := []struct {
+		name    string
+		spec    *models.ValueGenerator
+		schema  *models.Schema
+		seconds []int
+		want    []interface{}
+	}{
+		{
+			name:    "constant",
+			spec:    &models.ValueGenerator{Type: models.ValueGeneratorConstant, Value: "on"},
+			schema:  &models.Schema{Type: "string"},
+			seconds: []int{0, 10},
+			want:    []interface{}{"on", "on"},
+		},
+		{
+			name:    "sequence",
+			spec:    &models.ValueGenerator{Type: models.ValueGeneratorSequence, Values: []interface{}{1.0, "two", true}},
+			schema:  double,
+			seconds: []int{0, 1, 2, 3, 4},
+			want:    []interface{}{1.0, "two", true, 1.0, "two"},
+		},
+		{
+			name:    "empty sequence",
+			spec:    &models.ValueGenerator{Type: models.ValueGeneratorSequence},
+			schema:  double,
+			seconds: []int{0},
+			want:    []interface{}{nil},
+		},
+		{
+			name:    "sine",
+			spec:    &models.ValueGenerator{Type: models.ValueGeneratorSine, Min: 10, Max: 30, Period: 60},
+			schema:  &models.Schema{Type: "integer"},
+			seconds: []int{0, 15, 30, 45, 60},
+			want:    []interface{}{int64(20), int64(30), int64(20), int64(10), int64(20)},
+		},
+		{
+			name:    "step wrapping around",
+			spec:    &models.ValueGenerator{Type: models.ValueGeneratorStep, Min: 0, Max: 20, Step: 10, Period: 60},
+			schema:  double,
+			seconds: []int{0, 59, 60, 120, 180, 240},
+			want:    []interface{}{0.0, 0.0, 10.0, 20.0, 0.0, 10.0},
+		},
+		{
+			name:    "step with drift",
+			spec:    &models.ValueGenerator{Type: models.ValueGeneratorStep, Min: 5, Drift: 2},
+			schema:  double,
+			seconds: []int{0, 1800, 3600},
+			want:    []interface{}{5.0, 6.0, 7.0},
+		},
+		{
+			name:    "float",
+			spec:    &models.ValueGenerator{Type: models.ValueGeneratorStep, Min: 1.5},
+			schema:  &models.Schema{Type: "float"},
+			seconds: []int{0},
+			want:    []interface{}{float32(1.5)},
+		},
+		{
+			name:    "boolean",
+			spec:    &models.ValueGenerator{Type: models.ValueGeneratorSine, Min: 0, Max: 1, Period: 60},
+			schema:  &models.Schema{Type: "boolean"},
+			seconds: []int{15, 45},
+			want:    []interface{}{true, false},
+		},
+		{
+			name:    "string",
+			spec:    &models.ValueGenerator{Type: models.ValueGeneratorStep, Min: 2.5},
+			schema:  &models.Schema{Type: "string"},
+			seconds: []int{0},
+			want:    []interface{}{"2.5"},
+		},
+		{
+			name:    "no schema",
+			spec:    &models.ValueGenerator{Type: models.ValueGeneratorStep, Min: 3},
+			schema:  nil,
+			seconds: []int{0},
+			want:    []interface{}{3.0},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := newValueGenerator(tt.spec, newRandomSource(1, randomStreamValues))
+			var got []interface{}
+			for _, s := range tt.seconds {
+				got = append(got, g.next(tt.schema, start.Add(time.Duration(s)*time.Second)))
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("next() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValueGeneratorRandomBounds(t *testing.T) {
+	tests := []struct {
+		name     string
+		spec     *models.ValueGenerator
+		min      float64
+		max      float64
+		maxDelta float64
+	}{
+		{
+			name:     "random",
+			spec:     &models.ValueGenerator{Type: models.ValueGeneratorRandom, Min: -5, Max: 5},
+			min:      -5,
+			max:      5,
+			maxDelta: 10,
+		},
+		{
+			name:     "random walk",
+			spec:     &models.ValueGenerator{Type: models.ValueGeneratorRandomWalk, Min: 0, Max: 100, Step: 2},
+			min:      0,
+			max:      100,
+			maxDelta: 2,
+		},
+		{
+			name:     "step with noise",
+			spec:     &models.ValueGenerator{Type: models.ValueGeneratorStep, Min: 10, Noise: 1},
+			min:      9,
+			max:      11,
+			maxDelta: 2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := newValueGenerator(tt.spec, newRandomSource(1, randomStreamValues))
+			start := time.Now().UTC()
+			previous := math.NaN()
+			for i := 0; i < 1000; i++ {
+				v, ok := g.next(nil, start).(float64)
+				if !ok {
+					t.Fatalf("got %v, want a double", v)
+				}
+				if v < tt.min || v > tt.max {
+					t.Fatalf("got %g, want between %g and %g", v, tt.min, tt.max)
+				}
+				if !math.IsNaN(previous) && math.Abs(v-previous) > tt.maxDelta {
+					t.Fatalf("got %g after %g, want a change of at most %g", v, previous, tt.maxDelta)
+				}
+				previous = v
+			}
+		})
+	}
+}
@@ -0,0 +1,48 @@
+package storing
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/iot-for-all/starling/pkg/models"
+)
+
+type backfillCheckpoints struct {
+	store *store
+}
+
+// Get gets the backfill checkpoint of a simulation.
+func (b *backfillCheckpoints) Get(simulationId string) (*models.BackfillCheckpoint, error) {
+	var item models.BackfillCheckpoint
+
+	err := b.store.get([]byte(fmt.Sprintf("backfillCheckpoint-%s", simulationId)), &item)
+	if err != nil && errors.Is(err, badger.ErrKeyNotFound) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &item, nil
+}
+
+// Set creates or updates the backfill checkpoint of a simulation.
+func (b *backfillCheckpoints) Set(item *models.BackfillCheckpoint) error {
+	return b.store.set([]byte(fmt.Sprintf("backfillCheckpoint-%s", item.SimulationID)), item)
+}
+
+// Delete deletes the backfill checkpoint of a simulation.
+func (b *backfillCheckpoints) Delete(simulationId string) error {
+	err := b.store.delete([]byte(fmt.Sprintf("backfillCheckpoint-%s", simulationId)))
+	if err != nil && errors.Is(err, badger.ErrKeyNotFound) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,74 @@
+package storing
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/iot-for-all/starling/pkg/models"
+)
+
+type deviceModelFiles struct {
+	store *store
+}
+
+// Get gets a file of a device model by its name.
+func (f *deviceModelFiles) Get(modelID string, name string) (*models.DeviceModelFile, error) {
+	var item models.DeviceModelFile
+	err := f.store.get([]byte(fmt.Sprintf("deviceModelFile-%s/%s", modelID, name)), &item)
+	if err != nil && errors.Is(err, badger.ErrKeyNotFound) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &item, nil
+}
+
+// List lists all files of a device model.
+func (f *deviceModelFiles) List(modelID string) ([]models.DeviceModelFile, error) {
+	items := make([]models.DeviceModelFile, 0)
+	// ids are separated by a slash, which cannot appear in the ids of the api routes, so that the prefix of a model does
+	// not match the files of models with ids it is a prefix of
+	prefix := []byte(fmt.Sprintf("deviceModelFile-%s/", modelID))
+	err := f.store.list(prefix, func(k []byte, v []byte) error {
+		var file models.DeviceModelFile
+		err := json.Unmarshal(v, &file)
+		if err != nil {
+			return fmt.Errorf("failed to deserialize device model file %s: %w", k, err)
+		}
+
+		if file.ModelID == modelID {
+			items = append(items, file)
+		}
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return items, nil
+}
+
+// Set creates or updates a file of a device model.
+func (f *deviceModelFiles) Set(item *models.DeviceModelFile) error {
+	return f.store.set([]byte(fmt.Sprintf("deviceModelFile-%s/%s", item.ModelID, item.Name)), item)
+}
+
+// Delete deletes an existing file of a device model.
+func (f *deviceModelFiles) Delete(modelID string, name string) error {
+	err := f.store.delete([]byte(fmt.Sprintf("deviceModelFile-%s/%s", modelID, name)))
+	if err != nil && errors.Is(err, badger.ErrKeyNotFound) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
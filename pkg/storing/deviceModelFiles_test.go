@@ -0,0 +1,56 @@
+package storing
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/iot-for-all/starling/pkg/models"
+)
+
+func TestDeviceModelFilesList(t *testing.T) {
+	if err := Open(&Config{DataDirectory: t.TempDir()}); err != nil {
+		t.Fatal(err)
+	}
+	defer Close()
+
+	files := []*models.DeviceModelFile{
+		{ModelID: "a", Name: "b-c.csv"},
+		{ModelID: "a", Name: "d.csv"},
+		{ModelID: "a-b", Name: "c.csv"},
+		{ModelID: "ab", Name: "e.csv"},
+	}
+	for _, file := range files {
+		if err := DeviceModelFiles.Set(file); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		modelID string
+		want    []string
+	}{
+		{modelID: "a", want: []string{"b-c.csv", "d.csv"}},
+		{modelID: "a-b", want: []string{"c.csv"}},
+		{modelID: "ab", want: []string{"e.csv"}},
+		{modelID: "b", want: nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.modelID, func(t *testing.T) {
+			items, err := DeviceModelFiles.List(tt.modelID)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var names []string
+			for _, item := range items {
+				names = append(names, item.Name)
+			}
+			sort.Strings(names)
+			if !reflect.DeepEqual(names, tt.want) {
+				t.Errorf("List() = %v, want %v", names, tt.want)
+			}
+		})
+	}
+}
@@ -9,13 +9,19 @@ import (
 )
 
 var (
-	db            *badger.DB     // application database
-	DeviceModels  *deviceModels  // DeviceModels store
-	Simulations   *simulations   // Simulations store
-	DeviceConfigs *deviceConfigs // DeviceConfigs store
-	Targets       *targets       // Targets store
-	TargetModels  *targetModels  // TargetModels store
-	TargetDevices *targetDevices // TargetDevices store
+	db                       *badger.DB                // application database
+	DeviceModels             *deviceModels             // DeviceModels store
+	DeviceModelFiles         *deviceModelFiles         // DeviceModelFiles store
+	Simulations              *simulations              // Simulations store
+	DeviceConfigs            *deviceConfigs            // DeviceConfigs store
+	Targets                  *targets                  // Targets store
+	TargetModels             *targetModels             // TargetModels store
+	TargetDevices            *targetDevices            // TargetDevices store
+	TargetDeviceProperties   *targetDeviceProperties   // TargetDeviceProperties store
+	BackfillCheckpoints      *backfillCheckpoints      // BackfillCheckpoints store
+	TargetCertificates       *targetCertificates       // TargetCertificates store
+	TargetDeviceCertificates *targetDeviceCertificates // TargetDeviceCertificates store
+	TargetEnrollments        *targetEnrollments        // TargetEnrollments store
 )
 
 type store struct {
@@ -38,11 +44,17 @@ func Open(cfg *Config) error {
 	store := store{db: db}
 
 	DeviceModels = &deviceModels{store: &store}
+	DeviceModelFiles = &deviceModelFiles{store: &store}
 	Simulations = &simulations{store: &store}
 	DeviceConfigs = &deviceConfigs{store: &store}
 	Targets = &targets{store: &store}
 	TargetModels = &targetModels{store: &store}
 	TargetDevices = &targetDevices{store: &store}
+	TargetDeviceProperties = &targetDeviceProperties{store: &store}
+	BackfillCheckpoints = &backfillCheckpoints{store: &store}
+	TargetCertificates = &targetCertificates{store: &store}
+	TargetDeviceCertificates = &targetDeviceCertificates{store: &store}
+	TargetEnrollments = &targetEnrollments{store: &store}
 
 	log.Info().Msgf("initialized database from %s", dbFile)
 	return nil
@@ -0,0 +1,48 @@
+package storing
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/iot-for-all/starling/pkg/models"
+)
+
+type targetCertificates struct {
+	store *store
+}
+
+// Get gets the CA certificates of a target.
+func (t *targetCertificates) Get(targetId string) (*models.SimulationTargetCertificates, error) {
+	var item models.SimulationTargetCertificates
+
+	err := t.store.get([]byte(fmt.Sprintf("targetCertificates-%s", targetId)), &item)
+	if err != nil && errors.Is(err, badger.ErrKeyNotFound) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &item, nil
+}
+
+// Set create or updates the CA certificates of a target.
+func (t *targetCertificates) Set(item *models.SimulationTargetCertificates) error {
+	return t.store.set([]byte(fmt.Sprintf("targetCertificates-%s", item.TargetID)), item)
+}
+
+// Delete deletes the CA certificates of a target.
+func (t *targetCertificates) Delete(targetId string) error {
+	err := t.store.delete([]byte(fmt.Sprintf("targetCertificates-%s", targetId)))
+	if err != nil && errors.Is(err, badger.ErrKeyNotFound) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,75 @@
+package storing
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/iot-for-all/starling/pkg/models"
+)
+
+type targetDeviceCertificates struct {
+	store *store
+}
+
+// List lists the cached certificates of all devices in a target.
+func (t *targetDeviceCertificates) List(targetId string) ([]models.SimulationTargetDeviceCertificate, error) {
+	items := make([]models.SimulationTargetDeviceCertificate, 0)
+	// ids are separated by a slash, which cannot appear in the ids of the api routes, so that the prefix of a target does
+	// not match the certificates of targets with ids it is a prefix of
+	prefix := []byte(fmt.Sprintf("targetDeviceCertificate-%s/", targetId))
+	err := t.store.list(prefix, func(k []byte, v []byte) error {
+		var cert models.SimulationTargetDeviceCertificate
+		err := json.Unmarshal(v, &cert)
+		if err != nil {
+			return fmt.Errorf("failed to deserialize device certificate %s: %w", k, err)
+		}
+
+		if cert.TargetID == targetId {
+			items = append(items, cert)
+		}
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return items, nil
+}
+
+// Get gets the cached certificate of a device in a target.
+func (t *targetDeviceCertificates) Get(targetId string, deviceId string) (*models.SimulationTargetDeviceCertificate, error) {
+	var item models.SimulationTargetDeviceCertificate
+
+	err := t.store.get([]byte(fmt.Sprintf("targetDeviceCertificate-%s/%s", targetId, deviceId)), &item)
+	if err != nil && errors.Is(err, badger.ErrKeyNotFound) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &item, nil
+}
+
+// Set create or updates the cached certificate of a device in a target.
+func (t *targetDeviceCertificates) Set(item *models.SimulationTargetDeviceCertificate) error {
+	return t.store.set([]byte(fmt.Sprintf("targetDeviceCertificate-%s/%s", item.TargetID, item.DeviceID)), item)
+}
+
+// Delete deletes the cached certificate of a device in a target.
+func (t *targetDeviceCertificates) Delete(targetId string, deviceId string) error {
+	err := t.store.delete([]byte(fmt.Sprintf("targetDeviceCertificate-%s/%s", targetId, deviceId)))
+	if err != nil && errors.Is(err, badger.ErrKeyNotFound) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
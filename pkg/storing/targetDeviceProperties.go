@@ -0,0 +1,48 @@
+package storing
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/iot-for-all/starling/pkg/models"
+)
+
+type targetDeviceProperties struct {
+	store *store
+}
+
+// Get gets the persistent property values of a device in a target.
+func (t *targetDeviceProperties) Get(targetId string, deviceId string) (*models.SimulationTargetDeviceProperties, error) {
+	var item models.SimulationTargetDeviceProperties
+
+	err := t.store.get([]byte(fmt.Sprintf("targetDeviceProperties-%s-%s", targetId, deviceId)), &item)
+	if err != nil && errors.Is(err, badger.ErrKeyNotFound) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &item, nil
+}
+
+// Set create or updates the persistent property values of a device in a target.
+func (t *targetDeviceProperties) Set(item *models.SimulationTargetDeviceProperties) error {
+	return t.store.set([]byte(fmt.Sprintf("targetDeviceProperties-%s-%s", item.TargetID, item.DeviceID)), item)
+}
+
+// Delete deletes the persistent property values of a device in a target.
+func (t *targetDeviceProperties) Delete(targetId string, deviceId string) error {
+	err := t.store.delete([]byte(fmt.Sprintf("targetDeviceProperties-%s-%s", targetId, deviceId)))
+	if err != nil && errors.Is(err, badger.ErrKeyNotFound) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,75 @@
+package storing
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/iot-for-all/starling/pkg/models"
+)
+
+type targetEnrollments struct {
+	store *store
+}
+
+// List lists all individual enrollments in a target from the store.
+func (t *targetEnrollments) List(targetId string) ([]models.SimulationTargetEnrollment, error) {
+	items := make([]models.SimulationTargetEnrollment, 0)
+	// ids are separated by a slash, which cannot appear in the ids of the api routes, so that the prefix of a target does
+	// not match the enrollments of targets with ids it is a prefix of
+	prefix := []byte(fmt.Sprintf("targetEnrollments-%s/", targetId))
+	err := t.store.list(prefix, func(k []byte, v []byte) error {
+		var enrollment models.SimulationTargetEnrollment
+		err := json.Unmarshal(v, &enrollment)
+		if err != nil {
+			return fmt.Errorf("failed to deserialize enrollment %s: %w", k, err)
+		}
+
+		if enrollment.TargetID == targetId {
+			items = append(items, enrollment)
+		}
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return items, nil
+}
+
+// Get gets the individual enrollment of a device in a target.
+func (t *targetEnrollments) Get(targetId string, registrationId string) (*models.SimulationTargetEnrollment, error) {
+	var item models.SimulationTargetEnrollment
+
+	err := t.store.get([]byte(fmt.Sprintf("targetEnrollments-%s/%s", targetId, registrationId)), &item)
+	if err != nil && errors.Is(err, badger.ErrKeyNotFound) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &item, nil
+}
+
+// Set create or updates the individual enrollment of a device in a target.
+func (t *targetEnrollments) Set(item *models.SimulationTargetEnrollment) error {
+	return t.store.set([]byte(fmt.Sprintf("targetEnrollments-%s/%s", item.TargetID, item.RegistrationID)), item)
+}
+
+// Delete deletes the individual enrollment of a device in a target.
+func (t *targetEnrollments) Delete(targetId string, registrationId string) error {
+	err := t.store.delete([]byte(fmt.Sprintf("targetEnrollments-%s/%s", targetId, registrationId)))
+	if err != nil && errors.Is(err, badger.ErrKeyNotFound) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
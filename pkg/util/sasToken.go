@@ -15,7 +15,6 @@ func CreateSasToken(
 	expiresAfter time.Duration) (string, error) {
 
 	sr := url.QueryEscape(resource)
-	skn := url.QueryEscape(keyName)
 	se := strconv.FormatInt(time.Now().Add(expiresAfter).Unix(), 10)
 	sig, err := ComputeHmac(key, sr+"\n"+se)
 	if err != nil {
@@ -23,5 +22,11 @@ func CreateSasToken(
 	}
 
 	sig = url.QueryEscape(sig)
-	return fmt.Sprintf("SharedAccessSignature sr=%s&sig=%s&se=%s&skn=%s", sr, sig, se, skn), nil
+	token := fmt.Sprintf("SharedAccessSignature sr=%s&sig=%s&se=%s", sr, sig, se)
+
+	// tokens signed with a device key do not have a key name
+	if keyName != "" {
+		token += "&skn=" + url.QueryEscape(keyName)
+	}
+	return token, nil
 }